@@ -98,3 +98,11 @@ func (hs *HTTPServer) AdminDeleteAllSecretsManagerPluginSecrets(c *models.ReqCon
 	}
 	return response.Respond(http.StatusOK, fmt.Sprintf("All %d Secrets Manager plugin secrets deleted", len(items)))
 }
+
+// AdminGetSecretsStoreStatus reports whether the secrets are stored in the database although the secrets management
+// plugin is enabled, which is kept from the unauthenticated health endpoint as it describes the configuration
+func (hs *HTTPServer) AdminGetSecretsStoreStatus(c *models.ReqContext) response.Response {
+	return response.JSON(http.StatusOK, map[string]string{
+		"fallbackWarning": hs.secretsPluginCheck.FallbackWarning(),
+	})
+}
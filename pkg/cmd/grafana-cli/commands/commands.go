@@ -8,6 +8,7 @@ import (
 	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/commands/datamigrations"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/commands/secretsmigrations"
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/commands/secretsstore"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/runner"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/services"
@@ -147,6 +148,136 @@ var pluginCommands = []*cli.Command{
 	},
 }
 
+var conflictUsersFlags = []cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "ignore-email-domain",
+		Usage: "Ignores conflicts where the emails of all users belong to the given domain, can be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "only-identities",
+		Usage: "Path to a file listing one login or email per line, only conflicts involving them are considered",
+	},
+	&cli.StringFlag{
+		Name:  "identifier",
+		Usage: "Login or email of a single conflict to work on, fails if it is not a current conflict",
+	},
+	&cli.BoolFlag{
+		Name:  "trace",
+		Usage: "Writes the SQL executed, the rows considered and how each conflict was classified to stderr, prefixed with [trace]",
+	},
+	&cli.BoolFlag{
+		Name:  "normalize-email",
+		Usage: "Also considers the emails only differing by a +tag as conflicts, e.g. bob@example.com and bob+test@example.com. Review the conflicts carefully, the tags may be distinct people",
+	},
+	&cli.StringFlag{
+		Name:  "only",
+		Usage: "Only considers the conflicts of this type: email for emails differing by case, login for logins differing by case",
+	},
+	&cli.IntFlag{
+		Name:  "max-group-size",
+		Usage: "Conflicts with more users than this are flagged in the list and skipped by merges, to be reviewed manually",
+	},
+	&cli.Int64Flag{
+		Name:  "org-id",
+		Usage: "Only considers the conflicts involving a member of the organization with this id, the other users of these conflicts are included whatever their organizations",
+	},
+}
+
+var listConflictUsersFlags = append([]cli.Flag{
+	&cli.StringFlag{
+		Name:  "output",
+		Usage: "Format of the list: text, json, csv or tsv",
+		Value: "text",
+	},
+	&cli.StringFlag{
+		Name:  "template",
+		Usage: "Go text/template rendered for each user instead of --output, with the fields Block, Direction, ID, Email, Login, LastSeenAt, AuthModule, ConflictEmail and ConflictLogin",
+	},
+	&cli.StringFlag{
+		Name:  "export",
+		Usage: "Path of a new file the list is written to instead of stdout, as CSV with one row per user unless another --output than text is given",
+	},
+}, conflictUsersFlags...)
+
+var ingestConflictUsersFlags = append([]cli.Flag{
+	&cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "Shows the operations the merge would perform and the type of each conflict, Merge or SameIdentification, without changing the database",
+	},
+	&cli.BoolFlag{
+		Name:  "compare-dry-runs",
+		Usage: "Compares the operations of two captured outputs of --dry-run, given as <fileA> <fileB>, and fails if they differ. Nothing is merged",
+	},
+	&cli.DurationFlag{
+		Name:  "pause",
+		Usage: "Waits the given duration between the merges of two conflicts, e.g. 500ms, to let replication catch up",
+	},
+	&cli.StringSliceFlag{
+		Name:  "pre-merge-hook",
+		Usage: "Shell command run before each merge with CONFLICT_BLOCK, CONFLICT_KEEP and CONFLICT_DELETE set, a failure skips the conflict. Can be repeated",
+	},
+	&cli.StringSliceFlag{
+		Name:  "post-merge-hook",
+		Usage: "Shell command run after each merge with CONFLICT_RESULT also set, failures are only logged. Can be repeated",
+	},
+	&cli.BoolFlag{
+		Name:  "verify-uniqueness",
+		Usage: "Once all conflicts are resolved, checks that no login or email is left shared apart from case and surrounding spaces, and reports whether the database prevents new conflicts. The schema is not changed",
+	},
+	&cli.BoolFlag{
+		Name:  "merge-alert-notifications",
+		Usage: "Replaces the email addresses of the deleted accounts with the one of the kept account in the email notification channels of legacy alerting (alert_notification table), the contact points of unified alerting are not updated",
+	},
+	&cli.BoolFlag{
+		Name:  "batch",
+		Usage: "Reads the file as resolutions, one line per conflict with its identification and the id of the user to keep, e.g. \"conflict: alice@example.com 12\", and merges without prompting. Conflicts without a line are skipped",
+	},
+	&cli.BoolFlag{
+		Name:  "auto-dedup-identical",
+		Usage: "Merges the conflicts whose users all have the same email and login apart from case into the user with the lowest id, without a file or along with the resolutions read with --batch, which take precedence",
+	},
+	&cli.StringFlag{
+		Name:  "auto",
+		Usage: "Picks the user to keep of every conflict instead of reading a file, last-active keeps the user seen most recently and the lowest id on ties",
+	},
+	&cli.StringFlag{
+		Name:  "log-file",
+		Usage: "Path of a file receiving a JSON line per merged conflict with its time, the ids of the kept and deleted users and the outcome, appended to if it exists",
+	},
+	&cli.StringFlag{
+		Name:  "journal",
+		Usage: "Path of a JSON file recording the users deleted by each merge, appended to if it exists, which undo-user-merge can recreate them from",
+	},
+	&cli.BoolFlag{
+		Name:    "yes",
+		Aliases: []string{"y"},
+		Usage:   "Proceeds without asking for confirmation, e.g. once a dry run was reviewed",
+	},
+	&cli.IntFlag{
+		Name:  "batch-size",
+		Usage: "Merges the conflicts with --auto in pages of this many logins and emails, ordered by their lowercased value, instead of loading them all at once",
+	},
+	&cli.StringFlag{
+		Name:  "resume-after",
+		Usage: "With --batch-size, starts after this lowercased login or email, as logged at the end of every page",
+	},
+}, conflictUsersFlags...)
+
+var secretsKeyFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "org",
+		Usage: "Organization id of the secret, -1 lists the keys of all organizations",
+	},
+	&cli.StringFlag{
+		Name:  "namespace",
+		Usage: "Namespace of the secret",
+	},
+	&cli.StringFlag{
+		Name:  "type",
+		Usage: "Type of the secret",
+	},
+}
+
 var adminCommands = []*cli.Command{
 	{
 		Name:   "reset-admin-password",
@@ -192,6 +323,64 @@ var adminCommands = []*cli.Command{
 			},
 		},
 	},
+	{
+		Name:  "secrets",
+		Usage: "Manages the secrets stored in the secrets store",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "set",
+				Usage:  "Sets a secret, reading its value from stdin",
+				Flags:  secretsKeyFlags,
+				Action: runRunnerCommand(secretsstore.SetSecret),
+			},
+			{
+				Name:   "get",
+				Usage:  "Prints the value of a secret",
+				Flags:  secretsKeyFlags,
+				Action: runRunnerCommand(secretsstore.GetSecret),
+			},
+			{
+				Name:   "del",
+				Usage:  "Deletes a secret",
+				Flags:  secretsKeyFlags,
+				Action: runRunnerCommand(secretsstore.DeleteSecret),
+			},
+			{
+				Name:   "keys",
+				Usage:  "Lists the keys of the secrets matching the namespace and type",
+				Flags:  secretsKeyFlags,
+				Action: runRunnerCommand(secretsstore.ListKeys),
+			},
+			{
+				Name:  "encryption-versions",
+				Usage: "Counts the secrets stored in the database by encryption version",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "org",
+						Usage: "Organization id of the secrets, -1 counts the secrets of all organizations",
+						Value: -1,
+					},
+				},
+				Action: runRunnerCommand(secretsstore.CountEncryptionVersions),
+			},
+			{
+				Name:  "summary",
+				Usage: "Prints the number and total and average size in bytes of the secrets by organization, type and namespace prefix, without their values",
+				Flags: []cli.Flag{
+					&cli.IntFlag{
+						Name:  "org",
+						Usage: "Organization id of the secrets, -1 summarizes the secrets of all organizations",
+						Value: -1,
+					},
+					&cli.IntFlag{
+						Name:  "namespace-prefix-length",
+						Usage: "Number of characters of the namespaces to group the secrets by, 0 groups them by type only",
+					},
+				},
+				Action: runRunnerCommand(secretsstore.SummarizeSizes),
+			},
+		},
+	},
 	{
 		Name:  "user-manager",
 		Usage: "Runs different helpful user commands",
@@ -202,25 +391,51 @@ var adminCommands = []*cli.Command{
 				Usage: "runs a conflict resolution to find users with multiple entries",
 				Subcommands: []*cli.Command{
 					{
-						Name:   "list",
-						Usage:  "returns a list of users with more than one entry in the database",
-						Action: runListConflictUsers(),
+						Name:    "list",
+						Aliases: []string{"list-conflicting-users"},
+						Usage:   "returns a list of users with more than one entry in the database. Read-only, it never merges users",
+						Flags:   listConflictUsersFlags,
+						Action:  runListConflictUsers(),
 					},
 					{
 						Name:   "generate-file",
 						Usage:  "creates a conflict users file. Safe to execute multiple times.",
+						Flags:  conflictUsersFlags,
 						Action: runGenerateConflictUsersFile(),
 					},
 					{
 						Name:   "validate-file",
 						Usage:  "validates the conflict users file. Safe to execute multiple times.",
+						Flags:  conflictUsersFlags,
 						Action: runValidateConflictUsersFile(),
 					},
 					{
-						Name:   "ingest-file",
-						Usage:  "ingests the conflict users file",
+						Name:    "ingest-file",
+						Aliases: []string{"merge-conflicting-users"},
+						Usage:   "ingests the conflict users file, merging and deleting users",
+						Description: `Merges the conflict blocks of the file and prints a summary line such as
+"conflicts_summary resolved=2 skipped=0 failed=1".
+
+Exit codes:
+   0  all conflict blocks were resolved
+   1  the command could not run, e.g. an invalid file or a cancelled confirmation
+   2  some conflict blocks were resolved while others were skipped, failed or
+      had no resolution, e.g. missing from the --batch resolutions
+   3  no conflict block could be resolved`,
+						Flags:  ingestConflictUsersFlags,
 						Action: runIngestConflictUsersFile(),
 					},
+					{
+						Name:  "undo-user-merge",
+						Usage: "recreates the users deleted by the merges recorded in a journal of ingest-file, with their organization memberships",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "journal",
+								Usage: "Path of the journal written by ingest-file --journal",
+							},
+						},
+						Action: runUndoUserMerge(),
+					},
 				},
 			},
 		},
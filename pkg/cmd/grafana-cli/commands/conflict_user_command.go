@@ -4,24 +4,31 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fatih/color"
 	"github.com/grafana/grafana/pkg/bus"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
 	"github.com/grafana/grafana/pkg/cmd/grafana-cli/utils"
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/tracing"
 	"github.com/grafana/grafana/pkg/models"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/services/sqlstore/db"
 	"github.com/grafana/grafana/pkg/services/sqlstore/migrations"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
 	"github.com/grafana/grafana/pkg/services/user"
 	"github.com/grafana/grafana/pkg/services/user/userimpl"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
 	"github.com/urfave/cli/v2"
 )
 
@@ -39,7 +46,8 @@ func initConflictCfg(cmd *utils.ContextCommandLine) (*setting.Cfg, error) {
 	return cfg, nil
 }
 
-func initializeConflictResolver(cmd *utils.ContextCommandLine, f Formatter, ctx *cli.Context) (*ConflictResolver, error) {
+// newConflictResolver returns a resolver connected to the database, without any conflict loaded
+func newConflictResolver(cmd *utils.ContextCommandLine, ctx *cli.Context) (*ConflictResolver, error) {
 	cfg, err := initConflictCfg(cmd)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", "failed to load configuration", err)
@@ -48,12 +56,61 @@ func initializeConflictResolver(cmd *utils.ContextCommandLine, f Formatter, ctx
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", "failed to get to sql", err)
 	}
-	conflicts, err := GetUsersWithConflictingEmailsOrLogins(ctx, s)
+	resolver := ConflictResolver{Store: s, Config: cfg, MaxGroupSize: ctx.Int("max-group-size")}
+	if ctx.Bool("trace") {
+		resolver.Trace = os.Stderr
+	}
+	return &resolver, nil
+}
+
+func initializeConflictResolver(cmd *utils.ContextCommandLine, f Formatter, ctx *cli.Context) (*ConflictResolver, error) {
+	r, err := newConflictResolver(cmd, ctx)
+	if err != nil {
+		return nil, err
+	}
+	resolver, s := *r, r.Store
+	dialect := detectConflictQueryDialect(ctx.Context, s)
+	filter := conflictQueryFilter{orgId: ctx.Int64("org-id")}
+	resolver.trace("using the %s conflict query", dialect.name)
+	rawSQL, args := conflictingUserEntriesGroupedSQL(s, dialect, filter)
+	resolver.trace("executing SQL: %s with args %v", rawSQL, args)
+	conflicts, err := getUsersWithConflictingEmailsOrLogins(ctx.Context, s, dialect, filter)
 	if err != nil {
 		return nil, fmt.Errorf("%v: %w", "failed to get users with conflicting logins", err)
 	}
-	resolver := ConflictResolver{Users: conflicts}
+	resolver.trace("query returned %d rows", len(conflicts))
+	if ctx.Bool("normalize-email") {
+		if filter.orgId != 0 {
+			return nil, errors.New("--normalize-email can't be combined with --org-id")
+		}
+		plusAddressed, err := getUsersWithPlusAddressedEmailConflicts(ctx.Context, s)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", "failed to get users with plus-addressed emails", err)
+		}
+		resolver.trace("found %d users whose emails only differ by a +tag", len(plusAddressed))
+		resolver.NormalizeEmail = true
+		conflicts = append(conflicts, plusAddressed...)
+	}
+	resolver.Users = conflicts
 	resolver.BuildConflictBlocks(conflicts, f)
+	resolver.IgnoreEmailDomains(ctx.StringSlice("ignore-email-domain"))
+	if path := ctx.String("only-identities"); path != "" {
+		b, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", "failed to read identities file", err)
+		}
+		resolver.OnlyIdentities(parseIdentities(b))
+	}
+	if identifier := ctx.String("identifier"); identifier != "" {
+		if err := resolver.OnlyIdentifier(identifier); err != nil {
+			return nil, err
+		}
+	}
+	if only := ctx.String("only"); only != "" {
+		if err := resolver.OnlyConflictType(only); err != nil {
+			return nil, err
+		}
+	}
 	return &resolver, nil
 }
 
@@ -69,6 +126,32 @@ func getSqlStore(cfg *setting.Cfg) (*sqlstore.SQLStore, error) {
 func runListConflictUsers() func(context *cli.Context) error {
 	return func(context *cli.Context) error {
 		cmd := &utils.ContextCommandLine{Context: context}
+		formatter, err := getConflictOutputFormatter(context.String("output"), context.String("template"))
+		if err != nil {
+			return err
+		}
+		if path := context.String("export"); path != "" {
+			if _, ok := formatter.(textConflictFormatter); ok {
+				formatter = conflictOutputFormatters["csv"]
+			}
+			r, err := initializeConflictResolver(cmd, fmt.Sprintf, context)
+			if err != nil {
+				return fmt.Errorf("%v: %w", "failed to initialize conflict resolver", err)
+			}
+			if err := exportConflicts(filepath.Clean(path), formatter, r); err != nil {
+				return fmt.Errorf("could not export the conflicts: %w", err)
+			}
+			logger.Infof("exported the conflicts of %d users to %s\n", len(r.outputUsers()), path)
+			return nil
+		}
+		if _, ok := formatter.(textConflictFormatter); !ok {
+			// other outputs are meant for tooling, they only contain the conflicts and no colors
+			r, err := initializeConflictResolver(cmd, fmt.Sprintf, context)
+			if err != nil {
+				return fmt.Errorf("%v: %w", "failed to initialize conflict resolver", err)
+			}
+			return formatter.Format(os.Stdout, r)
+		}
 		whiteBold := color.New(color.FgWhite).Add(color.Bold)
 		r, err := initializeConflictResolver(cmd, whiteBold.Sprintf, context)
 		if err != nil {
@@ -78,6 +161,7 @@ func runListConflictUsers() func(context *cli.Context) error {
 			logger.Info(color.GreenString("No Conflicting users found.\n\n"))
 			return nil
 		}
+		logger.Infof("\n\n%s\n", r.ConflictCounts())
 		logger.Infof("\n\nShowing conflicts\n\n")
 		logger.Infof(r.ToStringPresentation())
 		logger.Infof("\n")
@@ -143,40 +227,180 @@ func runValidateConflictUsersFile() func(context *cli.Context) error {
 func runIngestConflictUsersFile() func(context *cli.Context) error {
 	return func(context *cli.Context) error {
 		cmd := &utils.ContextCommandLine{Context: context}
+		if context.Bool("compare-dry-runs") {
+			return compareDryRunFiles(cmd)
+		}
+		if context.Int("batch-size") > 0 {
+			return runPagedIngestConflictUsers(cmd, context)
+		}
 		r, err := initializeConflictResolver(cmd, fmt.Sprintf, context)
 		if err != nil {
 			return fmt.Errorf("%v: %w", "failed to initialize conflict resolver", err)
 		}
 
-		// read in the file to ingest
-		arg := cmd.Args().First()
-		if arg == "" {
-			return errors.New("please specify a absolute path to file to read from")
+		logger.Infof("%s\n", r.ConflictCounts())
+
+		if err := configureConflictMerge(r, context); err != nil {
+			return err
 		}
-		b, err := os.ReadFile(filepath.Clean(arg))
-		if err != nil {
-			return fmt.Errorf("could not read file with error %e", err)
+		if path := context.String("log-file"); path != "" && !context.Bool("dry-run") {
+			closeLog, err := r.useMergeLog(path)
+			if err != nil {
+				return fmt.Errorf("could not open the log file: %w", err)
+			}
+			defer closeLog()
 		}
-		validErr := getValidConflictUsers(r, b)
-		if validErr != nil {
-			return fmt.Errorf("could not validate file with error %s", validErr)
+
+		// read in the file to ingest
+		arg := cmd.Args().First()
+		batch := context.Bool("batch")
+		dedup := context.Bool("auto-dedup-identical")
+		if auto := context.String("auto"); auto != "" {
+			if arg != "" || batch {
+				return errors.New("--auto picks the users to keep, it can't be combined with a file")
+			}
+			if dedup {
+				return errors.New("--auto already picks the users to keep of every conflict, it can't be combined with --auto-dedup-identical")
+			}
+			strategy, err := getMergeTargetStrategy(auto)
+			if err != nil {
+				return err
+			}
+			resolutions, err := r.AutoResolutions(context.Context, strategy)
+			if err != nil {
+				return fmt.Errorf("could not pick the users to keep: %w", err)
+			}
+			r.ApplyConflictResolutions(resolutions)
+		} else if dedup && arg != "" && !batch {
+			return errors.New("--auto-dedup-identical can only be combined with a file of resolutions read with --batch")
+		} else {
+			resolutions := make(map[string]string)
+			if arg != "" || !dedup {
+				if arg == "" {
+					return errors.New("please specify a absolute path to file to read from")
+				}
+				b, err := os.ReadFile(filepath.Clean(arg))
+				if err != nil {
+					return fmt.Errorf("could not read file with error %e", err)
+				}
+				if batch {
+					if resolutions, err = parseConflictResolutions(b); err != nil {
+						return fmt.Errorf("could not parse resolutions file: %w", err)
+					}
+				} else if validErr := getValidConflictUsers(r, b); validErr != nil {
+					return fmt.Errorf("could not validate file with error %s", validErr)
+				}
+			}
+			if dedup {
+				// the resolutions of the file take precedence
+				for block, keepId := range r.identicalDuplicateResolutions() {
+					if _, ok := resolutions[block]; !ok {
+						resolutions[block] = keepId
+					}
+				}
+			}
+			if batch || dedup {
+				r.ApplyConflictResolutions(resolutions)
+			}
 		}
 		// should we rebuild blocks here?
 		// kind of a weird thing maybe?
 		if len(r.ValidUsers) == 0 {
 			return fmt.Errorf("no users")
 		}
-		r.showChanges()
-		if !confirm("\n\nWe encourage users to create a db backup before running this command. \n Proceed with operation?") {
+		r.showChanges(context.Context)
+		if context.Bool("dry-run") {
+			if err := r.showStoreOperations(context.Context); err != nil {
+				return fmt.Errorf("could not preview the merge: %w", err)
+			}
+			logger.Info("\n\ndry run, no changes were made.\n")
+			return nil
+		}
+		confirmed, err := confirm("\n\nWe encourage users to create a db backup before running this command. \n Proceed with operation?", batch || context.Bool("yes"))
+		if err != nil {
+			return err
+		}
+		if !confirmed {
 			return fmt.Errorf("user cancelled")
 		}
-		err = r.MergeConflictingUsers(context.Context)
+		summary, err := r.MergeConflictingUsers(context.Context)
+		return finishConflictMerge(context, r, summary, err)
+	}
+}
+
+// configureConflictMerge sets up the merge of the resolver from the flags of ingest-file
+func configureConflictMerge(r *ConflictResolver, context *cli.Context) error {
+	r.Pause = context.Duration("pause")
+	r.MergeAlertNotifications = context.Bool("merge-alert-notifications")
+	if path := context.String("journal"); path != "" && !context.Bool("dry-run") {
+		var err error
+		if r.Journal, err = OpenMergeJournal(path); err != nil {
+			return fmt.Errorf("could not open the journal: %w", err)
+		}
+	}
+	for _, command := range context.StringSlice("pre-merge-hook") {
+		r.PreMergeHooks = append(r.PreMergeHooks, ShellPreMergeHook(command))
+	}
+	for _, command := range context.StringSlice("post-merge-hook") {
+		r.PostMergeHooks = append(r.PostMergeHooks, ShellPostMergeHook(command))
+	}
+	return nil
+}
+
+// finishConflictMerge prints the summary of the merge, maps it to the exit code of ingest-file and, once
+// every conflict is resolved, verifies the uniqueness of logins and emails if requested
+func finishConflictMerge(context *cli.Context, r *ConflictResolver, summary ConflictMergeSummary, err error) error {
+	logger.Infof("%s\n", summary)
+	switch summary.ExitCode() {
+	case ConflictsExitFailed:
+		if err == nil {
+			return cli.Exit("no conflict was resolved", ConflictsExitFailed)
+		}
+		return cli.Exit(fmt.Sprintf("not able to merge with %s", err), ConflictsExitFailed)
+	case ConflictsExitPartial:
 		if err != nil {
-			return fmt.Errorf("not able to merge with %e", err)
+			return cli.Exit(fmt.Sprintf("conflicts partially resolved: %s", err), ConflictsExitPartial)
+		}
+		return cli.Exit("conflicts partially resolved", ConflictsExitPartial)
+	}
+	if err != nil {
+		// the merge was interrupted before any conflict could be merged
+		return err
+	}
+	logger.Info("\n\nconflicts resolved.\n")
+	if context.Bool("verify-uniqueness") {
+		if err := verifyCaseInsensitiveUniqueness(context.Context, r.Store); err != nil {
+			return fmt.Errorf("could not verify the uniqueness of logins and emails: %w", err)
 		}
-		logger.Info("\n\nconflicts resolved.\n")
+	}
+	return nil
+}
+
+// compareDryRunFiles compares the operations of the two outputs of ingest-file --dry-run given as arguments
+func compareDryRunFiles(cmd *utils.ContextCommandLine) error {
+	if cmd.Args().Len() != 2 {
+		return errors.New("please specify the two dry run outputs to compare")
+	}
+	fileA, fileB := cmd.Args().Get(0), cmd.Args().Get(1)
+	a, err := os.ReadFile(filepath.Clean(fileA))
+	if err != nil {
+		return fmt.Errorf("could not read file %s with error %w", fileA, err)
+	}
+	b, err := os.ReadFile(filepath.Clean(fileB))
+	if err != nil {
+		return fmt.Errorf("could not read file %s with error %w", fileB, err)
+	}
+	diff, err := compareDryRuns(a, b)
+	if err != nil {
+		return fmt.Errorf("could not compare the dry runs with error %w", err)
+	}
+	if len(diff) == 0 {
+		logger.Info(color.GreenString("The dry runs plan the same operations.\n\n"))
 		return nil
 	}
+	logger.Infof("\n\nDifferences between %s (-) and %s (+)\n\n", fileA, fileB)
+	logger.Infof("%s\n", strings.Join(diff, "\n\n"))
+	return fmt.Errorf("the dry runs plan different operations for %d conflict(s)", len(diff))
 }
 
 func getDocumentationForFile() string {
@@ -224,8 +448,8 @@ func getValidConflictUsers(r *ConflictResolver, b []byte) error {
 	for _, users := range r.Blocks {
 		for _, u := range users {
 			previouslySeenIds[strings.ToLower(u.ID)] = true
-			previouslySeenEmails[strings.ToLower(u.Email)] = true
-			previouslySeenLogins[strings.ToLower(u.Login)] = true
+			previouslySeenEmails[normalizeIdentification(u.Email)] = true
+			previouslySeenLogins[normalizeIdentification(u.Login)] = true
 		}
 	}
 
@@ -258,10 +482,10 @@ func getValidConflictUsers(r *ConflictResolver, b []byte) error {
 		if err != nil {
 			return fmt.Errorf("could not parse the content of the file with error %e", err)
 		}
-		if newUser.ConflictEmail != "" && !previouslySeenEmails[strings.ToLower(newUser.Email)] {
+		if newUser.ConflictEmail != "" && !previouslySeenEmails[normalizeIdentification(newUser.Email)] {
 			return fmt.Errorf("not valid email: %s, email not seen in previous conflicts", newUser.Email)
 		}
-		if newUser.ConflictLogin != "" && !previouslySeenLogins[strings.ToLower(newUser.Login)] {
+		if newUser.ConflictLogin != "" && !previouslySeenLogins[normalizeIdentification(newUser.Login)] {
 			return fmt.Errorf("not valid login: %s, login not seen in previous conflicts", newUser.Login)
 		}
 		// valid entry
@@ -272,41 +496,415 @@ func getValidConflictUsers(r *ConflictResolver, b []byte) error {
 	return nil
 }
 
-func (r *ConflictResolver) MergeConflictingUsers(ctx context.Context) error {
-	for block, users := range r.Blocks {
+// parseConflictResolutions reads a resolutions file of one line per conflict block, the identification of the
+// block followed by the id of the user to keep, e.g. "conflict: alice@example.com 12" or "alice@example.com 12".
+// Empty lines and # comments are skipped. The resolutions are keyed by conflict block.
+func parseConflictResolutions(b []byte) (map[string]string, error) {
+	resolutions := make(map[string]string)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected the conflict identification followed by the id of the user to keep, got %q", i+1, line)
+		}
+		keepId := fields[len(fields)-1]
+		if _, err := strconv.ParseInt(keepId, 10, 64); err != nil {
+			return nil, conflictError{kind: ErrInvalidConflictID, err: fmt.Errorf("line %d: the id %q of the user to keep is not a number", i+1, keepId)}
+		}
+		identification := strings.TrimSpace(strings.TrimPrefix(strings.Join(fields[:len(fields)-1], " "), "conflict:"))
+		block := fmt.Sprintf("conflict: %s", normalizeIdentification(identification))
+		if previous, ok := resolutions[block]; ok && previous != keepId {
+			return nil, fmt.Errorf("line %d: %q is resolved with both %s and %s", i+1, block, previous, keepId)
+		}
+		resolutions[block] = keepId
+	}
+	return resolutions, nil
+}
+
+// ApplyConflictResolutions marks the user to keep and the users to delete of every conflict block
+// with a resolution, in place of a conflict users file edited by hand. Conflict blocks without a
+// resolution, or whose resolution is not one of their users, are skipped and logged, and counted as
+// skipped by the next merge.
+func (r *ConflictResolver) ApplyConflictResolutions(resolutions map[string]string) {
+	resolved := make(ConflictingUsers, 0)
+	r.unresolved = 0
+	for _, block := range r.sortedBlocks() {
+		keepId, ok := resolutions[block]
+		if r.DiscardedBlocks[block] {
+			if ok {
+				logger.Warnf("%s: the conflict is discarded and has to be resolved manually, skipping\n", block)
+			}
+			r.unresolved++
+			continue
+		}
+		users := r.Blocks[block]
 		if len(users) < 2 {
-			return fmt.Errorf("not enough users to perform merge, found %d for id %s, should be at least 2", len(users), block)
+			continue
+		}
+		if !ok {
+			logger.Infof("%s: no resolution in the file, skipping\n", block)
+			r.unresolved++
+			continue
+		}
+		keep := false
+		for _, u := range users {
+			if u.ID == keepId {
+				keep = true
+				break
+			}
+		}
+		if !keep {
+			logger.Warnf("%s: the user to keep %s is not part of the conflict, skipping\n", block, keepId)
+			r.unresolved++
+			continue
+		}
+		for _, u := range users {
+			u.Direction = "-"
+			if u.ID == keepId {
+				u.Direction = "+"
+			}
+			resolved = append(resolved, u)
 		}
-		var intoUser user.User
-		var intoUserId int64
-		var fromUserIds []int64
+	}
+	for block := range resolutions {
+		if _, ok := r.Blocks[block]; !ok {
+			logger.Warnf("%s: resolved in the file but not a current conflict, ignoring\n", block)
+		}
+	}
+	r.ValidUsers = resolved
+	r.BuildConflictBlocks(resolved, fmt.Sprintf)
+}
 
-		// creating a session for each block of users
-		// we want to rollback incase something happens during update / delete
-		if err := r.Store.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
-			err := sess.Begin()
-			if err != nil {
-				return fmt.Errorf("could not open a db session: %w", err)
+// dryRunOperationsHeader starts the operations printed by ingest-file --dry-run, read back by --compare-dry-runs
+const dryRunOperationsHeader = "Operations that will be performed"
+
+// parseDryRunOperations reads the operations of a captured output of ingest-file --dry-run, by conflict block.
+// The operations of a block are the lines following it up to the next empty line.
+func parseDryRunOperations(b []byte) (map[string][]string, error) {
+	lines := strings.Split(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+	start := -1
+	for i, line := range lines {
+		if strings.TrimSpace(line) == dryRunOperationsHeader {
+			start = i + 1
+		}
+	}
+	if start < 0 {
+		return nil, fmt.Errorf("no %q section, the file is not an output of ingest-file --dry-run", dryRunOperationsHeader)
+	}
+	operations := make(map[string][]string)
+	var block string
+	for _, line := range lines[start:] {
+		switch {
+		case strings.TrimSpace(line) == "":
+			block = ""
+		case strings.HasPrefix(line, "conflict: "):
+			block = line
+			operations[block] = []string{}
+		case block != "":
+			operations[block] = append(operations[block], line)
+		}
+	}
+	return operations, nil
+}
+
+// compareDryRuns returns a readable description of every conflict block whose operations differ
+// between the two outputs of ingest-file --dry-run, with the removed lines prefixed by - and the added ones by +
+func compareDryRuns(a, b []byte) ([]string, error) {
+	operationsA, err := parseDryRunOperations(a)
+	if err != nil {
+		return nil, err
+	}
+	operationsB, err := parseDryRunOperations(b)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]string, 0, len(operationsA)+len(operationsB))
+	for block := range operationsA {
+		blocks = append(blocks, block)
+	}
+	for block := range operationsB {
+		if _, ok := operationsA[block]; !ok {
+			blocks = append(blocks, block)
+		}
+	}
+	sort.Strings(blocks)
+
+	diff := make([]string, 0)
+	for _, block := range blocks {
+		opsA, inA := operationsA[block]
+		opsB, inB := operationsB[block]
+		switch {
+		case !inB:
+			diff = append(diff, "- "+block)
+		case !inA:
+			diff = append(diff, "+ "+block)
+		default:
+			if lines, changed := diffLines(opsA, opsB); changed {
+				diff = append(diff, "~ "+block+"\n"+strings.Join(lines, "\n"))
 			}
-			for _, u := range users {
-				if u.Direction == "+" {
-					id, err := strconv.ParseInt(u.ID, 10, 64)
-					if err != nil {
-						return fmt.Errorf("could not convert id in +")
-					}
-					intoUserId = id
-				} else if u.Direction == "-" {
-					id, err := strconv.ParseInt(u.ID, 10, 64)
-					if err != nil {
-						return fmt.Errorf("could not convert id in -")
-					}
-					fromUserIds = append(fromUserIds, id)
+		}
+	}
+	return diff, nil
+}
+
+// diffLines returns the lines of a and b prefixed with - when only in a, + when only in b and spaces when in both,
+// in the order of a longest common subsequence, and whether any line differs
+func diffLines(a, b []string) ([]string, bool) {
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	lines := make([]string, 0, len(a)+len(b))
+	changed := false
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, "    "+a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			lines = append(lines, "  - "+a[i])
+			changed = true
+			i++
+		default:
+			lines = append(lines, "  + "+b[j])
+			changed = true
+			j++
+		}
+	}
+	return lines, changed
+}
+
+// Exit codes of the ingest-file command, letting automation tell a full resolution
+// apart from a partial one that might be worth retrying
+const (
+	// ConflictsExitResolved is returned when every conflict block was resolved
+	ConflictsExitResolved = 0
+	// ConflictsExitPartial is returned when some conflict blocks were resolved and others were skipped or failed,
+	// including the conflicts left without a resolution by --batch or --auto
+	ConflictsExitPartial = 2
+	// ConflictsExitFailed is returned when no conflict block could be resolved
+	ConflictsExitFailed = 3
+)
+
+// ConflictMergeSummary counts the outcome of merging the conflict blocks
+type ConflictMergeSummary struct {
+	Resolved int
+	Skipped  int
+	Failed   int
+}
+
+// ExitCode maps the summary to one of the ingest-file exit codes
+func (s ConflictMergeSummary) ExitCode() int {
+	switch {
+	case s.Skipped == 0 && s.Failed == 0:
+		return ConflictsExitResolved
+	case s.Resolved == 0:
+		return ConflictsExitFailed
+	default:
+		return ConflictsExitPartial
+	}
+}
+
+// String returns a machine-readable single line summary
+func (s ConflictMergeSummary) String() string {
+	return fmt.Sprintf("conflicts_summary resolved=%d skipped=%d failed=%d", s.Resolved, s.Skipped, s.Failed)
+}
+
+// MergeConflictingUsers merges every conflict block in its own transaction.
+// A failing block does not stop the others from being merged, the returned error joins the failures.
+func (r *ConflictResolver) MergeConflictingUsers(ctx context.Context) (ConflictMergeSummary, error) {
+	// the conflicts left without a resolution are not merged, so that automation can tell they remain
+	summary := ConflictMergeSummary{Skipped: r.unresolved}
+	r.unresolved = 0
+	var errs []string
+	blocks := r.sortedBlocks()
+	for i, block := range blocks {
+		if i > 0 && r.Pause > 0 {
+			if err := pause(ctx, r.Pause); err != nil {
+				summary.Skipped += len(blocks) - i
+				for _, skipped := range blocks[i:] {
+					r.logMerge(MergeLogEntry{Block: skipped, Outcome: MergeOutcomeSkipped, Reason: "merge interrupted"})
 				}
+				if len(errs) > 0 {
+					return summary, conflictError{kind: ErrMergeFailed, err: fmt.Errorf("merge interrupted: %w, could not merge %d conflict block(s): %s", err, len(errs), strings.Join(errs, "; "))}
+				}
+				return summary, fmt.Errorf("merge interrupted: %w", err)
 			}
-			if _, err := sess.ID(intoUserId).Where(sqlstore.NotServiceAccountFilter(r.Store)).Get(&intoUser); err != nil {
+		}
+		users := r.Blocks[block]
+		if len(users) < 2 {
+			summary.Skipped++
+			logger.Infof("not enough users to perform merge, found %d for id %s, should be at least 2, skipping\n", len(users), block)
+			r.logMerge(MergeLogEntry{Block: block, Outcome: MergeOutcomeSkipped, Reason: "not enough users"})
+			continue
+		}
+		if r.oversized(block) {
+			summary.Skipped++
+			logger.Warnf("%s: %d users exceed the maximum group size of %d, skipping, review it manually\n", block, len(users), r.MaxGroupSize)
+			r.logMerge(MergeLogEntry{Block: block, Outcome: MergeOutcomeSkipped, Reason: "group too large"})
+			continue
+		}
+		intoUserId, fromUserIds, malformed, err := blockUserIds(users)
+		if err != nil {
+			summary.Skipped++
+			logger.Warnf("%s: %s, skipping\n", block, err)
+			r.logMerge(MergeLogEntry{Block: block, Outcome: MergeOutcomeSkipped, Reason: err.Error()})
+			continue
+		}
+		if len(malformed) > 0 {
+			logger.Warnf("%s: ignoring the users to delete with malformed ids %s\n", block, strings.Join(malformed, ", "))
+		}
+		if len(fromUserIds) == 0 {
+			summary.Skipped++
+			logger.Warnf("%s: no user to delete with a valid id, skipping\n", block)
+			r.logMerge(MergeLogEntry{Block: block, IntoUserID: intoUserId, Outcome: MergeOutcomeSkipped, Reason: "no user to delete"})
+			continue
+		}
+		if err := r.runPreMergeHooks(ctx, block, users); err != nil {
+			summary.Failed++
+			errs = append(errs, fmt.Sprintf("%s: pre-merge hook: %s", block, err))
+			r.logMerge(MergeLogEntry{Block: block, IntoUserID: intoUserId, FromUserIDs: fromUserIds, Outcome: MergeOutcomeFailed, Reason: "pre-merge hook: " + err.Error()})
+			continue
+		}
+		mergeErr := r.mergeConflictBlock(ctx, block, intoUserId, fromUserIds)
+		r.runPostMergeHooks(ctx, block, users, mergeErr)
+		if mergeErr != nil {
+			summary.Failed++
+			errs = append(errs, fmt.Sprintf("%s: %s", block, mergeErr))
+			r.logMerge(MergeLogEntry{Block: block, IntoUserID: intoUserId, FromUserIDs: fromUserIds, Outcome: MergeOutcomeFailed, Reason: mergeErr.Error()})
+			continue
+		}
+		summary.Resolved++
+		r.logMerge(MergeLogEntry{Block: block, IntoUserID: intoUserId, FromUserIDs: fromUserIds, Outcome: MergeOutcomeResolved})
+	}
+	if len(errs) > 0 {
+		return summary, conflictError{kind: ErrMergeFailed, err: fmt.Errorf("could not merge %d conflict block(s): %s", len(errs), strings.Join(errs, "; "))}
+	}
+	return summary, nil
+}
+
+// PreMergeHook is called before a conflict block is merged, an error aborts the merge of that block
+type PreMergeHook func(ctx context.Context, block string, users ConflictingUsers) error
+
+// PostMergeHook is called after a conflict block is merged with the error of the merge, if any.
+// Its errors are only logged.
+type PostMergeHook func(ctx context.Context, block string, users ConflictingUsers, mergeErr error) error
+
+func (r *ConflictResolver) runPreMergeHooks(ctx context.Context, block string, users ConflictingUsers) error {
+	for _, hook := range r.PreMergeHooks {
+		if err := hook(ctx, block, users); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ConflictResolver) runPostMergeHooks(ctx context.Context, block string, users ConflictingUsers, mergeErr error) {
+	for _, hook := range r.PostMergeHooks {
+		if err := hook(ctx, block, users, mergeErr); err != nil {
+			logger.Infof("post-merge hook failed for %s: %s\n", block, err)
+		}
+	}
+}
+
+// ShellPreMergeHook runs a shell command before each merge, see conflictHookEnv for the details it receives
+func ShellPreMergeHook(command string) PreMergeHook {
+	return func(ctx context.Context, block string, users ConflictingUsers) error {
+		return runHookCommand(ctx, command, conflictHookEnv(block, users))
+	}
+}
+
+// ShellPostMergeHook runs a shell command after each merge, the result is passed in CONFLICT_RESULT
+func ShellPostMergeHook(command string) PostMergeHook {
+	return func(ctx context.Context, block string, users ConflictingUsers, mergeErr error) error {
+		result := "success"
+		if mergeErr != nil {
+			result = "failure: " + mergeErr.Error()
+		}
+		return runHookCommand(ctx, command, append(conflictHookEnv(block, users), "CONFLICT_RESULT="+result))
+	}
+}
+
+// conflictHookEnv passes the conflict block, the id of the user kept and the ids of the users deleted to hook commands
+func conflictHookEnv(block string, users ConflictingUsers) []string {
+	var keep string
+	var del []string
+	for _, u := range users {
+		if u.Direction == "+" {
+			keep = u.ID
+		} else if u.Direction == "-" {
+			del = append(del, u.ID)
+		}
+	}
+	return []string{
+		"CONFLICT_BLOCK=" + block,
+		"CONFLICT_KEEP=" + keep,
+		"CONFLICT_DELETE=" + strings.Join(del, ","),
+	}
+}
+
+func runHookCommand(ctx context.Context, command string, env []string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(), env...)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		logger.Infof("%s", out)
+	}
+	if err != nil {
+		return fmt.Errorf("hook command %q failed: %w", command, err)
+	}
+	return nil
+}
+
+// pause waits for the given duration unless the context is done first
+func pause(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (r *ConflictResolver) mergeConflictBlock(ctx context.Context, block string, intoUserId int64, fromUserIds []int64) error {
+	var intoUser user.User
+	journaled := false
+
+	// every block is merged in its own transaction, kept in the context so that the update
+	// of the kept user joins it, a failure rolls back all the changes made to the block
+	err := r.Store.InTransaction(ctx, func(ctx context.Context) error {
+		return r.Store.WithTransactionalDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			exists, err := sess.ID(intoUserId).Where(sqlstore.NotServiceAccountFilter(r.Store)).Get(&intoUser)
+			if err != nil {
 				return fmt.Errorf("could not find intoUser: %w", err)
 			}
-
+			if !exists {
+				// the users would be merged into nothing, e.g. when the conflicts changed since they were read
+				return fmt.Errorf("user to keep with id %d does not exist", intoUserId)
+			}
+			var deletedUsers []MergeJournalUser
+			// service accounts are never part of the conflicts, so the merged users own no service account tokens,
+			// and the API keys belong to their organization, neither has to be moved to the kept user
 			for _, fromUserId := range fromUserIds {
 				var fromUser user.User
 				exists, err := sess.ID(fromUserId).Where(sqlstore.NotServiceAccountFilter(r.Store)).Get(&fromUser)
@@ -316,80 +914,562 @@ func (r *ConflictResolver) MergeConflictingUsers(ctx context.Context) error {
 				if !exists {
 					fmt.Printf("user with id %d does not exist, skipping\n", fromUserId)
 				}
+				if r.Journal != nil && exists {
+					journaled, err := journalUser(sess, fromUser)
+					if err != nil {
+						return fmt.Errorf("could not read user %d for the journal: %w", fromUserId, err)
+					}
+					deletedUsers = append(deletedUsers, journaled)
+				}
+				if r.MergeAlertNotifications && exists {
+					// the email of the kept user is lowercased once the block is merged
+					if err := reassignAlertNotificationAddresses(sess, normalizeIdentification(intoUser.Email), fromUser.Email); err != nil {
+						return fmt.Errorf("could not move the alert notifications of user %d: %w", fromUserId, err)
+					}
+				}
+				if err := reassignTeamMemberships(sess, intoUserId, fromUserId); err != nil {
+					return fmt.Errorf("could not move the team memberships of user %d: %w", fromUserId, err)
+				}
+				if err := reassignStars(sess, intoUserId, fromUserId); err != nil {
+					return fmt.Errorf("could not move the starred dashboards of user %d: %w", fromUserId, err)
+				}
+				if err := reassignPreferences(sess, intoUserId, fromUserId); err != nil {
+					return fmt.Errorf("could not move the preferences of user %d: %w", fromUserId, err)
+				}
 				// // delete the user
 				delErr := r.Store.DeleteUserInSession(ctx, sess, &models.DeleteUserCommand{UserId: fromUserId})
 				if delErr != nil {
 					return fmt.Errorf("error during deletion of user: %w", delErr)
 				}
 			}
-			commitErr := sess.Commit()
-			if commitErr != nil {
-				return fmt.Errorf("could not commit operation for useridentification %s: %w", block, commitErr)
-			}
 			userStore := userimpl.ProvideStore(r.Store, setting.NewCfg())
 			updateMainCommand := &user.UpdateUserCommand{
 				UserID: intoUser.ID,
-				Login:  strings.ToLower(intoUser.Login),
-				Email:  strings.ToLower(intoUser.Email),
+				Login:  normalizeIdentification(intoUser.Login),
+				Email:  normalizeIdentification(intoUser.Email),
+			}
+			if err := userStore.Update(ctx, updateMainCommand); err != nil {
+				return fmt.Errorf("could not update user: %w", err)
+			}
+			if r.Journal != nil {
+				// recorded last and pending until the merge is committed, a failure to write the journal rolls back the merge
+				entry := MergeJournalEntry{Block: block, IntoUserID: intoUserId, MergedAt: time.Now(), DeletedUsers: deletedUsers, Pending: true}
+				if err := r.Journal.Record(entry); err != nil {
+					return fmt.Errorf("could not write the journal: %w", err)
+				}
+				journaled = true
+			}
+			return nil
+		})
+	})
+	if journaled {
+		r.settleJournal(block, err)
+	}
+	if err != nil {
+		return conflictError{kind: ErrMergeFailed, err: err}
+	}
+	return nil
+}
+
+// settleJournal confirms the pending journal entry of a merged block, or discards it when the merge was rolled back.
+// The merge is not failed by a journal that can't be written anymore, the entry is left pending instead.
+func (r *ConflictResolver) settleJournal(block string, mergeErr error) {
+	if mergeErr != nil {
+		if err := r.Journal.Discard(block); err != nil {
+			logger.Errorf("%s: the merge was rolled back but could not be removed from the journal, its entry is left pending: %s\n", block, err)
+		}
+		return
+	}
+	if err := r.Journal.Confirm(block); err != nil {
+		logger.Errorf("%s: the merge was committed but could not be confirmed in the journal, its entry is left pending: %s\n", block, err)
+	}
+}
+
+// reassignTeamMemberships moves the team memberships of the user being deleted to the kept user.
+// Where both are members of the same team, the membership of the kept user stays and gets the
+// higher of the two permissions, the other one is removed along with the deleted user.
+func reassignTeamMemberships(sess *sqlstore.DBSession, intoUserId int64, fromUserId int64) error {
+	var memberships []models.TeamMember
+	if err := sess.Where("user_id = ?", fromUserId).Find(&memberships); err != nil {
+		return err
+	}
+	for _, m := range memberships {
+		var existing models.TeamMember
+		has, err := sess.Where("team_id = ? AND user_id = ?", m.TeamId, intoUserId).Get(&existing)
+		if err != nil {
+			return err
+		}
+		if !has {
+			if _, err := sess.Exec("UPDATE team_member SET user_id = ? WHERE id = ?", intoUserId, m.Id); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.Permission > existing.Permission {
+			if _, err := sess.Exec("UPDATE team_member SET permission = ? WHERE id = ?", m.Permission, existing.Id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reassignStars moves the starred dashboards of the user being deleted to the kept user.
+// The dashboards the kept user already starred are left out, their stars are removed along with the deleted user.
+func reassignStars(sess *sqlstore.DBSession, intoUserId int64, fromUserId int64) error {
+	var starred []int64
+	if err := sess.Table("star").Where("user_id = ?", intoUserId).Cols("dashboard_id").Find(&starred); err != nil {
+		return err
+	}
+	query := sess.Table("star").Where("user_id = ?", fromUserId)
+	if len(starred) > 0 {
+		query.NotIn("dashboard_id", starred)
+	}
+	_, err := query.Update(map[string]interface{}{"user_id": intoUserId})
+	return err
+}
+
+// reassignPreferences moves the preferences of the user being deleted to the kept user, in the organizations
+// where the kept user has none. The preferences the kept user saved are left untouched.
+func reassignPreferences(sess *sqlstore.DBSession, intoUserId int64, fromUserId int64) error {
+	var orgIds []int64
+	if err := sess.Table("preferences").Where("user_id = ? AND team_id = 0", intoUserId).Cols("org_id").Find(&orgIds); err != nil {
+		return err
+	}
+	query := sess.Table("preferences").Where("user_id = ? AND team_id = 0", fromUserId)
+	if len(orgIds) > 0 {
+		query.NotIn("org_id", orgIds)
+	}
+	_, err := query.Update(map[string]interface{}{"user_id": intoUserId})
+	return err
+}
+
+// reassignAlertNotificationAddresses replaces the email address of a deleted account with the one of the kept
+// account in the email notification channels of legacy alerting, the alert_notification table. Alerting
+// references no user ids, only these addresses, so this is all that would be left behind by the deletion.
+// The contact points of unified alerting, part of the alertmanager configuration stored in the
+// alert_configuration table, are not covered and have to be updated from the UI or the provisioning API.
+func reassignAlertNotificationAddresses(sess *sqlstore.DBSession, intoEmail string, fromEmail string) error {
+	if fromEmail == "" || normalizeIdentification(intoEmail) == normalizeIdentification(fromEmail) {
+		return nil
+	}
+	var notifications []struct {
+		Id       int64
+		Settings *simplejson.Json
+	}
+	if err := sess.Table("alert_notification").Cols("id", "settings").Where("type = ?", "email").Find(&notifications); err != nil {
+		return err
+	}
+	for _, n := range notifications {
+		if n.Settings == nil {
+			continue
+		}
+		addresses := util.SplitEmails(n.Settings.Get("addresses").MustString())
+		changed := false
+		for i, address := range addresses {
+			if normalizeIdentification(address) == normalizeIdentification(fromEmail) {
+				addresses[i] = intoEmail
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		n.Settings.Set("addresses", strings.Join(addresses, ";"))
+		settings, err := n.Settings.Encode()
+		if err != nil {
+			return err
+		}
+		if _, err := sess.Exec("UPDATE alert_notification SET settings = ?, updated = ? WHERE id = ?", string(settings), time.Now(), n.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+hej@test.com+hej@test.com
+all of the permissions, roles and ownership will be transferred to the user.
++ id: 1, email: hej@test.com, login: hej@test.com
+these user(s) will be deleted and their permissions transferred.
+- id: 2, email: HEJ@TEST.COM, login: HEJ@TEST.COM
+- id: 3, email: hej@TEST.com, login: hej@TEST.com
+*/
+func (r *ConflictResolver) showChanges(ctx context.Context) {
+	if len(r.ValidUsers) == 0 {
+		fmt.Println("no changes will take place as we have no valid users.")
+		return
+	}
+
+	var b strings.Builder
+	for _, block := range r.sortedBlocks() {
+		if _, ok := r.DiscardedBlocks[block]; ok {
+			// skip block
+			continue
+		}
+		users := r.Blocks[block]
+
+		// looping as we want to can get these out of order (meaning the + and -)
+		var mainUser ConflictingUser
+		for _, u := range users {
+			if u.Direction == "+" {
+				mainUser = u
+				break
+			}
+		}
+		b.WriteString("Keep the following user.\n")
+		b.WriteString(fmt.Sprintf("%s\n", block))
+		b.WriteString(fmt.Sprintf("id: %s, email: %s, login: %s%s\n", mainUser.ID, mainUser.Email, mainUser.Login, r.describeOwnership(ctx, mainUser.ID)))
+		b.WriteString("\n\n")
+		b.WriteString("The following user(s) will be deleted.\n")
+		for _, user := range users {
+			if user.ID == mainUser.ID {
+				continue
+			}
+			// mergeable users
+			b.WriteString(fmt.Sprintf("id: %s, email: %s, login: %s%s\n", user.ID, user.Email, user.Login, r.describeOwnership(ctx, user.ID)))
+		}
+		b.WriteString("\n\n")
+	}
+	logger.Info("\n\nChanges that will take place\n\n")
+	logger.Infof(b.String())
+}
+
+// UserOwnership counts the resources recording a user as their creator or last editor. They keep
+// referring to the id of a deleted user, which helps to tell the account actually used apart.
+// Alert rules are not counted as they do not record who created or updated them.
+type UserOwnership struct {
+	Dashboards    int64
+	LibraryPanels int64
+}
+
+// userOwnership counts the resources created or last updated by the user
+func (r *ConflictResolver) userOwnership(ctx context.Context, userId int64) (UserOwnership, error) {
+	var ownership UserOwnership
+	err := r.Store.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		var err error
+		ownership.Dashboards, err = sess.Table("dashboard").
+			Where("is_folder = "+r.Store.Dialect.BooleanStr(false)+" AND (created_by = ? OR updated_by = ?)", userId, userId).Count()
+		if err != nil {
+			return err
+		}
+		// library panels are the library elements of kind 1
+		ownership.LibraryPanels, err = sess.Table("library_element").
+			Where("kind = 1 AND (created_by = ? OR updated_by = ?)", userId, userId).Count()
+		return err
+	})
+	return ownership, err
+}
+
+// describeOwnership returns the resources owned by the user as a suffix of its line in showChanges
+func (r *ConflictResolver) describeOwnership(ctx context.Context, id string) string {
+	userId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || r.Store == nil {
+		return ""
+	}
+	ownership, err := r.userOwnership(ctx, userId)
+	if err != nil {
+		logger.Debugf("could not count the resources of user %d: %s\n", userId, err)
+		return ""
+	}
+	return fmt.Sprintf(", dashboards: %d, library panels: %d", ownership.Dashboards, ownership.LibraryPanels)
+}
+
+// showStoreOperations prints the operations the store would perform to merge each conflict block
+func (r *ConflictResolver) showStoreOperations(ctx context.Context) error {
+	var b strings.Builder
+	for _, block := range r.sortedBlocks() {
+		b.WriteString(fmt.Sprintf("%s\n", block))
+		b.WriteString(fmt.Sprintf("type: %s\n", blockConflictType(r.Blocks[block])))
+		intoUserId, fromUserIds, malformed, err := blockUserIds(r.Blocks[block])
+		if err != nil {
+			b.WriteString(fmt.Sprintf("skipped: %s\n\n", err))
+			continue
+		}
+		if len(malformed) > 0 {
+			b.WriteString(fmt.Sprintf("ignored users to delete with malformed ids: %s\n", strings.Join(malformed, ", ")))
+		}
+		ops, err := r.previewMerge(ctx, intoUserId, fromUserIds)
+		if err != nil {
+			return err
+		}
+		for i, fromUserId := range fromUserIds {
+			b.WriteString(fmt.Sprintf("merge user %d into %d\n", fromUserId, intoUserId))
+			for _, op := range ops[i] {
+				b.WriteString(fmt.Sprintf("  %s %s: %d row(s)\n", op.Action, op.Table, op.Rows))
 			}
-			updateErr := userStore.Update(ctx, updateMainCommand)
-			if updateErr != nil {
-				return fmt.Errorf("could not update user: %w", updateErr)
+		}
+		b.WriteString("\n")
+	}
+	logger.Info("\n\n" + dryRunOperationsHeader + "\n\n")
+	logger.Infof(b.String())
+	return nil
+}
+
+// previewMerge returns the operations merging each user of fromUserIds into intoUserId would perform.
+// The rows the merge moves to the kept user are reported as moved rather than deleted with the user,
+// only those duplicating a row of the kept user are still deleted.
+func (r *ConflictResolver) previewMerge(ctx context.Context, intoUserId int64, fromUserIds []int64) ([][]sqlstore.MergeUserOperation, error) {
+	var moved []map[string]int64
+	err := r.Store.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		preview, err := newReassignmentPreview(sess, intoUserId)
+		if err != nil {
+			return err
+		}
+		for _, fromUserId := range fromUserIds {
+			m, err := preview.moved(sess, fromUserId)
+			if err != nil {
+				return err
 			}
+			moved = append(moved, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not preview the rows moved to user %d: %w", intoUserId, err)
+	}
+
+	var ops [][]sqlstore.MergeUserOperation
+	for i, fromUserId := range fromUserIds {
+		deletions, err := r.Store.MergeUserDryRun(ctx, intoUserId, fromUserId)
+		if err != nil {
+			return nil, fmt.Errorf("could not preview merging user %d into %d: %w", fromUserId, intoUserId, err)
+		}
+		ops = append(ops, withReassignments(deletions, moved[i]))
+	}
+	return ops, nil
+}
+
+// reassignedRows are the rows reassignTeamMemberships, reassignStars and reassignPreferences move to the kept user,
+// unless the kept user already has one for the same value of column
+var reassignedRows = []struct {
+	table  string
+	column string
+	where  string
+}{
+	{table: "team_member", column: "team_id", where: "user_id = ?"},
+	{table: "star", column: "dashboard_id", where: "user_id = ?"},
+	{table: "preferences", column: "org_id", where: "user_id = ? AND team_id = 0"},
+}
+
+// reassignmentPreview follows the teams, starred dashboards and organizations with preferences of the kept user
+// of a block, including those moved from the users previewed before, as the merge moves the rows of one user after the other
+type reassignmentPreview struct {
+	held map[string]map[int64]bool
+}
 
-			return nil
-		}); err != nil {
-			return err
+func newReassignmentPreview(sess *sqlstore.DBSession, intoUserId int64) (*reassignmentPreview, error) {
+	p := &reassignmentPreview{held: make(map[string]map[int64]bool)}
+	for _, rows := range reassignedRows {
+		var values []int64
+		if err := sess.Table(rows.table).Where(rows.where, intoUserId).Cols(rows.column).Find(&values); err != nil {
+			return nil, err
+		}
+		p.held[rows.table] = make(map[int64]bool)
+		for _, v := range values {
+			p.held[rows.table][v] = true
 		}
 	}
-	return nil
+	return p, nil
 }
 
-/*
-hej@test.com+hej@test.com
-all of the permissions, roles and ownership will be transferred to the user.
-+ id: 1, email: hej@test.com, login: hej@test.com
-these user(s) will be deleted and their permissions transferred.
-- id: 2, email: HEJ@TEST.COM, login: HEJ@TEST.COM
-- id: 3, email: hej@TEST.com, login: hej@TEST.com
-*/
-func (r *ConflictResolver) showChanges() {
-	if len(r.ValidUsers) == 0 {
-		fmt.Println("no changes will take place as we have no valid users.")
-		return
+// moved returns the number of rows of a user being deleted that the merge moves to the kept user, by table
+func (p *reassignmentPreview) moved(sess *sqlstore.DBSession, fromUserId int64) (map[string]int64, error) {
+	moved := make(map[string]int64)
+	for _, rows := range reassignedRows {
+		var values []int64
+		if err := sess.Table(rows.table).Where(rows.where, fromUserId).Cols(rows.column).Find(&values); err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			if !p.held[rows.table][v] {
+				p.held[rows.table][v] = true
+				moved[rows.table]++
+			}
+		}
 	}
+	return moved, nil
+}
 
-	var b strings.Builder
-	for block, users := range r.Blocks {
-		if _, ok := r.DiscardedBlocks[block]; ok {
-			// skip block
+// withReassignments turns the deletions of the rows moved to the kept user into moves, the rows left are
+// deleted with the user. Every table the merge moves rows of gets a move, even when no row is moved.
+func withReassignments(deletions []sqlstore.MergeUserOperation, moved map[string]int64) []sqlstore.MergeUserOperation {
+	reassigned := make(map[string]bool, len(reassignedRows))
+	for _, rows := range reassignedRows {
+		reassigned[rows.table] = true
+	}
+	ops := make([]sqlstore.MergeUserOperation, 0, len(deletions)+len(reassignedRows))
+	for _, op := range deletions {
+		if op.Action == "delete" && reassigned[op.Table] {
+			ops = append(ops, sqlstore.MergeUserOperation{Table: op.Table, Action: "move", Rows: moved[op.Table]})
+			op.Rows -= moved[op.Table]
+		}
+		ops = append(ops, op)
+	}
+	return ops
+}
+
+// Conflict types of a conflict block, shown by the dry run of ingest-file
+const (
+	// ConflictTypeSameIdentification is a block with users having the same email and the same login
+	// apart from case, the same person was signed up more than once
+	ConflictTypeSameIdentification = "SameIdentification"
+	// ConflictTypeMerge is a block whose users only share their email or their login apart from case
+	ConflictTypeMerge = "Merge"
+)
+
+// ConflictCounts is the number of conflict blocks by type and of the users they affect
+type ConflictCounts struct {
+	Blocks             int
+	Merge              int
+	SameIdentification int
+	Users              int
+}
+
+// String returns a header line giving a sense of the scale of the conflicts
+func (c ConflictCounts) String() string {
+	return fmt.Sprintf("Found %d conflict groups (%d merge, %d same-identification) affecting %d users",
+		c.Blocks, c.Merge, c.SameIdentification, c.Users)
+}
+
+// ConflictCounts counts the conflict blocks that can be merged, leaving out the discarded ones
+func (r *ConflictResolver) ConflictCounts() ConflictCounts {
+	var counts ConflictCounts
+	users := make(map[string]bool)
+	for block, blockUsers := range r.Blocks {
+		if r.DiscardedBlocks[block] || len(blockUsers) < 2 {
 			continue
 		}
+		counts.Blocks++
+		if blockConflictType(blockUsers) == ConflictTypeSameIdentification {
+			counts.SameIdentification++
+		} else {
+			counts.Merge++
+		}
+		for _, u := range blockUsers {
+			users[u.ID] = true
+		}
+	}
+	counts.Users = len(users)
+	return counts
+}
 
-		// looping as we want to can get these out of order (meaning the + and -)
-		var mainUser ConflictingUser
+// blockConflictType tells whether the users of a conflict block include duplicates of the same identification
+// or are distinct accounts merged because they share an email or a login. Duplicates take precedence, so that
+// the type agrees with sameIdentificationConflictIds.
+func blockConflictType(users ConflictingUsers) string {
+	if len(sameIdentificationConflictIds(users)) > 0 {
+		return ConflictTypeSameIdentification
+	}
+	return ConflictTypeMerge
+}
+
+// identicalDuplicateResolutions keeps the user with the lowest id of every conflict block whose users all have
+// the same email and the same login apart from case and surrounding spaces, as there is no user to choose.
+// The other conflict blocks have no resolution.
+func (r *ConflictResolver) identicalDuplicateResolutions() map[string]string {
+	resolutions := make(map[string]string)
+	for _, block := range r.sortedBlocks() {
+		users := r.Blocks[block]
+		if r.DiscardedBlocks[block] || len(users) < 2 || !identicalDuplicates(users) {
+			continue
+		}
+		var keepId int64
 		for _, u := range users {
-			if u.Direction == "+" {
-				mainUser = u
+			id, err := strconv.ParseInt(u.ID, 10, 64)
+			if err != nil {
+				keepId = 0
 				break
 			}
+			if keepId == 0 || id < keepId {
+				keepId = id
+			}
 		}
-		b.WriteString("Keep the following user.\n")
-		b.WriteString(fmt.Sprintf("%s\n", block))
-		b.WriteString(fmt.Sprintf("id: %s, email: %s, login: %s\n", mainUser.ID, mainUser.Email, mainUser.Login))
-		b.WriteString("\n\n")
-		b.WriteString("The following user(s) will be deleted.\n")
-		for _, user := range users {
-			if user.ID == mainUser.ID {
+		if keepId == 0 {
+			logger.Warnf("%s: malformed user ids, not deduplicated\n", block)
+			continue
+		}
+		r.trace("%q resolved by keeping user %d of identical duplicates", block, keepId)
+		resolutions[block] = strconv.FormatInt(keepId, 10)
+	}
+	return resolutions
+}
+
+// identicalDuplicates reports whether the users all have the same email and login apart from case and surrounding spaces
+func identicalDuplicates(users ConflictingUsers) bool {
+	for _, u := range users[1:] {
+		if normalizeIdentification(u.Email) != normalizeIdentification(users[0].Email) || normalizeIdentification(u.Login) != normalizeIdentification(users[0].Login) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameIdentificationConflictIds returns the ids of the users of a conflict block having
+// the same email and the same login as another user of the block, apart from case and surrounding spaces
+func sameIdentificationConflictIds(users ConflictingUsers) []string {
+	ids := make([]string, 0)
+	for i, u := range users {
+		for j, other := range users {
+			if i != j && normalizeIdentification(u.Email) == normalizeIdentification(other.Email) && normalizeIdentification(u.Login) == normalizeIdentification(other.Login) {
+				ids = append(ids, u.ID)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+var (
+	// ErrInvalidConflictID is returned when the id of a user to keep is not a number, a mistake in the conflicts file
+	ErrInvalidConflictID = errors.New("invalid conflict user id")
+	// ErrMergeFailed is returned when conflict blocks could not be merged in the database
+	ErrMergeFailed = errors.New("conflict merge failed")
+)
+
+// conflictError makes errors.Is match an error with ErrInvalidConflictID or ErrMergeFailed, leaving its message as is
+type conflictError struct {
+	kind error
+	err  error
+}
+
+func (e conflictError) Error() string        { return e.err.Error() }
+func (e conflictError) Unwrap() error        { return e.err }
+func (e conflictError) Is(target error) bool { return target == e.kind }
+
+// blockUserIds returns the id of the user to keep and the ids of the users to delete in a conflict block.
+// The malformed ids of users to delete are returned separately so that the valid ones can still be merged,
+// while a missing or malformed id of the user to keep is an error as the block can't be merged at all.
+func blockUserIds(users ConflictingUsers) (intoUserId int64, fromUserIds []int64, malformed []string, err error) {
+	hasIntoUser := false
+	for _, u := range users {
+		if u.Direction == "+" {
+			id, err := strconv.ParseInt(u.ID, 10, 64)
+			if err != nil {
+				return 0, nil, nil, conflictError{kind: ErrInvalidConflictID, err: fmt.Errorf("the id %q of the user to keep is not a number", u.ID)}
+			}
+			intoUserId = id
+			hasIntoUser = true
+		} else if u.Direction == "-" {
+			id, err := strconv.ParseInt(u.ID, 10, 64)
+			if err != nil {
+				malformed = append(malformed, strconv.Quote(u.ID))
 				continue
 			}
-			// mergeable users
-			b.WriteString(fmt.Sprintf("id: %s, email: %s, login: %s\n", user.ID, user.Email, user.Login))
+			fromUserIds = append(fromUserIds, id)
 		}
-		b.WriteString("\n\n")
 	}
-	logger.Info("\n\nChanges that will take place\n\n")
-	logger.Infof(b.String())
+	if !hasIntoUser {
+		return 0, nil, nil, errors.New("there is no user to keep")
+	}
+	// the user to keep is never deleted, even if it is also listed as a user to delete
+	kept := fromUserIds[:0]
+	for _, id := range fromUserIds {
+		if id != intoUserId {
+			kept = append(kept, id)
+		}
+	}
+	return intoUserId, kept, malformed, nil
 }
 
 // Formatter make it possible for us to write to terminal and to a file
@@ -418,19 +1498,25 @@ func (r *ConflictResolver) BuildConflictBlocks(users ConflictingUsers, f Formatt
 	blocks := make(map[string]ConflictingUsers)
 	for _, user := range users {
 		// conflict blocks is how we identify a conflict in the user base.
-		var conflictBlock string
+		var conflictBlock, reason string
 		if user.ConflictEmail != "" {
-			conflictBlock = f("conflict: %s", strings.ToLower(user.Email))
+			conflictBlock = f("conflict: %s", r.emailIdentification(user.Email))
+			reason = "email only differs by case from another user's"
 		} else if user.ConflictLogin != "" {
-			conflictBlock = f("conflict: %s", strings.ToLower(user.Login))
+			conflictBlock = f("conflict: %s", normalizeIdentification(user.Login))
+			reason = "login only differs by case from another user's"
 		} else if user.ConflictEmail != "" && user.ConflictLogin != "" {
 			// both conflicts
 			// should not be here unless changed in sql
-			conflictBlock = f("conflict: %s%s", strings.ToLower(user.Email), strings.ToLower(user.Login))
+			conflictBlock = f("conflict: %s%s", r.emailIdentification(user.Email), normalizeIdentification(user.Login))
+			reason = "email and login only differ by case from another user's"
 		}
+		r.trace("row id=%s email=%s login=%s auth_module=%s conflict_email=%q conflict_login=%q: identifier %q, %s",
+			user.ID, user.Email, user.Login, user.AuthModule, user.ConflictEmail, user.ConflictLogin, conflictBlock, reason)
 
 		// discard logic
-		if shouldDiscardBlock(seenUsersToBlock, conflictBlock, user) {
+		if otherBlock := seenUsersToBlock[user.ID]; shouldDiscardBlock(seenUsersToBlock, conflictBlock, user) {
+			r.trace("%q is discarded: user %s is also part of %q", conflictBlock, user.ID, otherBlock)
 			discardedBlocks[conflictBlock] = true
 		}
 
@@ -448,6 +1534,194 @@ func (r *ConflictResolver) BuildConflictBlocks(users ConflictingUsers, f Formatt
 	}
 	r.Blocks = blocks
 	r.DiscardedBlocks = discardedBlocks
+
+	if r.Trace != nil {
+		for _, block := range r.sortedBlocks() {
+			switch {
+			case discardedBlocks[block]:
+				r.trace("%q classified as discarded, it has to be resolved manually", block)
+			case len(blocks[block]) < 2:
+				r.trace("%q classified as not a conflict, it has a single user", block)
+			default:
+				r.trace("%q classified as a conflict between %d users", block, len(blocks[block]))
+			}
+		}
+	}
+}
+
+// emailIdentification returns the email a conflict block is named after, without its +tag with NormalizeEmail
+func (r *ConflictResolver) emailIdentification(email string) string {
+	if r.NormalizeEmail {
+		return normalizePlusAddressedEmail(email)
+	}
+	return normalizeIdentification(email)
+}
+
+// trace writes a line to Trace, if set
+func (r *ConflictResolver) trace(format string, a ...interface{}) {
+	if r.Trace == nil {
+		return
+	}
+	fmt.Fprintf(r.Trace, "[trace] "+format+"\n", a...)
+}
+
+// IgnoreEmailDomains removes the conflict blocks where the emails of all users
+// belong to one of the given domains, such as known-benign service accounts on a shared domain
+func (r *ConflictResolver) IgnoreEmailDomains(domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	ignoredUsers := make(map[string]bool)
+	for block, users := range r.Blocks {
+		if !allEmailsInDomains(users, domains) {
+			continue
+		}
+		r.trace("%q is ignored: the emails of all its users belong to %s", block, strings.Join(domains, ", "))
+		for _, u := range users {
+			ignoredUsers[u.ID] = true
+		}
+		delete(r.Blocks, block)
+		delete(r.DiscardedBlocks, block)
+	}
+	if len(ignoredUsers) == 0 {
+		return
+	}
+	users := make(ConflictingUsers, 0, len(r.Users))
+	for _, u := range r.Users {
+		if !ignoredUsers[u.ID] {
+			users = append(users, u)
+		}
+	}
+	r.Users = users
+}
+
+func allEmailsInDomains(users ConflictingUsers, domains []string) bool {
+	for _, u := range users {
+		if !emailInDomains(u.Email, domains) {
+			return false
+		}
+	}
+	return true
+}
+
+func emailInDomains(email string, domains []string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	emailDomain := email[at+1:]
+	for _, domain := range domains {
+		if strings.EqualFold(emailDomain, strings.TrimPrefix(strings.TrimSpace(domain), "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnlyIdentities keeps only the conflict blocks containing a user whose login or email is one of the given identities
+func (r *ConflictResolver) OnlyIdentities(identities []string) {
+	wanted := make(map[string]bool, len(identities))
+	for _, identity := range identities {
+		wanted[normalizeIdentification(identity)] = true
+	}
+	keptUsers := make(map[string]bool)
+	for block, users := range r.Blocks {
+		matches := false
+		for _, u := range users {
+			if wanted[normalizeIdentification(u.Login)] || wanted[normalizeIdentification(u.Email)] {
+				matches = true
+				break
+			}
+		}
+		if !matches {
+			r.trace("%q is left out: none of its users is one of the requested identities", block)
+			delete(r.Blocks, block)
+			delete(r.DiscardedBlocks, block)
+			continue
+		}
+		for _, u := range users {
+			keptUsers[u.ID] = true
+		}
+	}
+	users := make(ConflictingUsers, 0, len(keptUsers))
+	for _, u := range r.Users {
+		if keptUsers[u.ID] {
+			users = append(users, u)
+		}
+	}
+	r.Users = users
+}
+
+// OnlyConflictType keeps only the conflict blocks of the given type, "email" for the users whose emails
+// only differ by case and "login" for the users whose logins do, so that they can be resolved separately
+func (r *ConflictResolver) OnlyConflictType(conflictType string) error {
+	if conflictType != "email" && conflictType != "login" {
+		return fmt.Errorf("unknown conflict type %q, expected email or login", conflictType)
+	}
+	keptUsers := make(map[string]bool)
+	for block, users := range r.Blocks {
+		if isEmailConflict(users) != (conflictType == "email") {
+			r.trace("%q is left out: it is not a conflict of %s", block, conflictType)
+			delete(r.Blocks, block)
+			delete(r.DiscardedBlocks, block)
+			continue
+		}
+		for _, u := range users {
+			keptUsers[u.ID] = true
+		}
+	}
+	users := make(ConflictingUsers, 0, len(keptUsers))
+	for _, u := range r.Users {
+		if keptUsers[u.ID] {
+			users = append(users, u)
+		}
+	}
+	r.Users = users
+	return nil
+}
+
+// isEmailConflict reports whether a conflict block gathers users by email, blocks are
+// built by email first so a user in conflict on both is part of an email conflict
+func isEmailConflict(users ConflictingUsers) bool {
+	for _, u := range users {
+		if u.ConflictEmail != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// OnlyIdentifier keeps only the conflict block of the given login or email
+func (r *ConflictResolver) OnlyIdentifier(identifier string) error {
+	r.OnlyIdentities([]string{identifier})
+	if len(r.Blocks) == 0 {
+		return fmt.Errorf("%q does not correspond to a current conflict", identifier)
+	}
+	return nil
+}
+
+// parseIdentities reads one login or email per line, skipping empty lines and # comments
+func parseIdentities(b []byte) []string {
+	var identities []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identities = append(identities, line)
+	}
+	return identities
+}
+
+// sortedBlocks returns the conflict blocks in a stable order so that
+// repeated runs over the same conflicts present them identically
+func (r *ConflictResolver) sortedBlocks() []string {
+	blocks := make([]string, 0, len(r.Blocks))
+	for block := range r.Blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Strings(blocks)
+	return blocks
 }
 
 func contains(cu ConflictingUsers, target ConflictingUser) bool {
@@ -496,14 +1770,18 @@ func (r *ConflictResolver) ToStringPresentation() string {
 	*/
 	startOfBlock := make(map[string]bool)
 	var b strings.Builder
-	for block, users := range r.Blocks {
+	for _, block := range r.sortedBlocks() {
 		if _, ok := r.DiscardedBlocks[block]; ok {
 			// skip block
 			continue
 		}
-		for _, user := range users {
+		for _, user := range r.Blocks[block] {
 			if !startOfBlock[block] {
 				b.WriteString(fmt.Sprintf("%s\n", block))
+				if r.oversized(block) {
+					// a comment, skipped when the file is read back
+					b.WriteString(fmt.Sprintf("# %d users exceed the maximum group size of %d, this conflict is not merged, review it manually\n", len(r.Blocks[block]), r.MaxGroupSize))
+				}
 				startOfBlock[block] = true
 				b.WriteString(fmt.Sprintf("+ id: %s, email: %s, login: %s, last_seen_at: %s, auth_module: %s, conflict_email: %s, conflict_login: %s\n",
 					user.ID,
@@ -531,6 +1809,11 @@ func (r *ConflictResolver) ToStringPresentation() string {
 	return b.String()
 }
 
+// oversized reports whether a conflict block has more users than MaxGroupSize
+func (r *ConflictResolver) oversized(block string) bool {
+	return r.MaxGroupSize > 0 && len(r.Blocks[block]) > r.MaxGroupSize
+}
+
 type ConflictResolver struct {
 	Store           *sqlstore.SQLStore
 	Config          *setting.Cfg
@@ -538,6 +1821,26 @@ type ConflictResolver struct {
 	ValidUsers      ConflictingUsers
 	Blocks          map[string]ConflictingUsers
 	DiscardedBlocks map[string]bool
+	// Pause is waited between the merges of two conflict blocks
+	Pause          time.Duration
+	PreMergeHooks  []PreMergeHook
+	PostMergeHooks []PostMergeHook
+	// Trace receives a detailed account of how the conflicts were determined, if set
+	Trace io.Writer
+	// MergeAlertNotifications replaces the addresses of the merged away accounts in the alert notifications
+	MergeAlertNotifications bool
+	// Journal records the users deleted by the merges so that they can be recreated, if set
+	Journal *MergeJournal
+	// MergeLog receives a JSON line per merged conflict block with its outcome, if set
+	MergeLog io.Writer
+	// NormalizeEmail groups the users whose emails only differ by a +tag, e.g. bob@example.com and
+	// bob+test@example.com, in the same conflict block
+	NormalizeEmail bool
+	// unresolved is the number of conflict blocks ApplyConflictResolutions left without a user to keep
+	unresolved int
+	// MaxGroupSize is the number of users above which a conflict block is left for manual review
+	// instead of being merged, zero for no limit
+	MaxGroupSize int
 }
 
 type ConflictingUser struct {
@@ -606,10 +1909,15 @@ func (c *ConflictingUser) Marshal(filerow string) error {
 }
 
 func GetUsersWithConflictingEmailsOrLogins(ctx *cli.Context, s *sqlstore.SQLStore) (ConflictingUsers, error) {
+	return getUsersWithConflictingEmailsOrLogins(ctx.Context, s, detectConflictQueryDialect(ctx.Context, s), conflictQueryFilter{})
+}
+
+// getUsersWithConflictingEmailsOrLogins returns the users in conflict, only the conflicts kept by the filter
+func getUsersWithConflictingEmailsOrLogins(ctx context.Context, s *sqlstore.SQLStore, dialect conflictQueryDialect, filter conflictQueryFilter) (ConflictingUsers, error) {
 	queryUsers := make([]ConflictingUser, 0)
-	outerErr := s.WithDbSession(ctx.Context, func(dbSession *sqlstore.DBSession) error {
-		rawSQL := conflictingUserEntriesSQL(s)
-		err := dbSession.SQL(rawSQL).Find(&queryUsers)
+	outerErr := s.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		rawSQL, args := conflictingUserEntriesGroupedSQL(s, dialect, filter)
+		err := dbSession.SQL(rawSQL, args...).Find(&queryUsers)
 		return err
 	})
 	if outerErr != nil {
@@ -618,57 +1926,330 @@ func GetUsersWithConflictingEmailsOrLogins(ctx *cli.Context, s *sqlstore.SQLStor
 	return queryUsers, nil
 }
 
-// conflictingUserEntriesSQL orders conflicting users by their user_identification
-// sorts the users by their useridentification and ids
-func conflictingUserEntriesSQL(s *sqlstore.SQLStore) string {
+// CountUsersWithConflictingEmailsOrLogins returns the number of rows GetUsersWithConflictingEmailsOrLogins
+// would return, counted by the database, so that the existence of conflicts can be polled cheaply
+func CountUsersWithConflictingEmailsOrLogins(ctx context.Context, s *sqlstore.SQLStore) (int, error) {
+	rawSQL, args := conflictingUserEntriesUnionSQL(s, detectConflictQueryDialect(ctx, s), conflictQueryFilter{})
+	var count int
+	err := s.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		_, err := dbSession.SQL("SELECT COUNT(*) FROM ("+rawSQL+") AS conflicts", args...).Get(&count)
+		return err
+	})
+	return count, err
+}
+
+// conflictingUserEntriesSQL compares every pair of users to find the logins and emails used with different cases
+// or surrounding spaces, ordered by the conflicting email, login and id. The command no longer runs it, it uses
+// conflictingUserEntriesGroupedSQL and conflictingUserEntriesUnionSQL, and it is kept as the reference the tests
+// check those faster queries against.
+// Deleted users are removed from the user table, so every row belongs to an existing user, while disabled users
+// are still part of the conflicts.
+// The comparisons are made in a derived table as only SQLite lets the WHERE clause refer to the aliases of the
+// selected columns, and the users are cross joined so that Postgres lets user_auth be joined on the first one.
+func conflictingUserEntriesSQL(s *sqlstore.SQLStore, dialect conflictQueryDialect) string {
 	userDialect := db.DB.GetDialect(s).Quote("user")
+	cs := dialect.caseSensitive
 
 	sqlQuery := `
 	SELECT DISTINCT
-	u1.id,
-	u1.email,
-	u1.login,
-	u1.last_seen_at,
-	user_auth.auth_module,
-		( SELECT
-			'true'
-		FROM
-			` + userDialect + `
-		WHERE (LOWER(u1.email) = LOWER(u2.email)) AND(u1.email != u2.email)) AS conflict_email,
-		( SELECT
-			'true'
+	id,
+	email,
+	login,
+	last_seen_at,
+	auth_module,
+	conflict_email,
+	conflict_login
+	FROM (
+		SELECT
+		u1.id AS id,
+		u1.email AS email,
+		u1.login AS login,
+		u1.last_seen_at AS last_seen_at,
+		user_auth.auth_module AS auth_module,
+			CASE WHEN ` + normalizedSQL("u1.email") + ` = ` + normalizedSQL("u2.email") + ` AND ` + cs("u1.email") + ` != ` + cs("u2.email") + ` THEN 'true' END AS conflict_email,
+			CASE WHEN ` + normalizedSQL("u1.login") + ` = ` + normalizedSQL("u2.login") + ` AND ` + cs("u1.login") + ` != ` + cs("u2.login") + ` THEN 'true' END AS conflict_login
 		FROM
-			` + userDialect + `
-		WHERE (LOWER(u1.login) = LOWER(u2.login) AND(u1.login != u2.login))) AS conflict_login
-	FROM
-		 ` + userDialect + ` AS u1, ` + userDialect + ` AS u2
-	LEFT JOIN user_auth on user_auth.user_id = u1.id
+			` + userDialect + ` AS u1 CROSS JOIN ` + userDialect + ` AS u2
+		LEFT JOIN user_auth on user_auth.user_id = u1.id
+		WHERE (u1.` + notServiceAccount(s) + `) AND (u2.` + notServiceAccount(s) + `)
+	) AS pairs
 	WHERE (conflict_email IS NOT NULL
 		OR conflict_login IS NOT NULL)
-		AND (u1.` + notServiceAccount(s) + `)
-	ORDER BY conflict_email, conflict_login, u1.id`
+	ORDER BY conflict_email, conflict_login, id`
 	return sqlQuery
 }
 
+// conflictQueryDialect is the variant of the conflict query suited to a database
+type conflictQueryDialect struct {
+	name string
+	// caseSensitive returns an expression of column whose comparisons take the case into account
+	caseSensitive func(column string) string
+}
+
+// detectConflictQueryDialect picks the variant of the conflict query for the database of s.
+// The version is only queried from MySQL servers, to tell MySQL and MariaDB apart in the logs.
+func detectConflictQueryDialect(ctx context.Context, s *sqlstore.SQLStore) conflictQueryDialect {
+	driverName := db.DB.GetDialect(s).DriverName()
+	version := ""
+	if driverName == migrator.MySQL {
+		if err := s.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.SQL("SELECT VERSION()").Get(&version)
+			return err
+		}); err != nil {
+			logger.Debugf("could not get the version of the database: %s\n", err)
+		}
+	}
+	dialect := conflictQueryDialectFor(driverName, version)
+	logger.Debugf("using the %s conflict query\n", dialect.name)
+	return dialect
+}
+
+// conflictQueryDialectFor returns the variant of the conflict query for a driver and the version reported by the database.
+// SQLite and Postgres compare strings with their case, whatever their version, and the query uses no aggregate
+// differing between Postgres versions. MySQL and MariaDB compare strings without their case with their default
+// collations, so the columns are cast to binary strings, which both support in all their versions.
+func conflictQueryDialectFor(driverName string, version string) conflictQueryDialect {
+	asIs := func(column string) string { return column }
+	switch driverName {
+	case migrator.MySQL:
+		name := "mysql"
+		if strings.Contains(strings.ToLower(version), "mariadb") {
+			name = "mariadb"
+		}
+		return conflictQueryDialect{name: name, caseSensitive: func(column string) string {
+			return "CAST(" + column + " AS BINARY)"
+		}}
+	case migrator.Postgres:
+		return conflictQueryDialect{name: "postgres", caseSensitive: asIs}
+	case migrator.SQLite:
+		return conflictQueryDialect{name: "sqlite3", caseSensitive: asIs}
+	default:
+		logger.Warnf("unknown database driver %q, using the default conflict query\n", driverName)
+		return conflictQueryDialect{name: driverName, caseSensitive: asIs}
+	}
+}
+
+// conflictQueryFilter narrows down the conflicts of the conflict query, its zero value keeps them all
+type conflictQueryFilter struct {
+	// orgId keeps the logins and emails used by a member of the organization, if not 0
+	orgId int64
+	// identifications keeps the given lowercased logins and emails, if not empty
+	identifications []string
+}
+
+// conflictingUserEntriesGroupedSQL returns the same rows as conflictingUserEntriesSQL without comparing
+// every pair of users: the logins and emails used with different cases are found first with GROUP BY,
+// then only the users having one of them are joined, on their lowercased email and then login.
+// The filter only narrows down the logins and emails considered, all the users having them are still
+// returned. Its values are passed in the returned args.
+func conflictingUserEntriesGroupedSQL(s *sqlstore.SQLStore, dialect conflictQueryDialect, filter conflictQueryFilter) (string, []interface{}) {
+	sqlQuery, args := conflictingUserEntriesUnionSQL(s, dialect, filter)
+	return sqlQuery + `
+	ORDER BY conflict_email, conflict_login, id`, args
+}
+
+// conflictingUserEntriesUnionSQL returns the rows of conflictingUserEntriesGroupedSQL in no particular order
+func conflictingUserEntriesUnionSQL(s *sqlstore.SQLStore, dialect conflictQueryDialect, filter conflictQueryFilter) (string, []interface{}) {
+	userDialect := db.DB.GetDialect(s).Quote("user")
+	cs := dialect.caseSensitive
+	var args []interface{}
+
+	// users with a login or an email also used with a different case by another user,
+	// DISTINCT keeps SQLite from flattening the subquery and evaluating it for every joined row.
+	// Service accounts are left out on both sides, they are never merged with users.
+	candidates := `
+		SELECT DISTINCT id, email, login, last_seen_at, is_service_account, ` + normalizedSQL("email") + ` AS lower_email, ` + normalizedSQL("login") + ` AS lower_login
+		FROM ` + userDialect + `
+		WHERE (` + notServiceAccount(s) + `) AND (` + normalizedSQL("email") + ` IN (
+			SELECT ` + normalizedSQL("email") + ` FROM ` + userDialect + ` WHERE ` + notServiceAccount(s) + ` GROUP BY ` + normalizedSQL("email") + ` HAVING COUNT(DISTINCT ` + cs("email") + `) > 1
+		) OR ` + normalizedSQL("login") + ` IN (
+			SELECT ` + normalizedSQL("login") + ` FROM ` + userDialect + ` WHERE ` + notServiceAccount(s) + ` GROUP BY ` + normalizedSQL("login") + ` HAVING COUNT(DISTINCT ` + cs("login") + `) > 1
+		))`
+
+	pairs := func(column string) string {
+		orgFilter := ""
+		if filter.orgId != 0 {
+			orgFilter = `
+		AND u1.lower_` + column + ` IN (
+			SELECT ` + normalizedSQL(column) + ` FROM ` + userDialect + ` INNER JOIN org_user ON org_user.user_id = ` + userDialect + `.id WHERE org_user.org_id = ?
+		)`
+			args = append(args, filter.orgId)
+		}
+		if len(filter.identifications) > 0 {
+			orgFilter += `
+		AND u1.lower_` + column + ` IN (?` + strings.Repeat(", ?", len(filter.identifications)-1) + `)`
+			for _, identification := range filter.identifications {
+				args = append(args, identification)
+			}
+		}
+		return `
+	SELECT
+	u1.id AS id,
+	u1.email AS email,
+	u1.login AS login,
+	u1.last_seen_at AS last_seen_at,
+	user_auth.auth_module AS auth_module,
+		CASE WHEN u1.lower_email = u2.lower_email AND ` + cs("u1.email") + ` != ` + cs("u2.email") + ` THEN 'true' END AS conflict_email,
+		CASE WHEN u1.lower_login = u2.lower_login AND ` + cs("u1.login") + ` != ` + cs("u2.login") + ` THEN 'true' END AS conflict_login
+	FROM (` + candidates + `) AS u1
+	INNER JOIN (` + candidates + `) AS u2
+		ON u1.lower_` + column + ` = u2.lower_` + column + ` AND ` + cs("u1."+column) + ` != ` + cs("u2."+column) + `
+	LEFT JOIN user_auth on user_auth.user_id = u1.id
+	WHERE (u1.` + notServiceAccount(s) + `)` + orgFilter
+	}
+
+	// UNION removes the duplicates as DISTINCT does in conflictingUserEntriesSQL
+	sqlQuery := pairs("email") + `
+	UNION` + pairs("login")
+	return sqlQuery, args
+}
+
+// getUsersWithPlusAddressedEmailConflicts returns the users whose emails are the same once their +tag is removed,
+// such as bob@example.com and bob+test@example.com, while differing otherwise, as email conflicts.
+// The databases have no portable way to remove the tags, so every user is read and grouped here.
+func getUsersWithPlusAddressedEmailConflicts(ctx context.Context, s *sqlstore.SQLStore) (ConflictingUsers, error) {
+	rawSQL := `
+	SELECT u.id AS id, u.email AS email, u.login AS login, u.last_seen_at AS last_seen_at, user_auth.auth_module AS auth_module
+	FROM ` + db.DB.GetDialect(s).Quote("user") + ` AS u
+	LEFT JOIN user_auth ON user_auth.user_id = u.id
+	WHERE u.` + notServiceAccount(s) + `
+	ORDER BY u.id`
+	var users ConflictingUsers
+	if err := s.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		return sess.SQL(rawSQL).Find(&users)
+	}); err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string]ConflictingUsers)
+	for _, u := range users {
+		normalized := normalizePlusAddressedEmail(u.Email)
+		groups[normalized] = append(groups[normalized], u)
+	}
+	conflicts := make(ConflictingUsers, 0)
+	for _, u := range users {
+		group := groups[normalizePlusAddressedEmail(u.Email)]
+		// emails only differing by case are already conflicts of the conflict query
+		if !hasDistinctIdentifications(group) {
+			continue
+		}
+		u.ConflictEmail = "true"
+		conflicts = append(conflicts, u)
+	}
+	return conflicts, nil
+}
+
+func hasDistinctIdentifications(users ConflictingUsers) bool {
+	for _, u := range users {
+		if normalizeIdentification(u.Email) != normalizeIdentification(users[0].Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizePlusAddressedEmail returns an email as normalizeIdentification does, without the +tag of its local part
+func normalizePlusAddressedEmail(email string) string {
+	email = normalizeIdentification(email)
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local := email[:at]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local + email[at:]
+}
+
+// normalizedSQL returns the expression the conflict queries compare a login or email column with,
+// so that values differing only by case or by surrounding spaces are conflicts
+func normalizedSQL(column string) string {
+	return "LOWER(TRIM(" + column + "))"
+}
+
+// normalizeIdentification returns a login or email as normalizedSQL does, conflict blocks are named after it
+func normalizeIdentification(identification string) string {
+	return strings.ToLower(strings.Trim(identification, " "))
+}
+
 func notServiceAccount(ss *sqlstore.SQLStore) string {
 	return fmt.Sprintf("is_service_account = %s",
 		ss.Dialect.BooleanStr(false))
 }
 
+// verifyCaseInsensitiveUniqueness checks that no login or email is used by several users apart from case and
+// surrounding spaces, as the conflict query compares them, and reports whether the database prevents new conflicts.
+// Only MySQL can, when the login and email columns have case insensitive collations, the schema is never changed.
+func verifyCaseInsensitiveUniqueness(ctx context.Context, s *sqlstore.SQLStore) error {
+	userDialect := db.DB.GetDialect(s).Quote("user")
+	return s.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		for _, column := range []string{"login", "email"} {
+			var duplicates []string
+			err := sess.SQL("SELECT " + normalizedSQL(column) + " FROM " + userDialect + " WHERE " + notServiceAccount(s) +
+				" GROUP BY " + normalizedSQL(column) + " HAVING COUNT(*) > 1").Find(&duplicates)
+			if err != nil {
+				return err
+			}
+			if len(duplicates) > 0 {
+				return fmt.Errorf("%d %s(s) are still used by more than one user, resolve the remaining conflicts first", len(duplicates), column)
+			}
+		}
+
+		if s.GetDialect().DriverName() != migrator.MySQL {
+			logger.Info("no login or email is shared, but the database compares them with their case: new conflicts can still be created.\n")
+			return nil
+		}
+		var collations []string
+		err := sess.SQL("SELECT COLLATION_NAME FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'user' AND COLUMN_NAME IN ('login', 'email')").Find(&collations)
+		if err != nil {
+			return fmt.Errorf("could not read the collations of login and email: %w", err)
+		}
+		if caseInsensitiveCollations(collations) {
+			logger.Infof("no login or email is shared, and their unique indexes are case insensitive with the %s collations.\n", strings.Join(collations, " and "))
+		} else {
+			logger.Infof("no login or email is shared, but the %s collations compare them with their case: new conflicts can still be created.\n", strings.Join(collations, " and "))
+		}
+		return nil
+	})
+}
+
+// caseInsensitiveCollations reports whether the collations of both login and email ignore the case, as
+// the MySQL collations ending with _ci do. Binary and case sensitive collations, like utf8mb4_bin, don't.
+func caseInsensitiveCollations(collations []string) bool {
+	if len(collations) != 2 {
+		return false
+	}
+	for _, collation := range collations {
+		if !strings.HasSuffix(strings.ToLower(collation), "_ci") {
+			return false
+		}
+	}
+	return true
+}
+
 // confirm function asks for user input
-// returns bool
-func confirm(confirmPrompt string) bool {
+// returns bool, always true without asking when assumeYes is set.
+// A closed stdin is an error rather than a refusal, so that scripts can be told to use --yes.
+func confirm(confirmPrompt string, assumeYes bool) (bool, error) {
 	var input string
 	logger.Infof("%s? [y|n]: ", confirmPrompt)
+	if assumeYes {
+		logger.Infof("y (batch mode)\n")
+		return true, nil
+	}
 
 	_, err := fmt.Scanln(&input)
+	if errors.Is(err, io.EOF) || errors.Is(err, os.ErrClosed) {
+		return false, errors.New("could not read the confirmation as stdin is closed, use --yes to proceed without it")
+	}
 	if err != nil {
-		logger.Infof("could not parse input from user for confirmation")
-		return false
+		logger.Infof("could not parse input from user for confirmation\n")
+		return false, nil
 	}
 	input = strings.ToLower(input)
 	if input == "y" || input == "yes" {
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
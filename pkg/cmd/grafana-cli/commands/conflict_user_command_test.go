@@ -1,18 +1,27 @@
 package commands
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"sort"
+	"strconv"
+	"time"
 
 	"testing"
 
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/org/orgimpl"
 	"github.com/grafana/grafana/pkg/services/team/teamimpl"
 	"github.com/grafana/grafana/pkg/setting"
 
 	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/migrator"
+	"github.com/grafana/grafana/pkg/services/star"
 	"github.com/grafana/grafana/pkg/services/user"
 	"github.com/stretchr/testify/require"
 	"github.com/urfave/cli/v2"
@@ -627,7 +636,7 @@ func TestMergeUser(t *testing.T) {
 			require.Equal(t, 2, len(r.ValidUsers))
 
 			// test starts here
-			err = r.MergeConflictingUsers(context.Background())
+			_, err = r.MergeConflictingUsers(context.Background())
 			require.NoError(t, err)
 
 			// user with uppercaseemail should not exist
@@ -725,7 +734,7 @@ conflict: test2
 				require.NoError(t, validErr)
 
 				// test starts here
-				err = r.MergeConflictingUsers(context.Background())
+				_, err = r.MergeConflictingUsers(context.Background())
 				require.NoError(t, err)
 			}
 		}
@@ -782,3 +791,1589 @@ func TestMarshalConflictUser(t *testing.T) {
 		})
 	}
 }
+
+func TestCompareDryRuns(t *testing.T) {
+	dryRun := func(operations string) []byte {
+		return []byte(`Found 2 conflict groups (2 merge, 0 same-identification) affecting 4 users
+
+
+Changes that will take place
+
+Keep the following user.
+conflict: test
+id: 1, email: test, login: test
+
+
+The following user(s) will be deleted.
+id: 2, email: TEST, login: TEST
+
+
+
+` + dryRunOperationsHeader + `
+
+` + operations + `
+
+dry run, no changes were made.
+`)
+	}
+	runA := dryRun(`conflict: test
+type: Merge
+merge user 2 into 1
+  move star: 1 row(s)
+  delete star: 0 row(s)
+  delete user: 1 row(s)
+
+conflict: test2
+type: Merge
+merge user 4 into 3
+  delete user: 1 row(s)`)
+
+	t.Run("should not report differences for the same operations", func(t *testing.T) {
+		diff, err := compareDryRuns(runA, dryRun(`conflict: test2
+type: Merge
+merge user 4 into 3
+  delete user: 1 row(s)
+
+conflict: test
+type: Merge
+merge user 2 into 1
+  move star: 1 row(s)
+  delete star: 0 row(s)
+  delete user: 1 row(s)`))
+		require.NoError(t, err)
+		require.Empty(t, diff)
+	})
+
+	t.Run("should report changed and missing blocks", func(t *testing.T) {
+		diff, err := compareDryRuns(runA, dryRun(`conflict: test
+type: Merge
+merge user 1 into 2
+  move star: 1 row(s)
+  delete star: 0 row(s)
+  delete user: 1 row(s)
+
+conflict: test3
+type: Merge
+merge user 6 into 5
+  delete user: 1 row(s)`))
+		require.NoError(t, err)
+		require.Equal(t, []string{
+			"~ conflict: test\n    type: Merge\n  - merge user 2 into 1\n  + merge user 1 into 2\n      move star: 1 row(s)\n      delete star: 0 row(s)\n      delete user: 1 row(s)",
+			"- conflict: test2",
+			"+ conflict: test3",
+		}, diff)
+	})
+
+	t.Run("should reject a file that is not a dry run", func(t *testing.T) {
+		_, err := compareDryRuns(runA, []byte("conflict: test\n+ id: 1, email: test, login: test\n"))
+		require.ErrorContains(t, err, "not an output of ingest-file --dry-run")
+	})
+}
+
+func TestIgnoreEmailDomains(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "svc@localhost", Login: "svc", ConflictEmail: "true"},
+		{ID: "2", Email: "SVC@LOCALHOST", Login: "SVC", ConflictEmail: "true"},
+		{ID: "3", Email: "user@example.com", Login: "user", ConflictEmail: "true"},
+		{ID: "4", Email: "USER@EXAMPLE.COM", Login: "USER", ConflictEmail: "true"},
+		{ID: "5", Email: "mixed@localhost", Login: "mixed", ConflictLogin: "true"},
+		{ID: "6", Email: "mixed@example.com", Login: "MIXED", ConflictLogin: "true"},
+	}
+
+	t.Run("should exclude conflicts where all emails are in an ignored domain", func(t *testing.T) {
+		r := ConflictResolver{Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		require.Len(t, r.Blocks, 3)
+
+		r.IgnoreEmailDomains([]string{"@LocalHost"})
+		require.Len(t, r.Blocks, 2)
+		require.NotContains(t, r.Blocks, "conflict: svc@localhost")
+		require.Contains(t, r.Blocks, "conflict: user@example.com")
+		require.Contains(t, r.Blocks, "conflict: mixed")
+		require.Len(t, r.Users, 4)
+		require.NotContains(t, r.ToStringPresentation(), "svc@localhost")
+	})
+
+	t.Run("should keep all conflicts without ignored domains", func(t *testing.T) {
+		r := ConflictResolver{Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		r.IgnoreEmailDomains(nil)
+		require.Len(t, r.Blocks, 3)
+		require.Len(t, r.Users, 6)
+	})
+}
+
+func TestConflictMergeSummary(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		summary  ConflictMergeSummary
+		wantCode int
+	}{
+		{desc: "all resolved", summary: ConflictMergeSummary{Resolved: 2}, wantCode: ConflictsExitResolved},
+		{desc: "some failed", summary: ConflictMergeSummary{Resolved: 1, Failed: 1}, wantCode: ConflictsExitPartial},
+		{desc: "some skipped", summary: ConflictMergeSummary{Resolved: 1, Skipped: 1}, wantCode: ConflictsExitPartial},
+		{desc: "none resolved", summary: ConflictMergeSummary{Failed: 2}, wantCode: ConflictsExitFailed},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.wantCode, tc.summary.ExitCode())
+		})
+	}
+	require.Equal(t, "conflicts_summary resolved=1 skipped=2 failed=3", ConflictMergeSummary{Resolved: 1, Skipped: 2, Failed: 3}.String())
+}
+
+func TestMergeConflictingUsersPause(t *testing.T) {
+	t.Run("should stop waiting when the context is cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		r := ConflictResolver{
+			Pause: time.Hour,
+			Blocks: map[string]ConflictingUsers{
+				"conflict: a": {{ID: "1"}},
+				"conflict: b": {{ID: "2"}},
+				"conflict: c": {{ID: "3"}},
+			},
+		}
+		summary, err := r.MergeConflictingUsers(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, ConflictMergeSummary{Skipped: 3}, summary)
+	})
+}
+
+func TestOnlyIdentities(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+		{ID: "2", Email: "ALICE@EXAMPLE.COM", Login: "ALICE", ConflictEmail: "true"},
+		{ID: "3", Email: "bob@example.com", Login: "bob", ConflictEmail: "true"},
+		{ID: "4", Email: "BOB@EXAMPLE.COM", Login: "BOB", ConflictEmail: "true"},
+	}
+	r := ConflictResolver{Users: users}
+	r.BuildConflictBlocks(users, fmt.Sprintf)
+	require.Len(t, r.Blocks, 2)
+
+	identities := parseIdentities([]byte("# from the support ticket\n\n  Alice  \n"))
+	require.Equal(t, []string{"Alice"}, identities)
+
+	r.OnlyIdentities(identities)
+	require.Len(t, r.Blocks, 1)
+	require.Contains(t, r.Blocks, "conflict: alice@example.com")
+	require.Len(t, r.Users, 2)
+}
+
+func TestMergeHooks(t *testing.T) {
+	setup := func(t *testing.T) (*sqlstore.SQLStore, ConflictResolver, *user.User) {
+		t.Helper()
+		sqlStore := sqlstore.InitTestDB(t)
+		_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "hook@test.com", Login: "hook", OrgID: 1})
+		require.NoError(t, err)
+		dup, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "HOOK@TEST.COM", Login: "HOOK_DUP", OrgID: 1})
+		require.NoError(t, err)
+
+		conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: context.Background()}, sqlStore)
+		require.NoError(t, err)
+		r := ConflictResolver{Store: sqlStore}
+		r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+		tmpFile, err := generateConflictUsersFile(&r)
+		require.NoError(t, err)
+		b, err := os.ReadFile(tmpFile.Name())
+		require.NoError(t, err)
+		require.NoError(t, getValidConflictUsers(&r, b))
+		return sqlStore, r, dup
+	}
+
+	t.Run("should call the hooks around each merge", func(t *testing.T) {
+		sqlStore, r, _ := setup(t)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		var calls []string
+		r.PreMergeHooks = []PreMergeHook{func(ctx context.Context, block string, users ConflictingUsers) error {
+			calls = append(calls, "pre "+block)
+			return nil
+		}}
+		r.PostMergeHooks = []PostMergeHook{func(ctx context.Context, block string, users ConflictingUsers, mergeErr error) error {
+			calls = append(calls, fmt.Sprintf("post %s %v", block, mergeErr))
+			return errors.New("post-merge hook errors are only logged")
+		}}
+
+		summary, err := r.MergeConflictingUsers(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+		require.Equal(t, []string{"pre conflict: hook@test.com", "post conflict: hook@test.com <nil>"}, calls)
+	})
+
+	t.Run("should not merge when a pre-merge hook fails", func(t *testing.T) {
+		sqlStore, r, dup := setup(t)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		postCalled := false
+		r.PreMergeHooks = []PreMergeHook{func(ctx context.Context, block string, users ConflictingUsers) error {
+			return errors.New("snapshot failed")
+		}}
+		r.PostMergeHooks = []PostMergeHook{func(ctx context.Context, block string, users ConflictingUsers, mergeErr error) error {
+			postCalled = true
+			return nil
+		}}
+
+		summary, err := r.MergeConflictingUsers(context.Background())
+		require.ErrorContains(t, err, "snapshot failed")
+		require.Equal(t, ConflictMergeSummary{Failed: 1}, summary)
+		require.False(t, postCalled)
+
+		query := &models.GetUserByIdQuery{Id: dup.ID}
+		require.NoError(t, sqlStore.GetUserById(context.Background(), query))
+	})
+
+	t.Run("shell hooks receive the conflict details", func(t *testing.T) {
+		users := ConflictingUsers{{ID: "1", Direction: "+"}, {ID: "2", Direction: "-"}, {ID: "3", Direction: "-"}}
+		hook := ShellPreMergeHook(`test "$CONFLICT_BLOCK" = "conflict: a" && test "$CONFLICT_KEEP" = 1 && test "$CONFLICT_DELETE" = "2,3"`)
+		require.NoError(t, hook(context.Background(), "conflict: a", users))
+		require.Error(t, hook(context.Background(), "conflict: b", users))
+
+		post := ShellPostMergeHook(`test "$CONFLICT_RESULT" = success`)
+		require.NoError(t, post(context.Background(), "conflict: a", users, nil))
+		require.Error(t, post(context.Background(), "conflict: a", users, errors.New("merge failed")))
+	})
+}
+
+func TestVerifyCaseInsensitiveUniqueness(t *testing.T) {
+	t.Run("should fail cleanly when duplicates remain", func(t *testing.T) {
+		sqlStore := sqlstore.InitTestDB(t)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "dup@test.com", Login: "dup"})
+		require.NoError(t, err)
+		_, err = sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "DUP@TEST.COM", Login: "other"})
+		require.NoError(t, err)
+
+		err = verifyCaseInsensitiveUniqueness(context.Background(), sqlStore)
+		require.ErrorContains(t, err, "1 email(s) are still used by more than one user")
+	})
+
+	t.Run("should fail when logins only differ by surrounding spaces", func(t *testing.T) {
+		sqlStore := sqlstore.InitTestDB(t)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "spaced@test.com", Login: "spaced"})
+		require.NoError(t, err)
+		other, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "other@test.com", Login: "other"})
+		require.NoError(t, err)
+		err = sqlStore.WithDbSession(context.Background(), func(sess *sqlstore.DBSession) error {
+			_, err := sess.Exec("UPDATE "+sqlStore.GetDialect().Quote("user")+" SET login = ? WHERE id = ?", " Spaced ", other.ID)
+			return err
+		})
+		require.NoError(t, err)
+
+		err = verifyCaseInsensitiveUniqueness(context.Background(), sqlStore)
+		require.ErrorContains(t, err, "1 login(s) are still used by more than one user")
+	})
+
+	t.Run("should pass without duplicates and leave the schema as is", func(t *testing.T) {
+		sqlStore := sqlstore.InitTestDB(t)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "unique@test.com", Login: "unique"})
+		require.NoError(t, err)
+
+		require.NoError(t, verifyCaseInsensitiveUniqueness(context.Background(), sqlStore))
+
+		// no index was created, so the database still accepts new conflicts
+		_, err = sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "UNIQUE@TEST.COM", Login: "another"})
+		require.NoError(t, err)
+	})
+}
+
+func TestCaseInsensitiveCollations(t *testing.T) {
+	require.True(t, caseInsensitiveCollations([]string{"utf8mb4_general_ci", "utf8mb4_unicode_ci"}))
+	require.False(t, caseInsensitiveCollations([]string{"utf8mb4_bin", "utf8mb4_general_ci"}))
+	require.False(t, caseInsensitiveCollations([]string{"utf8mb4_0900_as_cs", "utf8mb4_0900_as_cs"}))
+	// the columns could not be found
+	require.False(t, caseInsensitiveCollations(nil))
+}
+
+func TestOnlyIdentifier(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+		{ID: "2", Email: "ALICE@EXAMPLE.COM", Login: "ALICE", ConflictEmail: "true"},
+		{ID: "3", Email: "bob@example.com", Login: "bob", ConflictEmail: "true"},
+		{ID: "4", Email: "BOB@EXAMPLE.COM", Login: "BOB", ConflictEmail: "true"},
+	}
+
+	t.Run("should keep only the matching conflict", func(t *testing.T) {
+		r := ConflictResolver{Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		require.NoError(t, r.OnlyIdentifier("Bob@Example.com"))
+		require.Len(t, r.Blocks, 1)
+		require.Contains(t, r.Blocks, "conflict: bob@example.com")
+	})
+
+	t.Run("should fail when the identifier is not a current conflict", func(t *testing.T) {
+		r := ConflictResolver{Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		err := r.OnlyIdentifier("carol")
+		require.EqualError(t, err, `"carol" does not correspond to a current conflict`)
+	})
+}
+
+func TestMergeTeamMemberships(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	teamSvc := teamimpl.ProvideService(sqlStore, setting.NewCfg())
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "team@test.com", Login: "team", OrgID: 1})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "TEAM@TEST.COM", Login: "TEAM_DUP", OrgID: 1})
+	require.NoError(t, err)
+
+	shared, err := teamSvc.CreateTeam("shared", "", 1)
+	require.NoError(t, err)
+	dupOnly, err := teamSvc.CreateTeam("dup only", "", 1)
+	require.NoError(t, err)
+	keptOnly, err := teamSvc.CreateTeam("kept only", "", 1)
+	require.NoError(t, err)
+	require.NoError(t, teamSvc.AddTeamMember(kept.ID, 1, shared.Id, false, 0))
+	require.NoError(t, teamSvc.AddTeamMember(dup.ID, 1, shared.Id, false, models.PERMISSION_ADMIN))
+	require.NoError(t, teamSvc.AddTeamMember(dup.ID, 1, dupOnly.Id, false, 0))
+	require.NoError(t, teamSvc.AddTeamMember(kept.ID, 1, keptOnly.Id, false, 0))
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{"conflict: team@test.com": fmt.Sprint(kept.ID)})
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+
+	var memberships []models.TeamMember
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		return sess.Where("user_id IN (?, ?)", kept.ID, dup.ID).Asc("team_id").Find(&memberships)
+	})
+	require.NoError(t, err)
+	require.Len(t, memberships, 3)
+	permissions := make(map[int64]models.PermissionType)
+	for _, m := range memberships {
+		require.Equal(t, kept.ID, m.UserId)
+		permissions[m.TeamId] = m.Permission
+	}
+	require.Equal(t, map[int64]models.PermissionType{
+		shared.Id:   models.PERMISSION_ADMIN,
+		dupOnly.Id:  0,
+		keptOnly.Id: 0,
+	}, permissions)
+}
+
+func TestMergeStarsAndPreferences(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "star@test.com", Login: "star", OrgID: 1})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "STAR@TEST.COM", Login: "STAR_DUP", OrgID: 1})
+	require.NoError(t, err)
+
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		for _, s := range []star.Star{
+			{UserID: kept.ID, DashboardID: 1},
+			{UserID: kept.ID, DashboardID: 2},
+			{UserID: dup.ID, DashboardID: 2},
+			{UserID: dup.ID, DashboardID: 3},
+		} {
+			s := s
+			if _, err := sess.Insert(&s); err != nil {
+				return err
+			}
+		}
+		for _, p := range []struct {
+			orgId, userId, homeDashboardId int64
+		}{
+			{1, kept.ID, 1},
+			{1, dup.ID, 2},
+			{2, dup.ID, 3},
+		} {
+			if _, err := sess.Exec("INSERT INTO preferences (org_id, user_id, team_id, version, home_dashboard_id, timezone, week_start, theme, created, updated) VALUES (?, ?, 0, 0, ?, '', '', '', ?, ?)",
+				p.orgId, p.userId, p.homeDashboardId, time.Now(), time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{"conflict: star@test.com": fmt.Sprint(kept.ID)})
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+
+	var stars []star.Star
+	var homeDashboards []struct {
+		OrgId           int64
+		UserId          int64
+		HomeDashboardId int64
+	}
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		if err := sess.Where("user_id IN (?, ?)", kept.ID, dup.ID).Asc("dashboard_id").Find(&stars); err != nil {
+			return err
+		}
+		return sess.Table("preferences").Cols("org_id", "user_id", "home_dashboard_id").
+			Where("user_id IN (?, ?)", kept.ID, dup.ID).Asc("org_id").Find(&homeDashboards)
+	})
+	require.NoError(t, err)
+
+	dashboardIds := make([]int64, 0, len(stars))
+	for _, s := range stars {
+		require.Equal(t, kept.ID, s.UserID)
+		dashboardIds = append(dashboardIds, s.DashboardID)
+	}
+	require.Equal(t, []int64{1, 2, 3}, dashboardIds)
+
+	require.Len(t, homeDashboards, 2)
+	// the preferences of the kept user win in the organization where both have some
+	require.Equal(t, int64(1), homeDashboards[0].HomeDashboardId)
+	require.Equal(t, int64(3), homeDashboards[1].HomeDashboardId)
+	for _, p := range homeDashboards {
+		require.Equal(t, kept.ID, p.UserId)
+	}
+}
+
+func TestPreviewMergeMatchesTheMerge(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	teamSvc := teamimpl.ProvideService(sqlStore, setting.NewCfg())
+	var users []*user.User
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "preview@test.com", Login: "preview", OrgID: 1},
+		{Email: "PREVIEW@TEST.COM", Login: "preview_dup", OrgID: 1},
+		{Email: "Preview@Test.com", Login: "preview_other", OrgID: 1},
+	} {
+		u, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+		users = append(users, u)
+	}
+	kept, dup, other := users[0], users[1], users[2]
+
+	// the rows of the second user to merge duplicate some of the kept user's and some of the first user's
+	for _, team := range []struct {
+		name    string
+		members []*user.User
+	}{
+		{"shared", []*user.User{kept, dup, other}},
+		{"dups", []*user.User{dup, other}},
+		{"other", []*user.User{other}},
+	} {
+		created, err := teamSvc.CreateTeam(team.name, "", 1)
+		require.NoError(t, err)
+		for _, member := range team.members {
+			require.NoError(t, teamSvc.AddTeamMember(member.ID, 1, created.Id, false, 0))
+		}
+	}
+	err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		for _, s := range []star.Star{
+			{UserID: kept.ID, DashboardID: 1},
+			{UserID: dup.ID, DashboardID: 1},
+			{UserID: dup.ID, DashboardID: 2},
+			{UserID: other.ID, DashboardID: 2},
+			{UserID: other.ID, DashboardID: 3},
+		} {
+			s := s
+			if _, err := sess.Insert(&s); err != nil {
+				return err
+			}
+		}
+		for _, p := range []struct{ orgId, userId int64 }{{1, kept.ID}, {1, dup.ID}, {2, dup.ID}, {2, other.ID}} {
+			if _, err := sess.Exec("INSERT INTO preferences (org_id, user_id, team_id, version, home_dashboard_id, timezone, week_start, theme, created, updated) VALUES (?, ?, 0, 0, 0, '', '', '', ?, ?)",
+				p.orgId, p.userId, time.Now(), time.Now()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{"conflict: preview@test.com": fmt.Sprint(kept.ID)})
+	intoUserId, fromUserIds, _, err := blockUserIds(r.Blocks["conflict: preview@test.com"])
+	require.NoError(t, err)
+	require.Equal(t, kept.ID, intoUserId)
+	ops, err := r.previewMerge(ctx, intoUserId, fromUserIds)
+	require.NoError(t, err)
+
+	rows := func(table string, userIds ...int64) int64 {
+		t.Helper()
+		var count int64
+		err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			var err error
+			count, err = sess.Table(table).In("user_id", userIds).Count()
+			return err
+		})
+		require.NoError(t, err)
+		return count
+	}
+	previewed := map[string]map[string]int64{}
+	for _, userOps := range ops {
+		for _, op := range userOps {
+			if previewed[op.Table] == nil {
+				previewed[op.Table] = map[string]int64{}
+			}
+			previewed[op.Table][op.Action] += op.Rows
+		}
+	}
+	require.Equal(t, map[string]int64{"move": 2, "delete": 3}, previewed["team_member"])
+	require.Equal(t, map[string]int64{"move": 2, "delete": 2}, previewed["star"])
+	require.Equal(t, map[string]int64{"move": 1, "delete": 2}, previewed["preferences"])
+
+	keptBefore := map[string]int64{}
+	for _, table := range []string{"team_member", "star", "preferences"} {
+		keptBefore[table] = rows(table, kept.ID)
+	}
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+
+	for _, table := range []string{"team_member", "star", "preferences"} {
+		require.Equal(t, keptBefore[table]+previewed[table]["move"], rows(table, kept.ID), table)
+		require.Zero(t, rows(table, dup.ID, other.ID), table)
+	}
+}
+
+func TestMergeAlertNotifications(t *testing.T) {
+	setup := func(t *testing.T, mergeNotifications bool) *sqlstore.SQLStore {
+		t.Helper()
+		sqlStore := sqlstore.InitTestDB(t)
+		_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "oncall@test.com", Login: "oncall", OrgID: 1})
+		require.NoError(t, err)
+		_, err = sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "oncall-old@test.com", Login: "ONCALL", OrgID: 1})
+		require.NoError(t, err)
+
+		err = sqlStore.WithDbSession(context.Background(), func(sess *sqlstore.DBSession) error {
+			for _, n := range []struct{ name, typ, addresses string }{
+				{name: "team", typ: "email", addresses: "someone@test.com;ONCALL-OLD@test.com"},
+				{name: "other", typ: "email", addresses: "someone@test.com"},
+				{name: "hook", typ: "webhook", addresses: "oncall-old@test.com"},
+			} {
+				settings := simplejson.NewFromAny(map[string]interface{}{"addresses": n.addresses})
+				if _, err := sess.Insert(&models.AlertNotification{OrgId: 1, Uid: n.name, Name: n.name, Type: n.typ, Settings: settings, Created: time.Now(), Updated: time.Now()}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		require.NoError(t, err)
+
+		conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: context.Background()}, sqlStore)
+		require.NoError(t, err)
+		r := ConflictResolver{Store: sqlStore, MergeAlertNotifications: mergeNotifications}
+		r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+		tmpFile, err := generateConflictUsersFile(&r)
+		require.NoError(t, err)
+		b, err := os.ReadFile(tmpFile.Name())
+		require.NoError(t, err)
+		require.NoError(t, getValidConflictUsers(&r, b))
+
+		if sqlStore.GetDialect().DriverName() != ignoredDatabase {
+			summary, err := r.MergeConflictingUsers(context.Background())
+			require.NoError(t, err)
+			require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+		}
+		return sqlStore
+	}
+
+	addresses := func(t *testing.T, sqlStore *sqlstore.SQLStore, name string) string {
+		t.Helper()
+		var notification models.AlertNotification
+		err := sqlStore.WithDbSession(context.Background(), func(sess *sqlstore.DBSession) error {
+			has, err := sess.Where("name = ?", name).Get(&notification)
+			require.True(t, has)
+			return err
+		})
+		require.NoError(t, err)
+		return notification.Settings.Get("addresses").MustString()
+	}
+
+	t.Run("should replace the address of the deleted account in email notifications", func(t *testing.T) {
+		sqlStore := setup(t, true)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		require.Equal(t, "someone@test.com;oncall@test.com", addresses(t, sqlStore, "team"))
+		require.Equal(t, "someone@test.com", addresses(t, sqlStore, "other"))
+		require.Equal(t, "oncall-old@test.com", addresses(t, sqlStore, "hook"))
+	})
+
+	t.Run("should leave the notifications alone without the flag", func(t *testing.T) {
+		sqlStore := setup(t, false)
+		if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+			return
+		}
+		require.Equal(t, "someone@test.com;ONCALL-OLD@test.com", addresses(t, sqlStore, "team"))
+	})
+}
+
+func TestBuildConflictBlocksTrace(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "ldap-editor", Login: "ldap-editor", ConflictEmail: "", ConflictLogin: "true"},
+		{ID: "2", Email: "LDAP-EDITOR", Login: "LDAP-EDITOR", ConflictEmail: "", ConflictLogin: "true"},
+		{ID: "3", Email: "user@test.com", Login: "user", ConflictEmail: "true", ConflictLogin: ""},
+		{ID: "4", Email: "USER@TEST.COM", Login: "user2", ConflictEmail: "true", ConflictLogin: ""},
+		{ID: "4", Email: "USER@TEST.COM", Login: "user2", ConflictEmail: "", ConflictLogin: "true"},
+		{ID: "5", Email: "other@test.com", Login: "USER2", ConflictEmail: "", ConflictLogin: "true"},
+	}
+
+	t.Run("should explain how each conflict was classified", func(t *testing.T) {
+		var trace bytes.Buffer
+		r := ConflictResolver{Trace: &trace}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+
+		out := trace.String()
+		require.Contains(t, out, `[trace] row id=1 email=ldap-editor login=ldap-editor auth_module= conflict_email="" conflict_login="true": identifier "conflict: ldap-editor", login only differs by case from another user's`)
+		require.Contains(t, out, `[trace] row id=3 email=user@test.com login=user auth_module= conflict_email="true" conflict_login="": identifier "conflict: user@test.com", email only differs by case from another user's`)
+		require.Contains(t, out, `[trace] "conflict: user2" is discarded: user 4 is also part of "conflict: user@test.com"`)
+		require.Contains(t, out, `[trace] "conflict: ldap-editor" classified as a conflict between 2 users`)
+		require.Contains(t, out, `[trace] "conflict: user2" classified as discarded, it has to be resolved manually`)
+	})
+
+	t.Run("should explain why conflicts were filtered out", func(t *testing.T) {
+		var trace bytes.Buffer
+		r := ConflictResolver{Trace: &trace, Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		r.IgnoreEmailDomains([]string{"test.com"})
+		r.OnlyIdentities([]string{"nobody"})
+
+		out := trace.String()
+		require.Contains(t, out, `[trace] "conflict: user@test.com" is ignored: the emails of all its users belong to test.com`)
+		require.Contains(t, out, `[trace] "conflict: ldap-editor" is left out: none of its users is one of the requested identities`)
+	})
+
+	t.Run("should not write anything without a trace writer", func(t *testing.T) {
+		r := ConflictResolver{}
+		require.NotPanics(t, func() { r.BuildConflictBlocks(users, fmt.Sprintf) })
+	})
+}
+
+// seedConflictingUsers inserts n users, every 10th one with a duplicate email and
+// every 15th one with a duplicate login differing only by case
+func seedConflictingUsers(tb testing.TB, sqlStore *sqlstore.SQLStore, n int) {
+	tb.Helper()
+	err := sqlStore.WithDbSession(context.Background(), func(sess *sqlstore.DBSession) error {
+		users := make([]*user.User, 0, n)
+		for i := 0; i < n; i++ {
+			u := &user.User{
+				Email:   fmt.Sprintf("user%d@test.com", i),
+				Login:   fmt.Sprintf("user%d", i),
+				OrgID:   1,
+				Created: time.Now(),
+				Updated: time.Now(),
+			}
+			switch {
+			case i%10 == 1:
+				u.Email = fmt.Sprintf("USER%d@test.com", i-1)
+			case i%15 == 2:
+				u.Login = fmt.Sprintf("USER%d", i-2)
+			}
+			users = append(users, u)
+		}
+		for start := 0; start < len(users); start += 100 {
+			end := start + 100
+			if end > len(users) {
+				end = len(users)
+			}
+			if _, err := sess.Insert(users[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		tb.Fatalf("failed to seed users: %s", err)
+	}
+}
+
+func queryConflictingUsers(tb testing.TB, sqlStore *sqlstore.SQLStore, rawSQL string) ConflictingUsers {
+	tb.Helper()
+	users := make(ConflictingUsers, 0)
+	err := sqlStore.WithDbSession(context.Background(), func(sess *sqlstore.DBSession) error {
+		return sess.SQL(rawSQL).Find(&users)
+	})
+	if err != nil {
+		tb.Fatalf("failed to query conflicting users: %s", err)
+	}
+	return users
+}
+
+// conflictingUserEntriesGroupedSQLText returns the grouped conflict query for all organizations, which has no args
+func conflictingUserEntriesGroupedSQLText(s *sqlstore.SQLStore, dialect conflictQueryDialect) string {
+	rawSQL, _ := conflictingUserEntriesGroupedSQL(s, dialect, conflictQueryFilter{})
+	return rawSQL
+}
+
+func TestConflictingUserEntriesGroupedSQL(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	seedConflictingUsers(t, sqlStore, 300)
+	// a user conflicting both on email and login
+	_, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "USER0@TEST.COM", Login: "User0"})
+	require.NoError(t, err)
+
+	dialect := detectConflictQueryDialect(context.Background(), sqlStore)
+	selfJoin := queryConflictingUsers(t, sqlStore, conflictingUserEntriesSQL(sqlStore, dialect))
+	grouped := queryConflictingUsers(t, sqlStore, conflictingUserEntriesGroupedSQLText(sqlStore, dialect))
+	require.NotEmpty(t, grouped)
+	require.ElementsMatch(t, selfJoin, grouped)
+}
+
+func TestCountUsersWithConflictingEmailsOrLogins(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	count, err := CountUsersWithConflictingEmailsOrLogins(ctx, sqlStore)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	seedConflictingUsers(t, sqlStore, 30)
+	// a user conflicting both on email and login
+	_, err = sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "USER0@TEST.COM", Login: "User0"})
+	require.NoError(t, err)
+
+	users, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	require.NotEmpty(t, users)
+	count, err = CountUsersWithConflictingEmailsOrLogins(ctx, sqlStore)
+	require.NoError(t, err)
+	require.Equal(t, len(users), count)
+}
+
+func TestConflictingUserEntriesSQL(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "conflict@test.com", Login: "conflict"},
+		{Email: "CONFLICT@TEST.COM", Login: "conflict_other"},
+		{Email: "other@test.com", Login: "CONFLICT"},
+		{Email: "unique@test.com", Login: "unique"},
+	} {
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+
+	users := queryConflictingUsers(t, sqlStore, conflictingUserEntriesSQL(sqlStore, detectConflictQueryDialect(ctx, sqlStore)))
+	conflicts := make([]string, 0, len(users))
+	for _, u := range users {
+		conflicts = append(conflicts, fmt.Sprintf("%s email=%s login=%s", u.Login, u.ConflictEmail, u.ConflictLogin))
+	}
+	require.ElementsMatch(t, []string{
+		"conflict email=true login=",
+		"conflict email= login=true",
+		"conflict_other email=true login=",
+		"CONFLICT email= login=true",
+	}, conflicts)
+}
+
+func BenchmarkConflictingUserEntriesSQL(b *testing.B) {
+	sqlStore := sqlstore.InitTestDB(b)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		b.Skip()
+	}
+	seedConflictingUsers(b, sqlStore, 1000)
+
+	dialect := detectConflictQueryDialect(context.Background(), sqlStore)
+	for name, rawSQL := range map[string]string{
+		"self join": conflictingUserEntriesSQL(sqlStore, dialect),
+		"grouped":   conflictingUserEntriesGroupedSQLText(sqlStore, dialect),
+	} {
+		rawSQL := rawSQL
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				queryConflictingUsers(b, sqlStore, rawSQL)
+			}
+		})
+	}
+}
+
+func TestConflictQueryDialectFor(t *testing.T) {
+	testCases := []struct {
+		driverName   string
+		version      string
+		expectedName string
+		expectedCase string
+	}{
+		{driverName: migrator.SQLite, expectedName: "sqlite3", expectedCase: "email"},
+		{driverName: migrator.Postgres, expectedName: "postgres", expectedCase: "email"},
+		{driverName: migrator.MySQL, version: "8.0.30", expectedName: "mysql", expectedCase: "CAST(email AS BINARY)"},
+		{driverName: migrator.MySQL, version: "5.7.39-log", expectedName: "mysql", expectedCase: "CAST(email AS BINARY)"},
+		{driverName: migrator.MySQL, version: "10.6.5-MariaDB-1:10.6.5+maria~focal", expectedName: "mariadb", expectedCase: "CAST(email AS BINARY)"},
+		{driverName: migrator.MySQL, expectedName: "mysql", expectedCase: "CAST(email AS BINARY)"},
+		{driverName: "mssql", expectedName: "mssql", expectedCase: "email"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.driverName+" "+tc.version, func(t *testing.T) {
+			dialect := conflictQueryDialectFor(tc.driverName, tc.version)
+			require.Equal(t, tc.expectedName, dialect.name)
+			require.Equal(t, tc.expectedCase, dialect.caseSensitive("email"))
+		})
+	}
+
+	t.Run("the dialect of the test database is detected", func(t *testing.T) {
+		sqlStore := sqlstore.InitTestDB(t)
+		dialect := detectConflictQueryDialect(context.Background(), sqlStore)
+		expected := conflictQueryDialectFor(sqlStore.GetDialect().DriverName(), "")
+		if sqlStore.GetDialect().DriverName() != migrator.MySQL {
+			require.Equal(t, expected.name, dialect.name)
+		}
+		require.Contains(t, conflictingUserEntriesGroupedSQLText(sqlStore, dialect), dialect.caseSensitive("u1.email"))
+	})
+}
+
+func TestBlockUserIds(t *testing.T) {
+	t.Run("should parse the ids of the users to keep and delete", func(t *testing.T) {
+		into, from, malformed, err := blockUserIds(ConflictingUsers{{Direction: "+", ID: "1"}, {Direction: "-", ID: "2"}, {Direction: "-", ID: "3"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), into)
+		require.Equal(t, []int64{2, 3}, from)
+		require.Empty(t, malformed)
+	})
+
+	t.Run("should report malformed ids of users to delete and keep the valid ones", func(t *testing.T) {
+		into, from, malformed, err := blockUserIds(ConflictingUsers{{Direction: "+", ID: "1"}, {Direction: "-", ID: "bogus"}, {Direction: "-", ID: "3"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), into)
+		require.Equal(t, []int64{3}, from)
+		require.Equal(t, []string{`"bogus"`}, malformed)
+	})
+
+	t.Run("should fail on a malformed id of the user to keep", func(t *testing.T) {
+		_, _, _, err := blockUserIds(ConflictingUsers{{Direction: "+", ID: "1x"}, {Direction: "-", ID: "2"}})
+		require.EqualError(t, err, `the id "1x" of the user to keep is not a number`)
+		require.ErrorIs(t, err, ErrInvalidConflictID)
+		require.NotErrorIs(t, err, ErrMergeFailed)
+	})
+
+	t.Run("should never delete the user to keep", func(t *testing.T) {
+		into, from, _, err := blockUserIds(ConflictingUsers{{Direction: "-", ID: "1"}, {Direction: "+", ID: "1"}, {Direction: "-", ID: "2"}})
+		require.NoError(t, err)
+		require.Equal(t, int64(1), into)
+		require.Equal(t, []int64{2}, from)
+	})
+
+	t.Run("should fail without a user to keep", func(t *testing.T) {
+		_, _, _, err := blockUserIds(ConflictingUsers{{Direction: "-", ID: "2"}})
+		require.EqualError(t, err, "there is no user to keep")
+	})
+}
+
+func TestMergeConflictingUsersWithMalformedIds(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	kept, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "kept@test.com", Login: "kept"})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(context.Background(), user.CreateUserCommand{Email: "KEPT@TEST.COM", Login: "kept_dup"})
+	require.NoError(t, err)
+
+	r := ConflictResolver{Store: sqlStore, Blocks: map[string]ConflictingUsers{
+		"conflict: kept@test.com": {
+			{Direction: "+", ID: fmt.Sprint(kept.ID), Email: kept.Email, Login: kept.Login},
+			{Direction: "-", ID: "not-a-number", Email: "Kept@Test.com", Login: "bogus"},
+			{Direction: "-", ID: fmt.Sprint(dup.ID), Email: dup.Email, Login: dup.Login},
+		},
+		"conflict: bogus@test.com": {
+			{Direction: "+", ID: "bogus", Email: "bogus@test.com", Login: "bogus"},
+			{Direction: "-", ID: "1", Email: "BOGUS@TEST.COM", Login: "BOGUS"},
+		},
+	}}
+
+	summary, err := r.MergeConflictingUsers(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1, Skipped: 1}, summary)
+
+	// the valid user to delete was merged despite the bogus id in its block
+	err = sqlStore.GetUserById(context.Background(), &models.GetUserByIdQuery{Id: dup.ID})
+	require.ErrorIs(t, err, user.ErrUserNotFound)
+	err = sqlStore.GetUserById(context.Background(), &models.GetUserByIdQuery{Id: kept.ID})
+	require.NoError(t, err)
+}
+
+func TestParseConflictResolutions(t *testing.T) {
+	resolutions, err := parseConflictResolutions([]byte("# resolved by the support team\n\nconflict: Alice@Example.com 2\nbob 3\nbob 3\n"))
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"conflict: alice@example.com": "2",
+		"conflict: bob":               "3",
+	}, resolutions)
+
+	_, err = parseConflictResolutions([]byte("alice@example.com\n"))
+	require.Error(t, err)
+	_, err = parseConflictResolutions([]byte("alice@example.com two\n"))
+	require.ErrorIs(t, err, ErrInvalidConflictID)
+	_, err = parseConflictResolutions([]byte("alice@example.com 1\nalice@example.com 2\n"))
+	require.Error(t, err)
+	require.NotErrorIs(t, err, ErrInvalidConflictID)
+}
+
+func TestApplyConflictResolutions(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+		{ID: "2", Email: "ALICE@EXAMPLE.COM", Login: "ALICE", ConflictEmail: "true"},
+		{ID: "3", Email: "bob@example.com", Login: "bob", ConflictEmail: "true"},
+		{ID: "4", Email: "BOB@EXAMPLE.COM", Login: "BOB", ConflictEmail: "true"},
+		{ID: "5", Email: "carol@example.com", Login: "carol", ConflictEmail: "true"},
+		{ID: "6", Email: "CAROL@EXAMPLE.COM", Login: "CAROL", ConflictEmail: "true"},
+	}
+	r := ConflictResolver{Users: users}
+	r.BuildConflictBlocks(users, fmt.Sprintf)
+	require.Len(t, r.Blocks, 3)
+
+	r.ApplyConflictResolutions(map[string]string{
+		"conflict: alice@example.com": "2",
+		// not one of the users of the conflict
+		"conflict: bob@example.com": "5",
+		// not a current conflict
+		"conflict: dave@example.com": "7",
+	})
+	require.Len(t, r.ValidUsers, 2)
+	require.Len(t, r.Blocks, 1)
+	intoUserId, fromUserIds, _, err := blockUserIds(r.Blocks["conflict: alice@example.com"])
+	require.NoError(t, err)
+	require.Equal(t, int64(2), intoUserId)
+	require.Equal(t, []int64{1}, fromUserIds)
+}
+
+func TestMergeUserFromResolutions(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		t.Skip("conflicting users can't be created")
+	}
+	ctx := context.Background()
+	keep, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "batch@test.com", Login: "batch", OrgID: 1})
+	require.NoError(t, err)
+	remove, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "BATCH@TEST.COM", Login: "BATCH", OrgID: 1})
+	require.NoError(t, err)
+	other, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "unresolved@test.com", Login: "unresolved", OrgID: 1})
+	require.NoError(t, err)
+	otherDup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "UNRESOLVED@TEST.COM", Login: "UNRESOLVED", OrgID: 1})
+	require.NoError(t, err)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+
+	resolutions, err := parseConflictResolutions([]byte(fmt.Sprintf("batch@test.com %d\n", keep.ID)))
+	require.NoError(t, err)
+	r.ApplyConflictResolutions(resolutions)
+	confirmed, err := confirm("Proceed with operation?", true)
+	require.NoError(t, err)
+	require.True(t, confirmed)
+
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	// the conflict missing from the resolutions is left unresolved and reported as such
+	require.Equal(t, ConflictMergeSummary{Resolved: 1, Skipped: 1}, summary)
+	require.Equal(t, ConflictsExitPartial, summary.ExitCode())
+
+	for id, exists := range map[int64]bool{keep.ID: true, remove.ID: false, other.ID: true, otherDup.ID: true} {
+		err := sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: id})
+		if exists {
+			require.NoError(t, err)
+		} else {
+			require.ErrorIs(t, err, user.ErrUserNotFound)
+		}
+	}
+}
+
+func TestMergeWithoutResolutionsFails(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		t.Skip("conflicting users can't be created")
+	}
+	ctx := context.Background()
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "left@test.com", Login: "left", OrgID: 1},
+		{Email: "LEFT@TEST.COM", Login: "LEFT", OrgID: 1},
+	} {
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{})
+
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Skipped: 1}, summary)
+	require.Equal(t, ConflictsExitFailed, summary.ExitCode())
+
+	// the unresolved conflicts are only reported by the merge that follows their resolution
+	summary, err = r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{}, summary)
+}
+
+func TestBlockConflictType(t *testing.T) {
+	testCases := []struct {
+		desc          string
+		users         ConflictingUsers
+		expectedType  string
+		expectedSames []string
+	}{
+		{
+			desc: "email conflict",
+			users: ConflictingUsers{
+				{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+				{ID: "2", Email: "ALICE@example.com", Login: "alice.smith", ConflictEmail: "true"},
+			},
+			expectedType:  ConflictTypeMerge,
+			expectedSames: []string{},
+		},
+		{
+			desc: "login conflict",
+			users: ConflictingUsers{
+				{ID: "1", Email: "alice@example.com", Login: "alice", ConflictLogin: "true"},
+				{ID: "2", Email: "alice.smith@example.com", Login: "ALICE", ConflictLogin: "true"},
+			},
+			expectedType:  ConflictTypeMerge,
+			expectedSames: []string{},
+		},
+		{
+			desc: "identical login and email",
+			users: ConflictingUsers{
+				{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true", ConflictLogin: "true"},
+				{ID: "2", Email: "ALICE@example.com", Login: "Alice", ConflictEmail: "true", ConflictLogin: "true"},
+			},
+			expectedType:  ConflictTypeSameIdentification,
+			expectedSames: []string{"1", "2"},
+		},
+		{
+			desc: "identical login and email alongside an email conflict",
+			users: ConflictingUsers{
+				{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+				{ID: "2", Email: "ALICE@example.com", Login: "alice.smith", ConflictEmail: "true"},
+				{ID: "3", Email: "Alice@Example.com", Login: "ALICE", ConflictEmail: "true"},
+			},
+			expectedType:  ConflictTypeSameIdentification,
+			expectedSames: []string{"1", "3"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			require.Equal(t, tc.expectedType, blockConflictType(tc.users))
+			require.Equal(t, tc.expectedSames, sameIdentificationConflictIds(tc.users))
+			c := newJSONConflict("conflict: alice@example.com", tc.users)
+			require.Equal(t, tc.expectedType, c.Type)
+			require.Equal(t, tc.expectedSames, c.SameIdentificationConflictIDs)
+		})
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	withStdin := func(t *testing.T, input string) {
+		t.Helper()
+		r, w, err := os.Pipe()
+		require.NoError(t, err)
+		_, err = w.WriteString(input)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+		stdin := os.Stdin
+		os.Stdin = r
+		t.Cleanup(func() {
+			os.Stdin = stdin
+			_ = r.Close()
+		})
+	}
+
+	t.Run("proceeds without reading stdin when assuming yes", func(t *testing.T) {
+		withStdin(t, "")
+		confirmed, err := confirm("Proceed with operation?", true)
+		require.NoError(t, err)
+		require.True(t, confirmed)
+	})
+
+	t.Run("reads the answer from stdin", func(t *testing.T) {
+		withStdin(t, "yes\n")
+		confirmed, err := confirm("Proceed with operation?", false)
+		require.NoError(t, err)
+		require.True(t, confirmed)
+
+		withStdin(t, "n\n")
+		confirmed, err = confirm("Proceed with operation?", false)
+		require.NoError(t, err)
+		require.False(t, confirmed)
+	})
+
+	t.Run("fails when stdin is closed", func(t *testing.T) {
+		withStdin(t, "")
+		_, err := confirm("Proceed with operation?", false)
+		require.Error(t, err)
+	})
+
+	t.Run("fails without panicking when stdin can't be read", func(t *testing.T) {
+		withStdin(t, "")
+		require.NoError(t, os.Stdin.Close())
+		require.NotPanics(t, func() {
+			confirmed, err := confirm("Proceed with operation?", false)
+			require.Error(t, err)
+			require.False(t, confirmed)
+		})
+	})
+
+	t.Run("refuses an empty answer", func(t *testing.T) {
+		withStdin(t, "\n")
+		confirmed, err := confirm("Proceed with operation?", false)
+		require.NoError(t, err)
+		require.False(t, confirmed)
+	})
+}
+
+func TestGetUsersWithConflictingEmailsOrLoginsInOrg(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	member, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "member@test.com", Login: "member"})
+	require.NoError(t, err)
+	// in conflict with a member of the organization without being a member itself
+	outsider, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "MEMBER@TEST.COM", Login: "MEMBER_OTHER"})
+	require.NoError(t, err)
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "outside@test.com", Login: "outside"},
+		{Email: "OUTSIDE@TEST.COM", Login: "OUTSIDE"},
+	} {
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+	orgSvc := orgimpl.ProvideService(sqlStore, setting.NewCfg())
+	scoped, err := orgSvc.CreateWithMember(ctx, &org.CreateOrgCommand{Name: "scoped org"})
+	require.NoError(t, err)
+	require.NoError(t, orgSvc.AddOrgUser(ctx, &org.AddOrgUserCommand{OrgID: scoped.ID, UserID: member.ID, Role: org.RoleViewer}))
+
+	dialect := detectConflictQueryDialect(ctx, sqlStore)
+	all, err := getUsersWithConflictingEmailsOrLogins(ctx, sqlStore, dialect, conflictQueryFilter{})
+	require.NoError(t, err)
+	require.Len(t, all, 4)
+
+	inOrg, err := getUsersWithConflictingEmailsOrLogins(ctx, sqlStore, dialect, conflictQueryFilter{orgId: scoped.ID})
+	require.NoError(t, err)
+	ids := make([]string, 0, len(inOrg))
+	for _, u := range inOrg {
+		ids = append(ids, u.ID)
+	}
+	require.ElementsMatch(t, []string{fmt.Sprint(member.ID), fmt.Sprint(outsider.ID)}, ids)
+
+	none, err := getUsersWithConflictingEmailsOrLogins(ctx, sqlStore, dialect, conflictQueryFilter{orgId: scoped.ID + 1})
+	require.NoError(t, err)
+	require.Empty(t, none)
+}
+
+func TestConflictCounts(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+		{ID: "2", Email: "ALICE@EXAMPLE.COM", Login: "ALICE", ConflictEmail: "true"},
+		{ID: "3", Email: "bob@example.com", Login: "bob", ConflictEmail: "true"},
+		{ID: "4", Email: "BOB@EXAMPLE.COM", Login: "bob.smith", ConflictEmail: "true"},
+		{ID: "5", Email: "Bob@Example.com", Login: "robert", ConflictEmail: "true"},
+		{ID: "6", Email: "carol@example.com", Login: "carol", ConflictLogin: "true"},
+	}
+	r := ConflictResolver{Users: users}
+	r.BuildConflictBlocks(users, fmt.Sprintf)
+
+	counts := r.ConflictCounts()
+	require.Equal(t, ConflictCounts{Blocks: 2, Merge: 1, SameIdentification: 1, Users: 5}, counts)
+	require.Equal(t, "Found 2 conflict groups (1 merge, 1 same-identification) affecting 5 users", counts.String())
+}
+
+func TestConflictingUsersExcludeServiceAccounts(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "robot@test.com", Login: "robot"},
+		{Email: "sa-robot@test.com", Login: "ROBOT", IsServiceAccount: true},
+		{Email: "human@test.com", Login: "human"},
+		{Email: "HUMAN@TEST.COM", Login: "HUMAN"},
+	} {
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+
+	dialect := detectConflictQueryDialect(ctx, sqlStore)
+	for name, rawSQL := range map[string]string{
+		"self join": conflictingUserEntriesSQL(sqlStore, dialect),
+		"grouped":   conflictingUserEntriesGroupedSQLText(sqlStore, dialect),
+	} {
+		t.Run(name, func(t *testing.T) {
+			logins := make([]string, 0)
+			for _, u := range queryConflictingUsers(t, sqlStore, rawSQL) {
+				logins = append(logins, u.Login)
+			}
+			require.ElementsMatch(t, []string{"human", "HUMAN"}, logins)
+		})
+	}
+}
+
+func TestConflictingUsersWithSurroundingSpaces(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "alice@test.com", Login: "alice"},
+		{Email: "alice-spaced@test.com", Login: "alice "},
+		{Email: "bob@test.com", Login: "bob"},
+	} {
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+
+	dialect := detectConflictQueryDialect(ctx, sqlStore)
+	for name, rawSQL := range map[string]string{
+		"self join": conflictingUserEntriesSQL(sqlStore, dialect),
+		"grouped":   conflictingUserEntriesGroupedSQLText(sqlStore, dialect),
+	} {
+		t.Run(name, func(t *testing.T) {
+			users := queryConflictingUsers(t, sqlStore, rawSQL)
+			logins := make([]string, 0)
+			for _, u := range users {
+				logins = append(logins, u.Login)
+			}
+			require.ElementsMatch(t, []string{"alice", "alice "}, logins)
+
+			r := ConflictResolver{Users: users}
+			r.BuildConflictBlocks(users, fmt.Sprintf)
+			require.Len(t, r.Blocks, 1)
+			require.Len(t, r.Blocks["conflict: alice"], 2)
+		})
+	}
+}
+
+func TestMergeConflictBlockRollsBack(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() != migrator.SQLite {
+		t.Skip("the failure is injected with a SQLite trigger")
+	}
+	ctx := context.Background()
+	teamSvc := teamimpl.ProvideService(sqlStore, setting.NewCfg())
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "rollback@test.com", Login: "ROLLBACK", OrgID: 1})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "ROLLBACK@TEST.COM", Login: "rollback_dup", OrgID: 1})
+	require.NoError(t, err)
+	team, err := teamSvc.CreateTeam("rollback", "", 1)
+	require.NoError(t, err)
+	require.NoError(t, teamSvc.AddTeamMember(dup.ID, 1, team.Id, false, 0))
+
+	// lowercasing the login of the kept user, the last operation of the merge, fails
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		_, err := sess.Exec(`CREATE TRIGGER fail_merge BEFORE UPDATE ON "user" WHEN NEW.login = 'rollback' BEGIN SELECT RAISE(ABORT, 'injected failure'); END`)
+		return err
+	})
+	require.NoError(t, err)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{"conflict: rollback@test.com": fmt.Sprint(kept.ID)})
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.ErrorContains(t, err, "injected failure")
+	require.ErrorIs(t, err, ErrMergeFailed)
+	require.NotErrorIs(t, err, ErrInvalidConflictID)
+	require.Equal(t, ConflictMergeSummary{Failed: 1}, summary)
+
+	// nothing of the merge was written
+	require.NoError(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: dup.ID}))
+	var memberships []models.TeamMember
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		return sess.Where("team_id = ?", team.Id).Find(&memberships)
+	})
+	require.NoError(t, err)
+	require.Len(t, memberships, 1)
+	require.Equal(t, dup.ID, memberships[0].UserId)
+}
+
+func TestUserOwnership(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	ctx := context.Background()
+	err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		for i, d := range []struct {
+			createdBy, updatedBy int64
+			isFolder             bool
+		}{
+			{1, 1, false},
+			{2, 1, false},
+			{2, 2, false},
+			{1, 1, true},
+		} {
+			dash := models.NewDashboard(fmt.Sprintf("dashboard %d", i))
+			dash.OrgId = 1
+			dash.CreatedBy = d.createdBy
+			dash.UpdatedBy = d.updatedBy
+			dash.IsFolder = d.isFolder
+			dash.SetUid(fmt.Sprintf("uid%d", i))
+			if _, err := sess.Insert(dash); err != nil {
+				return err
+			}
+		}
+		for i, e := range []struct {
+			kind, createdBy, updatedBy int64
+		}{
+			{1, 1, 2},
+			{1, 2, 2},
+			{2, 1, 1},
+		} {
+			if _, err := sess.Exec("INSERT INTO library_element (org_id, folder_id, uid, name, kind, type, description, model, created, created_by, updated, updated_by, version) VALUES (1, 0, ?, ?, ?, 'text', '', '{}', ?, ?, ?, ?, 1)",
+				fmt.Sprintf("uid%d", i), fmt.Sprintf("element %d", i), e.kind, time.Now(), e.createdBy, time.Now(), e.updatedBy); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	r := ConflictResolver{Store: sqlStore}
+	ownership, err := r.userOwnership(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, UserOwnership{Dashboards: 2, LibraryPanels: 1}, ownership)
+	ownership, err = r.userOwnership(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, UserOwnership{Dashboards: 2, LibraryPanels: 2}, ownership)
+	require.Equal(t, ", dashboards: 2, library panels: 2", r.describeOwnership(ctx, "2"))
+	require.Equal(t, ", dashboards: 0, library panels: 0", r.describeOwnership(ctx, "3"))
+}
+
+func TestMaxGroupSize(t *testing.T) {
+	users := make(ConflictingUsers, 0, 50)
+	for i := 1; i <= 50; i++ {
+		direction := "-"
+		if i == 1 {
+			direction = "+"
+		}
+		users = append(users, ConflictingUser{Direction: direction, ID: strconv.Itoa(i), Email: fmt.Sprintf("LDAP%d@example.com", i), Login: fmt.Sprintf("ldap%d", i), ConflictEmail: "true"})
+	}
+	newResolver := func(maxGroupSize int) *ConflictResolver {
+		return &ConflictResolver{Blocks: map[string]ConflictingUsers{"conflict: ldap@example.com": users}, MaxGroupSize: maxGroupSize}
+	}
+	const flag = "# 50 users exceed the maximum group size of 10"
+
+	t.Run("an oversized group is flagged and not merged", func(t *testing.T) {
+		r := newResolver(10)
+		var mergeLog bytes.Buffer
+		r.MergeLog = &mergeLog
+		require.Contains(t, r.ToStringPresentation(), "conflict: ldap@example.com\n"+flag)
+
+		summary, err := r.MergeConflictingUsers(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, ConflictMergeSummary{Skipped: 1}, summary)
+		require.Contains(t, mergeLog.String(), `"reason":"group too large"`)
+	})
+
+	t.Run("the flag is skipped when the file is read back", func(t *testing.T) {
+		r := newResolver(10)
+		b := []byte(r.ToStringPresentation())
+		require.NoError(t, getValidConflictUsers(r, b))
+		require.Len(t, r.ValidUsers, 50)
+	})
+
+	t.Run("groups within the limit are not flagged", func(t *testing.T) {
+		for _, maxGroupSize := range []int{0, 50} {
+			require.NotContains(t, newResolver(maxGroupSize).ToStringPresentation(), "maximum group size")
+		}
+	})
+}
+
+func TestOnlyConflictType(t *testing.T) {
+	users := ConflictingUsers{
+		{ID: "1", Email: "alice@example.com", Login: "alice", ConflictEmail: "true"},
+		{ID: "2", Email: "ALICE@EXAMPLE.COM", Login: "alice2", ConflictEmail: "true"},
+		{ID: "3", Email: "bob@example.com", Login: "bob", ConflictLogin: "true"},
+		{ID: "4", Email: "bob2@example.com", Login: "BOB", ConflictLogin: "true"},
+		{ID: "5", Email: "carol@example.com", Login: "carol", ConflictEmail: "true", ConflictLogin: "true"},
+		{ID: "6", Email: "CAROL@EXAMPLE.COM", Login: "CAROL", ConflictEmail: "true", ConflictLogin: "true"},
+	}
+	newResolver := func() *ConflictResolver {
+		r := &ConflictResolver{Users: users}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		require.Len(t, r.Blocks, 3)
+		return r
+	}
+	ids := func(users ConflictingUsers) []string {
+		ids := make([]string, 0, len(users))
+		for _, u := range users {
+			ids = append(ids, u.ID)
+		}
+		return ids
+	}
+
+	t.Run("email keeps the email conflicts", func(t *testing.T) {
+		r := newResolver()
+		require.NoError(t, r.OnlyConflictType("email"))
+		require.Equal(t, []string{"conflict: alice@example.com", "conflict: carol@example.com"}, r.sortedBlocks())
+		require.Equal(t, []string{"1", "2", "5", "6"}, ids(r.Users))
+	})
+
+	t.Run("login keeps the login conflicts", func(t *testing.T) {
+		r := newResolver()
+		require.NoError(t, r.OnlyConflictType("login"))
+		require.Equal(t, []string{"conflict: bob"}, r.sortedBlocks())
+		require.Equal(t, []string{"3", "4"}, ids(r.Users))
+	})
+
+	t.Run("the two types partition the conflicts", func(t *testing.T) {
+		email, login := newResolver(), newResolver()
+		require.NoError(t, email.OnlyConflictType("email"))
+		require.NoError(t, login.OnlyConflictType("login"))
+		require.ElementsMatch(t, ids(users), append(ids(email.Users), ids(login.Users)...))
+	})
+
+	t.Run("an unknown type fails", func(t *testing.T) {
+		require.EqualError(t, newResolver().OnlyConflictType("name"), `unknown conflict type "name", expected email or login`)
+	})
+}
+
+func TestNormalizePlusAddressedEmail(t *testing.T) {
+	for email, expected := range map[string]string{
+		"bob@example.com":         "bob@example.com",
+		"bob+test@example.com":    "bob@example.com",
+		"bob+a+b@Example.COM":     "bob@example.com",
+		" Bob+Test@EXAMPLE.com ":  "bob@example.com",
+		"not-an-email+tag":        "not-an-email+tag",
+		"+tag@example.com":        "@example.com",
+		"quoted@plus+example.com": "quoted@plus+example.com",
+	} {
+		require.Equal(t, expected, normalizePlusAddressedEmail(email), email)
+	}
+}
+
+func TestPlusAddressedEmailConflicts(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	ctx := context.Background()
+	for _, cmd := range []user.CreateUserCommand{
+		{Email: "bob@x.com", Login: "bob"},
+		{Email: "bob+test@x.com", Login: "bob_test"},
+		{Email: "carol@Example.COM", Login: "carol"},
+		{Email: "carol+ci@example.com", Login: "carol_ci"},
+		{Email: "dave@x.com", Login: "dave"},
+		{Email: "dave@y.com", Login: "dave_y"},
+	} {
+		cmd.OrgID = 1
+		_, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+	}
+
+	t.Run("without normalization the emails are not conflicts", func(t *testing.T) {
+		users, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+		require.NoError(t, err)
+		require.Empty(t, users)
+	})
+
+	t.Run("plus-addressed emails and mixed-case domains are grouped", func(t *testing.T) {
+		users, err := getUsersWithPlusAddressedEmailConflicts(ctx, sqlStore)
+		require.NoError(t, err)
+		r := ConflictResolver{Users: users, NormalizeEmail: true}
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		require.Equal(t, []string{"conflict: bob@x.com", "conflict: carol@example.com"}, r.sortedBlocks())
+		emails := func(block string) []string {
+			var emails []string
+			for _, u := range r.Blocks[block] {
+				emails = append(emails, u.Email)
+			}
+			return emails
+		}
+		require.Equal(t, []string{"bob@x.com", "bob+test@x.com"}, emails("conflict: bob@x.com"))
+		require.Equal(t, []string{"carol@Example.COM", "carol+ci@example.com"}, emails("conflict: carol@example.com"))
+	})
+}
+
+func TestIdenticalDuplicateResolutions(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	var ids []int64
+	for _, cmd := range []user.CreateUserCommand{
+		// identical apart from case
+		{Email: "dup@test.com", Login: "dup"},
+		{Email: "DUP@TEST.COM", Login: "DUP"},
+		// the same email with different logins
+		{Email: "merge@test.com", Login: "merge"},
+		{Email: "MERGE@TEST.COM", Login: "merge_other"},
+	} {
+		cmd.OrgID = 1
+		u, err := sqlStore.CreateUser(ctx, cmd)
+		require.NoError(t, err)
+		ids = append(ids, u.ID)
+	}
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	resolutions := r.identicalDuplicateResolutions()
+	require.Equal(t, map[string]string{"conflict: dup@test.com": strconv.FormatInt(ids[0], 10)}, resolutions)
+
+	r.ApplyConflictResolutions(resolutions)
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1, Skipped: 1}, summary)
+
+	// the duplicate with the highest id is gone, the users to choose from are left
+	require.ErrorIs(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: ids[1]}), user.ErrUserNotFound)
+	for _, id := range []int64{ids[0], ids[2], ids[3]} {
+		require.NoError(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: id}))
+	}
+}
+
+func TestMergeConflictingUsersKeepsTheUserToKeep(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "kept@test.com", Login: "kept", OrgID: 1})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "KEPT@TEST.COM", Login: "KEPT", OrgID: 1})
+	require.NoError(t, err)
+
+	// the user to keep is also listed as a user to delete
+	keptId, dupId := strconv.FormatInt(kept.ID, 10), strconv.FormatInt(dup.ID, 10)
+	r := ConflictResolver{Store: sqlStore, Blocks: map[string]ConflictingUsers{
+		"conflict: kept@test.com": {{Direction: "+", ID: keptId}, {Direction: "-", ID: keptId}, {Direction: "-", ID: dupId}},
+	}}
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1}, summary)
+
+	require.NoError(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: kept.ID}))
+	require.ErrorIs(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: dup.ID}), user.ErrUserNotFound)
+}
@@ -0,0 +1,215 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/utils"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+// MergeJournal records the users deleted by the merges of conflict blocks, so that they can be recreated
+// with undo-user-merge. It contains the password hashes of the users and is only readable by its owner.
+type MergeJournal struct {
+	path    string
+	Entries []MergeJournalEntry `json:"entries"`
+}
+
+// MergeJournalEntry is the merge of a conflict block. It is recorded as pending before the merge is committed
+// and confirmed once it is, so that an entry left pending tells the merge may have been rolled back.
+type MergeJournalEntry struct {
+	Block        string             `json:"block"`
+	IntoUserID   int64              `json:"intoUserId"`
+	MergedAt     time.Time          `json:"mergedAt"`
+	DeletedUsers []MergeJournalUser `json:"deletedUsers"`
+	Pending      bool               `json:"pending,omitempty"`
+}
+
+// MergeJournalUser is a user deleted by a merge, as it was stored
+type MergeJournalUser struct {
+	User           user.User     `json:"user"`
+	OrgMemberships []org.OrgUser `json:"orgMemberships"`
+}
+
+// OpenMergeJournal reads the journal at path, a journal that does not exist yet is empty
+func OpenMergeJournal(path string) (*MergeJournal, error) {
+	j := &MergeJournal{path: path}
+	b, err := os.ReadFile(filepath.Clean(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, j); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %w", path, err)
+	}
+	return j, nil
+}
+
+// Record adds the entry to the journal and writes it
+func (j *MergeJournal) Record(entry MergeJournalEntry) error {
+	return j.write(append(j.Entries, entry))
+}
+
+// Confirm marks the pending entry of block as committed
+func (j *MergeJournal) Confirm(block string) error {
+	i := j.pending(block)
+	if i < 0 {
+		return fmt.Errorf("no pending merge of %s in the journal", block)
+	}
+	entries := append([]MergeJournalEntry{}, j.Entries...)
+	entries[i].Pending = false
+	return j.write(entries)
+}
+
+// Discard removes the pending entry of block, whose merge was rolled back
+func (j *MergeJournal) Discard(block string) error {
+	i := j.pending(block)
+	if i < 0 {
+		return nil
+	}
+	entries := append(append([]MergeJournalEntry{}, j.Entries[:i]...), j.Entries[i+1:]...)
+	return j.write(entries)
+}
+
+// pending returns the index of the latest pending entry of block, or -1
+func (j *MergeJournal) pending(block string) int {
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		if j.Entries[i].Block == block && j.Entries[i].Pending {
+			return i
+		}
+	}
+	return -1
+}
+
+// write replaces the entries of the journal, replacing the file only once it is fully written
+func (j *MergeJournal) write(entries []MergeJournalEntry) error {
+	b, err := json.MarshalIndent(MergeJournal{Entries: entries}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	j.Entries = entries
+	return nil
+}
+
+// journalUser reads the user about to be deleted and its organization memberships
+func journalUser(sess *sqlstore.DBSession, u user.User) (MergeJournalUser, error) {
+	journaled := MergeJournalUser{User: u}
+	if err := sess.Where("user_id = ?", u.ID).Find(&journaled.OrgMemberships); err != nil {
+		return journaled, err
+	}
+	return journaled, nil
+}
+
+// UndoMerges recreates the users deleted by the merges of the journal, latest first, with their ids and
+// organization memberships. Users whose id, login or email are used again are skipped and logged.
+// The relations that were moved to the kept users or deleted along with the users are not restored.
+func UndoMerges(ctx context.Context, s *sqlstore.SQLStore, j *MergeJournal) (restored int, skipped int, err error) {
+	for i := len(j.Entries) - 1; i >= 0; i-- {
+		entry := j.Entries[i]
+		if entry.Pending {
+			logger.Warnf("%s: the merge was not confirmed and may have been rolled back, only the users that no longer exist are restored\n", entry.Block)
+		}
+		for _, deleted := range entry.DeletedUsers {
+			ok, err := restoreUser(ctx, s, deleted)
+			if err != nil {
+				return restored, skipped, fmt.Errorf("%s: could not restore user %d: %w", entry.Block, deleted.User.ID, err)
+			}
+			if !ok {
+				skipped++
+				continue
+			}
+			restored++
+			logger.Infof("%s: restored user %d (login %s, email %s), its teams, preferences, stars, permissions and tokens were not restored and may remain with user %d\n",
+				entry.Block, deleted.User.ID, deleted.User.Login, deleted.User.Email, entry.IntoUserID)
+		}
+	}
+	return restored, skipped, nil
+}
+
+func restoreUser(ctx context.Context, s *sqlstore.SQLStore, deleted MergeJournalUser) (bool, error) {
+	restored := false
+	err := s.WithTransactionalDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		u := deleted.User
+		if exists, err := sess.ID(u.ID).Exist(&user.User{}); err != nil || exists {
+			if exists {
+				logger.Warnf("user %d already exists, skipping\n", u.ID)
+			}
+			return err
+		}
+		// the users differed from the kept user by case only, which the unique indexes allow again
+		taken, err := sess.Where("login = ? OR email = ?", u.Login, u.Email).Exist(&user.User{})
+		if err != nil {
+			return err
+		}
+		if taken {
+			logger.Warnf("the login %s or the email %s of user %d is used by another user, skipping\n", u.Login, u.Email, u.ID)
+			return nil
+		}
+		if _, err := sess.Insert(&u); err != nil {
+			return err
+		}
+		for _, membership := range deleted.OrgMemberships {
+			membership := membership
+			membership.ID = 0
+			if exists, err := sess.Table("org").ID(membership.OrgID).Exist(); err != nil {
+				return err
+			} else if !exists {
+				logger.Warnf("organization %d of user %d no longer exists, skipping the membership\n", membership.OrgID, u.ID)
+				continue
+			}
+			if _, err := sess.Insert(&membership); err != nil {
+				return err
+			}
+		}
+		restored = true
+		return nil
+	})
+	return restored, err
+}
+
+func runUndoUserMerge() func(context *cli.Context) error {
+	return func(context *cli.Context) error {
+		path := context.String("journal")
+		if path == "" {
+			return errors.New("please specify the journal written by ingest-file with --journal")
+		}
+		j, err := OpenMergeJournal(path)
+		if err != nil {
+			return fmt.Errorf("could not read the journal: %w", err)
+		}
+		if len(j.Entries) == 0 {
+			return fmt.Errorf("no merge recorded in %s", path)
+		}
+		cmd := &utils.ContextCommandLine{Context: context}
+		cfg, err := initConflictCfg(cmd)
+		if err != nil {
+			return fmt.Errorf("%v: %w", "failed to load configuration", err)
+		}
+		s, err := getSqlStore(cfg)
+		if err != nil {
+			return fmt.Errorf("%v: %w", "failed to get to sql", err)
+		}
+		restored, skipped, err := UndoMerges(context.Context, s, j)
+		logger.Infof("undo_summary restored=%d skipped=%d\n", restored, skipped)
+		return err
+	}
+}
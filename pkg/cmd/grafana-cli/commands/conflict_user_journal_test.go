@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/org"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+func TestMergeJournal(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "journal@test.com", Login: "journal"})
+	require.NoError(t, err)
+	dup, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "JOURNAL@TEST.COM", Login: "JOURNAL", Password: "secret"})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenMergeJournal(path)
+	require.NoError(t, err)
+	require.Empty(t, journal.Entries)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore, Journal: journal}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	r.ApplyConflictResolutions(map[string]string{"conflict: journal@test.com": fmt.Sprint(kept.ID)})
+	_, err = r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.ErrorIs(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: dup.ID}), user.ErrUserNotFound)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	journal, err = OpenMergeJournal(path)
+	require.NoError(t, err)
+	require.Len(t, journal.Entries, 1)
+	entry := journal.Entries[0]
+	require.Equal(t, "conflict: journal@test.com", entry.Block)
+	require.Equal(t, kept.ID, entry.IntoUserID)
+	require.False(t, entry.Pending)
+	require.Len(t, entry.DeletedUsers, 1)
+	require.Equal(t, dup.ID, entry.DeletedUsers[0].User.ID)
+	require.Equal(t, "JOURNAL", entry.DeletedUsers[0].User.Login)
+	require.Len(t, entry.DeletedUsers[0].OrgMemberships, 1)
+
+	t.Run("undo recreates the deleted users with their organization memberships", func(t *testing.T) {
+		restored, skipped, err := UndoMerges(ctx, sqlStore, journal)
+		require.NoError(t, err)
+		require.Equal(t, 1, restored)
+		require.Equal(t, 0, skipped)
+
+		query := &models.GetUserByIdQuery{Id: dup.ID}
+		require.NoError(t, sqlStore.GetUserById(ctx, query))
+		require.Equal(t, "JOURNAL", query.Result.Login)
+		require.Equal(t, "JOURNAL@TEST.COM", query.Result.Email)
+		require.Equal(t, dup.Password, query.Result.Password)
+
+		var memberships []org.OrgUser
+		err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			return sess.Where("user_id = ?", dup.ID).Find(&memberships)
+		})
+		require.NoError(t, err)
+		require.Len(t, memberships, 1)
+		require.Equal(t, entry.DeletedUsers[0].OrgMemberships[0].OrgID, memberships[0].OrgID)
+	})
+
+	t.Run("undo skips the users that exist", func(t *testing.T) {
+		restored, skipped, err := UndoMerges(ctx, sqlStore, journal)
+		require.NoError(t, err)
+		require.Equal(t, 0, restored)
+		require.Equal(t, 1, skipped)
+	})
+}
+
+func TestMergeJournalPendingEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.json")
+	journal, err := OpenMergeJournal(path)
+	require.NoError(t, err)
+	r := ConflictResolver{Journal: journal}
+
+	require.NoError(t, journal.Record(MergeJournalEntry{Block: "conflict: committed", IntoUserID: 1, Pending: true}))
+	r.settleJournal("conflict: committed", nil)
+	require.NoError(t, journal.Record(MergeJournalEntry{Block: "conflict: rolled back", IntoUserID: 2, Pending: true}))
+	r.settleJournal("conflict: rolled back", errors.New("commit failed"))
+
+	journal, err = OpenMergeJournal(path)
+	require.NoError(t, err)
+	require.Len(t, journal.Entries, 1)
+	require.Equal(t, "conflict: committed", journal.Entries[0].Block)
+	require.False(t, journal.Entries[0].Pending)
+
+	require.Error(t, journal.Confirm("conflict: rolled back"))
+	require.NoError(t, journal.Discard("conflict: committed"))
+	require.Len(t, journal.Entries, 1)
+}
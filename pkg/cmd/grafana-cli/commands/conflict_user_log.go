@@ -0,0 +1,53 @@
+package commands
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
+)
+
+// Outcomes of the merge of a conflict block in the merge log
+const (
+	MergeOutcomeResolved = "resolved"
+	MergeOutcomeSkipped  = "skipped"
+	MergeOutcomeFailed   = "failed"
+)
+
+// MergeLogEntry is a line of the merge log, the outcome of the merge of a conflict block
+type MergeLogEntry struct {
+	Time        time.Time `json:"time"`
+	Block       string    `json:"block"`
+	IntoUserID  int64     `json:"intoUserId,omitempty"`
+	FromUserIDs []int64   `json:"fromUserIds,omitempty"`
+	Outcome     string    `json:"outcome"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// useMergeLog appends the merge log of r to the file at path, created only readable by its owner.
+// The returned function closes the file.
+func (r *ConflictResolver) useMergeLog(path string) (func(), error) {
+	f, err := os.OpenFile(filepath.Clean(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r.MergeLog = f
+	return func() {
+		if err := f.Close(); err != nil {
+			logger.Warnf("could not close the log file %s: %s\n", path, err)
+		}
+	}, nil
+}
+
+// logMerge writes a line to the merge log, if set. The merge is already done, a failure is only logged.
+func (r *ConflictResolver) logMerge(entry MergeLogEntry) {
+	if r.MergeLog == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	if err := json.NewEncoder(r.MergeLog).Encode(entry); err != nil {
+		logger.Warnf("%s: could not write to the merge log: %s\n", entry.Block, err)
+	}
+}
@@ -0,0 +1,52 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeLog(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	kept, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "log@test.com", Login: "log", OrgID: 1})
+	require.NoError(t, err)
+	merged, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "LOG@TEST.COM", Login: "LOG", OrgID: 1})
+	require.NoError(t, err)
+
+	var log bytes.Buffer
+	r := ConflictResolver{Store: sqlStore, MergeLog: &log}
+	r.BuildConflictBlocks(ConflictingUsers{
+		{Direction: "+", ID: fmt.Sprint(kept.ID), Email: kept.Email, Login: kept.Login, ConflictEmail: "true"},
+		{Direction: "-", ID: fmt.Sprint(merged.ID), Email: merged.Email, Login: merged.Login, ConflictEmail: "true"},
+		{Direction: "-", ID: "98", Email: "unresolved@test.com", Login: "unresolved", ConflictEmail: "true"},
+		{Direction: "-", ID: "99", Email: "UNRESOLVED@TEST.COM", Login: "UNRESOLVED", ConflictEmail: "true"},
+	}, fmt.Sprintf)
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1, Skipped: 1}, summary)
+
+	var entries []MergeLogEntry
+	decoder := json.NewDecoder(&log)
+	for decoder.More() {
+		var entry MergeLogEntry
+		require.NoError(t, decoder.Decode(&entry))
+		require.False(t, entry.Time.IsZero())
+		entry.Time = time.Time{}
+		entries = append(entries, entry)
+	}
+	require.Equal(t, []MergeLogEntry{
+		{Block: "conflict: log@test.com", IntoUserID: kept.ID, FromUserIDs: []int64{merged.ID}, Outcome: MergeOutcomeResolved},
+		{Block: "conflict: unresolved@test.com", Outcome: MergeOutcomeSkipped, Reason: "there is no user to keep"},
+	}, entries)
+}
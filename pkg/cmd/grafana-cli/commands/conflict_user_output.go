@@ -0,0 +1,211 @@
+package commands
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ConflictOutputFormatter renders the conflicts of a resolver for the list command
+type ConflictOutputFormatter interface {
+	Format(w io.Writer, r *ConflictResolver) error
+}
+
+// conflictOutputFormatters are the formatters selectable with --output
+var conflictOutputFormatters = map[string]ConflictOutputFormatter{
+	"text": textConflictFormatter{},
+	"json": jsonConflictFormatter{},
+	"csv":  delimitedConflictFormatter{comma: ','},
+	"tsv":  delimitedConflictFormatter{comma: '\t'},
+}
+
+// getConflictOutputFormatter returns the formatter for the given --output and --template values,
+// a template takes precedence over the output name
+func getConflictOutputFormatter(output string, tmpl string) (ConflictOutputFormatter, error) {
+	if tmpl != "" {
+		return newTemplateConflictFormatter(tmpl)
+	}
+	if output == "" {
+		output = "text"
+	}
+	f, ok := conflictOutputFormatters[output]
+	if !ok {
+		names := make([]string, 0, len(conflictOutputFormatters))
+		for name := range conflictOutputFormatters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown output %q, expected one of %s", output, strings.Join(names, ", "))
+	}
+	return f, nil
+}
+
+// conflictOutputUser is a user of a conflict as seen by the formatters, the first user
+// of each conflict is the one kept by default and has the + direction, the others have -
+type conflictOutputUser struct {
+	Block string
+	ConflictingUser
+}
+
+// outputUsers lists the users of the conflicts that were not discarded
+func (r *ConflictResolver) outputUsers() []conflictOutputUser {
+	users := make([]conflictOutputUser, 0, len(r.Users))
+	for _, block := range r.sortedBlocks() {
+		if r.DiscardedBlocks[block] {
+			continue
+		}
+		for i, u := range r.Blocks[block] {
+			u.Direction = "-"
+			if i == 0 {
+				u.Direction = "+"
+			}
+			users = append(users, conflictOutputUser{Block: block, ConflictingUser: u})
+		}
+	}
+	return users
+}
+
+// exportConflicts writes the conflicts to a new file at path, which is removed again if they can't be written
+func exportConflicts(path string, f ConflictOutputFormatter, r *ConflictResolver) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Format(file, r); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	return file.Close()
+}
+
+type textConflictFormatter struct{}
+
+func (textConflictFormatter) Format(w io.Writer, r *ConflictResolver) error {
+	_, err := io.WriteString(w, r.ToStringPresentation())
+	return err
+}
+
+type jsonConflictFormatter struct{}
+
+type jsonConflict struct {
+	Conflict string `json:"conflict"`
+	// UserIdentification is the login or email identifying the conflict in a batch resolutions file
+	UserIdentification string `json:"userIdentification"`
+	// Type is Merge or SameIdentification, see blockConflictType
+	Type              string   `json:"type"`
+	IDs               []string `json:"ids"`
+	ConflictingEmails []string `json:"conflictingEmails"`
+	ConflictingLogins []string `json:"conflictingLogins"`
+	// SameIdentificationConflictIDs are the users having the same email and login as another user, apart from case
+	SameIdentificationConflictIDs []string           `json:"sameIdentificationConflictIds"`
+	Users                         []jsonConflictUser `json:"users"`
+}
+
+// newJSONConflict aggregates the users of a conflict block
+func newJSONConflict(block string, users ConflictingUsers) jsonConflict {
+	c := jsonConflict{
+		Conflict:                      block,
+		UserIdentification:            strings.TrimPrefix(block, "conflict: "),
+		Type:                          blockConflictType(users),
+		IDs:                           make([]string, 0, len(users)),
+		ConflictingEmails:             make([]string, 0),
+		ConflictingLogins:             make([]string, 0),
+		SameIdentificationConflictIDs: sameIdentificationConflictIds(users),
+	}
+	for _, u := range users {
+		c.IDs = append(c.IDs, u.ID)
+		if u.ConflictEmail != "" {
+			c.ConflictingEmails = append(c.ConflictingEmails, u.Email)
+		}
+		if u.ConflictLogin != "" {
+			c.ConflictingLogins = append(c.ConflictingLogins, u.Login)
+		}
+	}
+	return c
+}
+
+type jsonConflictUser struct {
+	Direction     string `json:"direction"`
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	Login         string `json:"login"`
+	LastSeenAt    string `json:"lastSeenAt"`
+	AuthModule    string `json:"authModule"`
+	ConflictEmail string `json:"conflictEmail"`
+	ConflictLogin string `json:"conflictLogin"`
+}
+
+func (jsonConflictFormatter) Format(w io.Writer, r *ConflictResolver) error {
+	conflicts := make([]jsonConflict, 0)
+	for _, u := range r.outputUsers() {
+		if len(conflicts) == 0 || conflicts[len(conflicts)-1].Conflict != u.Block {
+			conflicts = append(conflicts, newJSONConflict(u.Block, r.Blocks[u.Block]))
+		}
+		last := &conflicts[len(conflicts)-1]
+		last.Users = append(last.Users, jsonConflictUser{
+			Direction:     u.Direction,
+			ID:            u.ID,
+			Email:         u.Email,
+			Login:         u.Login,
+			LastSeenAt:    u.LastSeenAt,
+			AuthModule:    u.AuthModule,
+			ConflictEmail: u.ConflictEmail,
+			ConflictLogin: u.ConflictLogin,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(conflicts)
+}
+
+// delimitedConflictFormatter writes one row per user, such as CSV or TSV
+type delimitedConflictFormatter struct {
+	comma rune
+}
+
+func (f delimitedConflictFormatter) Format(w io.Writer, r *ConflictResolver) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = f.comma
+	if err := cw.Write([]string{"conflict", "direction", "id", "email", "login", "last_seen_at", "auth_module", "conflict_email", "conflict_login"}); err != nil {
+		return err
+	}
+	for _, u := range r.outputUsers() {
+		if err := cw.Write([]string{u.Block, u.Direction, u.ID, u.Email, u.Login, u.LastSeenAt, u.AuthModule, u.ConflictEmail, u.ConflictLogin}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// templateConflictFormatter executes a text/template for each user, followed by a newline.
+// The template has access to Block, Direction and the other fields of ConflictingUser.
+type templateConflictFormatter struct {
+	tmpl *template.Template
+}
+
+func newTemplateConflictFormatter(text string) (*templateConflictFormatter, error) {
+	tmpl, err := template.New("conflict").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %w", err)
+	}
+	return &templateConflictFormatter{tmpl: tmpl}, nil
+}
+
+func (f *templateConflictFormatter) Format(w io.Writer, r *ConflictResolver) error {
+	for _, u := range r.outputUsers() {
+		if err := f.tmpl.Execute(w, u); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newOutputTestResolver() *ConflictResolver {
+	users := ConflictingUsers{
+		{ID: "1", Email: "user@test.com", Login: "user", LastSeenAt: "2012-07-26T16:08:11Z", AuthModule: "auth.saml", ConflictEmail: "true"},
+		{ID: "2", Email: "USER@TEST.COM", Login: "USER", LastSeenAt: "2012-07-26T16:08:11Z", ConflictEmail: "true"},
+		{ID: "3", Email: "other@test.com", Login: "other", ConflictLogin: "true"},
+		{ID: "4", Email: "other2@test.com", Login: "OTHER", ConflictLogin: "true"},
+	}
+	r := &ConflictResolver{Users: users}
+	r.BuildConflictBlocks(users, fmt.Sprintf)
+	return r
+}
+
+func TestConflictOutputFormatters(t *testing.T) {
+	format := func(t *testing.T, output string, tmpl string) string {
+		t.Helper()
+		f, err := getConflictOutputFormatter(output, tmpl)
+		require.NoError(t, err)
+		var b bytes.Buffer
+		require.NoError(t, f.Format(&b, newOutputTestResolver()))
+		return b.String()
+	}
+
+	t.Run("text", func(t *testing.T) {
+		require.Equal(t, newOutputTestResolver().ToStringPresentation(), format(t, "text", ""))
+		require.Equal(t, format(t, "text", ""), format(t, "", ""))
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var conflicts []jsonConflict
+		require.NoError(t, json.Unmarshal([]byte(format(t, "json", "")), &conflicts))
+		require.Len(t, conflicts, 2)
+		require.Equal(t, "conflict: other", conflicts[0].Conflict)
+		require.Equal(t, "conflict: user@test.com", conflicts[1].Conflict)
+		require.Equal(t, jsonConflictUser{
+			Direction:     "+",
+			ID:            "1",
+			Email:         "user@test.com",
+			Login:         "user",
+			LastSeenAt:    "2012-07-26T16:08:11Z",
+			AuthModule:    "auth.saml",
+			ConflictEmail: "true",
+		}, conflicts[1].Users[0])
+		require.Equal(t, "-", conflicts[1].Users[1].Direction)
+
+		require.Equal(t, "other", conflicts[0].UserIdentification)
+		require.Equal(t, ConflictTypeMerge, conflicts[0].Type)
+		require.Equal(t, []string{"3", "4"}, conflicts[0].IDs)
+		require.Empty(t, conflicts[0].ConflictingEmails)
+		require.Equal(t, []string{"other", "OTHER"}, conflicts[0].ConflictingLogins)
+		require.Empty(t, conflicts[0].SameIdentificationConflictIDs)
+
+		require.Equal(t, "user@test.com", conflicts[1].UserIdentification)
+		require.Equal(t, ConflictTypeSameIdentification, conflicts[1].Type)
+		require.Equal(t, []string{"user@test.com", "USER@TEST.COM"}, conflicts[1].ConflictingEmails)
+		require.Equal(t, []string{"1", "2"}, conflicts[1].SameIdentificationConflictIDs)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		expected := `conflict,direction,id,email,login,last_seen_at,auth_module,conflict_email,conflict_login
+conflict: other,+,3,other@test.com,other,,,,true
+conflict: other,-,4,other2@test.com,OTHER,,,,true
+conflict: user@test.com,+,1,user@test.com,user,2012-07-26T16:08:11Z,auth.saml,true,
+conflict: user@test.com,-,2,USER@TEST.COM,USER,2012-07-26T16:08:11Z,,true,
+`
+		require.Equal(t, expected, format(t, "csv", ""))
+	})
+
+	t.Run("tsv", func(t *testing.T) {
+		expected := "conflict\tdirection\tid\temail\tlogin\tlast_seen_at\tauth_module\tconflict_email\tconflict_login\n" +
+			"conflict: other\t+\t3\tother@test.com\tother\t\t\t\ttrue\n" +
+			"conflict: other\t-\t4\tother2@test.com\tOTHER\t\t\t\ttrue\n" +
+			"conflict: user@test.com\t+\t1\tuser@test.com\tuser\t2012-07-26T16:08:11Z\tauth.saml\ttrue\t\n" +
+			"conflict: user@test.com\t-\t2\tUSER@TEST.COM\tUSER\t2012-07-26T16:08:11Z\t\ttrue\t\n"
+		require.Equal(t, expected, format(t, "tsv", ""))
+	})
+
+	t.Run("custom template", func(t *testing.T) {
+		expected := "3 other (conflict: other, +)\n4 OTHER (conflict: other, -)\n1 user (conflict: user@test.com, +)\n2 USER (conflict: user@test.com, -)\n"
+		// the template takes precedence over the output
+		require.Equal(t, expected, format(t, "json", "{{.ID}} {{.Login}} ({{.Block}}, {{.Direction}})"))
+	})
+
+	t.Run("discarded conflicts are left out", func(t *testing.T) {
+		r := newOutputTestResolver()
+		r.DiscardedBlocks["conflict: other"] = true
+		f, err := getConflictOutputFormatter("", "{{.ID}}")
+		require.NoError(t, err)
+		var b bytes.Buffer
+		require.NoError(t, f.Format(&b, r))
+		require.Equal(t, "1\n2\n", b.String())
+	})
+
+	t.Run("unknown output", func(t *testing.T) {
+		_, err := getConflictOutputFormatter("xml", "")
+		require.EqualError(t, err, `unknown output "xml", expected one of csv, json, text, tsv`)
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		_, err := getConflictOutputFormatter("", "{{.ID")
+		require.ErrorContains(t, err, "invalid template")
+	})
+}
+
+func TestExportConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conflicts.csv")
+	require.NoError(t, exportConflicts(path, conflictOutputFormatters["csv"], newOutputTestResolver()))
+
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var expected bytes.Buffer
+	require.NoError(t, conflictOutputFormatters["csv"].Format(&expected, newOutputTestResolver()))
+	require.Equal(t, expected.String(), string(b))
+
+	// an existing file is never overwritten
+	require.Error(t, exportConflicts(path, conflictOutputFormatters["json"], newOutputTestResolver()))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, expected.String(), string(b))
+}
@@ -0,0 +1,176 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/utils"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/sqlstore/db"
+)
+
+// ConflictPageOptions configures the merge of the conflicts in pages
+type ConflictPageOptions struct {
+	// Size is the number of lowercased logins and emails in conflict loaded per page
+	Size int
+	// After is the lowercased login or email the first page starts after, empty to start from the beginning
+	After string
+	// OrgID only merges the conflicts involving a member of the organization, if not 0
+	OrgID int64
+	// IgnoreEmailDomains are passed to IgnoreEmailDomains for every page
+	IgnoreEmailDomains []string
+	// OnlyConflictType is passed to OnlyConflictType for every page, if set
+	OnlyConflictType string
+	// Strategy picks the user to keep of every conflict block
+	Strategy MergeTargetStrategy
+}
+
+// MergeConflictingUsersInPages merges the conflicts without loading them all at once: the lowercased logins and
+// emails in conflict are read in pages ordered by their value, and only the users having them are loaded and
+// merged before the next page. Merged conflicts no longer show up in the following pages, so the pages are
+// read again from the database with the last value of the previous page as a cursor, which is returned so that
+// an interrupted merge can be resumed after it.
+// A user being part of two conflict blocks is only detected within a page, a conflict block whose login and
+// email fall in different pages can be seen twice.
+func (r *ConflictResolver) MergeConflictingUsersInPages(ctx context.Context, opts ConflictPageOptions) (ConflictMergeSummary, string, error) {
+	var summary ConflictMergeSummary
+	var errs []string
+	if opts.Size <= 0 {
+		return summary, opts.After, fmt.Errorf("invalid page size %d", opts.Size)
+	}
+	dialect := detectConflictQueryDialect(ctx, r.Store)
+	after := opts.After
+	for page := 1; ; page++ {
+		identifications, err := getConflictIdentificationsPage(ctx, r.Store, dialect, after, opts.Size)
+		if err != nil {
+			return summary, after, fmt.Errorf("could not get the conflicts after %q: %w", after, err)
+		}
+		if len(identifications) == 0 {
+			break
+		}
+		r.trace("page %d: %d identification(s) from %q to %q", page, len(identifications), identifications[0], identifications[len(identifications)-1])
+		users, err := getUsersWithConflictingEmailsOrLogins(ctx, r.Store, dialect, conflictQueryFilter{orgId: opts.OrgID, identifications: identifications})
+		if err != nil {
+			return summary, after, fmt.Errorf("could not get the users in conflict after %q: %w", after, err)
+		}
+		r.Users = users
+		r.BuildConflictBlocks(users, fmt.Sprintf)
+		r.IgnoreEmailDomains(opts.IgnoreEmailDomains)
+		if opts.OnlyConflictType != "" {
+			if err := r.OnlyConflictType(opts.OnlyConflictType); err != nil {
+				return summary, after, err
+			}
+		}
+		if len(r.DiscardedBlocks) != 0 {
+			r.logDiscardedUsers()
+		}
+		resolutions, err := r.AutoResolutions(ctx, opts.Strategy)
+		if err != nil {
+			return summary, after, fmt.Errorf("could not pick the users to keep: %w", err)
+		}
+		r.ApplyConflictResolutions(resolutions)
+
+		pageSummary, err := r.MergeConflictingUsers(ctx)
+		summary.Resolved += pageSummary.Resolved
+		summary.Skipped += pageSummary.Skipped
+		summary.Failed += pageSummary.Failed
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		if ctx.Err() != nil {
+			// the merge of the page was interrupted, it is resumed from its beginning
+			if len(errs) > 0 {
+				return summary, after, errors.New(strings.Join(errs, "; "))
+			}
+			return summary, after, fmt.Errorf("merge interrupted: %w", ctx.Err())
+		}
+		after = identifications[len(identifications)-1]
+		logger.Infof("page %d merged, resume with --resume-after=%s\n", page, after)
+		if len(identifications) < opts.Size {
+			break
+		}
+	}
+	if len(errs) > 0 {
+		return summary, after, errors.New(strings.Join(errs, "; "))
+	}
+	return summary, after, nil
+}
+
+// getConflictIdentificationsPage returns up to limit normalized logins and emails used with different cases or
+// surrounding spaces by users, service accounts aside, after the given one and in order
+func getConflictIdentificationsPage(ctx context.Context, s *sqlstore.SQLStore, dialect conflictQueryDialect, after string, limit int) ([]string, error) {
+	userDialect := db.DB.GetDialect(s).Quote("user")
+	cs := dialect.caseSensitive
+	grouped := func(column string) string {
+		return `
+		SELECT ` + normalizedSQL(column) + ` AS identification FROM ` + userDialect + `
+		WHERE ` + notServiceAccount(s) + `
+		GROUP BY ` + normalizedSQL(column) + ` HAVING COUNT(DISTINCT ` + cs(column) + `) > 1`
+	}
+	rawSQL := `SELECT identification FROM (` + grouped("email") + `
+		UNION` + grouped("login") + `
+	) AS identifications
+	WHERE identification > ?
+	ORDER BY identification ` + s.GetDialect().Limit(int64(limit))
+
+	identifications := make([]string, 0, limit)
+	err := s.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		return sess.SQL(rawSQL, after).Find(&identifications)
+	})
+	return identifications, err
+}
+
+func runPagedIngestConflictUsers(cmd *utils.ContextCommandLine, context *cli.Context) error {
+	auto := context.String("auto")
+	switch {
+	case auto == "":
+		return errors.New("--batch-size picks the users to keep with --auto")
+	case cmd.Args().First() != "" || context.Bool("batch"):
+		return errors.New("--auto picks the users to keep, it can't be combined with a file")
+	case context.Bool("dry-run"):
+		return errors.New("--batch-size can't be combined with --dry-run, run list to review the conflicts")
+	case context.String("only-identities") != "" || context.String("identifier") != "":
+		return errors.New("--batch-size merges every conflict, it can't be combined with --only-identities or --identifier")
+	case context.Bool("normalize-email"):
+		return errors.New("--batch-size can't be combined with --normalize-email, which reads all the users at once")
+	}
+	strategy, err := getMergeTargetStrategy(auto)
+	if err != nil {
+		return err
+	}
+	r, err := newConflictResolver(cmd, context)
+	if err != nil {
+		return fmt.Errorf("%v: %w", "failed to initialize conflict resolver", err)
+	}
+	if err := configureConflictMerge(r, context); err != nil {
+		return err
+	}
+	if path := context.String("log-file"); path != "" {
+		closeLog, err := r.useMergeLog(path)
+		if err != nil {
+			return fmt.Errorf("could not open the log file: %w", err)
+		}
+		defer closeLog()
+	}
+	confirmed, err := confirm("\n\nWe encourage users to create a db backup before running this command. \n Proceed with operation?", context.Bool("yes"))
+	if err != nil {
+		return err
+	}
+	if !confirmed {
+		return fmt.Errorf("user cancelled")
+	}
+	summary, _, err := r.MergeConflictingUsersInPages(context.Context, ConflictPageOptions{
+		Size:               context.Int("batch-size"),
+		After:              context.String("resume-after"),
+		OrgID:              context.Int64("org-id"),
+		IgnoreEmailDomains: context.StringSlice("ignore-email-domain"),
+		OnlyConflictType:   context.String("only"),
+		Strategy:           strategy,
+	})
+	return finishConflictMerge(context, r, summary, err)
+}
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/stretchr/testify/require"
+)
+
+// createConflictPairs creates n pairs of users whose logins and emails only differ by case
+func createConflictPairs(tb testing.TB, sqlStore *sqlstore.SQLStore, n int) {
+	tb.Helper()
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		_, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: fmt.Sprintf("page%04d@test.com", i), Login: fmt.Sprintf("page%04d", i), OrgID: 1})
+		require.NoError(tb, err)
+		_, err = sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: fmt.Sprintf("PAGE%04d@TEST.COM", i), Login: fmt.Sprintf("PAGE%04d", i), OrgID: 1})
+		require.NoError(tb, err)
+	}
+}
+
+func TestGetConflictIdentificationsPage(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	createConflictPairs(t, sqlStore, 2)
+	_, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "alone@test.com", Login: "alone", OrgID: 1})
+	require.NoError(t, err)
+	dialect := detectConflictQueryDialect(ctx, sqlStore)
+
+	page, err := getConflictIdentificationsPage(ctx, sqlStore, dialect, "", 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"page0000", "page0000@test.com", "page0001"}, page)
+
+	page, err = getConflictIdentificationsPage(ctx, sqlStore, dialect, page[len(page)-1], 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"page0001@test.com"}, page)
+
+	page, err = getConflictIdentificationsPage(ctx, sqlStore, dialect, page[len(page)-1], 3)
+	require.NoError(t, err)
+	require.Empty(t, page)
+}
+
+func TestMergeConflictingUsersInPages(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	createConflictPairs(t, sqlStore, 5)
+
+	t.Run("resumes after the given identification", func(t *testing.T) {
+		r := ConflictResolver{Store: sqlStore}
+		summary, after, err := r.MergeConflictingUsersInPages(ctx, ConflictPageOptions{Size: 2, After: "page0002@test.com", Strategy: lastActiveMergeTarget})
+		require.NoError(t, err)
+		require.Equal(t, ConflictMergeSummary{Resolved: 2}, summary)
+		require.Equal(t, "page0004@test.com", after)
+	})
+
+	t.Run("merges the remaining conflicts page by page", func(t *testing.T) {
+		r := ConflictResolver{Store: sqlStore}
+		summary, after, err := r.MergeConflictingUsersInPages(ctx, ConflictPageOptions{Size: 2, Strategy: lastActiveMergeTarget})
+		require.NoError(t, err)
+		require.Equal(t, ConflictMergeSummary{Resolved: 3}, summary)
+		require.Equal(t, "page0002@test.com", after)
+
+		conflicts, err := getUsersWithConflictingEmailsOrLogins(ctx, sqlStore, detectConflictQueryDialect(ctx, sqlStore), conflictQueryFilter{})
+		require.NoError(t, err)
+		require.Empty(t, conflicts)
+	})
+
+	t.Run("rejects an empty page", func(t *testing.T) {
+		r := ConflictResolver{Store: sqlStore}
+		_, _, err := r.MergeConflictingUsersInPages(ctx, ConflictPageOptions{Strategy: lastActiveMergeTarget})
+		require.EqualError(t, err, "invalid page size 0")
+	})
+}
+
+// BenchmarkConflictIdentificationsPages reads the conflicts one page at a time, the allocations per page
+// depend on the page size and not on the number of conflicts
+func BenchmarkConflictIdentificationsPages(b *testing.B) {
+	sqlStore := sqlstore.InitTestDB(b)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	createConflictPairs(b, sqlStore, 500)
+	dialect := detectConflictQueryDialect(ctx, sqlStore)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		after := ""
+		for {
+			page, err := getConflictIdentificationsPage(ctx, sqlStore, dialect, after, 100)
+			require.NoError(b, err)
+			if len(page) == 0 {
+				break
+			}
+			users, err := getUsersWithConflictingEmailsOrLogins(ctx, sqlStore, dialect, conflictQueryFilter{identifications: page})
+			require.NoError(b, err)
+			require.NotEmpty(b, users)
+			after = page[len(page)-1]
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/logger"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+// MergeTargetStrategy picks the user to keep among the users of a conflict block, selectable with --auto
+type MergeTargetStrategy func(users []user.User) int64
+
+// mergeTargetStrategies are the strategies selectable with --auto
+var mergeTargetStrategies = map[string]MergeTargetStrategy{
+	"last-active": lastActiveMergeTarget,
+}
+
+// getMergeTargetStrategy returns the strategy for the given --auto value
+func getMergeTargetStrategy(name string) (MergeTargetStrategy, error) {
+	strategy, ok := mergeTargetStrategies[name]
+	if !ok {
+		names := make([]string, 0, len(mergeTargetStrategies))
+		for name := range mergeTargetStrategies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return strategy, nil
+}
+
+// lastActiveMergeTarget keeps the user seen most recently, the one with the lowest id on ties
+func lastActiveMergeTarget(users []user.User) int64 {
+	target := users[0]
+	for _, u := range users[1:] {
+		if u.LastSeenAt.After(target.LastSeenAt) || (u.LastSeenAt.Equal(target.LastSeenAt) && u.ID < target.ID) {
+			target = u
+		}
+	}
+	return target.ID
+}
+
+// AutoResolutions picks the user to keep of every conflict block with the strategy, from the users as they
+// are currently stored. The resolutions can be applied with ApplyConflictResolutions.
+// A block with a malformed user id is reported and left unresolved, the other blocks are still resolved.
+func (r *ConflictResolver) AutoResolutions(ctx context.Context, strategy MergeTargetStrategy) (map[string]string, error) {
+	resolutions := make(map[string]string)
+	for _, block := range r.sortedBlocks() {
+		if r.DiscardedBlocks[block] || len(r.Blocks[block]) < 2 {
+			continue
+		}
+		ids := make([]int64, 0, len(r.Blocks[block]))
+		malformed := make([]string, 0)
+		for _, u := range r.Blocks[block] {
+			id, err := strconv.ParseInt(u.ID, 10, 64)
+			if err != nil {
+				malformed = append(malformed, strconv.Quote(u.ID))
+				continue
+			}
+			ids = append(ids, id)
+		}
+		if len(malformed) > 0 {
+			logger.Warnf("%s: malformed user ids %s, skipping\n", block, strings.Join(malformed, ", "))
+			continue
+		}
+		var users []user.User
+		err := r.Store.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			return sess.In("id", ids).Asc("id").Find(&users)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: could not get the users: %w", block, err)
+		}
+		if len(users) == 0 {
+			logger.Warnf("%s: the users no longer exist, skipping\n", block)
+			continue
+		}
+		keepId := strategy(users)
+		r.trace("%q resolved by keeping user %d", block, keepId)
+		resolutions[block] = strconv.FormatInt(keepId, 10)
+	}
+	return resolutions, nil
+}
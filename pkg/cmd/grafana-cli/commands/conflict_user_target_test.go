@@ -0,0 +1,69 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/models"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/services/user"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestLastActiveMergeTarget(t *testing.T) {
+	now := time.Now()
+	require.Equal(t, int64(2), lastActiveMergeTarget([]user.User{
+		{ID: 1, LastSeenAt: now.Add(-time.Hour)},
+		{ID: 2, LastSeenAt: now},
+		{ID: 3, LastSeenAt: now.Add(-2 * time.Hour)},
+	}))
+	require.Equal(t, int64(1), lastActiveMergeTarget([]user.User{
+		{ID: 3, LastSeenAt: now},
+		{ID: 1, LastSeenAt: now},
+		{ID: 2, LastSeenAt: now.Add(-time.Hour)},
+	}))
+}
+
+func TestGetMergeTargetStrategy(t *testing.T) {
+	_, err := getMergeTargetStrategy("last-active")
+	require.NoError(t, err)
+	_, err = getMergeTargetStrategy("oldest")
+	require.EqualError(t, err, `unknown strategy "oldest", expected one of last-active`)
+}
+
+func TestAutoResolutions(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	if sqlStore.GetDialect().DriverName() == ignoredDatabase {
+		return
+	}
+	ctx := context.Background()
+	first, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "auto@test.com", Login: "auto", OrgID: 1})
+	require.NoError(t, err)
+	active, err := sqlStore.CreateUser(ctx, user.CreateUserCommand{Email: "AUTO@TEST.COM", Login: "AUTO", OrgID: 1})
+	require.NoError(t, err)
+	err = sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		_, err := sess.Exec("UPDATE "+sqlStore.GetDialect().Quote("user")+" SET last_seen_at = ? WHERE id = ?", time.Now(), active.ID)
+		return err
+	})
+	require.NoError(t, err)
+
+	conflictUsers, err := GetUsersWithConflictingEmailsOrLogins(&cli.Context{Context: ctx}, sqlStore)
+	require.NoError(t, err)
+	r := ConflictResolver{Store: sqlStore}
+	r.BuildConflictBlocks(conflictUsers, fmt.Sprintf)
+	// a block with a malformed id is skipped without failing the others
+	r.Blocks["conflict: bogus@test.com"] = ConflictingUsers{{ID: "bogus", Email: "bogus@test.com"}, {ID: fmt.Sprint(first.ID), Email: "BOGUS@TEST.COM"}}
+
+	resolutions, err := r.AutoResolutions(ctx, lastActiveMergeTarget)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"conflict: auto@test.com": fmt.Sprint(active.ID)}, resolutions)
+
+	r.ApplyConflictResolutions(resolutions)
+	summary, err := r.MergeConflictingUsers(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ConflictMergeSummary{Resolved: 1, Skipped: 1}, summary)
+	require.ErrorIs(t, sqlStore.GetUserById(ctx, &models.GetUserByIdQuery{Id: first.ID}), user.ErrUserNotFound)
+}
@@ -0,0 +1,142 @@
+package secretsstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/runner"
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/utils"
+	"github.com/grafana/grafana/pkg/infra/log"
+	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
+)
+
+var errMissingKeyFlags = errors.New("the flags `org`, `namespace` and `type` are required")
+
+func SetSecret(c utils.CommandLine, runner runner.Runner) error {
+	return setSecret(c, runner.SecretsKVStore, os.Stdin)
+}
+
+func GetSecret(c utils.CommandLine, runner runner.Runner) error {
+	return getSecret(c, runner.SecretsKVStore, os.Stdout)
+}
+
+func DeleteSecret(c utils.CommandLine, runner runner.Runner) error {
+	return deleteSecret(c, runner.SecretsKVStore)
+}
+
+func ListKeys(c utils.CommandLine, runner runner.Runner) error {
+	return listKeys(c, runner.SecretsKVStore, os.Stdout)
+}
+
+// CountEncryptionVersions always reads the database, even when a secrets plugin manages the secrets,
+// because only the database records the encryption of the secrets
+func CountEncryptionVersions(c utils.CommandLine, runner runner.Runner) error {
+	store := secretskvs.NewSQLSecretsKVStore(runner.SQLStore, runner.SecretsService, log.New("secrets.kvstore"))
+	return countEncryptionVersions(c, store, os.Stdout)
+}
+
+// setSecret reads the secret value from stdin so that it is not exposed in the process arguments
+func setSecret(c utils.CommandLine, store secretskvs.SecretsKVStore, stdin io.Reader) error {
+	orgId, namespace, typ, err := keyFromFlags(c)
+	if err != nil {
+		return err
+	}
+	b, err := io.ReadAll(stdin)
+	if err != nil {
+		return fmt.Errorf("can't read secret value from stdin: %w", err)
+	}
+	// only strip the line ending added by echo or a heredoc
+	value := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	if value == "" {
+		return errors.New("can't set an empty secret value")
+	}
+	return store.Set(context.Background(), orgId, namespace, typ, value)
+}
+
+func getSecret(c utils.CommandLine, store secretskvs.SecretsKVStore, stdout io.Writer) error {
+	orgId, namespace, typ, err := keyFromFlags(c)
+	if err != nil {
+		return err
+	}
+	value, exists, err := store.Get(context.Background(), orgId, namespace, typ)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("secret not found for org %d, namespace %s and type %s", orgId, namespace, typ)
+	}
+	_, err = fmt.Fprintln(stdout, value)
+	return err
+}
+
+func deleteSecret(c utils.CommandLine, store secretskvs.SecretsKVStore) error {
+	orgId, namespace, typ, err := keyFromFlags(c)
+	if err != nil {
+		return err
+	}
+	return store.Del(context.Background(), orgId, namespace, typ)
+}
+
+func listKeys(c utils.CommandLine, store secretskvs.SecretsKVStore, stdout io.Writer) error {
+	orgId, namespace, typ, err := keyFromFlags(c)
+	if err != nil {
+		return err
+	}
+	keys, err := store.Keys(context.Background(), orgId, namespace, typ)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(stdout, "%d\t%s\t%s\n", k.OrgId, k.Namespace, k.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SummarizeSizes summarizes the database with aggregate queries, and a secrets plugin on a best-effort basis
+func SummarizeSizes(c utils.CommandLine, runner runner.Runner) error {
+	return summarizeSizes(c, runner.SecretsKVStore, os.Stdout)
+}
+
+func summarizeSizes(c utils.CommandLine, store secretskvs.SecretsKVStore, stdout io.Writer) error {
+	summaries, err := secretskvs.SummarizeSizes(context.Background(), store, int64(c.Int("org")), c.Int("namespace-prefix-length"))
+	if err != nil {
+		return err
+	}
+	for _, s := range summaries {
+		if _, err := fmt.Fprintf(stdout, "%d\t%s\t%s\t%d\t%d\t%.1f\n", s.OrgId, s.Type, s.NamespacePrefix, s.Count, s.TotalSize, s.AverageSize()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type encryptionVersionCounter interface {
+	EncryptionVersionCounts(ctx context.Context, orgId int64) ([]secretskvs.EncryptionVersionCount, error)
+}
+
+func countEncryptionVersions(c utils.CommandLine, store encryptionVersionCounter, stdout io.Writer) error {
+	counts, err := store.EncryptionVersionCounts(context.Background(), int64(c.Int("org")))
+	if err != nil {
+		return err
+	}
+	for _, count := range counts {
+		if _, err := fmt.Fprintf(stdout, "%s\t%d\n", count.EncryptionVersion, count.Count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func keyFromFlags(c utils.CommandLine) (int64, string, string, error) {
+	orgId, namespace, typ := int64(c.Int("org")), c.String("namespace"), c.String("type")
+	if orgId == 0 || namespace == "" || typ == "" {
+		return 0, "", "", errMissingKeyFlags
+	}
+	return orgId, namespace, typ, nil
+}
@@ -0,0 +1,136 @@
+package secretsstore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/cmd/grafana-cli/commands/commandstest"
+	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretsStoreCommands(t *testing.T) {
+	flags := map[string]string{"org": "1", "namespace": "my-datasource", "type": "datasource"}
+
+	t.Run("set reads the value from stdin", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		err = setSecret(c, store, strings.NewReader("my secret\n"))
+		require.NoError(t, err)
+
+		value, exists, err := store.Get(context.Background(), 1, "my-datasource", "datasource")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, "my secret", value)
+	})
+
+	t.Run("set fails on an empty value", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		err = setSecret(c, store, strings.NewReader(""))
+		require.Error(t, err)
+	})
+
+	t.Run("get writes the value to stdout", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		require.NoError(t, store.Set(context.Background(), 1, "my-datasource", "datasource", "my secret"))
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		err = getSecret(c, store, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "my secret\n", out.String())
+	})
+
+	t.Run("get fails when the secret does not exist", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		err = getSecret(c, store, &bytes.Buffer{})
+		require.Error(t, err)
+	})
+
+	t.Run("del removes the secret", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		require.NoError(t, store.Set(context.Background(), 1, "my-datasource", "datasource", "my secret"))
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		err = deleteSecret(c, store)
+		require.NoError(t, err)
+
+		_, exists, err := store.Get(context.Background(), 1, "my-datasource", "datasource")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("keys lists the matching keys", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		require.NoError(t, store.Set(context.Background(), 1, "my-datasource", "datasource", "my secret"))
+		require.NoError(t, store.Set(context.Background(), 2, "my-datasource", "datasource", "other secret"))
+		c, err := commandstest.NewCliContext(flags)
+		require.NoError(t, err)
+
+		var out bytes.Buffer
+		err = listKeys(c, store, &out)
+		require.NoError(t, err)
+		assert.Equal(t, "1\tmy-datasource\tdatasource\n", out.String())
+	})
+
+	t.Run("commands require the key flags", func(t *testing.T) {
+		store := secretskvs.NewFakeSecretsKVStore()
+		c, err := commandstest.NewCliContext(map[string]string{"org": "1"})
+		require.NoError(t, err)
+
+		err = deleteSecret(c, store)
+		assert.Equal(t, errMissingKeyFlags, err)
+	})
+}
+
+type fakeEncryptionVersionCounter struct {
+	orgId  int64
+	counts []secretskvs.EncryptionVersionCount
+}
+
+func (f *fakeEncryptionVersionCounter) EncryptionVersionCounts(_ context.Context, orgId int64) ([]secretskvs.EncryptionVersionCount, error) {
+	f.orgId = orgId
+	return f.counts, nil
+}
+
+func TestCountEncryptionVersions(t *testing.T) {
+	store := &fakeEncryptionVersionCounter{counts: []secretskvs.EncryptionVersionCount{
+		{EncryptionVersion: "envelope/aes-cfb", Count: 3},
+		{EncryptionVersion: secretskvs.LegacyEncryptionVersion, Count: 1},
+	}}
+	c, err := commandstest.NewCliContext(map[string]string{"org": "2"})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = countEncryptionVersions(c, store, &out)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), store.orgId)
+	assert.Equal(t, "envelope/aes-cfb\t3\nlegacy\t1\n", out.String())
+}
+
+func TestSummarizeSizes(t *testing.T) {
+	store := secretskvs.NewInMemorySecretsKVStore()
+	require.NoError(t, store.Set(context.Background(), 1, "prom-a", "datasource", "1234"))
+	require.NoError(t, store.Set(context.Background(), 1, "prom-b", "datasource", "123"))
+	c, err := commandstest.NewCliContext(map[string]string{"org": "1", "namespace-prefix-length": "4"})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = summarizeSizes(c, store, &out)
+	require.NoError(t, err)
+	assert.Equal(t, "1\tdatasource\tprom\t2\t7\t3.5\n", out.String())
+	assert.NotContains(t, out.String(), "1234")
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
 	"github.com/grafana/grafana/pkg/services/secrets/manager"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/services/user"
@@ -18,13 +19,14 @@ type Runner struct {
 	EncryptionService encryption.Internal
 	SecretsService    *manager.SecretsService
 	SecretsMigrator   secrets.Migrator
+	SecretsKVStore    secretskvs.SecretsKVStore
 	UserService       user.Service
 }
 
 func New(cfg *setting.Cfg, sqlStore *sqlstore.SQLStore, settingsProvider setting.Provider,
 	encryptionService encryption.Internal, features featuremgmt.FeatureToggles,
 	secretsService *manager.SecretsService, secretsMigrator secrets.Migrator,
-	userService user.Service,
+	secretsKVStore secretskvs.SecretsKVStore, userService user.Service,
 ) Runner {
 	return Runner{
 		Cfg:               cfg,
@@ -33,6 +35,7 @@ func New(cfg *setting.Cfg, sqlStore *sqlstore.SQLStore, settingsProvider setting
 		EncryptionService: encryptionService,
 		SecretsService:    secretsService,
 		SecretsMigrator:   secretsMigrator,
+		SecretsKVStore:    secretsKVStore,
 		Features:          features,
 		UserService:       userService,
 	}
@@ -86,6 +86,8 @@ func LoadGrafanaInstancesWithThema(path string, cueFS fs.FS, rt *thema.Runtime,
 
 // prefixWithGrafanaCUE constructs an fs.FS that merges the provided fs.FS with one
 // containing grafana's cue.mod at the root. The provided prefix should be the
+// path from the grafana root to the directory containing the lineage, so that
+// every component can share this loader instead of building its own fs.FS.
 //
 // The returned fs.FS is suitable for passing to a CUE loader, such as
 // cuelang.org/cue/load.Instances or
@@ -0,0 +1,31 @@
+package cuectx_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/grafana/thema"
+	"github.com/stretchr/testify/require"
+
+	"github.com/grafana/grafana/pkg/coremodel/playlist"
+	"github.com/grafana/grafana/pkg/cuectx"
+)
+
+// The shared loader should bind the same lineage as a coremodel loading its own embedded CUE file
+func TestLoadGrafanaInstancesWithThema(t *testing.T) {
+	path := filepath.Join("pkg", "coremodel", "playlist")
+	b, err := os.ReadFile(filepath.Join("..", "coremodel", "playlist", "coremodel.cue"))
+	require.NoError(t, err)
+	cueFS := fstest.MapFS{"coremodel.cue": &fstest.MapFile{Data: b}}
+
+	rt := cuectx.GrafanaThemaRuntime()
+	lin, err := cuectx.LoadGrafanaInstancesWithThema(path, cueFS, rt)
+	require.NoError(t, err)
+
+	expected, err := playlist.Lineage(rt)
+	require.NoError(t, err)
+	require.Equal(t, expected.Name(), lin.Name())
+	require.Equal(t, thema.LatestVersion(expected), thema.LatestVersion(lin))
+}
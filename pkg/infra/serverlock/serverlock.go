@@ -3,6 +3,7 @@ package serverlock
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
@@ -11,6 +12,9 @@ import (
 	"go.opentelemetry.io/otel/attribute"
 )
 
+// ErrLockAlreadyExists is returned by LockExecuteAndRelease when another process holds the lock
+var ErrLockAlreadyExists = errors.New("there is already a lock for this actionName")
+
 func ProvideService(sqlStore *sqlstore.SQLStore, tracer tracing.Tracer) *ServerLockService {
 	return &ServerLockService{
 		SQLStore: sqlStore,
@@ -184,7 +188,7 @@ func (sl *ServerLockService) acquireForRelease(ctx context.Context, actionName s
 		if len(lockRows) > 0 {
 			result := lockRows[0]
 			if sl.isLockWithinInterval(result, maxInterval) {
-				return errors.New("there is already a lock for this actionName: " + actionName)
+				return fmt.Errorf("%w: %s", ErrLockAlreadyExists, actionName)
 			} else {
 				// lock has timeouted, so we update the timestamp
 				result.LastExecution = time.Now().Unix()
@@ -326,6 +326,8 @@ var wireBasicSet = wire.NewSet(
 	guardian.ProvideService,
 	sanitizer.ProvideService,
 	secretsStore.ProvideService,
+	secretsStore.ProvideRemoteSecretsPluginCheck,
+	wire.Bind(new(secretsStore.UseRemoteSecretsPluginCheck), new(*secretsStore.RemoteSecretsPluginCheck)),
 	avatar.ProvideAvatarCacheServer,
 	authproxy.ProvideAuthProxy,
 	statscollector.ProvideService,
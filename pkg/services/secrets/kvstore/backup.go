@@ -0,0 +1,63 @@
+package kvstore
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Export returns the decrypted values of the secrets of an organization by namespace and type, e.g. to back them
+// up before migrating them to the plugin. Expired secrets are left out. The types are listed from all the items
+// of the store as none of the stores can list the types of a namespace, but the values are read with GetMany:
+// GetAll leaves the values it can't decrypt empty, which Import would then set over the real ones, while
+// GetMany fails the export.
+func Export(ctx context.Context, store SecretsKVStore, orgId int64) (map[string]map[string]string, error) {
+	items, err := store.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	typs := make(map[string][]string)
+	for _, item := range items {
+		if *item.OrgId != orgId || item.expired(now) {
+			continue
+		}
+		typs[*item.Namespace] = append(typs[*item.Namespace], *item.Type)
+	}
+	secrets := make(map[string]map[string]string)
+	for namespace := range typs {
+		values, err := store.GetMany(ctx, orgId, namespace, typs[namespace])
+		if err != nil {
+			return nil, err
+		}
+		// the secrets deleted or expired since they were listed are left out
+		if len(values) > 0 {
+			secrets[namespace] = values
+		}
+	}
+	return secrets, nil
+}
+
+// Import sets the secrets returned by Export in an organization, replacing the secrets of the same namespace
+// and type and leaving the others as they are. The secrets are set one by one in order, the secrets set before
+// a failure are kept.
+func Import(ctx context.Context, store SecretsKVStore, orgId int64, secrets map[string]map[string]string) error {
+	namespaces := make([]string, 0, len(secrets))
+	for namespace := range secrets {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		typs := make([]string, 0, len(secrets[namespace]))
+		for typ := range secrets[namespace] {
+			typs = append(typs, typ)
+		}
+		sort.Strings(typs)
+		for _, typ := range typs {
+			if err := store.Set(ctx, orgId, namespace, typ, secrets[namespace][typ]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/secrets/manager"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+		"cache": func(t *testing.T) SecretsKVStore {
+			return WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			require.NoError(t, kv.Set(ctx, 1, "prometheus", "datasource", `{"basicAuthPassword":"secret"}`))
+			require.NoError(t, kv.Set(ctx, 1, "prometheus", "other", "other type"))
+			require.NoError(t, kv.Set(ctx, 1, "loki", "datasource", "loki value"))
+			require.NoError(t, kv.Set(ctx, 2, "prometheus", "datasource", "other org"))
+
+			backup, err := Export(ctx, kv, 1)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]map[string]string{
+				"prometheus": {"datasource": `{"basicAuthPassword":"secret"}`, "other": "other type"},
+				"loki":       {"datasource": "loki value"},
+			}, backup)
+
+			// the secrets are lost, then restored
+			require.NoError(t, kv.DelAll(ctx, 1, "prometheus"))
+			require.NoError(t, kv.Set(ctx, 1, "loki", "datasource", "changed value"))
+			require.NoError(t, Import(ctx, kv, 1, backup))
+
+			restored, err := Export(ctx, kv, 1)
+			require.NoError(t, err)
+			assert.Equal(t, backup, restored)
+			value, exists, err := kv.Get(ctx, 2, "prometheus", "datasource")
+			require.NoError(t, err)
+			assert.True(t, exists)
+			assert.Equal(t, "other org", value)
+		})
+	}
+
+	t.Run("the secrets can be restored to another store", func(t *testing.T) {
+		kv := NewSQLSecretsKVStore(sqlstore.InitTestDB(t), secretsService, log.New("test.logger"))
+		require.NoError(t, kv.Set(ctx, 1, "prometheus", "datasource", "value"))
+		backup, err := Export(ctx, kv, 1)
+		require.NoError(t, err)
+
+		other := NewInMemorySecretsKVStore()
+		require.NoError(t, Import(ctx, other, 1, backup))
+		value, exists, err := other.Get(ctx, 1, "prometheus", "datasource")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, "value", value)
+	})
+
+	t.Run("expired secrets are not exported", func(t *testing.T) {
+		testStore := sqlstore.InitTestDB(t)
+		kv := NewSQLSecretsKVStore(testStore, secretsService, log.New("test.logger"))
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "session", "token", "value", time.Hour))
+		err := testStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.Exec("UPDATE secrets SET expires_at = ?", time.Now().Add(-time.Minute))
+			return err
+		})
+		require.NoError(t, err)
+		backup, err := Export(ctx, kv, 1)
+		require.NoError(t, err)
+		assert.Empty(t, backup)
+	})
+
+	t.Run("a secret that can't be decrypted fails the export", func(t *testing.T) {
+		testStore := sqlstore.InitTestDB(t)
+		kv := NewSQLSecretsKVStore(testStore, secretsService, log.New("test.logger"))
+		require.NoError(t, kv.Set(ctx, 1, "prometheus", "datasource", "value"))
+		require.NoError(t, kv.Set(ctx, 1, "loki", "datasource", "value"))
+		err := testStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.Exec("UPDATE secrets SET value = ? WHERE namespace = ?", "Y29ycnVwdGVkIGNpcGhlcnRleHQ=", "loki")
+			return err
+		})
+		require.NoError(t, err)
+		backup, err := Export(ctx, kv, 1)
+		require.Error(t, err)
+		assert.Nil(t, backup)
+	})
+}
@@ -4,6 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/grafana/grafana/pkg/infra/localcache"
@@ -13,9 +16,12 @@ import (
 var errSecretStoreIsNotCached = errors.New("SecretsKVStore is not a CachedKVStore")
 
 type CachedKVStore struct {
-	log   log.Logger
-	cache *localcache.CacheService
-	store SecretsKVStore
+	// writes counts the changes made through the store, kept first for its 64-bit alignment
+	writes      uint64
+	log         log.Logger
+	cache       *localcache.CacheService
+	store       SecretsKVStore
+	invalidator CacheInvalidator
 }
 
 func WithCache(store SecretsKVStore, defaultExpiration time.Duration, cleanupInterval time.Duration) *CachedKVStore {
@@ -26,39 +32,227 @@ func WithCache(store SecretsKVStore, defaultExpiration time.Duration, cleanupInt
 	}
 }
 
+// WithInvalidator makes the store share the changes of secrets with the other stores using
+// the same CacheInvalidator, so that none of them serves a value changed by another one.
+func (kv *CachedKVStore) WithInvalidator(invalidator CacheInvalidator) *CachedKVStore {
+	kv.invalidator = invalidator
+	return kv
+}
+
+// cacheKey identifies a secret in the cache. The namespace and type are quoted so that
+// no two secrets share a key, e.g. namespace "ab" and type "c" and namespace "a" and type "bc".
+func cacheKey(orgId int64, namespace string, typ string) string {
+	return fmt.Sprintf("%d/%q/%q", orgId, namespace, typ)
+}
+
+// Operations labelling the cache metrics
+const (
+	cacheOpGet          = "get"
+	cacheOpGetMany      = "get_many"
+	cacheOpExists       = "exists"
+	cacheOpSet          = "set"
+	cacheOpSetWithTTL   = "set_with_ttl"
+	cacheOpSwap         = "compare_and_swap"
+	cacheOpSetIfAbsent  = "set_if_absent"
+	cacheOpDel          = "del"
+	cacheOpDelAll       = "del_all"
+	cacheOpRename       = "rename"
+	cacheOpInvalidation = "invalidation"
+)
+
+// evict removes a secret from the cache, counted as an eviction if it was cached
+func (kv *CachedKVStore) evict(operation string, orgId int64, namespace string, typ string) {
+	key := cacheKey(orgId, namespace, typ)
+	if _, ok := kv.cache.Get(key); ok {
+		cacheEvictionsCounter.WithLabelValues(operation).Inc()
+	}
+	kv.cache.Delete(key)
+}
+
+// evictNamespace removes the secrets of every type in a namespace from the cache,
+// in all organizations when orgId is AllOrganizations
+func (kv *CachedKVStore) evictNamespace(operation string, orgId int64, namespace string) {
+	// the org id is followed by the quoted namespace, which can't be the prefix of another quoted namespace
+	suffix := fmt.Sprintf("/%q/", namespace)
+	for key := range kv.cache.Items() {
+		org, rest, ok := strings.Cut(key, "/")
+		if !ok || !strings.HasPrefix("/"+rest, suffix) {
+			continue
+		}
+		if orgId != AllOrganizations && org != strconv.FormatInt(orgId, 10) {
+			continue
+		}
+		cacheEvictionsCounter.WithLabelValues(operation).Inc()
+		kv.cache.Delete(key)
+	}
+}
+
+// dropInvalidated removes the values changed by other stores from the cache
+func (kv *CachedKVStore) dropInvalidated(ctx context.Context) {
+	if kv.invalidator == nil {
+		return
+	}
+	keys, err := kv.invalidator.Invalidated(ctx)
+	if err != nil {
+		kv.log.Warn("failed to read the invalidated secrets, cached values may be stale", "err", err)
+		return
+	}
+	for _, k := range keys {
+		if k.Type == "" {
+			kv.evictNamespace(cacheOpInvalidation, k.OrgId, k.Namespace)
+			continue
+		}
+		kv.evict(cacheOpInvalidation, k.OrgId, k.Namespace, k.Type)
+	}
+}
+
+// publish notifies the other stores that a secret changed, failures only leave their cache stale until it expires
+func (kv *CachedKVStore) publish(ctx context.Context, orgId int64, namespace string, typ string) {
+	if kv.invalidator == nil {
+		return
+	}
+	if err := kv.invalidator.Publish(ctx, Key{OrgId: orgId, Namespace: namespace, Type: typ}); err != nil {
+		kv.log.Warn("failed to publish secret change to the other instances", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+	}
+}
+
 func (kv *CachedKVStore) Get(ctx context.Context, orgId int64, namespace string, typ string) (string, bool, error) {
-	key := fmt.Sprint(orgId, namespace, typ)
+	kv.dropInvalidated(ctx)
+	key := cacheKey(orgId, namespace, typ)
 	if value, ok := kv.cache.Get(key); ok {
 		kv.log.Debug("got secret value from cache", "orgId", orgId, "type", typ, "namespace", namespace)
+		cacheHitsCounter.WithLabelValues(cacheOpGet).Inc()
 		return fmt.Sprint(value), true, nil
 	}
+	cacheMissesCounter.WithLabelValues(cacheOpGet).Inc()
+	writes := atomic.LoadUint64(&kv.writes)
 	value, ok, err := kv.store.Get(ctx, orgId, namespace, typ)
 	if err != nil {
 		return "", false, err
 	}
-	if ok {
+	// a value read before a concurrent change would be cached over the changed one
+	if ok && atomic.LoadUint64(&kv.writes) == writes {
 		kv.cache.SetDefault(key, value)
 	}
 	return value, ok, err
 }
 
+// GetMany gets the values missing from the cache from the store at once
+func (kv *CachedKVStore) GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error) {
+	kv.dropInvalidated(ctx)
+	values := make(map[string]string, len(typs))
+	missing := make([]string, 0, len(typs))
+	for _, typ := range typs {
+		if value, ok := kv.cache.Get(cacheKey(orgId, namespace, typ)); ok {
+			values[typ] = fmt.Sprint(value)
+		} else {
+			missing = append(missing, typ)
+		}
+	}
+	cacheHitsCounter.WithLabelValues(cacheOpGetMany).Add(float64(len(values)))
+	cacheMissesCounter.WithLabelValues(cacheOpGetMany).Add(float64(len(missing)))
+	if len(missing) == 0 {
+		return values, nil
+	}
+	writes := atomic.LoadUint64(&kv.writes)
+	fetched, err := kv.store.GetMany(ctx, orgId, namespace, missing)
+	if err != nil {
+		return nil, err
+	}
+	cacheable := atomic.LoadUint64(&kv.writes) == writes
+	for typ, value := range fetched {
+		values[typ] = value
+		if cacheable {
+			kv.cache.SetDefault(cacheKey(orgId, namespace, typ), value)
+		}
+	}
+	return values, nil
+}
+
+func (kv *CachedKVStore) Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error) {
+	kv.dropInvalidated(ctx)
+	if _, ok := kv.cache.Get(cacheKey(orgId, namespace, typ)); ok {
+		cacheHitsCounter.WithLabelValues(cacheOpExists).Inc()
+		return true, nil
+	}
+	cacheMissesCounter.WithLabelValues(cacheOpExists).Inc()
+	return kv.store.Exists(ctx, orgId, namespace, typ)
+}
+
 func (kv *CachedKVStore) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
+	atomic.AddUint64(&kv.writes, 1)
 	err := kv.store.Set(ctx, orgId, namespace, typ, value)
 	if err != nil {
+		// the store may have changed the secret before failing
+		kv.evict(cacheOpSet, orgId, namespace, typ)
 		return err
 	}
-	key := fmt.Sprint(orgId, namespace, typ)
-	kv.cache.SetDefault(key, value)
+	kv.cache.SetDefault(cacheKey(orgId, namespace, typ), value)
+	kv.publish(ctx, orgId, namespace, typ)
 	return nil
 }
 
+// SetWithTTL doesn't cache the value. Once read again it is cached for the default expiration of the cache,
+// so it can be served for that long after a shorter ttl has elapsed.
+func (kv *CachedKVStore) SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error {
+	atomic.AddUint64(&kv.writes, 1)
+	err := kv.store.SetWithTTL(ctx, orgId, namespace, typ, value, ttl)
+	kv.evict(cacheOpSetWithTTL, orgId, namespace, typ)
+	if err != nil {
+		return err
+	}
+	kv.publish(ctx, orgId, namespace, typ)
+	return nil
+}
+
+// CompareAndSwap compares with the value in the store, not with the cached one which may be stale
+func (kv *CachedKVStore) CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error) {
+	atomic.AddUint64(&kv.writes, 1)
+	swapped, err := kv.store.CompareAndSwap(ctx, orgId, namespace, typ, oldValue, newValue)
+	if err != nil || !swapped {
+		// the cached value, if any, may be the one that didn't match
+		kv.evict(cacheOpSwap, orgId, namespace, typ)
+		return swapped, err
+	}
+	kv.cache.SetDefault(cacheKey(orgId, namespace, typ), newValue)
+	kv.publish(ctx, orgId, namespace, typ)
+	return true, nil
+}
+
+// SetIfAbsent checks the store, not the cache, for the secret
+func (kv *CachedKVStore) SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error) {
+	atomic.AddUint64(&kv.writes, 1)
+	set, err := kv.store.SetIfAbsent(ctx, orgId, namespace, typ, value)
+	if err != nil || !set {
+		// the secret was set by someone else, its cached value, if any, may be stale
+		kv.evict(cacheOpSetIfAbsent, orgId, namespace, typ)
+		return set, err
+	}
+	kv.cache.SetDefault(cacheKey(orgId, namespace, typ), value)
+	kv.publish(ctx, orgId, namespace, typ)
+	return true, nil
+}
+
 func (kv *CachedKVStore) Del(ctx context.Context, orgId int64, namespace string, typ string) error {
+	atomic.AddUint64(&kv.writes, 1)
 	err := kv.store.Del(ctx, orgId, namespace, typ)
+	kv.evict(cacheOpDel, orgId, namespace, typ)
 	if err != nil {
 		return err
 	}
-	key := fmt.Sprint(orgId, namespace, typ)
-	kv.cache.Delete(key)
+	kv.publish(ctx, orgId, namespace, typ)
+	return nil
+}
+
+func (kv *CachedKVStore) DelAll(ctx context.Context, orgId int64, namespace string) error {
+	atomic.AddUint64(&kv.writes, 1)
+	err := kv.store.DelAll(ctx, orgId, namespace)
+	kv.evictNamespace(cacheOpDelAll, orgId, namespace)
+	if err != nil {
+		return err
+	}
+	// a key without a type stands for the whole namespace
+	kv.publish(ctx, orgId, namespace, "")
 	return nil
 }
 
@@ -66,17 +260,21 @@ func (kv *CachedKVStore) Keys(ctx context.Context, orgId int64, namespace string
 	return kv.store.Keys(ctx, orgId, namespace, typ)
 }
 
-func (kv *CachedKVStore) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string) error {
-	err := kv.store.Rename(ctx, orgId, namespace, typ, newNamespace)
+func (kv *CachedKVStore) Namespaces(ctx context.Context, orgId int64) ([]string, error) {
+	return kv.store.Namespaces(ctx, orgId)
+}
+
+func (kv *CachedKVStore) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
+	atomic.AddUint64(&kv.writes, 1)
+	err := kv.store.Rename(ctx, orgId, namespace, typ, newNamespace, overwrite)
+	// the new namespace may have held a secret, overwritten by the rename
+	kv.evict(cacheOpRename, orgId, namespace, typ)
+	kv.evict(cacheOpRename, orgId, newNamespace, typ)
 	if err != nil {
 		return err
 	}
-	key := fmt.Sprint(orgId, namespace, typ)
-	if value, ok := kv.cache.Get(key); ok {
-		newKey := fmt.Sprint(orgId, newNamespace, typ)
-		kv.cache.SetDefault(newKey, value)
-		kv.cache.Delete(key)
-	}
+	kv.publish(ctx, orgId, namespace, typ)
+	kv.publish(ctx, orgId, newNamespace, typ)
 	return nil
 }
 
@@ -0,0 +1,198 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/util"
+)
+
+const cacheInvalidationNamespace = "secrets_cache_invalidation"
+
+// CacheInvalidator lets the CachedKVStores of Grafana instances sharing a database
+// drop the cached values of the secrets changed by another instance.
+type CacheInvalidator interface {
+	// Publish notifies the other instances that the secret with the given key changed. A key without a type
+	// stands for every secret of its namespace, and one with the org id AllOrganizations for every organization.
+	Publish(ctx context.Context, key Key) error
+	// Invalidated returns the keys of the secrets changed by other instances since the previous call
+	Invalidated(ctx context.Context) ([]Key, error)
+}
+
+// CacheInvalidationChannel connects the CacheInvalidators of stores running in the same process
+type CacheInvalidationChannel struct {
+	mu      sync.Mutex
+	members []*channelCacheInvalidator
+}
+
+func NewCacheInvalidationChannel() *CacheInvalidationChannel {
+	return &CacheInvalidationChannel{}
+}
+
+// Join returns a CacheInvalidator receiving the keys published by the other members of the channel
+func (c *CacheInvalidationChannel) Join() CacheInvalidator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	member := &channelCacheInvalidator{channel: c}
+	c.members = append(c.members, member)
+	return member
+}
+
+type channelCacheInvalidator struct {
+	channel *CacheInvalidationChannel
+	pending []Key
+}
+
+func (i *channelCacheInvalidator) Publish(_ context.Context, key Key) error {
+	i.channel.mu.Lock()
+	defer i.channel.mu.Unlock()
+	for _, member := range i.channel.members {
+		if member != i {
+			member.pending = append(member.pending, key)
+		}
+	}
+	return nil
+}
+
+func (i *channelCacheInvalidator) Invalidated(_ context.Context) ([]Key, error) {
+	i.channel.mu.Lock()
+	defer i.channel.mu.Unlock()
+	keys := i.pending
+	i.pending = nil
+	return keys, nil
+}
+
+// dbCacheInvalidator appends a row to the kv_store table for every change of a secret. Every instance polls
+// the table, at most once per interval, for the changes made by the others. The rows are never updated, and
+// are pruned once they are older than retention: by then, the values cached before the change have expired.
+type dbCacheInvalidator struct {
+	mu         sync.Mutex
+	log        log.Logger
+	kvStore    *kvstore.NamespacedKVStore
+	instanceId string
+	interval   time.Duration
+	retention  time.Duration
+	lastPoll   time.Time
+	// published counts the changes of this instance, so that each has a row of its own
+	published uint64
+	// seen holds the rows already read, until they are pruned
+	seen map[string]bool
+}
+
+// NewDBCacheInvalidator returns a CacheInvalidator sharing the changes through the database. retention must be
+// longer than the secrets are cached for, and leave room for the clock differences between the instances.
+func NewDBCacheInvalidator(kv kvstore.KVStore, interval time.Duration, retention time.Duration) CacheInvalidator {
+	return &dbCacheInvalidator{
+		log:        log.New("secrets.kvstore.cache_invalidation"),
+		kvStore:    kvstore.WithNamespace(kv, 0, cacheInvalidationNamespace),
+		instanceId: util.GenerateShortUID(),
+		interval:   interval,
+		retention:  retention,
+		seen:       make(map[string]bool),
+	}
+}
+
+// changeRow returns the key of the row of a change, made of the time of the change so that old rows can be
+// pruned, the instance making it, and a counter keeping the rows of the changes of a same instance apart
+func changeRow(at time.Time, instanceId string, n uint64) string {
+	return fmt.Sprintf("%d/%s/%d", at.UnixNano(), instanceId, n)
+}
+
+// parseChangeRow returns the time and the instance of the change of a row
+func parseChangeRow(row string) (time.Time, string, error) {
+	parts := strings.SplitN(row, "/", 3)
+	if len(parts) != 3 {
+		return time.Time{}, "", fmt.Errorf("malformed cache invalidation row %q", row)
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("malformed cache invalidation row %q: %w", row, err)
+	}
+	return time.Unix(0, nanos), parts[1], nil
+}
+
+func (i *dbCacheInvalidator) Publish(ctx context.Context, key Key) error {
+	k, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.published++
+	row := changeRow(time.Now(), i.instanceId, i.published)
+	i.seen[row] = true
+	i.mu.Unlock()
+	return i.kvStore.Set(ctx, row, string(k))
+}
+
+// Invalidated reads the rows of the changes, the concurrent calls return without waiting for the query
+func (i *dbCacheInvalidator) Invalidated(ctx context.Context) ([]Key, error) {
+	i.mu.Lock()
+	if time.Since(i.lastPoll) < i.interval {
+		i.mu.Unlock()
+		return nil, nil
+	}
+	i.lastPoll = time.Now()
+	i.mu.Unlock()
+
+	all, err := i.kvStore.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows := all[0]
+
+	var keys []Key
+	var expired []string
+	oldest := time.Now().Add(-i.retention)
+	i.mu.Lock()
+	for row, k := range rows {
+		at, instanceId, err := parseChangeRow(row)
+		if err != nil {
+			i.mu.Unlock()
+			return nil, err
+		}
+		if at.Before(oldest) {
+			expired = append(expired, row)
+		}
+		if i.seen[row] {
+			continue
+		}
+		i.seen[row] = true
+		if instanceId == i.instanceId {
+			continue
+		}
+		var key Key
+		if err := json.Unmarshal([]byte(k), &key); err != nil {
+			i.mu.Unlock()
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	// the rows pruned by other instances are forgotten too
+	for row := range i.seen {
+		if _, ok := rows[row]; !ok {
+			if at, _, err := parseChangeRow(row); err == nil && at.Before(oldest) {
+				delete(i.seen, row)
+			}
+		}
+	}
+	i.mu.Unlock()
+
+	for _, row := range expired {
+		if err := i.kvStore.Del(ctx, row); err != nil {
+			// the row is pruned by a later poll, the changes read are still returned
+			i.log.Warn("failed to prune the secrets cache invalidation rows", "err", err)
+			break
+		}
+		i.mu.Lock()
+		delete(i.seen, row)
+		i.mu.Unlock()
+	}
+	return keys, nil
+}
@@ -0,0 +1,183 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/secrets/manager"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedKVStore_Invalidation(t *testing.T) {
+	ctx := context.Background()
+
+	// setup returns two cached stores sharing a database, as two Grafana instances would
+	setup := func(t *testing.T, invalidators func(sqlStore *sqlstore.SQLStore) (CacheInvalidator, CacheInvalidator)) (*CachedKVStore, *CachedKVStore) {
+		t.Helper()
+		sqlStore := sqlstore.InitTestDB(t)
+		secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+		a := WithCache(NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")), time.Minute, time.Minute)
+		b := WithCache(NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")), time.Minute, time.Minute)
+		if invalidators != nil {
+			invA, invB := invalidators(sqlStore)
+			a.WithInvalidator(invA)
+			b.WithInvalidator(invB)
+		}
+		require.NoError(t, a.Set(ctx, 1, "ns", "type", "old"))
+		require.NoError(t, a.Set(ctx, 1, "other", "type", "other"))
+		// cache the secrets on both instances
+		for _, kv := range []*CachedKVStore{a, b} {
+			for _, namespace := range []string{"ns", "other"} {
+				_, _, err := kv.Get(ctx, 1, namespace, "type")
+				require.NoError(t, err)
+			}
+		}
+		return a, b
+	}
+
+	channel := func(*sqlstore.SQLStore) (CacheInvalidator, CacheInvalidator) {
+		c := NewCacheInvalidationChannel()
+		return c.Join(), c.Join()
+	}
+	database := func(sqlStore *sqlstore.SQLStore) (CacheInvalidator, CacheInvalidator) {
+		kv := kvstore.ProvideService(sqlStore)
+		return NewDBCacheInvalidator(kv, 0, time.Hour), NewDBCacheInvalidator(kv, 0, time.Hour)
+	}
+
+	t.Run("without invalidation the other instance serves stale values", func(t *testing.T) {
+		a, b := setup(t, nil)
+		require.NoError(t, b.Set(ctx, 1, "ns", "type", "new"))
+		value, _, err := a.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.Equal(t, "old", value)
+	})
+
+	for name, invalidators := range map[string]func(*sqlstore.SQLStore) (CacheInvalidator, CacheInvalidator){
+		"channel":  channel,
+		"database": database,
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Run("set invalidates the other instance", func(t *testing.T) {
+				a, b := setup(t, invalidators)
+				require.NoError(t, b.Set(ctx, 1, "ns", "type", "new"))
+				value, _, err := a.Get(ctx, 1, "ns", "type")
+				require.NoError(t, err)
+				assert.Equal(t, "new", value)
+
+				// the other secrets stay cached
+				_, cached := a.cache.Get(cacheKey(1, "other", "type"))
+				assert.True(t, cached)
+			})
+
+			t.Run("del invalidates the other instance", func(t *testing.T) {
+				a, b := setup(t, invalidators)
+				require.NoError(t, b.Del(ctx, 1, "ns", "type"))
+				_, exists, err := a.Get(ctx, 1, "ns", "type")
+				require.NoError(t, err)
+				assert.False(t, exists)
+			})
+
+			t.Run("rename invalidates the other instance", func(t *testing.T) {
+				a, b := setup(t, invalidators)
+				require.NoError(t, b.Rename(ctx, 1, "ns", "type", "renamed", false))
+				_, exists, err := a.Get(ctx, 1, "ns", "type")
+				require.NoError(t, err)
+				assert.False(t, exists)
+				value, exists, err := a.Get(ctx, 1, "renamed", "type")
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, "old", value)
+			})
+
+			t.Run("an instance keeps its own changes cached", func(t *testing.T) {
+				a, _ := setup(t, invalidators)
+				require.NoError(t, a.Set(ctx, 1, "ns", "type", "new"))
+				_, _, err := a.Get(ctx, 1, "ns", "type")
+				require.NoError(t, err)
+				_, cached := a.cache.Get(cacheKey(1, "ns", "type"))
+				assert.True(t, cached)
+			})
+		})
+	}
+}
+
+func TestDBCacheInvalidator(t *testing.T) {
+	ctx := context.Background()
+	kv := kvstore.ProvideService(sqlstore.InitTestDB(t))
+	rows := func(t *testing.T) map[string]string {
+		t.Helper()
+		all, err := kvstore.WithNamespace(kv, 0, cacheInvalidationNamespace).GetAll(ctx)
+		require.NoError(t, err)
+		return all[0]
+	}
+
+	a := NewDBCacheInvalidator(kv, 0, 50*time.Millisecond)
+	b := NewDBCacheInvalidator(kv, 0, 50*time.Millisecond)
+	key := Key{OrgId: 1, Namespace: "ns", Type: "type"}
+
+	t.Run("every change is read once by the other instances", func(t *testing.T) {
+		require.NoError(t, a.Publish(ctx, key))
+		require.NoError(t, a.Publish(ctx, key))
+		assert.Len(t, rows(t), 2)
+
+		keys, err := b.Invalidated(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []Key{key, key}, keys)
+		keys, err = b.Invalidated(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+
+		keys, err = a.Invalidated(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, keys, "an instance doesn't read its own changes")
+	})
+
+	t.Run("the changes are pruned once older than the retention", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		require.NoError(t, b.Publish(ctx, key))
+		_, err := a.Invalidated(ctx)
+		require.NoError(t, err)
+		assert.Len(t, rows(t), 1, "only the recent change is kept")
+	})
+}
+
+func TestWithConfiguredCache(t *testing.T) {
+	cfg := setting.NewCfg()
+	cfg.Raw.Section("secrets").Key("cache_invalidation").SetValue("database")
+	kv := kvstore.ProvideService(sqlstore.InitTestDB(t))
+
+	cached, ok := withConfiguredCache(cfg, kv, NewInMemorySecretsKVStore()).(*CachedKVStore)
+	require.True(t, ok)
+	assert.NotNil(t, cached.invalidator)
+
+	cached, ok = withConfiguredCache(cfg, nil, NewInMemorySecretsKVStore()).(*CachedKVStore)
+	require.True(t, ok)
+	assert.Nil(t, cached.invalidator, "a store not shared with the other instances doesn't publish nor poll")
+}
+
+func TestCachedKVStore_RenameOverwrite(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySecretsKVStore()
+	cached := WithCache(store, time.Minute, time.Minute)
+
+	// only the overwritten secret is cached
+	require.NoError(t, store.Set(ctx, 1, "old", "type", "old value"))
+	require.NoError(t, cached.Set(ctx, 1, "taken", "type", "taken value"))
+
+	require.NoError(t, cached.Rename(ctx, 1, "old", "type", "taken", true))
+
+	_, exists, err := cached.Get(ctx, 1, "old", "type")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	value, exists, err := cached.Get(ctx, 1, "taken", "type")
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "old value", value)
+}
@@ -0,0 +1,146 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCachedKVStore(t *testing.T) {
+	ctx := context.Background()
+
+	get := func(t *testing.T, kv *FixedKVStore) string {
+		t.Helper()
+		value, ok, err := kv.Get(ctx)
+		require.NoError(t, err)
+		require.True(t, ok)
+		return value
+	}
+
+	t.Run("a set value is read back immediately", func(t *testing.T) {
+		secret := With(WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute), 1, "ns", "type")
+		require.NoError(t, secret.Set(ctx, "old"))
+		assert.Equal(t, "old", get(t, secret))
+		require.NoError(t, secret.Set(ctx, "new"))
+		assert.Equal(t, "new", get(t, secret))
+	})
+
+	t.Run("a deleted value is not read back", func(t *testing.T) {
+		secret := With(WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute), 1, "ns", "type")
+		require.NoError(t, secret.Set(ctx, "old"))
+		assert.Equal(t, "old", get(t, secret))
+		require.NoError(t, secret.Del(ctx))
+		_, ok, err := secret.Get(ctx)
+		require.NoError(t, err)
+		assert.False(t, ok)
+		exists, err := secret.Exists(ctx)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("a renamed value is read from its new namespace only", func(t *testing.T) {
+		cached := WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		secret := With(cached, 1, "ns", "type")
+		overwritten := With(cached, 1, "renamed", "type")
+		require.NoError(t, secret.Set(ctx, "moved"))
+		require.NoError(t, overwritten.Set(ctx, "overwritten"))
+		assert.Equal(t, "moved", get(t, secret))
+		assert.Equal(t, "overwritten", get(t, overwritten))
+
+		require.NoError(t, secret.Rename(ctx, "renamed", true))
+		assert.Equal(t, "moved", get(t, overwritten))
+		_, ok, err := cached.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("secrets whose org, namespace and type concatenate alike are cached apart", func(t *testing.T) {
+		cached := WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		secrets := []*FixedKVStore{
+			With(cached, 1, "1ns", "type"),
+			With(cached, 11, "ns", "type"),
+			With(cached, 11, "nst", "ype"),
+		}
+		for _, secret := range secrets {
+			require.NoError(t, secret.Set(ctx, secret.Namespace+"/"+secret.Type))
+		}
+		for _, secret := range secrets {
+			assert.Equal(t, secret.Namespace+"/"+secret.Type, get(t, secret))
+		}
+	})
+	t.Run("values deleted with their namespace are not read back", func(t *testing.T) {
+		cached := WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		deleted := []*FixedKVStore{With(cached, 1, "ns", "type1"), With(cached, 1, "ns", "type2"), With(cached, 2, "ns", "type1")}
+		kept := []*FixedKVStore{With(cached, 1, "ns2", "type1"), With(cached, 1, "n", "s/type1")}
+		for _, secret := range append(deleted, kept...) {
+			require.NoError(t, secret.Set(ctx, "value"))
+			assert.Equal(t, "value", get(t, secret))
+		}
+
+		require.NoError(t, cached.DelAll(ctx, AllOrganizations, "ns"))
+		for _, secret := range deleted {
+			_, ok, err := secret.Get(ctx)
+			require.NoError(t, err)
+			assert.False(t, ok)
+		}
+		for _, secret := range kept {
+			_, ok := cached.cache.Get(cacheKey(secret.OrgId, secret.Namespace, secret.Type))
+			assert.True(t, ok)
+		}
+	})
+	t.Run("many values are read from the cache and the store", func(t *testing.T) {
+		store := NewInMemorySecretsKVStore()
+		cached := WithCache(store, time.Minute, time.Minute)
+		require.NoError(t, cached.Set(ctx, 1, "ns", "cached", "old"))
+		require.NoError(t, store.Set(ctx, 1, "ns", "stored", "stored"))
+		// the cache is bypassed, the value served from the cache is the old one
+		require.NoError(t, store.Set(ctx, 1, "ns", "cached", "bypassed"))
+
+		values, err := cached.GetMany(ctx, 1, "ns", []string{"cached", "stored", "missing"})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"cached": "old", "stored": "stored"}, values)
+		_, ok := cached.cache.Get(cacheKey(1, "ns", "stored"))
+		assert.True(t, ok)
+	})
+}
+
+func TestCachedKVStore_Metrics(t *testing.T) {
+	ctx := context.Background()
+	count := func(counter *prometheus.CounterVec, operation string) float64 {
+		return testutil.ToFloat64(counter.WithLabelValues(operation))
+	}
+	hits, misses := count(cacheHitsCounter, cacheOpGet), count(cacheMissesCounter, cacheOpGet)
+	manyHits, manyMisses := count(cacheHitsCounter, cacheOpGetMany), count(cacheMissesCounter, cacheOpGetMany)
+	evictions := count(cacheEvictionsCounter, cacheOpDel)
+
+	store := NewInMemorySecretsKVStore()
+	require.NoError(t, store.Set(ctx, 1, "ns", "type", "value"))
+	cached := WithCache(store, time.Minute, time.Minute)
+	secret := With(cached, 1, "ns", "type")
+
+	_, _, err := secret.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, hits, count(cacheHitsCounter, cacheOpGet))
+	assert.Equal(t, misses+1, count(cacheMissesCounter, cacheOpGet))
+
+	_, _, err = secret.Get(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, hits+1, count(cacheHitsCounter, cacheOpGet))
+	assert.Equal(t, misses+1, count(cacheMissesCounter, cacheOpGet))
+
+	_, err = cached.GetMany(ctx, 1, "ns", []string{"type", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, manyHits+1, count(cacheHitsCounter, cacheOpGetMany))
+	assert.Equal(t, manyMisses+1, count(cacheMissesCounter, cacheOpGetMany))
+
+	require.NoError(t, secret.Del(ctx))
+	assert.Equal(t, evictions+1, count(cacheEvictionsCounter, cacheOpDel))
+	// nothing is left to evict
+	require.NoError(t, secret.Del(ctx))
+	assert.Equal(t, evictions+1, count(cacheEvictionsCounter, cacheOpDel))
+}
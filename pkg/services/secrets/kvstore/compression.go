@@ -0,0 +1,49 @@
+package kvstore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// gzipCompression tags the secrets whose value was compressed with gzip before being encrypted,
+// the secrets stored uncompressed have no compression
+const gzipCompression = "gzip"
+
+// compressValue compresses a value larger than threshold with gzip, returning the payload to encrypt and its
+// compression. A threshold of zero or less disables the compression, and a value that doesn't shrink is kept as is.
+func compressValue(value string, threshold int) ([]byte, string, error) {
+	if threshold <= 0 || len(value) <= threshold {
+		return []byte(value), "", nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write([]byte(value)); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	if buf.Len() >= len(value) {
+		return []byte(value), "", nil
+	}
+	return buf.Bytes(), gzipCompression, nil
+}
+
+// decompressValue returns the value of a decrypted payload stored with the given compression
+func decompressValue(payload []byte, compression string) ([]byte, error) {
+	switch compression {
+	case "":
+		return payload, nil
+	case gzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = r.Close() }()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown secret compression %q", compression)
+	}
+}
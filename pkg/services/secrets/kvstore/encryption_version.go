@@ -0,0 +1,75 @@
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+
+	"github.com/grafana/grafana/pkg/services/encryption"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+const (
+	// LegacyEncryptionVersion tags the secrets stored before their encryption version was recorded
+	LegacyEncryptionVersion = "legacy"
+
+	envelopeEncryptionVersionPrefix = "envelope/"
+	keyIdDelimiter                  = '#'
+	algorithmDelimiter              = '*'
+)
+
+// EncryptionVersion returns the version tag of a ciphertext produced by the secrets service:
+// the encryption algorithm, prefixed with "envelope/" when the value was encrypted with a data key.
+// The ciphertext only has to be parsed, not decrypted.
+func EncryptionVersion(ciphertext []byte) string {
+	version := ""
+	if len(ciphertext) > 0 && ciphertext[0] == keyIdDelimiter {
+		if end := bytes.IndexByte(ciphertext[1:], keyIdDelimiter); end != -1 {
+			version = envelopeEncryptionVersionPrefix
+			ciphertext = ciphertext[end+2:]
+		}
+	}
+	return version + encryptionAlgorithm(ciphertext)
+}
+
+// encryptionAlgorithm follows the encryption service: payloads without a valid algorithm
+// prefix were encrypted with the default algorithm, AES-CFB.
+func encryptionAlgorithm(payload []byte) string {
+	if len(payload) == 0 || payload[0] != algorithmDelimiter {
+		return encryption.AesCfb
+	}
+	end := bytes.IndexByte(payload[1:], algorithmDelimiter)
+	if end == -1 {
+		return encryption.AesCfb
+	}
+	algorithm, err := base64.RawStdEncoding.DecodeString(string(payload[1 : end+1]))
+	if err != nil || len(algorithm) == 0 {
+		return encryption.AesCfb
+	}
+	return string(algorithm)
+}
+
+// EncryptionVersionCount is the number of secrets encrypted with a given version
+type EncryptionVersionCount struct {
+	EncryptionVersion string
+	Count             int64
+}
+
+// EncryptionVersionCounts counts the secrets of an organization by encryption version, to find out how
+// many of them are left to re-encrypt after an encryption upgrade. To count the secrets of all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *SecretsKVStoreSQL) EncryptionVersionCounts(ctx context.Context, orgId int64) ([]EncryptionVersionCount, error) {
+	var counts []EncryptionVersionCount
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		query := dbSession.Table("secrets").Select("encryption_version, COUNT(*) AS count")
+		if orgId != AllOrganizations {
+			query.Where("org_id = ?", orgId)
+		}
+		return query.GroupBy("encryption_version").OrderBy("encryption_version").Find(&counts)
+	})
+	if err != nil {
+		kv.log.Error("error counting secrets by encryption version", "orgId", orgId, "err", err)
+		return nil, err
+	}
+	return counts, nil
+}
@@ -0,0 +1,95 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/secrets/manager"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptionVersion(t *testing.T) {
+	testCases := []struct {
+		desc       string
+		ciphertext string
+		expected   string
+	}{
+		{desc: "legacy encryption without algorithm", ciphertext: "salt1234ciphertext", expected: "aes-cfb"},
+		{desc: "legacy encryption with algorithm", ciphertext: "*YWVzLWdjbQ*ciphertext", expected: "aes-gcm"},
+		{desc: "legacy encryption with empty algorithm", ciphertext: "**ciphertext", expected: "aes-cfb"},
+		{desc: "envelope encryption without algorithm", ciphertext: "#a2V5#salt1234ciphertext", expected: "envelope/aes-cfb"},
+		{desc: "envelope encryption with algorithm", ciphertext: "#a2V5#*YWVzLWdjbQ*ciphertext", expected: "envelope/aes-gcm"},
+		{desc: "unterminated key id", ciphertext: "#a2V5salt1234ciphertext", expected: "aes-cfb"},
+		{desc: "empty ciphertext", ciphertext: "", expected: "aes-cfb"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			assert.Equal(t, tc.expected, EncryptionVersion([]byte(tc.ciphertext)))
+		})
+	}
+}
+
+func TestSecretsKVStoreSQL_EncryptionVersionCounts(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+
+	ctx := context.Background()
+
+	require.NoError(t, kv.Set(ctx, 1, "ns1", "datasource", "secret1"))
+	require.NoError(t, kv.Set(ctx, 1, "ns2", "datasource", "secret2"))
+	require.NoError(t, kv.Set(ctx, 2, "ns1", "datasource", "secret3"))
+
+	// rows written before the encryption version was recorded get the default value of the column
+	err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		now := time.Now()
+		for i, orgId := range []int64{1, 2, 2} {
+			if _, err := sess.Exec("INSERT INTO secrets (org_id, namespace, type, value, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+				orgId, "legacy", fmt.Sprintf("type%d", i), "", now, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("counts the secrets of an organization", func(t *testing.T) {
+		counts, err := kv.EncryptionVersionCounts(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, []EncryptionVersionCount{
+			{EncryptionVersion: "envelope/aes-cfb", Count: 2},
+			{EncryptionVersion: LegacyEncryptionVersion, Count: 1},
+		}, counts)
+	})
+
+	t.Run("counts the secrets of all organizations", func(t *testing.T) {
+		counts, err := kv.EncryptionVersionCounts(ctx, AllOrganizations)
+		require.NoError(t, err)
+		assert.Equal(t, []EncryptionVersionCount{
+			{EncryptionVersion: "envelope/aes-cfb", Count: 3},
+			{EncryptionVersion: LegacyEncryptionVersion, Count: 3},
+		}, counts)
+	})
+
+	t.Run("counts nothing for an organization without secrets", func(t *testing.T) {
+		counts, err := kv.EncryptionVersionCounts(ctx, 3)
+		require.NoError(t, err)
+		assert.Empty(t, counts)
+	})
+
+	t.Run("re-setting a secret updates its encryption version", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 2, "legacy", "type1", "new secret"))
+		counts, err := kv.EncryptionVersionCounts(ctx, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []EncryptionVersionCount{
+			{EncryptionVersion: "envelope/aes-cfb", Count: 2},
+			{EncryptionVersion: LegacyEncryptionVersion, Count: 1},
+		}, counts)
+	})
+}
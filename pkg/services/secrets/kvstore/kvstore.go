@@ -2,6 +2,8 @@ package kvstore
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/grafana/grafana/pkg/infra/kvstore"
@@ -15,10 +17,42 @@ import (
 )
 
 const (
-	// Wildcard to query all organizations
+	// Wildcard to query all organizations, honored by Keys, Namespaces and DelAll. The keys returned by Keys hold the
+	// org id of each secret. The methods reading or writing a single secret, like Get, take the org id of
+	// that secret: to read the secrets of all organizations, list their keys with Keys and get each one.
 	AllOrganizations = -1
+
+	// Default maximum size in bytes of a secret value for each backend
+	defaultSQLMaxValueSize    = 16 << 20
+	defaultPluginMaxValueSize = maxPluginSecretValueSize
+	// defaultCacheExpiration is how long a secret is cached unless `cache_expiration` is set
+	defaultCacheExpiration = 5 * time.Second
+	// defaultCacheCleanupInterval is how often the expired secrets are removed from the cache unless
+	// `cache_cleanup_interval` is set
+	defaultCacheCleanupInterval = 5 * time.Minute
+)
+
+var (
+	ErrSecretValueTooLarge = errors.New("secret value is too large")
+	// ErrSecretAlreadyExists is returned when renaming a secret to the namespace of another secret
+	ErrSecretAlreadyExists = errors.New("secret already exists")
+	// ErrSecretExpiryNotSupported is returned by SetWithTTL when the store can't expire secrets
+	ErrSecretExpiryNotSupported = errors.New("expiring secrets are not supported by the store")
 )
 
+// checkValueSize returns ErrSecretValueTooLarge when value is larger than limit.
+// A limit of zero or less means values of any size are accepted.
+func checkValueSize(backend string, limit int, value string) error {
+	if limit > 0 && len(value) > limit {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes of the %s backend", ErrSecretValueTooLarge, len(value), limit, backend)
+	}
+	return nil
+}
+
+func secretAlreadyExistsError(orgId int64, namespace string, typ string) error {
+	return fmt.Errorf("%w (orgId=%d, namespace=%s, type=%s)", ErrSecretAlreadyExists, orgId, namespace, typ)
+}
+
 func ProvideService(
 	sqlStore sqlstore.Store,
 	secretsService secrets.Service,
@@ -30,7 +64,12 @@ func ProvideService(
 	var logger = log.New("secrets.kvstore")
 	var store SecretsKVStore
 	ctx := context.Background()
-	store = NewSQLSecretsKVStore(sqlStore, secretsService, logger)
+	section := cfg.SectionWithEnvOverrides("secrets")
+	maxCacheEntries := section.Key("decryption_cache_max_entries").MustInt(0)
+	sqlStoreImpl := NewSQLSecretsKVStoreWithCacheSize(sqlStore, secretsService, logger, maxCacheEntries)
+	sqlStoreImpl.SetMaxValueSize(section.Key("sql_max_value_size").MustInt(defaultSQLMaxValueSize))
+	sqlStoreImpl.SetCompressionThreshold(section.Key("sql_compression_threshold").MustInt(0))
+	store = sqlStoreImpl
 	err := EvaluateRemoteSecretsPlugin(ctx, pluginsManager, cfg)
 	if err != nil {
 		logger.Debug("secrets manager evaluator returned false", "reason", err.Error())
@@ -53,7 +92,19 @@ func ProvideService(
 			// as the plugin is installed, SecretsKVStoreSQL is now replaced with
 			// an instance of SecretsKVStorePlugin with the sql store as a fallback
 			// (used for migration and in case a secret is not found).
-			store = NewPluginSecretsKVStore(secretsPlugin, secretsService, namespacedKVStore, features, WithCache(store, 5*time.Second, 5*time.Minute), logger)
+			// only the outer store shares its changes with the other instances, the fallback is cached on its own
+			pluginStore := NewPluginSecretsKVStore(secretsPlugin, secretsService, namespacedKVStore, features, withConfiguredCache(cfg, nil, store), logger)
+			maxValueSize := section.Key("plugin_max_value_size").MustInt(defaultPluginMaxValueSize)
+			if maxValueSize > maxPluginSecretValueSize {
+				return nil, fmt.Errorf("secrets.plugin_max_value_size is %d bytes, above the %d bytes the plugin may return", maxValueSize, maxPluginSecretValueSize)
+			}
+			pluginStore.SetMaxValueSize(maxValueSize)
+			pluginStore.SetCallTimeout(section.Key("plugin_call_timeout").MustDuration(defaultPluginCallTimeout))
+			if section.Key("plugin_read_fallback").MustBool(false) {
+				logger.Warn("secrets the plugin fails to get are read from the database")
+				pluginStore.SetReadFallback(true)
+			}
+			store = pluginStore
 		}
 	}
 
@@ -61,16 +112,57 @@ func ProvideService(
 		logger.Debug("secrets kvstore is using the default (SQL) implementation for secrets management")
 	}
 
-	return WithCache(store, 5*time.Second, 5*time.Minute), nil
+	return withConfiguredCache(cfg, kvstore, store), nil
+}
+
+// withConfiguredCache wraps store in a CachedKVStore, which shares the changes of secrets with
+// the other Grafana instances through the database when `cache_invalidation` is set to `database`
+// and kv is not nil. The secrets are cached for `cache_expiration`, the store is returned as is when it is zero.
+func withConfiguredCache(cfg *setting.Cfg, kv kvstore.KVStore, store SecretsKVStore) SecretsKVStore {
+	section := cfg.SectionWithEnvOverrides("secrets")
+	expiration := section.Key("cache_expiration").MustDuration(defaultCacheExpiration)
+	if expiration <= 0 {
+		return store
+	}
+	cached := WithCache(store, expiration, section.Key("cache_cleanup_interval").MustDuration(defaultCacheCleanupInterval))
+	if kv != nil && section.Key("cache_invalidation").MustString("") == "database" {
+		interval := section.Key("cache_invalidation_interval").MustDuration(time.Second)
+		// the changes are kept until the values cached before them have expired, with a margin for the clocks
+		cached.WithInvalidator(NewDBCacheInvalidator(kv, interval, expiration+interval+time.Minute))
+	}
+	return cached
 }
 
 // SecretsKVStore is an interface for k/v store.
 type SecretsKVStore interface {
 	Get(ctx context.Context, orgId int64, namespace string, typ string) (string, bool, error)
+	// GetMany gets the secrets of the given types in a namespace, by type. The types without a secret are left out.
+	GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error)
+	// Exists reports whether a secret is stored, without decrypting it
+	Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error)
 	Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error
+	// SetWithTTL sets a secret that is no longer returned once ttl has elapsed, as if it was deleted.
+	// Setting the secret again with Set makes it never expire.
+	SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error
+	// CompareAndSwap sets a secret to newValue only if its value is oldValue, and reports whether it was set.
+	// A missing or expired secret matches no value, and the swapped secret never expires.
+	CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error)
+	// SetIfAbsent sets a secret only if it is missing or expired, and reports whether it was set.
+	// The set secret never expires.
+	SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error)
 	Del(ctx context.Context, orgId int64, namespace string, typ string) error
+	// DelAll deletes the secrets of every type in a namespace. To delete them in all
+	// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+	DelAll(ctx context.Context, orgId int64, namespace string) error
+	// Keys lists the keys of the secrets of a type in a namespace. To list them in all
+	// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
 	Keys(ctx context.Context, orgId int64, namespace string, typ string) ([]Key, error)
-	Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string) error
+	// Namespaces lists the namespaces holding a secret of any type, in order. To list them in all
+	// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+	Namespaces(ctx context.Context, orgId int64) ([]string, error)
+	// Rename moves a secret to newNamespace. It returns ErrSecretAlreadyExists if a secret of the same type
+	// exists in newNamespace, unless overwrite is true, in which case that secret is replaced.
+	Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error
 	GetAll(ctx context.Context) ([]Item, error)
 }
 
@@ -96,20 +188,71 @@ func (kv *FixedKVStore) Get(ctx context.Context) (string, bool, error) {
 	return kv.kvStore.Get(ctx, kv.OrgId, kv.Namespace, kv.Type)
 }
 
+func (kv *FixedKVStore) Exists(ctx context.Context) (bool, error) {
+	return kv.kvStore.Exists(ctx, kv.OrgId, kv.Namespace, kv.Type)
+}
+
 func (kv *FixedKVStore) Set(ctx context.Context, value string) error {
 	return kv.kvStore.Set(ctx, kv.OrgId, kv.Namespace, kv.Type, value)
 }
 
+func (kv *FixedKVStore) SetWithTTL(ctx context.Context, value string, ttl time.Duration) error {
+	return kv.kvStore.SetWithTTL(ctx, kv.OrgId, kv.Namespace, kv.Type, value, ttl)
+}
+
+func (kv *FixedKVStore) CompareAndSwap(ctx context.Context, oldValue string, newValue string) (bool, error) {
+	return kv.kvStore.CompareAndSwap(ctx, kv.OrgId, kv.Namespace, kv.Type, oldValue, newValue)
+}
+
+func (kv *FixedKVStore) SetIfAbsent(ctx context.Context, value string) (bool, error) {
+	return kv.kvStore.SetIfAbsent(ctx, kv.OrgId, kv.Namespace, kv.Type, value)
+}
+
+// Update sets the secret to the value returned by fn for its current value. The secret is only set if it wasn't
+// changed since it was read, otherwise it is read again and fn is called with the new value, so fn may be called
+// more than once. A missing secret is created with SetIfAbsent, so a secret created concurrently is not overwritten.
+func (kv *FixedKVStore) Update(ctx context.Context, fn func(old string, exists bool) (string, error)) error {
+	for {
+		old, exists, err := kv.Get(ctx)
+		if err != nil {
+			return err
+		}
+		value, err := fn(old, exists)
+		if err != nil {
+			return err
+		}
+		var swapped bool
+		if exists {
+			swapped, err = kv.CompareAndSwap(ctx, old, value)
+		} else {
+			swapped, err = kv.SetIfAbsent(ctx, value)
+		}
+		if err != nil || swapped {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
 func (kv *FixedKVStore) Del(ctx context.Context) error {
 	return kv.kvStore.Del(ctx, kv.OrgId, kv.Namespace, kv.Type)
 }
 
+// DelAll deletes the secrets of every type in the namespace of kv, not only the secret of its type
+func (kv *FixedKVStore) DelAll(ctx context.Context) error {
+	return kv.kvStore.DelAll(ctx, kv.OrgId, kv.Namespace)
+}
+
 func (kv *FixedKVStore) Keys(ctx context.Context) ([]Key, error) {
 	return kv.kvStore.Keys(ctx, kv.OrgId, kv.Namespace, kv.Type)
 }
 
-func (kv *FixedKVStore) Rename(ctx context.Context, newNamespace string) error {
-	err := kv.kvStore.Rename(ctx, kv.OrgId, kv.Namespace, kv.Type, newNamespace)
+// Rename moves the secret to newNamespace, failing with ErrSecretAlreadyExists if it is taken unless overwrite
+// is true. The store only follows the secret to newNamespace once it was renamed.
+func (kv *FixedKVStore) Rename(ctx context.Context, newNamespace string, overwrite bool) error {
+	err := kv.kvStore.Rename(ctx, kv.OrgId, kv.Namespace, kv.Type, newNamespace, overwrite)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,180 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/secrets/manager"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/ini.v1"
+)
+
+func TestFixedKVStore_Update(t *testing.T) {
+	ctx := context.Background()
+	increment := func(old string, exists bool) (string, error) {
+		if !exists {
+			return "1", nil
+		}
+		n, err := strconv.Atoi(old)
+		return strconv.Itoa(n + 1), err
+	}
+	get := func(t *testing.T, kv *FixedKVStore) string {
+		t.Helper()
+		value, exists, err := kv.Get(ctx)
+		require.NoError(t, err)
+		require.True(t, exists)
+		return value
+	}
+
+	t.Run("a missing secret is created", func(t *testing.T) {
+		kv := With(NewInMemorySecretsKVStore(), 1, "ns", "counter")
+		require.NoError(t, kv.Update(ctx, increment))
+		assert.Equal(t, "1", get(t, kv))
+	})
+
+	t.Run("an error of the callback leaves the secret unchanged", func(t *testing.T) {
+		kv := With(NewInMemorySecretsKVStore(), 1, "ns", "counter")
+		require.NoError(t, kv.Set(ctx, "1"))
+		err := kv.Update(ctx, func(string, bool) (string, error) {
+			return "2", errors.New("mocked update error")
+		})
+		require.EqualError(t, err, "mocked update error")
+		assert.Equal(t, "1", get(t, kv))
+	})
+
+	const updates = 50
+	concurrentUpdates := func(t *testing.T, kv *FixedKVStore) {
+		t.Helper()
+		var wg sync.WaitGroup
+		errs := make(chan error, updates)
+		for i := 0; i < updates; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- kv.Update(ctx, increment)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("concurrent updates are all applied", func(t *testing.T) {
+		kv := With(NewInMemorySecretsKVStore(), 1, "ns", "counter")
+		require.NoError(t, kv.Set(ctx, "0"))
+		concurrentUpdates(t, kv)
+		assert.Equal(t, strconv.Itoa(updates), get(t, kv))
+	})
+
+	t.Run("concurrent updates of a missing secret are all applied", func(t *testing.T) {
+		kv := With(NewInMemorySecretsKVStore(), 1, "ns", "counter")
+		concurrentUpdates(t, kv)
+		assert.Equal(t, strconv.Itoa(updates), get(t, kv))
+	})
+}
+
+func TestFixedKVStore_Rename(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(t *testing.T) (*FixedKVStore, SecretsKVStore) {
+		store := NewInMemorySecretsKVStore()
+		require.NoError(t, store.Set(ctx, 1, "old", "type", "old value"))
+		require.NoError(t, store.Set(ctx, 1, "taken", "type", "taken value"))
+		return With(store, 1, "old", "type"), store
+	}
+	value := func(t *testing.T, store SecretsKVStore, namespace string) string {
+		t.Helper()
+		value, exists, err := store.Get(ctx, 1, namespace, "type")
+		require.NoError(t, err)
+		require.True(t, exists)
+		return value
+	}
+
+	t.Run("a clean rename moves the secret and the store", func(t *testing.T) {
+		kv, store := newStore(t)
+		require.NoError(t, kv.Rename(ctx, "new", false))
+		assert.Equal(t, "new", kv.Namespace)
+		assert.Equal(t, "old value", value(t, store, "new"))
+	})
+
+	t.Run("a rename to a taken namespace fails and leaves the store as is", func(t *testing.T) {
+		kv, store := newStore(t)
+		err := kv.Rename(ctx, "taken", false)
+		require.ErrorIs(t, err, ErrSecretAlreadyExists)
+		assert.Equal(t, "old", kv.Namespace)
+		assert.Equal(t, "old value", value(t, store, "old"))
+		assert.Equal(t, "taken value", value(t, store, "taken"))
+	})
+
+	t.Run("a rename with overwrite replaces the other secret", func(t *testing.T) {
+		kv, store := newStore(t)
+		require.NoError(t, kv.Rename(ctx, "taken", true))
+		assert.Equal(t, "taken", kv.Namespace)
+		assert.Equal(t, "old value", value(t, store, "taken"))
+	})
+}
+
+func TestProvideService_CacheConfig(t *testing.T) {
+	ctx := context.Background()
+	provide := func(t *testing.T, rawCfg string) (SecretsKVStore, *sqlstore.SQLStore) {
+		t.Helper()
+		raw, err := ini.Load([]byte(rawCfg))
+		require.NoError(t, err)
+		sqlStore := sqlstore.InitTestDB(t)
+		secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+		store, err := ProvideService(sqlStore, secretsService, NewFakeSecretsPluginManager(t, false), kvstore.ProvideService(sqlStore), NewFakeFeatureToggles(t, false), &setting.Cfg{Raw: raw})
+		require.NoError(t, err)
+		return store, sqlStore
+	}
+
+	// cachedFor returns how long a secret read from the store stays in its cache
+	cachedFor := func(t *testing.T, store SecretsKVStore) time.Duration {
+		t.Helper()
+		require.IsType(t, &CachedKVStore{}, store)
+		require.NoError(t, store.Set(ctx, 1, "ns", "type", "value"))
+		_, _, err := store.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		item, ok := store.(*CachedKVStore).cache.Items()[cacheKey(1, "ns", "type")]
+		require.True(t, ok)
+		return time.Until(time.Unix(0, item.Expiration))
+	}
+
+	t.Run("the secrets are cached by default", func(t *testing.T) {
+		store, _ := provide(t, "")
+		assert.InDelta(t, defaultCacheExpiration, cachedFor(t, store), float64(time.Second))
+	})
+
+	t.Run("the cache expiration can be configured", func(t *testing.T) {
+		store, _ := provide(t, "[secrets]\ncache_expiration = 1h\ncache_cleanup_interval = 2h")
+		assert.InDelta(t, time.Hour, cachedFor(t, store), float64(time.Second))
+	})
+
+	t.Run("a zero expiration disables the cache", func(t *testing.T) {
+		store, sqlStore := provide(t, "[secrets]\ncache_expiration = 0")
+		require.IsType(t, &SecretsKVStoreSQL{}, store)
+
+		require.NoError(t, store.Set(ctx, 1, "ns", "type", "value"))
+		value, exists, err := store.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Equal(t, "value", value)
+
+		// a change made by another instance is seen right away
+		other := NewSQLSecretsKVStore(sqlStore, manager.SetupTestService(t, fakes.NewFakeSecretsStore()), log.New("test.logger"))
+		require.NoError(t, other.Del(ctx, 1, "ns", "type"))
+		_, exists, err = store.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
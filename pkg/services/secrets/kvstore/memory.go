@@ -0,0 +1,225 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InMemorySecretsKVStore is a thread-safe in-memory SecretsKVStore meant to be used in tests.
+// Like the SQL store, keys and items are returned in the order they were first stored.
+type InMemorySecretsKVStore struct {
+	mu     sync.RWMutex
+	items  map[Key]*Item
+	nextId int64
+}
+
+func NewInMemorySecretsKVStore() *InMemorySecretsKVStore {
+	return &InMemorySecretsKVStore{items: make(map[Key]*Item)}
+}
+
+var _ SecretsKVStore = &InMemorySecretsKVStore{}
+
+// Get an item from the store
+func (kv *InMemorySecretsKVStore) Get(ctx context.Context, orgId int64, namespace string, typ string) (string, bool, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	item, ok := kv.items[buildKey(orgId, namespace, typ)]
+	if !ok || item.expired(time.Now()) {
+		return "", false, nil
+	}
+	return item.Value, true, nil
+}
+
+// GetMany gets the items of the given types in a namespace
+func (kv *InMemorySecretsKVStore) GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	values := make(map[string]string, len(typs))
+	now := time.Now()
+	for _, typ := range typs {
+		if item, ok := kv.items[buildKey(orgId, namespace, typ)]; ok && !item.expired(now) {
+			values[typ] = item.Value
+		}
+	}
+	return values, nil
+}
+
+// Exists reports whether an item is in the store
+func (kv *InMemorySecretsKVStore) Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	item, ok := kv.items[buildKey(orgId, namespace, typ)]
+	return ok && !item.expired(time.Now()), nil
+}
+
+// Set an item in the store
+func (kv *InMemorySecretsKVStore) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
+	kv.set(orgId, namespace, typ, value, nil)
+	return nil
+}
+
+// SetWithTTL sets an item in the store that expires after ttl
+func (kv *InMemorySecretsKVStore) SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %s for secret (orgId=%d, namespace=%s, type=%s)", ttl, orgId, namespace, typ)
+	}
+	expiresAt := time.Now().Add(ttl)
+	kv.set(orgId, namespace, typ, value, &expiresAt)
+	return nil
+}
+
+func (kv *InMemorySecretsKVStore) set(orgId int64, namespace string, typ string, value string, expiresAt *time.Time) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.setLocked(orgId, namespace, typ, value, expiresAt)
+}
+
+// setLocked sets an item, kv.mu must be held
+func (kv *InMemorySecretsKVStore) setLocked(orgId int64, namespace string, typ string, value string, expiresAt *time.Time) {
+	k := buildKey(orgId, namespace, typ)
+	now := time.Now()
+	if item, ok := kv.items[k]; ok {
+		item.Value = value
+		item.ExpiresAt = expiresAt
+		item.Updated = now
+		return
+	}
+	kv.nextId++
+	kv.items[k] = &Item{
+		Id:        kv.nextId,
+		OrgId:     &k.OrgId,
+		Namespace: &k.Namespace,
+		Type:      &k.Type,
+		Value:     value,
+		ExpiresAt: expiresAt,
+		Created:   now,
+		Updated:   now,
+	}
+}
+
+// CompareAndSwap sets an item to newValue only if its value is oldValue
+func (kv *InMemorySecretsKVStore) CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	item, ok := kv.items[buildKey(orgId, namespace, typ)]
+	if !ok || item.expired(time.Now()) || item.Value != oldValue {
+		return false, nil
+	}
+	item.Value = newValue
+	item.ExpiresAt = nil
+	item.Updated = time.Now()
+	return true, nil
+}
+
+// SetIfAbsent sets an item only if it is missing or expired
+func (kv *InMemorySecretsKVStore) SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if item, ok := kv.items[buildKey(orgId, namespace, typ)]; ok && !item.expired(time.Now()) {
+		return false, nil
+	}
+	kv.setLocked(orgId, namespace, typ, value, nil)
+	return true, nil
+}
+
+// Del deletes an item from the store.
+func (kv *InMemorySecretsKVStore) Del(ctx context.Context, orgId int64, namespace string, typ string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	delete(kv.items, buildKey(orgId, namespace, typ))
+	return nil
+}
+
+// DelAll deletes the items of every type in a namespace. To delete them in all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *InMemorySecretsKVStore) DelAll(ctx context.Context, orgId int64, namespace string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	for k := range kv.items {
+		if k.Namespace == namespace && (orgId == AllOrganizations || k.OrgId == orgId) {
+			delete(kv.items, k)
+		}
+	}
+	return nil
+}
+
+// Keys get all keys for a given namespace and type, expired items aside. To query for all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *InMemorySecretsKVStore) Keys(ctx context.Context, orgId int64, namespace string, typ string) ([]Key, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	now := time.Now()
+	keys := make([]Key, 0)
+	for _, item := range kv.sortedItems() {
+		if *item.Namespace != namespace || *item.Type != typ || item.expired(now) {
+			continue
+		}
+		if orgId != AllOrganizations && *item.OrgId != orgId {
+			continue
+		}
+		keys = append(keys, buildKey(*item.OrgId, *item.Namespace, *item.Type))
+	}
+	return keys, nil
+}
+
+// Namespaces lists the namespaces holding an item of any type. To list them in all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *InMemorySecretsKVStore) Namespaces(ctx context.Context, orgId int64) ([]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	now := time.Now()
+	items := make([]Item, 0, len(kv.items))
+	for _, item := range kv.items {
+		if !item.expired(now) {
+			items = append(items, *item)
+		}
+	}
+	return itemNamespaces(items, orgId), nil
+}
+
+// Rename an item in the store, renaming a missing item does nothing
+func (kv *InMemorySecretsKVStore) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	k := buildKey(orgId, namespace, typ)
+	item, ok := kv.items[k]
+	if !ok || namespace == newNamespace {
+		return nil
+	}
+	newKey := buildKey(orgId, newNamespace, typ)
+	if target, exists := kv.items[newKey]; exists && !target.expired(time.Now()) && !overwrite {
+		return secretAlreadyExistsError(orgId, newNamespace, typ)
+	}
+	delete(kv.items, k)
+	item.Namespace = &newKey.Namespace
+	item.Updated = time.Now()
+	kv.items[newKey] = item
+	return nil
+}
+
+// GetAll returns a copy of all the items in the store
+func (kv *InMemorySecretsKVStore) GetAll(ctx context.Context) ([]Item, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	items := make([]Item, 0, len(kv.items))
+	for _, item := range kv.sortedItems() {
+		orgId, namespace, typ := *item.OrgId, *item.Namespace, *item.Type
+		copied := *item
+		copied.OrgId, copied.Namespace, copied.Type = &orgId, &namespace, &typ
+		items = append(items, copied)
+	}
+	return items, nil
+}
+
+// sortedItems returns the items in insertion order, callers must hold the lock
+func (kv *InMemorySecretsKVStore) sortedItems() []*Item {
+	items := make([]*Item, 0, len(kv.items))
+	for _, item := range kv.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+	return items
+}
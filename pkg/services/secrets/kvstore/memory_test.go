@@ -0,0 +1,108 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemorySecretsKVStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("set, get and delete", func(t *testing.T) {
+		kv := NewInMemorySecretsKVStore()
+		require.NoError(t, kv.Set(ctx, 1, "ns", "type", "value"))
+
+		value, ok, err := kv.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", value)
+
+		require.NoError(t, kv.Set(ctx, 1, "ns", "type", "updated"))
+		value, _, err = kv.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.Equal(t, "updated", value)
+
+		require.NoError(t, kv.Del(ctx, 1, "ns", "type"))
+		_, ok, err = kv.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("keys are listed in insertion order and honor all organizations", func(t *testing.T) {
+		kv := NewInMemorySecretsKVStore()
+		require.NoError(t, kv.Set(ctx, 2, "ns", "type", "v"))
+		require.NoError(t, kv.Set(ctx, 1, "ns", "type", "v"))
+		require.NoError(t, kv.Set(ctx, 1, "other", "type", "v"))
+
+		keys, err := kv.Keys(ctx, AllOrganizations, "ns", "type")
+		require.NoError(t, err)
+		assert.Equal(t, []Key{{OrgId: 2, Namespace: "ns", Type: "type"}, {OrgId: 1, Namespace: "ns", Type: "type"}}, keys)
+
+		keys, err = kv.Keys(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.Equal(t, []Key{{OrgId: 1, Namespace: "ns", Type: "type"}}, keys)
+	})
+
+	t.Run("expired items are not listed", func(t *testing.T) {
+		kv := NewInMemorySecretsKVStore()
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "ns", "expired", "v", time.Millisecond))
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "ns", "live", "v", time.Hour))
+		time.Sleep(10 * time.Millisecond)
+
+		keys, err := kv.Keys(ctx, 1, "ns", "expired")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+		keys, err = kv.Keys(ctx, 1, "ns", "live")
+		require.NoError(t, err)
+		assert.Equal(t, []Key{{OrgId: 1, Namespace: "ns", Type: "live"}}, keys)
+	})
+
+	t.Run("rename moves the item", func(t *testing.T) {
+		kv := NewInMemorySecretsKVStore()
+		require.NoError(t, kv.Set(ctx, 1, "ns", "type", "value"))
+		require.NoError(t, kv.Rename(ctx, 1, "ns", "type", "renamed", false))
+
+		_, ok, err := kv.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		value, ok, err := kv.Get(ctx, 1, "renamed", "type")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "value", value)
+
+		items, err := kv.GetAll(ctx)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		assert.Equal(t, "renamed", *items[0].Namespace)
+
+		require.NoError(t, kv.Rename(ctx, 1, "missing", "type", "other", false))
+	})
+
+	t.Run("concurrent access", func(t *testing.T) {
+		kv := NewInMemorySecretsKVStore()
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				ns := fmt.Sprintf("ns-%d", i)
+				assert.NoError(t, kv.Set(ctx, 1, ns, "type", "value"))
+				_, _, err := kv.Get(ctx, 1, ns, "type")
+				assert.NoError(t, err)
+				_, err = kv.GetAll(ctx)
+				assert.NoError(t, err)
+			}(i)
+		}
+		wg.Wait()
+
+		items, err := kv.GetAll(ctx)
+		require.NoError(t, err)
+		assert.Len(t, items, 20)
+	})
+}
@@ -0,0 +1,61 @@
+package kvstore
+
+import (
+	"github.com/grafana/grafana/pkg/infra/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	decryptionCacheEvictionsCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "secrets_kvstore_decryption_cache_evictions_total",
+			Help:      "A counter for secrets evicted from the decryption cache because it reached its maximum size",
+		},
+	)
+
+	cacheHitsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "secrets_kvstore_cache_hits_total",
+			Help:      "A counter for secrets read from the cache of the cached secrets store, by operation",
+		},
+		[]string{"operation"},
+	)
+
+	cacheMissesCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "secrets_kvstore_cache_misses_total",
+			Help:      "A counter for secrets missing from the cache of the cached secrets store and read from the store, by operation",
+		},
+		[]string{"operation"},
+	)
+
+	cacheEvictionsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "secrets_kvstore_cache_evictions_total",
+			Help:      "A counter for secrets removed from the cache of the cached secrets store because they changed, by operation",
+		},
+		[]string{"operation"},
+	)
+
+	pluginHealthCheckFailuresCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metrics.ExporterName,
+			Name:      "secrets_kvstore_plugin_health_check_failures_total",
+			Help:      "A counter for the failed health checks of the secrets management plugin",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		decryptionCacheEvictionsCounter,
+		cacheHitsCounter,
+		cacheMissesCounter,
+		cacheEvictionsCounter,
+		pluginHealthCheckFailuresCounter,
+	)
+}
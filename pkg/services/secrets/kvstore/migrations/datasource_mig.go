@@ -2,12 +2,22 @@ package migrations
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/services/datasources"
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
 	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/grafana/grafana/pkg/util"
 )
 
 const (
@@ -17,27 +27,105 @@ const (
 	compatibleSecretMigrationValue = "compatible"
 	// Migration happened with disableSecretCompatibility set to true
 	completeSecretMigrationValue = "complete"
+	// JsonData flag set on each data source whose secrets have been migrated
+	dataSourceMigrationCompleteKey = "secretMigrationComplete"
+	// Number of data sources between two logs of the migration progress
+	dataSourceMigrationProgressInterval = 100
 )
 
 type DataSourceSecretMigrationService struct {
 	dataSourcesService datasources.DataSourceService
+	secretsStore       secretskvs.SecretsKVStore
+	secretsService     secrets.Service
 	kvStore            *kvstore.NamespacedKVStore
 	features           featuremgmt.FeatureToggles
+
+	// continueOnError makes the migration log and record failing data sources instead of aborting
+	continueOnError bool
+	// failedDataSourcesFile is where the uids of data sources that failed to migrate are recorded
+	failedDataSourcesFile string
+	// retryFailed restricts the migration to the data sources listed in failedDataSourcesFile
+	retryFailed bool
+	// reportFile is where a JSON report of the outcome for each data source is written
+	reportFile string
+	// dataSourceTypes restricts the migration to the data sources of these types, all types are migrated when empty
+	dataSourceTypes map[string]bool
+}
+
+// dataSourceMigrationReport is the JSON report written to reportFile after a migration run
+type dataSourceMigrationReport struct {
+	DataSources []dataSourceMigrationResult `json:"datasources"`
+}
+
+type dataSourceMigrationResult struct {
+	Uid   string `json:"uid"`
+	Name  string `json:"name"`
+	OrgId int64  `json:"orgId"`
+	// Migrated is true when the data source secrets were migrated by this run, false when a previous run already did
+	Migrated             bool   `json:"migrated"`
+	LegacySecretsDeleted bool   `json:"legacySecretsDeleted"`
+	Error                string `json:"error,omitempty"`
+}
+
+func (r *dataSourceMigrationReport) add(ds *datasources.DataSource, migrated bool, legacySecretsDeleted bool, err error) {
+	result := dataSourceMigrationResult{
+		Uid:                  ds.Uid,
+		Name:                 ds.Name,
+		OrgId:                ds.OrgId,
+		Migrated:             migrated,
+		LegacySecretsDeleted: legacySecretsDeleted,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.DataSources = append(r.DataSources, result)
 }
 
 func ProvideDataSourceMigrationService(
+	cfg *setting.Cfg,
 	dataSourcesService datasources.DataSourceService,
+	secretsStore secretskvs.SecretsKVStore,
+	secretsService secrets.Service,
 	kvStore kvstore.KVStore,
 	features featuremgmt.FeatureToggles,
 ) *DataSourceSecretMigrationService {
+	section := cfg.SectionWithEnvOverrides("secrets")
+	dataSourceTypes := make(map[string]bool)
+	for _, typ := range util.SplitString(section.Key("migration_datasource_types").MustString("")) {
+		dataSourceTypes[typ] = true
+	}
 	return &DataSourceSecretMigrationService{
-		dataSourcesService: dataSourcesService,
-		kvStore:            kvstore.WithNamespace(kvStore, 0, secretskvs.DataSourceSecretType),
-		features:           features,
+		dataSourcesService:    dataSourcesService,
+		secretsStore:          secretsStore,
+		secretsService:        secretsService,
+		kvStore:               kvstore.WithNamespace(kvStore, 0, secretskvs.DataSourceSecretType),
+		features:              features,
+		continueOnError:       section.Key("migration_continue_on_error").MustBool(false),
+		failedDataSourcesFile: section.Key("migration_failed_datasources_file").MustString(""),
+		retryFailed:           section.Key("migration_retry_failed").MustBool(false),
+		reportFile:            section.Key("migration_report_file").MustString(""),
+		dataSourceTypes:       dataSourceTypes,
 	}
 }
 
-func (s *DataSourceSecretMigrationService) Migrate(ctx context.Context) error {
+// Migrate migrates the secrets of the data sources one at a time. Each data source is updated in a transaction
+// of its own, so a failure leaves the data sources migrated before it migrated and a later run resumes with the others.
+// Once the migration status records a complete migration, the data sources are not read again.
+func (s *DataSourceSecretMigrationService) Migrate(ctx context.Context) (err error) {
+	report := &dataSourceMigrationReport{DataSources: make([]dataSourceMigrationResult, 0)}
+	if s.reportFile != "" {
+		// the report is written even when the migration fails part way
+		defer func() {
+			if reportErr := writeMigrationReport(s.reportFile, report); reportErr != nil {
+				if err == nil {
+					err = reportErr
+				} else {
+					logger.Error("failed to write data source secret migration report", "error", reportErr)
+				}
+			}
+		}()
+	}
+
 	migrationStatus, _, err := s.kvStore.Get(ctx, secretMigrationStatusKey)
 	if err != nil {
 		return err
@@ -45,6 +133,9 @@ func (s *DataSourceSecretMigrationService) Migrate(ctx context.Context) error {
 	logger.Debug(fmt.Sprint("secret migration status is ", migrationStatus))
 	// If this flag is true, delete secrets from the legacy secrets store as they are migrated
 	disableSecretsCompatibility := s.features.IsEnabled(featuremgmt.FlagDisableSecretsCompatibility)
+	if s.retryFailed {
+		return s.retryFailedDataSources(ctx, report, disableSecretsCompatibility)
+	}
 	// If migration hasn't happened, migrate to unified secrets and keep copy in legacy
 	// If a complete migration happened and now backwards compatibility is enabled, copy secrets back to legacy
 	needCompatibility := migrationStatus != compatibleSecretMigrationValue && !disableSecretsCompatibility
@@ -60,34 +151,48 @@ func (s *DataSourceSecretMigrationService) Migrate(ctx context.Context) error {
 			return err
 		}
 
-		for _, ds := range query.Result {
-			secureJsonData, err := s.dataSourcesService.DecryptedValues(ctx, ds)
+		logger.Info("migrating data source secrets", "total", len(query.Result))
+		failed := make([]string, 0)
+		for i, ds := range query.Result {
+			if i > 0 && i%dataSourceMigrationProgressInterval == 0 {
+				logger.Info(fmt.Sprintf("processed %d/%d data sources", i, len(query.Result)), "failed", len(failed))
+			}
+			if len(s.dataSourceTypes) > 0 && !s.dataSourceTypes[ds.Type] {
+				logger.Debug("skipping data source of a type not listed in migration_datasource_types", "orgId", ds.OrgId, "uid", ds.Uid, "type", ds.Type)
+				continue
+			}
+			migrated, err := s.migrateOrRecoverDataSource(ctx, ds, disableSecretsCompatibility)
+			report.add(ds, migrated, err == nil && disableSecretsCompatibility, err)
+			countDataSourceMigration(migrated, err)
 			if err != nil {
-				return err
+				if !s.continueOnError {
+					return err
+				}
+				logger.Error("failed to migrate data source secrets", "orgId", ds.OrgId, "uid", ds.Uid, "error", err)
+				failed = append(failed, ds.Uid)
 			}
+		}
 
-			// Secrets are set by the update data source function if the SecureJsonData is set in the command
-			// Secrets are deleted by the update data source function if the disableSecretsCompatibility flag is enabled
-			err = s.dataSourcesService.UpdateDataSource(ctx, &datasources.UpdateDataSourceCommand{
-				Id:             ds.Id,
-				OrgId:          ds.OrgId,
-				Uid:            ds.Uid,
-				Name:           ds.Name,
-				JsonData:       ds.JsonData,
-				SecureJsonData: secureJsonData,
-
-				// These are needed by the SQL function due to UseBool and MustCols
-				IsDefault:       ds.IsDefault,
-				BasicAuth:       ds.BasicAuth,
-				WithCredentials: ds.WithCredentials,
-				ReadOnly:        ds.ReadOnly,
-				User:            ds.User,
-			})
-			if err != nil {
+		logger.Info(fmt.Sprintf("processed %d/%d data sources", len(query.Result), len(query.Result)), "failed", len(failed))
+
+		if s.failedDataSourcesFile != "" {
+			if err := writeFailedDataSources(s.failedDataSourcesFile, failed); err != nil {
 				return err
 			}
 		}
 
+		if len(s.dataSourceTypes) > 0 {
+			// the data sources of the other types still have to be migrated by a later run
+			logger.Info("migrated the secrets of the data sources of the listed types only, the migration status is left unchanged", "types", strings.Join(s.sortedDataSourceTypes(), ","))
+			return nil
+		}
+
+		if len(failed) > 0 {
+			// the failed data sources still have to be migrated, a later run or a retry of the failed data sources migrates them
+			logger.Warn("some data sources failed to migrate, the migration status is left unchanged", "failed", len(failed))
+			return nil
+		}
+
 		var newMigStatus string
 		if disableSecretsCompatibility {
 			newMigStatus = completeSecretMigrationValue
@@ -99,7 +204,220 @@ func (s *DataSourceSecretMigrationService) Migrate(ctx context.Context) error {
 			return err
 		}
 		logger.Debug(fmt.Sprint("set secret migration status to ", newMigStatus))
+	} else if s.reportFile != "" {
+		query := &datasources.GetAllDataSourcesQuery{}
+		if err := s.dataSourcesService.GetAllDataSources(ctx, query); err != nil {
+			return err
+		}
+		for _, ds := range query.Result {
+			report.add(ds, false, migrationStatus == completeSecretMigrationValue, nil)
+		}
+	}
+
+	return nil
+}
+
+func (s *DataSourceSecretMigrationService) sortedDataSourceTypes() []string {
+	types := make([]string, 0, len(s.dataSourceTypes))
+	for typ := range s.dataSourceTypes {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// retryFailedDataSources migrates only the data sources recorded as failed by a previous run
+// and rewrites the failure file so that it only lists the data sources that are still failing.
+func (s *DataSourceSecretMigrationService) retryFailedDataSources(ctx context.Context, report *dataSourceMigrationReport, disableSecretsCompatibility bool) error {
+	if s.failedDataSourcesFile == "" {
+		return errors.New("retrying failed data sources requires `migration_failed_datasources_file` to be set")
+	}
+	uids, err := readFailedDataSources(s.failedDataSourcesFile)
+	if err != nil {
+		return err
+	}
+	if len(uids) == 0 {
+		logger.Info("no failed data sources to retry", "file", s.failedDataSourcesFile)
+		return nil
+	}
+
+	toRetry := make(map[string]bool, len(uids))
+	for _, uid := range uids {
+		toRetry[uid] = true
+	}
+
+	query := &datasources.GetAllDataSourcesQuery{}
+	if err := s.dataSourcesService.GetAllDataSources(ctx, query); err != nil {
+		return err
+	}
+
+	failed := make([]string, 0)
+	for _, ds := range query.Result {
+		if !toRetry[ds.Uid] {
+			continue
+		}
+		delete(toRetry, ds.Uid)
+		migrated, err := s.migrateOrRecoverDataSource(ctx, ds, disableSecretsCompatibility)
+		report.add(ds, migrated, err == nil && disableSecretsCompatibility, err)
+		countDataSourceMigration(migrated, err)
+		if err != nil {
+			logger.Error("failed to migrate data source secrets", "orgId", ds.OrgId, "uid", ds.Uid, "error", err)
+			failed = append(failed, ds.Uid)
+		}
 	}
 
+	for uid := range toRetry {
+		logger.Warn("data source recorded as failed no longer exists, skipping", "uid", uid)
+	}
+
+	logger.Info("retried failed data source secret migrations", "retried", len(uids), "stillFailing", len(failed))
+	if len(failed) == 0 {
+		logger.Info("all failed data sources are migrated, the next run without `migration_retry_failed` records the migration status")
+	}
+	return writeFailedDataSources(s.failedDataSourcesFile, failed)
+}
+
+// migrateOrRecoverDataSource migrates the data source secrets unless they are already in their migrated state.
+// The secretMigrationComplete flag alone is not trusted, the secrets store is checked for the migrated secrets.
+// The flag is written in the same transaction as the data source update that sets the secret, which rolls back
+// if setting the secret fails, so an interrupted migration leaves a secret without the flag but not the reverse.
+// A data source in its migrated state but without the secretMigrationComplete flag most likely had its JsonData
+// overwritten by an update, so a warning is logged and the flag is set again without migrating the secrets.
+// migrated reports whether the secrets were migrated by this call.
+func (s *DataSourceSecretMigrationService) migrateOrRecoverDataSource(ctx context.Context, ds *datasources.DataSource, disableSecretsCompatibility bool) (migrated bool, err error) {
+	upToDate, err := s.isDataSourceMigrated(ctx, ds, disableSecretsCompatibility)
+	if err != nil {
+		return false, err
+	}
+	if !upToDate {
+		if err := s.migrateDataSource(ctx, ds); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	if ds.JsonData != nil && ds.JsonData.Get(dataSourceMigrationCompleteKey).MustBool(false) {
+		return false, nil
+	}
+
+	logger.Warn("data source secrets are migrated but the secretMigrationComplete flag is missing from its JsonData, setting it again",
+		"orgId", ds.OrgId, "uid", ds.Uid)
+	return false, s.updateDataSource(ctx, ds, nil)
+}
+
+// isDataSourceMigrated checks whether the secrets store holds the data source secrets and
+// the legacy secrets are kept or deleted according to disableSecretsCompatibility.
+func (s *DataSourceSecretMigrationService) isDataSourceMigrated(ctx context.Context, ds *datasources.DataSource, disableSecretsCompatibility bool) (bool, error) {
+	stored, exists, err := s.secretsStore.Get(ctx, ds.OrgId, ds.Name, secretskvs.DataSourceSecretType)
+	if err != nil || !exists {
+		return false, err
+	}
+	if len(ds.SecureJsonData) == 0 {
+		return disableSecretsCompatibility, nil
+	}
+	if disableSecretsCompatibility {
+		return false, nil
+	}
+
+	storedValues := make(map[string]string)
+	if err := json.Unmarshal([]byte(stored), &storedValues); err != nil {
+		return false, nil
+	}
+	legacyValues, err := s.secretsService.DecryptJsonData(ctx, ds.SecureJsonData)
+	if err != nil {
+		return false, err
+	}
+	if len(storedValues) != len(legacyValues) {
+		return false, nil
+	}
+	for k, v := range legacyValues {
+		if storedValue, ok := storedValues[k]; !ok || storedValue != v {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *DataSourceSecretMigrationService) migrateDataSource(ctx context.Context, ds *datasources.DataSource) error {
+	secureJsonData, err := s.dataSourcesService.DecryptedValues(ctx, ds)
+	if err != nil {
+		return err
+	}
+	values := make([]string, 0, len(secureJsonData))
+	for _, v := range secureJsonData {
+		values = append(values, v)
+	}
+	return secretskvs.RedactSecrets(s.updateDataSource(ctx, ds, secureJsonData), values...)
+}
+
+// updateDataSource rewrites the data source with its secretMigrationComplete flag set.
+// When secureJsonData is nil the current secrets are kept.
+func (s *DataSourceSecretMigrationService) updateDataSource(ctx context.Context, ds *datasources.DataSource, secureJsonData map[string]string) error {
+	if ds.JsonData == nil {
+		ds.JsonData = simplejson.New()
+	}
+	ds.JsonData.Set(dataSourceMigrationCompleteKey, true)
+
+	// Secrets are set by the update data source function if the SecureJsonData is set in the command
+	// Secrets are deleted by the update data source function if the disableSecretsCompatibility flag is enabled
+	return s.dataSourcesService.UpdateDataSource(ctx, &datasources.UpdateDataSourceCommand{
+		Id:             ds.Id,
+		OrgId:          ds.OrgId,
+		Uid:            ds.Uid,
+		Name:           ds.Name,
+		JsonData:       ds.JsonData,
+		SecureJsonData: secureJsonData,
+
+		// These are needed by the SQL function due to UseBool and MustCols
+		IsDefault:       ds.IsDefault,
+		BasicAuth:       ds.BasicAuth,
+		WithCredentials: ds.WithCredentials,
+		ReadOnly:        ds.ReadOnly,
+		User:            ds.User,
+	})
+}
+
+// readFailedDataSources reads the data source uids, one per line, from the failure file.
+// A missing file means there is nothing to retry.
+func readFailedDataSources(path string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read failed data sources file: %w", err)
+	}
+	uids := make([]string, 0)
+	for _, line := range strings.Split(string(b), "\n") {
+		if uid := strings.TrimSpace(line); uid != "" {
+			uids = append(uids, uid)
+		}
+	}
+	return uids, nil
+}
+
+// writeFailedDataSources records the data source uids, one per line, in the failure file.
+// The file is removed when there are no failures left.
+func writeFailedDataSources(path string, uids []string) error {
+	if len(uids) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove failed data sources file: %w", err)
+		}
+		return nil
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(uids, "\n")+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write failed data sources file: %w", err)
+	}
+	return nil
+}
+
+// writeMigrationReport writes the outcome of the migration for each data source as JSON
+func writeMigrationReport(path string, report *dataSourceMigrationReport) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal data source secret migration report: %w", err)
+	}
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		return fmt.Errorf("failed to write data source secret migration report: %w", err)
+	}
 	return nil
 }
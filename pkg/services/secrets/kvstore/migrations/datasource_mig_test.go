@@ -2,32 +2,44 @@ package migrations
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/grafana/grafana/pkg/components/simplejson"
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
 	acmock "github.com/grafana/grafana/pkg/services/accesscontrol/mock"
 	"github.com/grafana/grafana/pkg/services/datasources"
 	dsservice "github.com/grafana/grafana/pkg/services/datasources/service"
 	"github.com/grafana/grafana/pkg/services/featuremgmt"
+	"github.com/grafana/grafana/pkg/services/secrets"
 	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
 	secretsmng "github.com/grafana/grafana/pkg/services/secrets/manager"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func SetupTestDataSourceSecretMigrationService(t *testing.T, sqlStore *sqlstore.SQLStore, kvStore kvstore.KVStore, secretsStore secretskvs.SecretsKVStore, compatibility bool) *DataSourceSecretMigrationService {
 	t.Helper()
-	cfg := &setting.Cfg{}
+	return setupTestDataSourceSecretMigrationServiceWithCfg(t, setting.NewCfg(), sqlStore, kvStore, secretsStore, compatibility)
+}
+
+func setupTestDataSourceSecretMigrationServiceWithCfg(t *testing.T, cfg *setting.Cfg, sqlStore *sqlstore.SQLStore, kvStore kvstore.KVStore, secretsStore secretskvs.SecretsKVStore, compatibility bool) *DataSourceSecretMigrationService {
+	t.Helper()
 	features := featuremgmt.WithFeatures()
 	if !compatibility {
 		features = featuremgmt.WithFeatures(featuremgmt.FlagDisableSecretsCompatibility, true)
 	}
 	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
 	dsService := dsservice.ProvideService(sqlStore, secretsService, secretsStore, cfg, features, acmock.New().WithDisabled(), acmock.NewMockedPermissionsService())
-	migService := ProvideDataSourceMigrationService(dsService, kvStore, features)
+	migService := ProvideDataSourceMigrationService(cfg, dsService, secretsStore, secretsService, kvStore, features)
 	return migService
 }
 
@@ -345,3 +357,543 @@ func TestMigrate(t *testing.T) {
 		assert.True(t, exist)
 	})
 }
+
+func TestMigrateRetryFailed(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretsStore := &failingSecretsKVStore{
+		SecretsKVStore: secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")),
+		failingNames:   map[string]bool{"Broken": true},
+	}
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+
+	failedFile := filepath.Join(t.TempDir(), "failed_datasources")
+	cfg := setting.NewCfg()
+	cfg.Raw.Section("secrets").Key("migration_continue_on_error").SetValue("true")
+	cfg.Raw.Section("secrets").Key("migration_failed_datasources_file").SetValue(failedFile)
+
+	dataSourceOrg := int64(1)
+	for _, cmd := range []*datasources.AddDataSourceCommand{
+		{Name: "Working", Uid: "working-uid"},
+		{Name: "Broken", Uid: "broken-uid"},
+	} {
+		cmd.OrgId = dataSourceOrg
+		cmd.Type = datasources.DS_MYSQL
+		cmd.Access = datasources.DS_ACCESS_DIRECT
+		cmd.Url = "http://test"
+		cmd.EncryptedSecureJsonData = map[string][]byte{
+			"password": []byte("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+		}
+		require.NoError(t, ds.AddDataSource(context.Background(), cmd))
+	}
+
+	// Run the migration, the broken data source should be recorded as failed
+	migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+	err := migService.Migrate(context.Background())
+	require.NoError(t, err)
+
+	b, err := os.ReadFile(failedFile)
+	require.NoError(t, err)
+	assert.Equal(t, "broken-uid\n", string(b))
+
+	_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, "Working", secretskvs.DataSourceSecretType)
+	require.NoError(t, err)
+	assert.True(t, exist)
+	_, exist, err = secretsStore.Get(context.Background(), dataSourceOrg, "Broken", secretskvs.DataSourceSecretType)
+	require.NoError(t, err)
+	assert.False(t, exist)
+
+	// the migration status is not recorded while a data source failed
+	_, exist, err = kvStore.Get(context.Background(), 0, secretskvs.DataSourceSecretType, secretMigrationStatusKey)
+	require.NoError(t, err)
+	assert.False(t, exist)
+
+	t.Run("retrying keeps the data sources that still fail", func(t *testing.T) {
+		cfg.Raw.Section("secrets").Key("migration_retry_failed").SetValue("true")
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		err := migService.Migrate(context.Background())
+		require.NoError(t, err)
+
+		b, err := os.ReadFile(failedFile)
+		require.NoError(t, err)
+		assert.Equal(t, "broken-uid\n", string(b))
+	})
+
+	t.Run("retrying migrates only the failed data sources and clears the file", func(t *testing.T) {
+		secretsStore.failingNames = map[string]bool{"Working": true}
+		cfg.Raw.Section("secrets").Key("migration_retry_failed").SetValue("true")
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		err := migService.Migrate(context.Background())
+		require.NoError(t, err)
+
+		_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, "Broken", secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		assert.True(t, exist)
+
+		_, err = os.Stat(failedFile)
+		assert.True(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("the migration status is recorded once no data source fails", func(t *testing.T) {
+		secretsStore.failingNames = map[string]bool{}
+		cfg.Raw.Section("secrets").Key("migration_retry_failed").SetValue("false")
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		require.NoError(t, migService.Migrate(context.Background()))
+
+		value, exist, err := kvStore.Get(context.Background(), 0, secretskvs.DataSourceSecretType, secretMigrationStatusKey)
+		require.NoError(t, err)
+		assert.True(t, exist)
+		assert.Equal(t, completeSecretMigrationValue, value)
+	})
+}
+
+func TestMigrateKeepsMigratedDataSourcesOnFailure(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretsStore := &failingSecretsKVStore{
+		SecretsKVStore: secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")),
+		failingNames:   map[string]bool{"Broken": true},
+	}
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+
+	// the data sources are migrated in the order of their names
+	dataSourceOrg := int64(1)
+	for _, cmd := range []*datasources.AddDataSourceCommand{
+		{Name: "Alpha", Uid: "alpha-uid"},
+		{Name: "Broken", Uid: "broken-uid"},
+		{Name: "Zulu", Uid: "zulu-uid"},
+	} {
+		cmd.OrgId = dataSourceOrg
+		cmd.Type = datasources.DS_MYSQL
+		cmd.Access = datasources.DS_ACCESS_DIRECT
+		cmd.Url = "http://test"
+		cmd.EncryptedSecureJsonData = map[string][]byte{
+			"password": []byte("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+		}
+		require.NoError(t, ds.AddDataSource(context.Background(), cmd))
+	}
+	migrated := func(t *testing.T, name string) bool {
+		t.Helper()
+		_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, name, secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		dataSource := &datasources.GetDataSourceQuery{OrgId: dataSourceOrg, Name: name}
+		require.NoError(t, ds.GetDataSource(context.Background(), dataSource))
+		flagged := dataSource.Result.JsonData != nil && dataSource.Result.JsonData.Get(dataSourceMigrationCompleteKey).MustBool(false)
+		assert.Equal(t, exist, flagged, "the secrets and the flag of %s are migrated together", name)
+		return exist
+	}
+
+	migService := SetupTestDataSourceSecretMigrationService(t, sqlStore, kvStore, secretsStore, false)
+	require.Error(t, migService.Migrate(context.Background()))
+	assert.True(t, migrated(t, "Alpha"), "the data source migrated before the failure stays migrated")
+	assert.False(t, migrated(t, "Broken"))
+	assert.False(t, migrated(t, "Zulu"))
+
+	secretsStore.failingNames = nil
+	migService = SetupTestDataSourceSecretMigrationService(t, sqlStore, kvStore, secretsStore, false)
+	require.NoError(t, migService.Migrate(context.Background()))
+	for _, name := range []string{"Alpha", "Broken", "Zulu"} {
+		assert.True(t, migrated(t, name))
+	}
+}
+
+// failingSecretsKVStore fails to set the secrets of the data sources with the given names
+type failingSecretsKVStore struct {
+	secretskvs.SecretsKVStore
+	failingNames map[string]bool
+}
+
+func (f *failingSecretsKVStore) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
+	if f.failingNames[namespace] {
+		return errors.New("mocked set error")
+	}
+	return f.SecretsKVStore.Set(ctx, orgId, namespace, typ, value)
+}
+
+func TestMigrateReport(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretsStore := &failingSecretsKVStore{
+		SecretsKVStore: secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")),
+		failingNames:   map[string]bool{"Broken": true},
+	}
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	cfg := setting.NewCfg()
+	cfg.Raw.Section("secrets").Key("migration_report_file").SetValue(reportFile)
+
+	dataSourceOrg := int64(1)
+	for _, cmd := range []*datasources.AddDataSourceCommand{
+		{Name: "Broken", Uid: "broken-uid"},
+		{Name: "Working", Uid: "working-uid"},
+	} {
+		cmd.OrgId = dataSourceOrg
+		cmd.Type = datasources.DS_MYSQL
+		cmd.Access = datasources.DS_ACCESS_DIRECT
+		cmd.Url = "http://test"
+		cmd.EncryptedSecureJsonData = map[string][]byte{
+			"password": []byte("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+		}
+		require.NoError(t, ds.AddDataSource(context.Background(), cmd))
+	}
+
+	counts := func() map[string]float64 {
+		return map[string]float64{
+			dataSourceMigrationMigrated: testutil.ToFloat64(dataSourceMigrationsCounter.WithLabelValues(dataSourceMigrationMigrated)),
+			dataSourceMigrationSkipped:  testutil.ToFloat64(dataSourceMigrationsCounter.WithLabelValues(dataSourceMigrationSkipped)),
+			dataSourceMigrationFailed:   testutil.ToFloat64(dataSourceMigrationsCounter.WithLabelValues(dataSourceMigrationFailed)),
+		}
+	}
+	// countedOutcomes returns the outcomes counted since before
+	countedOutcomes := func(before map[string]float64) map[string]float64 {
+		after := counts()
+		for outcome := range after {
+			after[outcome] -= before[outcome]
+		}
+		return after
+	}
+
+	readReport := func(t *testing.T) dataSourceMigrationReport {
+		t.Helper()
+		b, err := os.ReadFile(reportFile)
+		require.NoError(t, err)
+		var report dataSourceMigrationReport
+		require.NoError(t, json.Unmarshal(b, &report))
+		return report
+	}
+
+	t.Run("the report is written when the migration fails", func(t *testing.T) {
+		before := counts()
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		err := migService.Migrate(context.Background())
+		require.Error(t, err)
+		assert.Equal(t, map[string]float64{"migrated": 0, "skipped": 0, "failed": 1}, countedOutcomes(before))
+
+		report := readReport(t)
+		require.Len(t, report.DataSources, 1)
+		assert.Equal(t, "broken-uid", report.DataSources[0].Uid)
+		assert.False(t, report.DataSources[0].Migrated)
+		assert.Equal(t, "mocked set error", report.DataSources[0].Error)
+	})
+
+	t.Run("the report lists the migrated data sources", func(t *testing.T) {
+		secretsStore.failingNames = nil
+		before := counts()
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		require.NoError(t, migService.Migrate(context.Background()))
+		assert.Equal(t, map[string]float64{"migrated": 2, "skipped": 0, "failed": 0}, countedOutcomes(before))
+
+		report := readReport(t)
+		require.Len(t, report.DataSources, 2)
+		for _, result := range report.DataSources {
+			assert.Equal(t, dataSourceOrg, result.OrgId)
+			assert.True(t, result.Migrated)
+			assert.True(t, result.LegacySecretsDeleted)
+			assert.Empty(t, result.Error)
+		}
+	})
+
+	t.Run("the report lists the data sources as already migrated", func(t *testing.T) {
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+		require.NoError(t, migService.Migrate(context.Background()))
+
+		report := readReport(t)
+		require.Len(t, report.DataSources, 2)
+		for _, result := range report.DataSources {
+			assert.False(t, result.Migrated)
+			assert.True(t, result.LegacySecretsDeleted)
+		}
+	})
+}
+
+func TestMigrateRecoversMigrationFlag(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretsStore := secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+
+	reportFile := filepath.Join(t.TempDir(), "report.json")
+	cfg := setting.NewCfg()
+	cfg.Raw.Section("secrets").Key("migration_report_file").SetValue(reportFile)
+	migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, true)
+
+	// the legacy secrets must be decryptable to be compared with the stored ones
+	encrypted, err := migService.secretsService.EncryptJsonData(context.Background(), map[string]string{"password": "secret"}, secrets.WithoutScope())
+	require.NoError(t, err)
+
+	dataSourceOrg := int64(1)
+	dataSourceName := "Test"
+	err = ds.AddDataSource(context.Background(), &datasources.AddDataSourceCommand{
+		OrgId:                   dataSourceOrg,
+		Name:                    dataSourceName,
+		Uid:                     "test-uid",
+		Type:                    datasources.DS_MYSQL,
+		Access:                  datasources.DS_ACCESS_DIRECT,
+		Url:                     "http://test",
+		EncryptedSecureJsonData: encrypted,
+	})
+	require.NoError(t, err)
+
+	getDataSource := func(t *testing.T) *datasources.DataSource {
+		t.Helper()
+		query := &datasources.GetDataSourceQuery{OrgId: dataSourceOrg, Name: dataSourceName}
+		require.NoError(t, ds.GetDataSource(context.Background(), query))
+		return query.Result
+	}
+
+	// clobberJsonData overwrites the data source JsonData, dropping the migration flag,
+	// and resets the migration status so the next run goes through all data sources
+	clobberJsonData := func(t *testing.T) {
+		t.Helper()
+		current := getDataSource(t)
+		err := ds.UpdateDataSource(context.Background(), &datasources.UpdateDataSourceCommand{
+			Id:                      current.Id,
+			OrgId:                   current.OrgId,
+			Uid:                     current.Uid,
+			Name:                    current.Name,
+			JsonData:                simplejson.New(),
+			EncryptedSecureJsonData: current.SecureJsonData,
+		})
+		require.NoError(t, err)
+		require.NoError(t, kvStore.Del(context.Background(), 0, secretskvs.DataSourceSecretType, secretMigrationStatusKey))
+	}
+
+	migrated := func(t *testing.T) bool {
+		t.Helper()
+		b, err := os.ReadFile(reportFile)
+		require.NoError(t, err)
+		var report dataSourceMigrationReport
+		require.NoError(t, json.Unmarshal(b, &report))
+		require.Len(t, report.DataSources, 1)
+		return report.DataSources[0].Migrated
+	}
+
+	require.NoError(t, migService.Migrate(context.Background()))
+	assert.True(t, migrated(t))
+	assert.True(t, getDataSource(t).JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+
+	t.Run("a lost flag is set again without migrating when the stored secret matches", func(t *testing.T) {
+		clobberJsonData(t)
+		require.False(t, getDataSource(t).JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+
+		require.NoError(t, migService.Migrate(context.Background()))
+		assert.False(t, migrated(t))
+		assert.True(t, getDataSource(t).JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+	})
+
+	t.Run("a lost flag leads to a migration when the stored secret differs", func(t *testing.T) {
+		clobberJsonData(t)
+		require.NoError(t, secretsStore.Set(context.Background(), dataSourceOrg, dataSourceName, secretskvs.DataSourceSecretType, `{"password":"stale"}`))
+
+		require.NoError(t, migService.Migrate(context.Background()))
+		assert.True(t, migrated(t))
+		assert.True(t, getDataSource(t).JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+	})
+}
+
+// countingDataSourceService counts the data source reads and writes of the migration
+type countingDataSourceService struct {
+	datasources.DataSourceService
+	reads, writes int
+}
+
+func (c *countingDataSourceService) GetAllDataSources(ctx context.Context, query *datasources.GetAllDataSourcesQuery) error {
+	c.reads++
+	return c.DataSourceService.GetAllDataSources(ctx, query)
+}
+
+func (c *countingDataSourceService) UpdateDataSource(ctx context.Context, cmd *datasources.UpdateDataSourceCommand) error {
+	c.writes++
+	return c.DataSourceService.UpdateDataSource(ctx, cmd)
+}
+
+func TestMigrateAfterCompleteMigration(t *testing.T) {
+	for name, compatibility := range map[string]bool{"with compatibility": true, "without compatibility": false} {
+		t.Run(name, func(t *testing.T) {
+			sqlStore := sqlstore.InitTestDB(t)
+			kvStore := kvstore.ProvideService(sqlStore)
+			secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+			secretsStore := secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+			migService := SetupTestDataSourceSecretMigrationService(t, sqlStore, kvStore, secretsStore, compatibility)
+			ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+			for _, name := range []string{"First", "Second"} {
+				require.NoError(t, ds.AddDataSource(context.Background(), &datasources.AddDataSourceCommand{
+					OrgId:  1,
+					Name:   name,
+					Type:   datasources.DS_MYSQL,
+					Access: datasources.DS_ACCESS_DIRECT,
+					Url:    "http://test",
+					EncryptedSecureJsonData: map[string][]byte{
+						"password": []byte("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"),
+					},
+				}))
+			}
+
+			counting := &countingDataSourceService{DataSourceService: migService.dataSourcesService}
+			migService.dataSourcesService = counting
+			require.NoError(t, migService.Migrate(context.Background()))
+			assert.Equal(t, 1, counting.reads)
+			assert.Equal(t, 2, counting.writes)
+
+			// the migration status is all that is read once the migration is complete
+			counting.reads, counting.writes = 0, 0
+			require.NoError(t, migService.Migrate(context.Background()))
+			assert.Zero(t, counting.reads)
+			assert.Zero(t, counting.writes)
+		})
+	}
+}
+
+// crashingSecretsKVStore sets the secrets, then fails as if Grafana stopped before the data source update was committed
+type crashingSecretsKVStore struct {
+	secretskvs.SecretsKVStore
+	crash bool
+}
+
+func (c *crashingSecretsKVStore) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
+	if err := c.SecretsKVStore.Set(ctx, orgId, namespace, typ, value); err != nil || !c.crash {
+		return err
+	}
+	return errors.New("mocked crash")
+}
+
+func TestMigrateResumesAfterCrash(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	// the secrets are kept apart from the database, like in a plugin, so a set secret outlives the rolled back update
+	secretsStore := &crashingSecretsKVStore{
+		SecretsKVStore: secretskvs.NewInMemorySecretsKVStore(),
+		crash:          true,
+	}
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+	migService := SetupTestDataSourceSecretMigrationService(t, sqlStore, kvStore, secretsStore, true)
+
+	encrypted, err := migService.secretsService.EncryptJsonData(context.Background(), map[string]string{"password": "secret"}, secrets.WithoutScope())
+	require.NoError(t, err)
+	dataSourceOrg := int64(1)
+	dataSourceName := "Test"
+	require.NoError(t, ds.AddDataSource(context.Background(), &datasources.AddDataSourceCommand{
+		OrgId:                   dataSourceOrg,
+		Name:                    dataSourceName,
+		Uid:                     "test-uid",
+		Type:                    datasources.DS_MYSQL,
+		Access:                  datasources.DS_ACCESS_DIRECT,
+		Url:                     "http://test",
+		EncryptedSecureJsonData: encrypted,
+	}))
+
+	flagged := func(t *testing.T) bool {
+		t.Helper()
+		query := &datasources.GetDataSourceQuery{OrgId: dataSourceOrg, Name: dataSourceName}
+		require.NoError(t, ds.GetDataSource(context.Background(), query))
+		return query.Result.JsonData != nil && query.Result.JsonData.Get(dataSourceMigrationCompleteKey).MustBool(false)
+	}
+	stored := func(t *testing.T) string {
+		t.Helper()
+		value, exists, err := secretsStore.Get(context.Background(), dataSourceOrg, dataSourceName, secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		if !exists {
+			return ""
+		}
+		return value
+	}
+
+	t.Run("a crash after the secret is set leaves the flag unset", func(t *testing.T) {
+		require.EqualError(t, migService.Migrate(context.Background()), "mocked crash")
+		assert.JSONEq(t, `{"password":"secret"}`, stored(t))
+		assert.False(t, flagged(t), "the flag is only set along with the secret")
+	})
+
+	t.Run("the next run sets the flag", func(t *testing.T) {
+		secretsStore.crash = false
+		require.NoError(t, migService.Migrate(context.Background()))
+		assert.JSONEq(t, `{"password":"secret"}`, stored(t))
+		assert.True(t, flagged(t))
+	})
+
+	t.Run("a flag without its secret is not trusted", func(t *testing.T) {
+		require.NoError(t, secretsStore.Del(context.Background(), dataSourceOrg, dataSourceName, secretskvs.DataSourceSecretType))
+		require.NoError(t, kvStore.Del(context.Background(), 0, secretskvs.DataSourceSecretType, secretMigrationStatusKey))
+		require.True(t, flagged(t))
+
+		require.NoError(t, migService.Migrate(context.Background()))
+		assert.JSONEq(t, `{"password":"secret"}`, stored(t))
+		assert.True(t, flagged(t))
+	})
+}
+
+func TestMigrateDataSourceTypes(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	kvStore := kvstore.ProvideService(sqlStore)
+	secretsService := secretsmng.SetupTestService(t, fakes.NewFakeSecretsStore())
+	secretsStore := secretskvs.NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	ds := dsservice.CreateStore(sqlStore, log.NewNopLogger())
+
+	cfg := setting.NewCfg()
+	cfg.Raw.Section("secrets").Key("migration_datasource_types").SetValue(datasources.DS_MYSQL)
+
+	dataSourceOrg := int64(1)
+	legacySecret := []byte("9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+	for _, cmd := range []*datasources.AddDataSourceCommand{
+		{Name: "Listed", Uid: "listed-uid", Type: datasources.DS_MYSQL},
+		{Name: "Unlisted", Uid: "unlisted-uid", Type: datasources.DS_POSTGRES},
+	} {
+		cmd.OrgId = dataSourceOrg
+		cmd.Access = datasources.DS_ACCESS_DIRECT
+		cmd.Url = "http://test"
+		cmd.JsonData = simplejson.New()
+		cmd.EncryptedSecureJsonData = map[string][]byte{"password": legacySecret}
+		require.NoError(t, ds.AddDataSource(context.Background(), cmd))
+	}
+
+	getDataSource := func(t *testing.T, name string) *datasources.DataSource {
+		t.Helper()
+		query := &datasources.GetDataSourceQuery{OrgId: dataSourceOrg, Name: name}
+		require.NoError(t, ds.GetDataSource(context.Background(), query))
+		return query.Result
+	}
+
+	migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, cfg, sqlStore, kvStore, secretsStore, false)
+	require.NoError(t, migService.Migrate(context.Background()))
+
+	t.Run("the data sources of the listed types are migrated", func(t *testing.T) {
+		_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, "Listed", secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		assert.True(t, exist)
+
+		listed := getDataSource(t, "Listed")
+		assert.True(t, listed.JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+		assert.Empty(t, listed.SecureJsonData)
+	})
+
+	t.Run("the data sources of the other types are left untouched", func(t *testing.T) {
+		_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, "Unlisted", secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		assert.False(t, exist)
+
+		unlisted := getDataSource(t, "Unlisted")
+		assert.False(t, unlisted.JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+		assert.Equal(t, map[string][]byte{"password": legacySecret}, unlisted.SecureJsonData)
+	})
+
+	t.Run("the migration status is left unchanged", func(t *testing.T) {
+		_, exist, err := kvStore.Get(context.Background(), 0, secretskvs.DataSourceSecretType, secretMigrationStatusKey)
+		require.NoError(t, err)
+		assert.False(t, exist)
+	})
+
+	t.Run("a later run without allowlist migrates the other types", func(t *testing.T) {
+		migService := setupTestDataSourceSecretMigrationServiceWithCfg(t, setting.NewCfg(), sqlStore, kvStore, secretsStore, false)
+		require.NoError(t, migService.Migrate(context.Background()))
+
+		_, exist, err := secretsStore.Get(context.Background(), dataSourceOrg, "Unlisted", secretskvs.DataSourceSecretType)
+		require.NoError(t, err)
+		assert.True(t, exist)
+		assert.True(t, getDataSource(t, "Unlisted").JsonData.Get(dataSourceMigrationCompleteKey).MustBool())
+	})
+}
@@ -23,6 +23,8 @@ type MigrateFromPluginService struct {
 	secretsService secrets.Service
 	manager        plugins.SecretsPluginManager
 	kvstore        kvstore.KVStore
+	// dryRun only logs the secrets that would be migrated, neither the database nor the plugin are changed
+	dryRun bool
 }
 
 func ProvideMigrateFromPluginService(
@@ -39,6 +41,7 @@ func ProvideMigrateFromPluginService(
 		secretsService: secretsService,
 		manager:        manager,
 		kvstore:        kvstore,
+		dryRun:         cfg.SectionWithEnvOverrides("secrets").Key("migrate_from_plugin_dry_run").MustBool(false),
 	}
 }
 
@@ -59,8 +62,25 @@ func (s *MigrateFromPluginService) Migrate(ctx context.Context) error {
 	logger.Debug("retrieved all secrets from plugin", "num secrets", totalSecrets)
 	// create a secret sql store manually
 	secretsSql := secretskvs.NewSQLSecretsKVStore(s.sqlStore, s.secretsService, logger)
+	skipped := 0
 	for i, item := range res.Items {
 		logger.Debug(fmt.Sprintf("Migrating secret %d of %d", i+1, totalSecrets), "current", i+1, "secretCount", totalSecrets)
+		// a secret already in the sql store, e.g. by a previous interrupted run, is left as is
+		value, exists, err := secretsSql.Get(ctx, item.Key.OrgId, item.Key.Namespace, item.Key.Type)
+		if err != nil {
+			logger.Error("Error checking secret in unified secrets", "orgId", item.Key.OrgId,
+				"namespace", item.Key.Namespace, "type", item.Key.Type)
+			return err
+		}
+		if exists && value == item.Value {
+			skipped++
+			continue
+		}
+		if s.dryRun {
+			logger.Info("Dry run: the secret would be migrated from the plugin", "orgId", item.Key.OrgId,
+				"namespace", item.Key.Namespace, "type", item.Key.Type, "overwrites", exists)
+			continue
+		}
 		// Add to sql store
 		err = secretsSql.Set(ctx, item.Key.OrgId, item.Key.Namespace, item.Key.Type, item.Value)
 		if err != nil {
@@ -69,6 +89,18 @@ func (s *MigrateFromPluginService) Migrate(ctx context.Context) error {
 			return err
 		}
 	}
+	if s.dryRun {
+		logger.Info("Dry run of the migration of secrets from plugin complete, nothing was changed", "secretCount", totalSecrets, "alreadyMigrated", skipped)
+		return nil
+	}
+	logger.Info("Migrated secrets from plugin", "secretCount", totalSecrets, "alreadyMigrated", skipped)
+
+	// the checkpoint of a previous migration to the plugin refers to the ids of secrets that are back in the
+	// database, a later migration to the plugin must not take them for migrated
+	if err := secretskvs.GetNamespacedKVStore(s.kvstore).Del(ctx, toPluginCheckpointKey); err != nil {
+		logger.Error("Failed to clear the checkpoint of the migration to the plugin", "error", err.Error())
+		return err
+	}
 
 	for i, item := range res.Items {
 		logger.Debug(fmt.Sprintf("Cleaning secret %d of %d", i+1, totalSecrets), "current", i+1, "secretCount", totalSecrets)
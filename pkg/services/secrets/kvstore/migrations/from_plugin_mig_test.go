@@ -37,6 +37,70 @@ func TestPluginSecretMigrationService_MigrateFromPlugin(t *testing.T) {
 		validateSecretWasStoredInSql(t, sqlStore, ctx, 1, "secret-1", "bogus", "value-1")
 		validateSecretWasStoredInSql(t, sqlStore, ctx, 1, "secret-2", "bogus", "value-2")
 	})
+
+	t.Run("the checkpoint of the migration to the plugin is cleared", func(t *testing.T) {
+		migratorService, plugin, _ := setupTestMigrateFromPluginService(t)
+		namespacedKVStore := secretskvs.GetNamespacedKVStore(migratorService.kvstore)
+		require.NoError(t, namespacedKVStore.Set(ctx, toPluginCheckpointKey, "1"))
+		addSecretToPluginStore(t, plugin, ctx, 1, "secret-1", "bogus", "value-1")
+
+		require.NoError(t, migratorService.Migrate(ctx))
+
+		_, exists, err := namespacedKVStore.Get(ctx, toPluginCheckpointKey)
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("secrets already in Grafana are skipped", func(t *testing.T) {
+		migratorService, plugin, sqlStore := setupTestMigrateFromPluginService(t)
+
+		require.NoError(t, sqlStore.Set(ctx, 1, "secret-1", "bogus", "value-1"))
+		require.NoError(t, sqlStore.Set(ctx, 1, "secret-2", "bogus", "stale"))
+		before := sqlSecretCiphertexts(t, migratorService, ctx)
+		addSecretToPluginStore(t, plugin, ctx, 1, "secret-1", "bogus", "value-1")
+		addSecretToPluginStore(t, plugin, ctx, 1, "secret-2", "bogus", "value-2")
+
+		require.NoError(t, migratorService.Migrate(ctx))
+
+		// a new store doesn't serve the values cached before the migration
+		sqlStore = secretskvs.NewSQLSecretsKVStore(migratorService.sqlStore, migratorService.secretsService, log.New("test.logger"))
+		validatePluginSecretsWereDeleted(t, plugin, ctx)
+		validateSecretWasStoredInSql(t, sqlStore, ctx, 1, "secret-1", "bogus", "value-1")
+		validateSecretWasStoredInSql(t, sqlStore, ctx, 1, "secret-2", "bogus", "value-2")
+		after := sqlSecretCiphertexts(t, migratorService, ctx)
+		require.Equal(t, before["secret-1"], after["secret-1"], "the secret already migrated is not written again")
+		require.NotEqual(t, before["secret-2"], after["secret-2"])
+	})
+
+	t.Run("a dry run changes nothing", func(t *testing.T) {
+		migratorService, plugin, sqlStore := setupTestMigrateFromPluginService(t)
+		migratorService.dryRun = true
+
+		addSecretToPluginStore(t, plugin, ctx, 1, "secret-1", "bogus", "value-1")
+		require.NoError(t, migratorService.Migrate(ctx))
+
+		res, err := plugin.GetAllSecrets(ctx, &secretsmanagerplugin.GetAllSecretsRequest{})
+		require.NoError(t, err)
+		require.Len(t, res.Items, 1)
+		_, exists, err := sqlStore.Get(ctx, 1, "secret-1", "bogus")
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+}
+
+// sqlSecretCiphertexts returns the encrypted value of each secret in sql by namespace, which changes whenever it is written
+func sqlSecretCiphertexts(t *testing.T, migratorService *MigrateFromPluginService, ctx context.Context) map[string]string {
+	t.Helper()
+	var items []secretskvs.Item
+	err := migratorService.sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		return sess.Find(&items)
+	})
+	require.NoError(t, err)
+	ciphertexts := make(map[string]string, len(items))
+	for _, item := range items {
+		ciphertexts[*item.Namespace] = item.Value
+	}
+	return ciphertexts
 }
 
 // Set up services used in migration
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"github.com/grafana/grafana/pkg/infra/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of the secret migration of a data source
+const (
+	dataSourceMigrationMigrated = "migrated"
+	dataSourceMigrationSkipped  = "skipped"
+	dataSourceMigrationFailed   = "failed"
+)
+
+var dataSourceMigrationsCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: metrics.ExporterName,
+		Name:      "secrets_datasource_migrations_total",
+		Help:      "A counter for the data sources whose secrets were migrated, skipped as already migrated, or failed to migrate",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(
+		dataSourceMigrationsCounter,
+	)
+}
+
+// countDataSourceMigration counts the outcome of the secret migration of a data source
+func countDataSourceMigration(migrated bool, err error) {
+	outcome := dataSourceMigrationSkipped
+	if err != nil {
+		outcome = dataSourceMigrationFailed
+	} else if migrated {
+		outcome = dataSourceMigrationMigrated
+	}
+	dataSourceMigrationsCounter.WithLabelValues(outcome).Inc()
+}
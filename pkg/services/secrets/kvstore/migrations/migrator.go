@@ -2,6 +2,7 @@ package migrations
 
 import (
 	"context"
+	"errors"
 	"reflect"
 	"time"
 
@@ -78,8 +79,10 @@ func (s *SecretMigrationProviderImpl) Migrate(ctx context.Context) error {
 			logger.Debug("Finished secret migration service", "service", serviceName)
 		}
 	})
-	if err != nil {
-		logger.Error("Server lock for secret migration already exists")
+	if errors.Is(err, serverlock.ErrLockAlreadyExists) {
+		logger.Info("Skipping secret migration, another run holds the migration lock")
+	} else if err != nil {
+		logger.Error("Failed to acquire the server lock for secret migration", "error", err)
 	}
 	return nil
 }
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/grafana/grafana/pkg/infra/serverlock"
+	"github.com/grafana/grafana/pkg/infra/tracing"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blockingMigrationService counts its runs and blocks until released
+type blockingMigrationService struct {
+	runs    int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingMigrationService) Migrate(ctx context.Context) error {
+	atomic.AddInt32(&s.runs, 1)
+	s.started <- struct{}{}
+	<-s.release
+	return nil
+}
+
+func TestSecretMigrationProvider_ConcurrentRuns(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	lockService := serverlock.ProvideService(sqlStore, tracing.InitializeTracerForTest())
+	service := &blockingMigrationService{started: make(chan struct{}, 1), release: make(chan struct{})}
+
+	// two providers sharing the database, like two instances of Grafana
+	first := &SecretMigrationProviderImpl{ServerLockService: lockService, services: []SecretMigrationService{service}}
+	second := &SecretMigrationProviderImpl{ServerLockService: lockService, services: []SecretMigrationService{service}}
+
+	done := make(chan error)
+	go func() {
+		done <- first.Migrate(context.Background())
+	}()
+	<-service.started
+
+	// the first run holds the lock so the second one is skipped
+	require.NoError(t, second.Migrate(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&service.runs))
+
+	close(service.release)
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&service.runs))
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/plugins"
@@ -11,10 +13,18 @@ import (
 	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 	"github.com/grafana/grafana/pkg/setting"
+	"golang.org/x/time/rate"
 )
 
 var errSecretStoreIsNotPlugin = errors.New("SecretsKVStore is not a SecretsKVStorePlugin")
 
+const (
+	// toPluginCheckpointKey stores the id of the last secret migrated to the plugin, so that an interrupted migration resumes after it
+	toPluginCheckpointKey = "to_plugin_migration_checkpoint"
+	// toPluginProgressInterval is the number of secrets between two progress reports
+	toPluginProgressInterval = 100
+)
+
 // MigrateToPluginService This migrator will handle migration of datasource secrets (aka Unified secrets)
 // into the plugin secrets configured
 type MigrateToPluginService struct {
@@ -24,6 +34,8 @@ type MigrateToPluginService struct {
 	secretsService secrets.Service
 	kvstore        kvstore.KVStore
 	manager        plugins.SecretsPluginManager
+	// limiter paces the writes to the plugin, nil means unlimited
+	limiter *rate.Limiter
 }
 
 func ProvideMigrateToPluginService(
@@ -34,6 +46,10 @@ func ProvideMigrateToPluginService(
 	kvstore kvstore.KVStore,
 	manager plugins.SecretsPluginManager,
 ) *MigrateToPluginService {
+	var limiter *rate.Limiter
+	if writesPerSecond := cfg.SectionWithEnvOverrides("secrets").Key("migration_rate_limit").MustFloat64(0); writesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(writesPerSecond), 1)
+	}
 	return &MigrateToPluginService{
 		secretsStore:   secretsStore,
 		cfg:            cfg,
@@ -41,6 +57,7 @@ func ProvideMigrateToPluginService(
 		secretsService: secretsService,
 		kvstore:        kvstore,
 		manager:        manager,
+		limiter:        limiter,
 	}
 }
 
@@ -53,7 +70,7 @@ func (s *MigrateToPluginService) Migrate(ctx context.Context) error {
 		tmpStore, err := secretskvs.GetUnwrappedStoreFromCache(s.secretsStore)
 		if err != nil {
 			tmpStore = s.secretsStore
-			logger.Warn("secret store is not cached, this is unexpected - continuing migration anyway.")
+			logger.Debug("secret store is not cached, the cache may be disabled - continuing migration")
 		}
 		pluginStore, ok := tmpStore.(*secretskvs.SecretsKVStorePlugin)
 		if !ok {
@@ -80,13 +97,48 @@ func (s *MigrateToPluginService) Migrate(ctx context.Context) error {
 			totalSec := len(allSec)
 			logger.Debug(fmt.Sprintf("Total amount of secrets to migrate: %d", totalSec))
 
+			checkpoint, err := s.readCheckpoint(ctx, namespacedKVStore)
+			if err != nil {
+				return err
+			}
+			if checkpoint > 0 {
+				logger.Info("resuming migration of unified secrets to the plugin", "checkpoint", checkpoint)
+			}
+			// the checkpoint relies on secrets being migrated in the order of their ids
+			sort.SliceStable(allSec, func(i, j int) bool { return allSec[i].Id < allSec[j].Id })
+
 			// We just set it again as the current secret store should be the plugin secret
 			for i, sec := range allSec {
+				if sec.Id > 0 && sec.Id <= checkpoint {
+					// the checkpoint can be stale, e.g. when the secrets were migrated back from the plugin since,
+					// so a secret is only skipped if the plugin holds it, as it is deleted from the database below
+					keys, err := pluginStore.Keys(ctx, *sec.OrgId, *sec.Namespace, *sec.Type)
+					if err != nil {
+						return err
+					}
+					if len(keys) > 0 {
+						continue
+					}
+					logger.Warn("secret before the migration checkpoint is missing from the plugin, migrating it", "orgId", *sec.OrgId, "namespace", *sec.Namespace, "type", *sec.Type)
+				}
+				if s.limiter != nil {
+					if err := s.limiter.Wait(ctx); err != nil {
+						return err
+					}
+				}
 				logger.Debug(fmt.Sprintf("Migrating secret %d of %d", i+1, totalSec), "current", i+1, "secretCount", totalSec)
 				err = pluginStore.Set(ctx, *sec.OrgId, *sec.Namespace, *sec.Type, sec.Value)
 				if err != nil {
 					return err
 				}
+				if sec.Id > 0 {
+					if err := namespacedKVStore.Set(ctx, toPluginCheckpointKey, strconv.FormatInt(sec.Id, 10)); err != nil {
+						return err
+					}
+				}
+				if (i+1)%toPluginProgressInterval == 0 {
+					logger.Info("migrating unified secrets to the plugin", "migrated", i+1, "secretCount", totalSec)
+				}
 			}
 			return nil
 		})
@@ -115,6 +167,24 @@ func (s *MigrateToPluginService) Migrate(ctx context.Context) error {
 			}
 		}
 		logger.Debug("deleted unified secrets after migration", "number of secrets", totalSec)
+		if err := namespacedKVStore.Del(ctx, toPluginCheckpointKey); err != nil {
+			logger.Error("failed to clear the migration checkpoint", "error", err)
+			return err
+		}
 	}
 	return nil
 }
+
+// readCheckpoint returns the id of the last secret migrated by an interrupted migration, or 0
+func (s *MigrateToPluginService) readCheckpoint(ctx context.Context, kv *kvstore.NamespacedKVStore) (int64, error) {
+	value, exists, err := kv.Get(ctx, toPluginCheckpointKey)
+	if err != nil || !exists {
+		return 0, err
+	}
+	checkpoint, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		logger.Warn("ignoring invalid migration checkpoint", "checkpoint", value)
+		return 0, nil
+	}
+	return checkpoint, nil
+}
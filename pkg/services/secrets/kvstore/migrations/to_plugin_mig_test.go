@@ -3,6 +3,7 @@ package migrations
 import (
 	"context"
 	"errors"
+	"strconv"
 	"testing"
 	"time"
 
@@ -46,6 +47,82 @@ func TestPluginSecretMigrationService_MigrateToPlugin(t *testing.T) {
 		validateSecretWasStoredInPlugin(t, secretsStore, ctx, orgId, namespace1, typ)
 		validateSecretWasStoredInPlugin(t, secretsStore, ctx, orgId, namespace1, typ)
 	})
+
+	t.Run("migration resumes after the checkpoint", func(t *testing.T) {
+		migratorService, secretsStore, sqlSecretStore := setupTestMigrateToPluginService(t)
+		var orgId int64 = 1
+		namespace1, namespace2 := "namespace-test", "namespace-test2"
+		typ := "type-test"
+
+		addSecretToSqlStore(t, sqlSecretStore, ctx, orgId, namespace1, typ, "SUPER_SECRET")
+		addSecretToSqlStore(t, sqlSecretStore, ctx, orgId, namespace2, typ, "SUPER_SECRET")
+
+		// simulate an interrupted run that already migrated the first secret
+		items, err := sqlSecretStore.GetAll(ctx)
+		require.NoError(t, err)
+		var firstId int64
+		for _, item := range items {
+			if *item.Namespace == namespace1 {
+				firstId = item.Id
+			}
+		}
+		namespacedKVStore := secretskvs.GetNamespacedKVStore(migratorService.kvstore)
+		require.NoError(t, namespacedKVStore.Set(ctx, toPluginCheckpointKey, strconv.FormatInt(firstId, 10)))
+		require.NoError(t, secretsStore.Set(ctx, orgId, namespace1, typ, "SUPER_SECRET"))
+
+		require.NoError(t, migratorService.Migrate(ctx))
+
+		validateSqlSecretWasDeleted(t, sqlSecretStore, ctx, orgId, namespace1, typ)
+		validateSqlSecretWasDeleted(t, sqlSecretStore, ctx, orgId, namespace2, typ)
+		validateSecretWasStoredInPlugin(t, secretsStore, ctx, orgId, namespace1, typ)
+		validateSecretWasStoredInPlugin(t, secretsStore, ctx, orgId, namespace2, typ)
+
+		_, exists, err := namespacedKVStore.Get(ctx, toPluginCheckpointKey)
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("a secret before a stale checkpoint is still migrated", func(t *testing.T) {
+		migratorService, secretsStore, sqlSecretStore := setupTestMigrateToPluginService(t)
+		var orgId int64 = 1
+		namespace := "namespace-test"
+		typ := "type-test"
+
+		addSecretToSqlStore(t, sqlSecretStore, ctx, orgId, namespace, typ, "SUPER_SECRET")
+		items, err := sqlSecretStore.GetAll(ctx)
+		require.NoError(t, err)
+		require.Len(t, items, 1)
+		// the checkpoint was left behind, but the secret is not in the plugin
+		namespacedKVStore := secretskvs.GetNamespacedKVStore(migratorService.kvstore)
+		require.NoError(t, namespacedKVStore.Set(ctx, toPluginCheckpointKey, strconv.FormatInt(items[0].Id, 10)))
+
+		require.NoError(t, migratorService.Migrate(ctx))
+
+		validateSqlSecretWasDeleted(t, sqlSecretStore, ctx, orgId, namespace, typ)
+		value, exists, err := secretsStore.Get(ctx, orgId, namespace, typ)
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, "SUPER_SECRET", value)
+	})
+
+	t.Run("migration is paced by the rate limit", func(t *testing.T) {
+		migratorService, secretsStore, sqlSecretStore := setupTestMigrateToPluginServiceWithCfg(t, `
+		[secrets]
+		use_plugin = true
+		migration_rate_limit = 20
+		`)
+		var orgId int64 = 1
+		typ := "type-test"
+		for _, namespace := range []string{"ns1", "ns2", "ns3"} {
+			addSecretToSqlStore(t, sqlSecretStore, ctx, orgId, namespace, typ, "SUPER_SECRET")
+		}
+
+		start := time.Now()
+		require.NoError(t, migratorService.Migrate(ctx))
+		// the first write goes through immediately, the two others wait 50ms each
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+		validateSecretWasStoredInPlugin(t, secretsStore, ctx, orgId, "ns3", typ)
+	})
 }
 
 // With fatal flag unset, do a migration with backwards compatibility disabled. When unified secrets are deleted, return an error on the first deletion
@@ -91,11 +168,15 @@ func validateSecretWasStoredInPlugin(t *testing.T, secretsStore secretskvs.Secre
 // Set up services used in migration
 func setupTestMigrateToPluginService(t *testing.T) (*MigrateToPluginService, secretskvs.SecretsKVStore, secretskvs.SecretsKVStore) {
 	t.Helper()
-
-	rawCfg := `
+	return setupTestMigrateToPluginServiceWithCfg(t, `
 		[secrets]
 		use_plugin = true
-		`
+		`)
+}
+
+func setupTestMigrateToPluginServiceWithCfg(t *testing.T, rawCfg string) (*MigrateToPluginService, secretskvs.SecretsKVStore, secretskvs.SecretsKVStore) {
+	t.Helper()
+
 	raw, err := ini.Load([]byte(rawCfg))
 	require.NoError(t, err)
 	cfg := &setting.Cfg{Raw: raw}
@@ -1,6 +1,7 @@
 package kvstore
 
 import (
+	"sort"
 	"time"
 )
 
@@ -17,11 +18,38 @@ type Item struct {
 	Namespace *string
 	Type      *string
 	Value     string
+	// EncryptionVersion tags the encryption used for Value, see EncryptionVersion
+	EncryptionVersion string
+	// ExpiresAt is when the item is no longer returned, it never expires when nil
+	ExpiresAt *time.Time
+	// Compression of the value before it was encrypted, empty when it wasn't compressed
+	Compression string
 
 	Created time.Time
 	Updated time.Time
 }
 
+// expired reports whether the item had expired at the given time
+func (i *Item) expired(now time.Time) bool {
+	return i.ExpiresAt != nil && !i.ExpiresAt.After(now)
+}
+
+// itemNamespaces returns the distinct namespaces of the items of an organization, or of all of them
+// when orgId is AllOrganizations, in order
+func itemNamespaces(items []Item, orgId int64) []string {
+	seen := make(map[string]bool)
+	namespaces := make([]string, 0)
+	for _, item := range items {
+		if (orgId != AllOrganizations && *item.OrgId != orgId) || seen[*item.Namespace] {
+			continue
+		}
+		seen[*item.Namespace] = true
+		namespaces = append(namespaces, *item.Namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
 func (i *Item) TableName() string {
 	return "secrets"
 }
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
@@ -21,8 +23,22 @@ var (
 	startupOnce               sync.Once
 	errPluginDisabledByConfig = errors.New("remote secret management plugin disabled because the property `secrets.use_plugin` is not set to `true`")
 	errPluginNotInstalled     = errors.New("remote secret management plugin disabled because there is no installed plugin of type `secretsmanager`")
+	errPluginInvalidResponse  = errors.New("remote secret management plugin returned an invalid response")
 )
 
+// maxPluginSecretValueSize bounds the size of a secret value returned by the plugin
+const maxPluginSecretValueSize = 1 << 20
+
+// defaultPluginCallTimeout bounds how long a call to the plugin may take, so that a stuck plugin
+// fails the requests reading secrets instead of blocking them
+const defaultPluginCallTimeout = 30 * time.Second
+
+// defaultPluginHealthCheckInterval is how often RemoteSecretsPluginCheck probes the plugin
+const defaultPluginHealthCheckInterval = time.Minute
+
+// pluginHealthCheckNamespace is the namespace of the secret looked up to probe the plugin, which is never stored
+const pluginHealthCheckNamespace = "secrets_kvstore_health_check"
+
 // SecretsKVStorePlugin provides a key/value store backed by the Grafana plugin gRPC interface
 type SecretsKVStorePlugin struct {
 	sync.Mutex
@@ -33,6 +49,11 @@ type SecretsKVStorePlugin struct {
 	backwardsCompatibilityDisabled bool
 	fallbackEnabled                bool
 	fallbackStore                  SecretsKVStore
+	maxValueSize                   int
+	callTimeout                    time.Duration
+	readFallback                   bool
+	// compareAndSwapMu serializes the compare and swaps of the store, the plugin can't do them atomically
+	compareAndSwapMu sync.Mutex
 }
 
 func NewPluginSecretsKVStore(
@@ -50,7 +71,47 @@ func NewPluginSecretsKVStore(
 		kvstore:                        kvstore,
 		backwardsCompatibilityDisabled: features.IsEnabled(featuremgmt.FlagDisableSecretsCompatibility),
 		fallbackStore:                  fallback,
+		callTimeout:                    defaultPluginCallTimeout,
+		maxValueSize:                   maxPluginSecretValueSize,
+	}
+}
+
+// SetMaxValueSize sets the maximum size in bytes of the values accepted by Set. It is capped at the size of the
+// values the plugin may return, as a larger value could be set but never read back. Zero or less means the cap.
+func (kv *SecretsKVStorePlugin) SetMaxValueSize(size int) {
+	if size <= 0 || size > maxPluginSecretValueSize {
+		size = maxPluginSecretValueSize
+	}
+	kv.maxValueSize = size
+}
+
+// SetCallTimeout sets how long a call to the plugin may take before failing with context.DeadlineExceeded.
+// Zero or less means the calls are only bounded by the context of the caller.
+func (kv *SecretsKVStorePlugin) SetCallTimeout(timeout time.Duration) {
+	kv.callTimeout = timeout
+}
+
+// SetReadFallback sets whether a secret the plugin fails to get is read from the fallback store instead,
+// where it may remain from before the migration to the plugin
+func (kv *SecretsKVStorePlugin) SetReadFallback(enabled bool) {
+	kv.readFallback = enabled
+}
+
+// callPlugin runs a call to the plugin with the call timeout applied to ctx
+func (kv *SecretsKVStorePlugin) callPlugin(ctx context.Context, method string, call func(ctx context.Context) error) error {
+	if kv.callTimeout <= 0 {
+		return call(ctx)
 	}
+	callCtx, cancel := context.WithTimeout(ctx, kv.callTimeout)
+	defer cancel()
+	err := call(callCtx)
+	// the plugin reports the deadline as a gRPC status, it is replaced by an error the callers can check,
+	// unless the deadline of the caller was reached first
+	if err != nil && ctx.Err() == nil && errors.Is(callCtx.Err(), context.DeadlineExceeded) {
+		kv.log.Error("remote secret management plugin call timed out", "method", method, "timeout", kv.callTimeout)
+		return fmt.Errorf("remote secret management plugin did not answer %s within %s: %w", method, kv.callTimeout, context.DeadlineExceeded)
+	}
+	return err
 }
 
 // Get an item from the store
@@ -64,8 +125,17 @@ func (kv *SecretsKVStorePlugin) Get(ctx context.Context, orgId int64, namespace
 		},
 	}
 
-	res, err := kv.secretsPlugin.GetSecret(ctx, req)
-	if res.UserFriendlyError != "" {
+	var res *smp.GetSecretResponse
+	err := kv.callPlugin(ctx, "GetSecret", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.GetSecret(ctx, req)
+		return err
+	})
+	if err == nil {
+		err = validateGetSecretResponse(res)
+	}
+	if err != nil {
+		res = &smp.GetSecretResponse{}
+	} else if res.UserFriendlyError != "" {
 		err = wrapUserFriendlySecretError(res.UserFriendlyError)
 	}
 
@@ -77,14 +147,59 @@ func (kv *SecretsKVStorePlugin) Get(ctx context.Context, orgId int64, namespace
 		if err != nil || res.UserFriendlyError != "" || !res.Exists {
 			res.DecryptedValue, res.Exists, err = kv.fallbackStore.Get(ctx, orgId, namespace, typ)
 		}
+	} else if err != nil && kv.readFallback {
+		return kv.getFromReadFallback(ctx, orgId, namespace, typ, err)
 	}
 
 	return res.DecryptedValue, res.Exists, err
 }
 
+// getFromReadFallback reads a secret the plugin failed to get from the fallback store, failing with the error
+// of the plugin when the fallback store doesn't have it either
+func (kv *SecretsKVStorePlugin) getFromReadFallback(ctx context.Context, orgId int64, namespace string, typ string, pluginErr error) (string, bool, error) {
+	value, exists, err := kv.fallbackStore.Get(ctx, orgId, namespace, typ)
+	if err != nil || !exists {
+		kv.log.Error("secrets management plugin failed to get a secret, which is not in the database either",
+			"orgId", orgId, "namespace", namespace, "type", typ, "err", pluginErr, "fallbackErr", err)
+		return "", false, pluginErr
+	}
+	kv.log.Warn("secrets management plugin failed to get a secret, serving it from the database in degraded mode",
+		"orgId", orgId, "namespace", namespace, "type", typ, "err", pluginErr)
+	return value, true, nil
+}
+
+// GetMany gets the items of the given types in a namespace one by one, the plugin has no batch request
+func (kv *SecretsKVStorePlugin) GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error) {
+	values := make(map[string]string, len(typs))
+	for _, typ := range typs {
+		value, exists, err := kv.Get(ctx, orgId, namespace, typ)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			values[typ] = value
+		}
+	}
+	return values, nil
+}
+
+// Exists reports whether an item is in the store, by listing its key rather than getting its value
+func (kv *SecretsKVStorePlugin) Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error) {
+	keys, err := kv.Keys(ctx, orgId, namespace, typ)
+	exists := len(keys) > 0
+	if kv.fallbackEnabled && (err != nil || !exists) {
+		return kv.fallbackStore.Exists(ctx, orgId, namespace, typ)
+	}
+	return exists, err
+}
+
 // Set an item in the store
 // If it is the first time a secret has been set and backwards compatibility is disabled, mark plugin startup errors fatal
 func (kv *SecretsKVStorePlugin) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
+	if err := checkValueSize("plugin", kv.maxValueSize, value); err != nil {
+		return err
+	}
+
 	req := &smp.SetSecretRequest{
 		KeyDescriptor: &smp.Key{
 			OrgId:     orgId,
@@ -94,14 +209,57 @@ func (kv *SecretsKVStorePlugin) Set(ctx context.Context, orgId int64, namespace
 		Value: value,
 	}
 
-	res, err := kv.secretsPlugin.SetSecret(ctx, req)
-	if err == nil && res.UserFriendlyError != "" {
-		err = wrapUserFriendlySecretError(res.UserFriendlyError)
+	var res *smp.SetSecretResponse
+	err := kv.callPlugin(ctx, "SetSecret", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.SetSecret(ctx, req)
+		return err
+	})
+	if err == nil && res == nil {
+		err = invalidPluginResponse("SetSecret", "empty response")
+	} else if err == nil && res.UserFriendlyError != "" {
+		// the user friendly error is shown as is, so it is redacted rather than wrapped
+		err = wrapUserFriendlySecretError(redactString(res.UserFriendlyError, value))
 	}
 
 	updateFatalFlag(ctx, kv)
 
-	return err
+	return secretError("set", orgId, namespace, typ, err, value)
+}
+
+// SetWithTTL is not supported by the plugin, which has no notion of expiry
+func (kv *SecretsKVStorePlugin) SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error {
+	return fmt.Errorf("%w (orgId=%d, namespace=%s, type=%s)", ErrSecretExpiryNotSupported, orgId, namespace, typ)
+}
+
+// CompareAndSwap sets an item to newValue only if its value is oldValue. The plugin has no conditional
+// request, so this is only atomic with the other compare and swaps of this store: a Set, or a change made
+// by another Grafana instance, between the Get and the Set is overwritten.
+func (kv *SecretsKVStorePlugin) CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error) {
+	kv.compareAndSwapMu.Lock()
+	defer kv.compareAndSwapMu.Unlock()
+	value, exists, err := kv.Get(ctx, orgId, namespace, typ)
+	if err != nil || !exists || value != oldValue {
+		return false, err
+	}
+	if err := kv.Set(ctx, orgId, namespace, typ, newValue); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetIfAbsent sets an item only if it is missing. Like CompareAndSwap, this is only atomic with the other
+// conditional writes of this store.
+func (kv *SecretsKVStorePlugin) SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error) {
+	kv.compareAndSwapMu.Lock()
+	defer kv.compareAndSwapMu.Unlock()
+	exists, err := kv.Exists(ctx, orgId, namespace, typ)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := kv.Set(ctx, orgId, namespace, typ, value); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Del deletes an item from the store.
@@ -114,14 +272,38 @@ func (kv *SecretsKVStorePlugin) Del(ctx context.Context, orgId int64, namespace
 		},
 	}
 
-	res, err := kv.secretsPlugin.DeleteSecret(ctx, req)
-	if err == nil && res.UserFriendlyError != "" {
+	var res *smp.DeleteSecretResponse
+	err := kv.callPlugin(ctx, "DeleteSecret", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.DeleteSecret(ctx, req)
+		return err
+	})
+	if err == nil && res == nil {
+		err = invalidPluginResponse("DeleteSecret", "empty response")
+	} else if err == nil && res.UserFriendlyError != "" {
 		err = wrapUserFriendlySecretError(res.UserFriendlyError)
 	}
 
 	return err
 }
 
+// DelAll deletes the items of every type in a namespace. The plugin can neither delete nor list the items
+// of a namespace, so they are found among all the items and deleted one by one.
+func (kv *SecretsKVStorePlugin) DelAll(ctx context.Context, orgId int64, namespace string) error {
+	items, err := kv.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if *item.Namespace != namespace || (orgId != AllOrganizations && *item.OrgId != orgId) {
+			continue
+		}
+		if err := kv.Del(ctx, *item.OrgId, namespace, *item.Type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Keys get all keys for a given namespace. To query for all
 // organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
 func (kv *SecretsKVStorePlugin) Keys(ctx context.Context, orgId int64, namespace string, typ string) ([]Key, error) {
@@ -134,18 +316,42 @@ func (kv *SecretsKVStorePlugin) Keys(ctx context.Context, orgId int64, namespace
 		AllOrganizations: orgId == AllOrganizations,
 	}
 
-	res, err := kv.secretsPlugin.ListSecrets(ctx, req)
+	var res *smp.ListSecretsResponse
+	err := kv.callPlugin(ctx, "ListSecrets", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.ListSecrets(ctx, req)
+		return err
+	})
 	if err != nil {
 		return nil, err
-	} else if res.UserFriendlyError != "" {
+	}
+	if err := validateListSecretsResponse(res); err != nil {
+		return nil, err
+	}
+	if res.UserFriendlyError != "" {
 		err = wrapUserFriendlySecretError(res.UserFriendlyError)
 	}
 
 	return parseKeys(res.Keys), err
 }
 
+// Namespaces lists the namespaces holding an item of any type. The plugin can't list the keys of every type,
+// so the namespaces are collected from all the items.
+func (kv *SecretsKVStorePlugin) Namespaces(ctx context.Context, orgId int64) ([]string, error) {
+	items, err := kv.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return itemNamespaces(items, orgId), nil
+}
+
 // Rename an item in the store
-func (kv *SecretsKVStorePlugin) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string) error {
+func (kv *SecretsKVStorePlugin) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
+	if newNamespace != namespace {
+		if err := kv.deleteRenameTarget(ctx, orgId, namespace, typ, newNamespace, overwrite); err != nil {
+			return err
+		}
+	}
+
 	req := &smp.RenameSecretRequest{
 		KeyDescriptor: &smp.Key{
 			OrgId:     orgId,
@@ -155,21 +361,53 @@ func (kv *SecretsKVStorePlugin) Rename(ctx context.Context, orgId int64, namespa
 		NewNamespace: newNamespace,
 	}
 
-	res, err := kv.secretsPlugin.RenameSecret(ctx, req)
-	if err == nil && res.UserFriendlyError != "" {
+	var res *smp.RenameSecretResponse
+	err := kv.callPlugin(ctx, "RenameSecret", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.RenameSecret(ctx, req)
+		return err
+	})
+	if err == nil && res == nil {
+		err = invalidPluginResponse("RenameSecret", "empty response")
+	} else if err == nil && res.UserFriendlyError != "" {
 		err = wrapUserFriendlySecretError(res.UserFriendlyError)
 	}
 
 	return err
 }
 
+// deleteRenameTarget makes room for a secret renamed to newNamespace, which must not be taken unless overwrite
+// is true. The plugin API has no way to check and rename atomically, so this only narrows the window for a conflict.
+func (kv *SecretsKVStorePlugin) deleteRenameTarget(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
+	targets, err := kv.Keys(ctx, orgId, newNamespace, typ)
+	if err != nil || len(targets) == 0 {
+		return err
+	}
+	// renaming a missing secret must not delete the target
+	sources, err := kv.Keys(ctx, orgId, namespace, typ)
+	if err != nil || len(sources) == 0 {
+		return err
+	}
+	if !overwrite {
+		return secretAlreadyExistsError(orgId, newNamespace, typ)
+	}
+	return kv.Del(ctx, orgId, newNamespace, typ)
+}
+
 func (kv *SecretsKVStorePlugin) GetAll(ctx context.Context) ([]Item, error) {
 	req := &smp.GetAllSecretsRequest{}
 
-	res, err := kv.secretsPlugin.GetAllSecrets(ctx, req)
+	var res *smp.GetAllSecretsResponse
+	err := kv.callPlugin(ctx, "GetAllSecrets", func(ctx context.Context) (err error) {
+		res, err = kv.secretsPlugin.GetAllSecrets(ctx, req)
+		return err
+	})
 	if err != nil {
 		return nil, err
-	} else if res.UserFriendlyError != "" {
+	}
+	if err := validateGetAllSecretsResponse(res); err != nil {
+		return nil, err
+	}
+	if res.UserFriendlyError != "" {
 		err = wrapUserFriendlySecretError(res.UserFriendlyError)
 	}
 
@@ -211,6 +449,69 @@ func parseItems(items []*smp.Item) []Item {
 	return newItems
 }
 
+func invalidPluginResponse(method string, reason string) error {
+	return fmt.Errorf("%w to %s: %s", errPluginInvalidResponse, method, reason)
+}
+
+// validatePluginString makes sure a value returned by the plugin is safe to hand over to the callers,
+// so that a misbehaving plugin is reported as such rather than through confusing decryption errors downstream
+func validatePluginString(method string, field string, value string) error {
+	if len(value) > maxPluginSecretValueSize {
+		return invalidPluginResponse(method, fmt.Sprintf("%s exceeds the maximum size of %d bytes", field, maxPluginSecretValueSize))
+	}
+	if !utf8.ValidString(value) {
+		return invalidPluginResponse(method, fmt.Sprintf("%s is not valid UTF-8", field))
+	}
+	return nil
+}
+
+func validatePluginKey(method string, k *smp.Key) error {
+	if k == nil {
+		return invalidPluginResponse(method, "missing key")
+	}
+	if err := validatePluginString(method, "key namespace", k.Namespace); err != nil {
+		return err
+	}
+	return validatePluginString(method, "key type", k.Type)
+}
+
+func validateGetSecretResponse(res *smp.GetSecretResponse) error {
+	if res == nil {
+		return invalidPluginResponse("GetSecret", "empty response")
+	}
+	return validatePluginString("GetSecret", "secret value", res.DecryptedValue)
+}
+
+func validateListSecretsResponse(res *smp.ListSecretsResponse) error {
+	if res == nil {
+		return invalidPluginResponse("ListSecrets", "empty response")
+	}
+	for _, k := range res.Keys {
+		if err := validatePluginKey("ListSecrets", k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateGetAllSecretsResponse(res *smp.GetAllSecretsResponse) error {
+	if res == nil {
+		return invalidPluginResponse("GetAllSecrets", "empty response")
+	}
+	for _, i := range res.Items {
+		if i == nil {
+			return invalidPluginResponse("GetAllSecrets", "missing item")
+		}
+		if err := validatePluginKey("GetAllSecrets", i.Key); err != nil {
+			return err
+		}
+		if err := validatePluginString("GetAllSecrets", "secret value", i.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func updateFatalFlag(ctx context.Context, skv *SecretsKVStorePlugin) {
 	// This function makes the most sense in here because it handles all possible scenarios:
 	//   - User changed backwards compatibility flag, so we have to migrate secrets either to or from the plugin (get or set)
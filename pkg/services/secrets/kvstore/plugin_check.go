@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/plugins"
+	"github.com/grafana/grafana/pkg/setting"
+)
+
+// UseRemoteSecretsPluginCheck reports on the remote secrets management plugin storing the secrets
+type UseRemoteSecretsPluginCheck interface {
+	// HealthCheck probes the plugin, it returns nil when the secrets are not stored by a plugin
+	HealthCheck(ctx context.Context) error
+	// FallbackWarning returns why the secrets are stored in the database although `secrets.use_plugin` is set,
+	// or an empty string when the plugin is in use or was not requested
+	FallbackWarning() string
+}
+
+// RemoteSecretsPluginCheck probes the plugin storing the secrets every `plugin_health_check_interval` while
+// Grafana runs, so that a failing plugin is noticed before the users reading secrets are
+type RemoteSecretsPluginCheck struct {
+	log             log.Logger
+	plugin          *SecretsKVStorePlugin
+	interval        time.Duration
+	fallbackWarning string
+}
+
+func ProvideRemoteSecretsPluginCheck(store SecretsKVStore, pluginsManager plugins.SecretsPluginManager, cfg *setting.Cfg) *RemoteSecretsPluginCheck {
+	if unwrapped, err := GetUnwrappedStoreFromCache(store); err == nil {
+		store = unwrapped
+	}
+	plugin, _ := store.(*SecretsKVStorePlugin)
+	return &RemoteSecretsPluginCheck{
+		log:             log.New("secrets.kvstore.plugin_check"),
+		plugin:          plugin,
+		interval:        cfg.SectionWithEnvOverrides("secrets").Key("plugin_health_check_interval").MustDuration(defaultPluginHealthCheckInterval),
+		fallbackWarning: pluginFallbackWarning(plugin != nil, pluginsManager, cfg),
+	}
+}
+
+// pluginFallbackWarning tells why ProvideService stored the secrets in the database although the plugin was requested
+func pluginFallbackWarning(usingPlugin bool, pluginsManager plugins.SecretsPluginManager, cfg *setting.Cfg) string {
+	if usingPlugin {
+		return ""
+	}
+	switch err := EvaluateRemoteSecretsPlugin(context.Background(), pluginsManager, cfg); {
+	case errors.Is(err, errPluginNotInstalled):
+		return "the secrets management plugin is enabled but not installed, secrets are stored in the database"
+	case err == nil:
+		return "the secrets management plugin failed to start, secrets are stored in the database"
+	default:
+		return ""
+	}
+}
+
+// HealthCheck probes the plugin by listing the keys of a secret that is never stored, without decrypting anything
+func (c *RemoteSecretsPluginCheck) HealthCheck(ctx context.Context) error {
+	if c.plugin == nil {
+		return nil
+	}
+	_, err := c.plugin.Keys(ctx, 0, pluginHealthCheckNamespace, "probe")
+	return err
+}
+
+func (c *RemoteSecretsPluginCheck) FallbackWarning() string {
+	return c.fallbackWarning
+}
+
+// IsDisabled skips the probes when the secrets are not stored by a plugin or the interval is not positive
+func (c *RemoteSecretsPluginCheck) IsDisabled() bool {
+	return c.plugin == nil || c.interval <= 0
+}
+
+// Run probes the plugin every interval until Grafana shuts down. Failed probes are logged and counted.
+func (c *RemoteSecretsPluginCheck) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	healthy := true
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		err := c.HealthCheck(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			pluginHealthCheckFailuresCounter.Inc()
+			c.log.Error("secrets management plugin health check failed", "err", err)
+		} else if !healthy {
+			c.log.Info("secrets management plugin health check succeeded again")
+		}
+		healthy = err == nil
+	}
+}
@@ -2,11 +2,21 @@ package kvstore
 
 import (
 	"context"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/plugins/backendplugin/secretsmanagerplugin"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/grafana/grafana/pkg/setting"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Set fatal flag to true, then simulate a plugin start failure
@@ -31,6 +41,31 @@ func TestFatalPluginErr_PluginFailsToStartWithFatalFlagNotSet(t *testing.T) {
 	assert.IsType(t, &SecretsKVStoreSQL{}, store)
 }
 
+// Set fatal flag to false, then simulate a plugin start failure
+// Should result in a warning about the fallback to the sql impl
+func TestPluginFallbackWarning(t *testing.T) {
+	t.Run("the warning is set when the plugin fails to start", func(t *testing.T) {
+		fields, err := SetupFatalCrashTest(t, true, false, false)
+		require.NoError(t, err)
+		check := ProvideRemoteSecretsPluginCheck(fields.SecretsKVStore, fields.PluginManager, SetupTestConfig(t))
+		assert.Contains(t, check.FallbackWarning(), "failed to start")
+	})
+
+	t.Run("the warning is not set when the plugin starts", func(t *testing.T) {
+		fields, err := SetupFatalCrashTest(t, false, false, false)
+		require.NoError(t, err)
+		check := ProvideRemoteSecretsPluginCheck(fields.SecretsKVStore, fields.PluginManager, SetupTestConfig(t))
+		assert.Empty(t, check.FallbackWarning())
+	})
+
+	t.Run("the warning is not set when the plugin is not requested", func(t *testing.T) {
+		fields, err := SetupFatalCrashTest(t, true, false, false)
+		require.NoError(t, err)
+		check := ProvideRemoteSecretsPluginCheck(fields.SecretsKVStore, fields.PluginManager, setting.NewCfg())
+		assert.Empty(t, check.FallbackWarning())
+	})
+}
+
 // With fatal flag not set, store a secret in the plugin while backwards compatibility is disabled
 // Should result in the fatal flag going from unset -> set to true
 func TestFatalPluginErr_FatalFlagGetsSetWithBackwardsCompatDisabled(t *testing.T) {
@@ -74,3 +109,233 @@ func TestFatalPluginErr_FatalFlagGetsUnSetWithBackwardsCompatEnabled(t *testing.
 	assert.NoError(t, err)
 	assert.False(t, isFatal)
 }
+
+// malformedSecretsPlugin returns the configured responses regardless of the request
+type malformedSecretsPlugin struct {
+	fakeGRPCSecretsPlugin
+	getRes    *secretsmanagerplugin.GetSecretResponse
+	listRes   *secretsmanagerplugin.ListSecretsResponse
+	getAllRes *secretsmanagerplugin.GetAllSecretsResponse
+}
+
+func (c *malformedSecretsPlugin) GetSecret(_ context.Context, _ *secretsmanagerplugin.GetSecretRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.GetSecretResponse, error) {
+	return c.getRes, nil
+}
+
+func (c *malformedSecretsPlugin) SetSecret(_ context.Context, _ *secretsmanagerplugin.SetSecretRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.SetSecretResponse, error) {
+	return nil, nil
+}
+
+func (c *malformedSecretsPlugin) ListSecrets(_ context.Context, _ *secretsmanagerplugin.ListSecretsRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.ListSecretsResponse, error) {
+	return c.listRes, nil
+}
+
+func (c *malformedSecretsPlugin) GetAllSecrets(_ context.Context, _ *secretsmanagerplugin.GetAllSecretsRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.GetAllSecretsResponse, error) {
+	return c.getAllRes, nil
+}
+
+func TestPluginSecretsKVStore_InvalidResponses(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(p secretsmanagerplugin.SecretsManagerPlugin) *SecretsKVStorePlugin {
+		return &SecretsKVStorePlugin{secretsPlugin: p, log: log.New("test.logger")}
+	}
+
+	t.Run("get fails on an empty response", func(t *testing.T) {
+		_, exists, err := newStore(&malformedSecretsPlugin{}).Get(ctx, 1, "ns", "type")
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+		assert.False(t, exists)
+	})
+
+	t.Run("get fails on a non UTF-8 value", func(t *testing.T) {
+		p := &malformedSecretsPlugin{getRes: &secretsmanagerplugin.GetSecretResponse{DecryptedValue: "\xff\xfe", Exists: true}}
+		_, _, err := newStore(p).Get(ctx, 1, "ns", "type")
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+		assert.Contains(t, err.Error(), "GetSecret: secret value is not valid UTF-8")
+	})
+
+	t.Run("get fails on an oversized value", func(t *testing.T) {
+		p := &malformedSecretsPlugin{getRes: &secretsmanagerplugin.GetSecretResponse{DecryptedValue: strings.Repeat("a", maxPluginSecretValueSize+1), Exists: true}}
+		_, _, err := newStore(p).Get(ctx, 1, "ns", "type")
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+	})
+
+	t.Run("set fails on an empty response", func(t *testing.T) {
+		t.Cleanup(ResetPlugin)
+		store := newStore(&malformedSecretsPlugin{})
+		store.kvstore = GetNamespacedKVStore(kvstore.ProvideService(sqlstore.InitTestDB(t)))
+		err := store.Set(ctx, 1, "ns", "type", "value")
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+	})
+
+	t.Run("set rejects an oversized value without calling the plugin", func(t *testing.T) {
+		store := newStore(&malformedSecretsPlugin{})
+		store.SetMaxValueSize(4)
+		err := store.Set(ctx, 1, "ns", "type", "value")
+		assert.ErrorIs(t, err, ErrSecretValueTooLarge)
+		assert.Contains(t, err.Error(), "limit of 4 bytes of the plugin backend")
+	})
+
+	t.Run("the maximum value size is capped at the size of the values the plugin may return", func(t *testing.T) {
+		store := newStore(&malformedSecretsPlugin{})
+		store.SetMaxValueSize(2 * maxPluginSecretValueSize)
+		err := store.Set(ctx, 1, "ns", "type", strings.Repeat("a", maxPluginSecretValueSize+1))
+		assert.ErrorIs(t, err, ErrSecretValueTooLarge)
+	})
+
+	t.Run("keys fails on a missing key", func(t *testing.T) {
+		p := &malformedSecretsPlugin{listRes: &secretsmanagerplugin.ListSecretsResponse{Keys: []*secretsmanagerplugin.Key{nil}}}
+		_, err := newStore(p).Keys(ctx, 1, "ns", "type")
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+	})
+
+	t.Run("get all fails on a non UTF-8 value", func(t *testing.T) {
+		p := &malformedSecretsPlugin{getAllRes: &secretsmanagerplugin.GetAllSecretsResponse{Items: []*secretsmanagerplugin.Item{
+			{Key: &secretsmanagerplugin.Key{OrgId: 1, Namespace: "ns", Type: "type"}, Value: "\xc3\x28"},
+		}}}
+		_, err := newStore(p).GetAll(ctx)
+		assert.ErrorIs(t, err, errPluginInvalidResponse)
+	})
+
+	t.Run("valid responses pass", func(t *testing.T) {
+		p := &malformedSecretsPlugin{getRes: &secretsmanagerplugin.GetSecretResponse{DecryptedValue: "välue", Exists: false}}
+		value, _, err := newStore(p).Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.Equal(t, "välue", value)
+	})
+}
+
+// hangingSecretsPlugin answers a request for a secret only after the delay, or fails when its context is done first
+type hangingSecretsPlugin struct {
+	fakeGRPCSecretsPlugin
+	delay time.Duration
+}
+
+func (c *hangingSecretsPlugin) GetSecret(ctx context.Context, in *secretsmanagerplugin.GetSecretRequest, opts ...grpc.CallOption) (*secretsmanagerplugin.GetSecretResponse, error) {
+	select {
+	case <-time.After(c.delay):
+		return c.fakeGRPCSecretsPlugin.GetSecret(ctx, in, opts...)
+	case <-ctx.Done():
+		return nil, status.Error(codes.DeadlineExceeded, ctx.Err().Error())
+	}
+}
+
+func TestPluginSecretsKVStore_CallTimeout(t *testing.T) {
+	newStore := func(delay time.Duration) *SecretsKVStorePlugin {
+		p := &hangingSecretsPlugin{fakeGRPCSecretsPlugin: fakeGRPCSecretsPlugin{kv: map[Key]string{}}, delay: delay}
+		return &SecretsKVStorePlugin{secretsPlugin: p, log: log.New("test.logger"), callTimeout: defaultPluginCallTimeout}
+	}
+
+	t.Run("a stuck plugin fails with a deadline error", func(t *testing.T) {
+		store := newStore(time.Minute)
+		store.SetCallTimeout(10 * time.Millisecond)
+		_, exists, err := store.Get(context.Background(), 1, "ns", "type")
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Contains(t, err.Error(), "did not answer GetSecret within 10ms")
+		assert.False(t, exists)
+	})
+
+	t.Run("a plugin answering in time is not affected", func(t *testing.T) {
+		store := newStore(time.Millisecond)
+		store.SetCallTimeout(time.Minute)
+		_, exists, err := store.Get(context.Background(), 1, "ns", "type")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+
+	t.Run("the deadline of the caller is left as is", func(t *testing.T) {
+		store := newStore(time.Minute)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err := store.Get(ctx, 1, "ns", "type")
+		assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+		assert.NotContains(t, err.Error(), "did not answer")
+	})
+}
+
+// failingSecretsPlugin fails every request for a secret
+type failingSecretsPlugin struct {
+	fakeGRPCSecretsPlugin
+}
+
+func (c *failingSecretsPlugin) GetSecret(_ context.Context, _ *secretsmanagerplugin.GetSecretRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.GetSecretResponse, error) {
+	return nil, status.Error(codes.Unavailable, "mocked plugin error")
+}
+
+func (c *failingSecretsPlugin) ListSecrets(_ context.Context, _ *secretsmanagerplugin.ListSecretsRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.ListSecretsResponse, error) {
+	return nil, status.Error(codes.Unavailable, "mocked plugin error")
+}
+
+func TestPluginSecretsKVStore_ReadFallback(t *testing.T) {
+	ctx := context.Background()
+	newStore := func(readFallback bool) (*SecretsKVStorePlugin, SecretsKVStore) {
+		fallback := NewInMemorySecretsKVStore()
+		store := &SecretsKVStorePlugin{secretsPlugin: &failingSecretsPlugin{}, fallbackStore: fallback, log: log.New("test.logger")}
+		store.SetReadFallback(readFallback)
+		return store, fallback
+	}
+
+	t.Run("a secret the plugin fails to get is read from the fallback store", func(t *testing.T) {
+		store, fallback := newStore(true)
+		require.NoError(t, fallback.Set(ctx, 1, "ns", "type", "value"))
+		value, exists, err := store.Get(ctx, 1, "ns", "type")
+		require.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, "value", value)
+	})
+
+	t.Run("the plugin error is returned when the fallback store has no secret", func(t *testing.T) {
+		store, _ := newStore(true)
+		_, exists, err := store.Get(ctx, 1, "ns", "type")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.False(t, exists)
+	})
+
+	t.Run("the fallback store is not read unless enabled", func(t *testing.T) {
+		store, fallback := newStore(false)
+		require.NoError(t, fallback.Set(ctx, 1, "ns", "type", "value"))
+		_, exists, err := store.Get(ctx, 1, "ns", "type")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.False(t, exists)
+	})
+}
+
+func TestRemoteSecretsPluginCheck(t *testing.T) {
+	ctx := context.Background()
+	newCheck := func(p secretsmanagerplugin.SecretsManagerPlugin, interval time.Duration) *RemoteSecretsPluginCheck {
+		store := &SecretsKVStorePlugin{secretsPlugin: p, log: log.New("test.logger")}
+		cfg := setting.NewCfg()
+		cfg.Raw.Section("secrets").Key("plugin_health_check_interval").SetValue(interval.String())
+		return ProvideRemoteSecretsPluginCheck(WithCache(store, time.Minute, time.Minute), NewFakeSecretsPluginManager(t, false), cfg)
+	}
+
+	t.Run("a healthy plugin passes", func(t *testing.T) {
+		require.NoError(t, newCheck(&fakeGRPCSecretsPlugin{kv: map[Key]string{}}, time.Minute).HealthCheck(ctx))
+	})
+
+	t.Run("a failing plugin fails", func(t *testing.T) {
+		err := newCheck(&failingSecretsPlugin{}, time.Minute).HealthCheck(ctx)
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("the check is disabled without a plugin or an interval", func(t *testing.T) {
+		check := ProvideRemoteSecretsPluginCheck(NewFakeSQLSecretsKVStore(t), NewFakeSecretsPluginManager(t, false), setting.NewCfg())
+		assert.True(t, check.IsDisabled())
+		require.NoError(t, check.HealthCheck(ctx))
+		assert.True(t, newCheck(&failingSecretsPlugin{}, 0).IsDisabled())
+		assert.False(t, newCheck(&failingSecretsPlugin{}, time.Minute).IsDisabled())
+	})
+
+	t.Run("the failed checks are counted until the check is stopped", func(t *testing.T) {
+		before := testutil.ToFloat64(pluginHealthCheckFailuresCounter)
+		ctx, cancel := context.WithCancel(ctx)
+		done := make(chan error)
+		go func() {
+			done <- newCheck(&failingSecretsPlugin{}, time.Millisecond).Run(ctx)
+		}()
+		assert.Eventually(t, func() bool {
+			return testutil.ToFloat64(pluginHealthCheckFailuresCounter) >= before+2
+		}, time.Second, time.Millisecond)
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+	})
+}
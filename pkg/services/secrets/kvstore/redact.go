@@ -0,0 +1,69 @@
+package kvstore
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const redactedSecret = "[REDACTED]"
+
+// redactedError is an error whose message had its secret values removed.
+// It still unwraps to the original error so that errors.Is and errors.As keep working.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e redactedError) Error() string {
+	return e.msg
+}
+
+func (e redactedError) Unwrap() error {
+	return e.err
+}
+
+// RedactSecrets returns err with every occurrence of the given secret values, and of their
+// base64 encodings, removed from its message. It returns nil if err is nil.
+// Only the message is redacted: printing an error unwrapped from the result bypasses the redaction.
+func RedactSecrets(err error, values ...string) error {
+	if err == nil {
+		return nil
+	}
+	msg := redactString(err.Error(), values...)
+	if msg == err.Error() {
+		return err
+	}
+	return redactedError{msg: msg, err: err}
+}
+
+func redactString(s string, values ...string) string {
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		for _, v := range []string{value, base64.StdEncoding.EncodeToString([]byte(value)), b64.EncodeToString([]byte(value))} {
+			s = strings.ReplaceAll(s, v, redactedSecret)
+		}
+	}
+	return s
+}
+
+// secretError adds the key of the secret an operation failed on to err, which never includes
+// the secret values given, be they decrypted values or ciphertexts.
+func secretError(op string, orgId int64, namespace string, typ string, err error, values ...string) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to %s secret (orgId=%d, namespace=%s, type=%s): %w", op, orgId, namespace, typ, RedactSecrets(err, values...))
+}
+
+// ciphertexts returns the stored value of the item, both encoded and decoded,
+// to be redacted from the errors about it.
+func (i Item) ciphertexts() []string {
+	decoded, err := b64.DecodeString(i.Value)
+	if err != nil {
+		return []string{i.Value}
+	}
+	return []string{i.Value, string(decoded)}
+}
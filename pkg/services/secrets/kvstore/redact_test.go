@@ -0,0 +1,129 @@
+package kvstore
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/kvstore"
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/plugins/backendplugin/secretsmanagerplugin"
+	"github.com/grafana/grafana/pkg/services/datasources"
+	"github.com/grafana/grafana/pkg/services/secrets"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+const leakySecret = "s3cr3t-p4ssw0rd"
+
+var errLeaky = errors.New("leaky error")
+
+// leakySecretsService fails to encrypt and decrypt, echoing its payload in the error
+type leakySecretsService struct {
+	fakes.FakeSecretsService
+}
+
+func (s leakySecretsService) Encrypt(_ context.Context, payload []byte, _ secrets.EncryptionOptions) ([]byte, error) {
+	return nil, fmt.Errorf("%w: cannot encrypt %s", errLeaky, payload)
+}
+
+func (s leakySecretsService) Decrypt(_ context.Context, payload []byte) ([]byte, error) {
+	return nil, fmt.Errorf("%w: cannot decrypt %s", errLeaky, payload)
+}
+
+// leakySecretsPlugin fails to set secrets, echoing the value in the error
+type leakySecretsPlugin struct {
+	fakeGRPCSecretsPlugin
+	userFriendly bool
+}
+
+func (c *leakySecretsPlugin) SetSecret(_ context.Context, req *secretsmanagerplugin.SetSecretRequest, _ ...grpc.CallOption) (*secretsmanagerplugin.SetSecretResponse, error) {
+	if c.userFriendly {
+		return &secretsmanagerplugin.SetSecretResponse{UserFriendlyError: "value " + req.Value + " was refused"}, nil
+	}
+	return nil, fmt.Errorf("%w: cannot set %s", errLeaky, req.Value)
+}
+
+func assertRedacted(t *testing.T, err error) {
+	t.Helper()
+	require.Error(t, err)
+	for _, s := range []string{leakySecret, base64.StdEncoding.EncodeToString([]byte(leakySecret)), b64.EncodeToString([]byte(leakySecret))} {
+		assert.NotContains(t, err.Error(), s)
+	}
+	assert.Contains(t, err.Error(), redactedSecret)
+}
+
+func TestRedactSecrets(t *testing.T) {
+	t.Run("nil errors stay nil", func(t *testing.T) {
+		assert.NoError(t, RedactSecrets(nil, leakySecret))
+	})
+
+	t.Run("errors without secrets are returned as is", func(t *testing.T) {
+		assert.Equal(t, errLeaky, RedactSecrets(errLeaky, leakySecret))
+	})
+
+	t.Run("secrets and their base64 encodings are redacted", func(t *testing.T) {
+		err := fmt.Errorf("%w: %s %s", errLeaky, leakySecret, base64.StdEncoding.EncodeToString([]byte(leakySecret)))
+		redacted := RedactSecrets(err, leakySecret)
+		assertRedacted(t, redacted)
+		assert.ErrorIs(t, redacted, errLeaky)
+	})
+}
+
+func TestSecretsKVStoreSQL_RedactsErrors(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+
+	t.Run("set", func(t *testing.T) {
+		kv := NewSQLSecretsKVStore(sqlStore, leakySecretsService{}, log.New("test.logger"))
+		err := kv.Set(ctx, 1, "ns", "type", leakySecret)
+		assertRedacted(t, err)
+		assert.ErrorIs(t, err, errLeaky)
+		assert.Contains(t, err.Error(), "orgId=1, namespace=ns, type=type")
+	})
+
+	t.Run("get", func(t *testing.T) {
+		// store the secret unencrypted so that the ciphertext echoed by the failing decryption is the secret itself
+		err := sqlStore.WithNewDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			orgId, namespace, typ := int64(1), "ns", "type"
+			_, err := sess.Insert(&Item{OrgId: &orgId, Namespace: &namespace, Type: &typ, Value: b64.EncodeToString([]byte(leakySecret)), Created: time.Now(), Updated: time.Now()})
+			return err
+		})
+		require.NoError(t, err)
+
+		kv := NewSQLSecretsKVStore(sqlStore, leakySecretsService{}, log.New("test.logger"))
+		_, _, err = kv.Get(ctx, 1, "ns", "type")
+		assertRedacted(t, err)
+		assert.ErrorIs(t, err, errLeaky)
+	})
+}
+
+func TestSecretsKVStorePlugin_RedactsErrors(t *testing.T) {
+	ctx := context.Background()
+	t.Cleanup(ResetPlugin)
+	newStore := func(p secretsmanagerplugin.SecretsManagerPlugin) *SecretsKVStorePlugin {
+		store := &SecretsKVStorePlugin{secretsPlugin: p, log: log.New("test.logger")}
+		store.kvstore = GetNamespacedKVStore(kvstore.ProvideService(sqlstore.InitTestDB(t)))
+		return store
+	}
+
+	t.Run("set", func(t *testing.T) {
+		err := newStore(&leakySecretsPlugin{}).Set(ctx, 1, "ns", "type", leakySecret)
+		assertRedacted(t, err)
+		assert.ErrorIs(t, err, errLeaky)
+	})
+
+	t.Run("set with a user friendly error", func(t *testing.T) {
+		err := newStore(&leakySecretsPlugin{userFriendly: true}).Set(ctx, 1, "ns", "type", leakySecret)
+		assertRedacted(t, err)
+		var userFriendly datasources.ErrDatasourceSecretsPluginUserFriendly
+		require.ErrorAs(t, err, &userFriendly)
+		assertRedacted(t, userFriendly)
+	})
+}
@@ -0,0 +1,125 @@
+package kvstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+)
+
+// SizeSummary is the number and size of the secrets of an organization sharing a type and a namespace prefix.
+// It never includes the values of the secrets.
+type SizeSummary struct {
+	OrgId           int64
+	Type            string
+	NamespacePrefix string
+	Count           int64
+	// TotalSize is the size in bytes of the stored values, encrypted and encoded for the database
+	TotalSize int64
+}
+
+// AverageSize is the average size in bytes of the stored values
+func (s SizeSummary) AverageSize() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.TotalSize) / float64(s.Count)
+}
+
+// SummarizeSizes reports the number and size of the secrets by organization, type and the first prefixLength
+// characters of their namespace, ignoring the namespace when prefixLength is zero. To summarize the secrets of all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+// The database is summarized with aggregate queries. Other stores are summarized on a best-effort basis
+// from all their decrypted values, whose sizes differ from the sizes of the values as they are stored.
+func SummarizeSizes(ctx context.Context, store SecretsKVStore, orgId int64, prefixLength int) ([]SizeSummary, error) {
+	if unwrapped, err := GetUnwrappedStoreFromCache(store); err == nil {
+		store = unwrapped
+	}
+	if sqlStore, ok := store.(*SecretsKVStoreSQL); ok {
+		return sqlStore.SizeSummaries(ctx, orgId, prefixLength)
+	}
+	items, err := store.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return summarizeItemSizes(items, orgId, prefixLength), nil
+}
+
+// SizeSummaries implements SummarizeSizes for the database
+func (kv *SecretsKVStoreSQL) SizeSummaries(ctx context.Context, orgId int64, prefixLength int) ([]SizeSummary, error) {
+	if prefixLength < 0 {
+		return nil, fmt.Errorf("invalid namespace prefix length %d", prefixLength)
+	}
+	var summaries []SizeSummary
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		// postgres doesn't allow grouping by a constant, so the prefix is only grouped by when there is one
+		prefix, groupBy := "''", "org_id, type"
+		if prefixLength > 0 {
+			// prefixLength is an int, it can't be used for an injection
+			prefix = fmt.Sprintf("SUBSTR(namespace, 1, %d)", prefixLength)
+			groupBy += ", " + prefix
+		}
+		query := dbSession.Table("secrets").
+			Select(fmt.Sprintf("org_id, type, %s AS namespace_prefix, COUNT(*) AS count, COALESCE(SUM(LENGTH(value)), 0) AS total_size", prefix))
+		if orgId != AllOrganizations {
+			query.Where("org_id = ?", orgId)
+		}
+		return query.GroupBy(groupBy).
+			OrderBy("org_id, type, namespace_prefix").
+			Find(&summaries)
+	})
+	if err != nil {
+		kv.log.Error("error summarizing secret sizes", "orgId", orgId, "err", err)
+		return nil, err
+	}
+	return summaries, nil
+}
+
+func summarizeItemSizes(items []Item, orgId int64, prefixLength int) []SizeSummary {
+	type group struct {
+		orgId  int64
+		typ    string
+		prefix string
+	}
+	groups := make(map[group]*SizeSummary)
+	for _, item := range items {
+		if item.OrgId == nil || item.Namespace == nil || item.Type == nil {
+			continue
+		}
+		if orgId != AllOrganizations && *item.OrgId != orgId {
+			continue
+		}
+		prefix := ""
+		if prefixLength > 0 {
+			prefix = *item.Namespace
+			if runes := []rune(prefix); len(runes) > prefixLength {
+				prefix = string(runes[:prefixLength])
+			}
+		}
+		g := group{orgId: *item.OrgId, typ: *item.Type, prefix: prefix}
+		summary, ok := groups[g]
+		if !ok {
+			summary = &SizeSummary{OrgId: g.orgId, Type: g.typ, NamespacePrefix: g.prefix}
+			groups[g] = summary
+		}
+		summary.Count++
+		summary.TotalSize += int64(len(item.Value))
+	}
+
+	summaries := make([]SizeSummary, 0, len(groups))
+	for _, summary := range groups {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.OrgId != b.OrgId {
+			return a.OrgId < b.OrgId
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		return a.NamespacePrefix < b.NamespacePrefix
+	})
+	return summaries
+}
@@ -0,0 +1,98 @@
+package kvstore
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana/pkg/infra/log"
+	"github.com/grafana/grafana/pkg/services/secrets/fakes"
+	"github.com/grafana/grafana/pkg/services/secrets/manager"
+	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecretsKVStoreSQL_SizeSummaries(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+
+	ctx := context.Background()
+
+	// the values are inserted as is so that their sizes are known
+	seed := []struct {
+		orgId     int64
+		namespace string
+		typ       string
+		size      int
+	}{
+		{orgId: 1, namespace: "prom-a", typ: "datasource", size: 10},
+		{orgId: 1, namespace: "prom-b", typ: "datasource", size: 20},
+		{orgId: 1, namespace: "loki-a", typ: "datasource", size: 30},
+		{orgId: 1, namespace: "plugin", typ: "plugin", size: 5},
+		{orgId: 2, namespace: "prom-a", typ: "datasource", size: 40},
+	}
+	err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+		now := time.Now()
+		for _, s := range seed {
+			if _, err := sess.Exec("INSERT INTO secrets (org_id, namespace, type, value, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+				s.orgId, s.namespace, s.typ, strings.Repeat("a", s.size), now, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("summarizes an organization by type", func(t *testing.T) {
+		summaries, err := kv.SizeSummaries(ctx, 1, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []SizeSummary{
+			{OrgId: 1, Type: "datasource", Count: 3, TotalSize: 60},
+			{OrgId: 1, Type: "plugin", Count: 1, TotalSize: 5},
+		}, summaries)
+		assert.Equal(t, 20.0, summaries[0].AverageSize())
+	})
+
+	t.Run("summarizes all organizations by type and namespace prefix", func(t *testing.T) {
+		summaries, err := kv.SizeSummaries(ctx, AllOrganizations, 4)
+		require.NoError(t, err)
+		assert.Equal(t, []SizeSummary{
+			{OrgId: 1, Type: "datasource", NamespacePrefix: "loki", Count: 1, TotalSize: 30},
+			{OrgId: 1, Type: "datasource", NamespacePrefix: "prom", Count: 2, TotalSize: 30},
+			{OrgId: 1, Type: "plugin", NamespacePrefix: "plug", Count: 1, TotalSize: 5},
+			{OrgId: 2, Type: "datasource", NamespacePrefix: "prom", Count: 1, TotalSize: 40},
+		}, summaries)
+	})
+
+	t.Run("summarizes nothing for an organization without secrets", func(t *testing.T) {
+		summaries, err := kv.SizeSummaries(ctx, 3, 0)
+		require.NoError(t, err)
+		assert.Empty(t, summaries)
+	})
+
+	t.Run("a cached store is summarized by the database", func(t *testing.T) {
+		summaries, err := SummarizeSizes(ctx, WithCache(kv, time.Minute, time.Minute), 2, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []SizeSummary{{OrgId: 2, Type: "datasource", Count: 1, TotalSize: 40}}, summaries)
+	})
+}
+
+func TestSummarizeSizes_BestEffort(t *testing.T) {
+	ctx := context.Background()
+	store := NewInMemorySecretsKVStore()
+	require.NoError(t, store.Set(ctx, 1, "prom-a", "datasource", "1234"))
+	require.NoError(t, store.Set(ctx, 1, "prom-b", "datasource", "12"))
+	require.NoError(t, store.Set(ctx, 1, "loki-a", "datasource", "123456"))
+	require.NoError(t, store.Set(ctx, 2, "prom-a", "datasource", "1"))
+
+	summaries, err := SummarizeSizes(ctx, store, 1, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []SizeSummary{
+		{OrgId: 1, Type: "datasource", NamespacePrefix: "loki", Count: 1, TotalSize: 6},
+		{OrgId: 1, Type: "datasource", NamespacePrefix: "prom", Count: 2, TotalSize: 6},
+	}, summaries)
+	assert.Equal(t, 3.0, summaries[1].AverageSize())
+}
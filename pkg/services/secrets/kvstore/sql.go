@@ -1,8 +1,10 @@
 package kvstore
 
 import (
+	"container/list"
 	"context"
 	"encoding/base64"
+	"fmt"
 	"sync"
 	"time"
 
@@ -17,31 +19,95 @@ type SecretsKVStoreSQL struct {
 	sqlStore        sqlstore.Store
 	secretsService  secrets.Service
 	decryptionCache decryptionCache
+	maxValueSize    int
+	// compressionThreshold is the size in bytes above which values are compressed, zero or less disables it
+	compressionThreshold int
 }
 
+// decryptionCache keeps the decrypted values of the secrets by id. When maxEntries
+// is greater than zero, the least recently used entries are evicted once the cache is full.
+// The methods of decryptionCache must be called while holding its lock.
 type decryptionCache struct {
-	cache map[int64]cachedDecrypted
+	cache      map[int64]*list.Element
+	lru        *list.List
+	maxEntries int
 	sync.Mutex
 }
 
 type cachedDecrypted struct {
+	id      int64
 	updated time.Time
 	value   string
 }
 
+func newDecryptionCache(maxEntries int) decryptionCache {
+	return decryptionCache{
+		cache:      make(map[int64]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+func (c *decryptionCache) get(id int64) (cachedDecrypted, bool) {
+	elem, ok := c.cache[id]
+	if !ok {
+		return cachedDecrypted{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(cachedDecrypted), true
+}
+
+func (c *decryptionCache) set(entry cachedDecrypted) {
+	if elem, ok := c.cache[entry.id]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.cache[entry.id] = c.lru.PushFront(entry)
+	if c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.cache, oldest.Value.(cachedDecrypted).id)
+		decryptionCacheEvictionsCounter.Inc()
+	}
+}
+
+func (c *decryptionCache) delete(id int64) {
+	if elem, ok := c.cache[id]; ok {
+		c.lru.Remove(elem)
+		delete(c.cache, id)
+	}
+}
+
 var b64 = base64.RawStdEncoding
 
 func NewSQLSecretsKVStore(sqlStore sqlstore.Store, secretsService secrets.Service, logger log.Logger) *SecretsKVStoreSQL {
+	return NewSQLSecretsKVStoreWithCacheSize(sqlStore, secretsService, logger, 0)
+}
+
+// NewSQLSecretsKVStoreWithCacheSize returns a SecretsKVStoreSQL whose decryption cache holds at most
+// maxCacheEntries values, evicting the least recently used ones. Zero means the cache is unbounded.
+func NewSQLSecretsKVStoreWithCacheSize(sqlStore sqlstore.Store, secretsService secrets.Service, logger log.Logger, maxCacheEntries int) *SecretsKVStoreSQL {
 	return &SecretsKVStoreSQL{
-		sqlStore:       sqlStore,
-		secretsService: secretsService,
-		log:            logger,
-		decryptionCache: decryptionCache{
-			cache: make(map[int64]cachedDecrypted),
-		},
+		sqlStore:        sqlStore,
+		secretsService:  secretsService,
+		log:             logger,
+		decryptionCache: newDecryptionCache(maxCacheEntries),
 	}
 }
 
+// SetMaxValueSize sets the maximum size in bytes of the values accepted by Set.
+// Zero or less means values of any size are accepted.
+func (kv *SecretsKVStoreSQL) SetMaxValueSize(size int) {
+	kv.maxValueSize = size
+}
+
+// SetCompressionThreshold makes Set compress the values larger than size bytes before encrypting them.
+// Zero or less means values are never compressed. Values stored compressed are read back whatever the threshold.
+func (kv *SecretsKVStoreSQL) SetCompressionThreshold(size int) {
+	kv.compressionThreshold = size
+}
+
 // Get an item from the store
 func (kv *SecretsKVStoreSQL) Get(ctx context.Context, orgId int64, namespace string, typ string) (string, bool, error) {
 	item := Item{
@@ -58,7 +124,7 @@ func (kv *SecretsKVStoreSQL) Get(ctx context.Context, orgId int64, namespace str
 			kv.log.Error("error getting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 			return err
 		}
-		if !has {
+		if !has || item.expired(time.Now()) {
 			kv.log.Debug("secret value not found", "orgId", orgId, "type", typ, "namespace", namespace)
 			return nil
 		}
@@ -69,7 +135,8 @@ func (kv *SecretsKVStoreSQL) Get(ctx context.Context, orgId int64, namespace str
 	if err == nil && isFound {
 		decryptedValue, err = kv.getDecryptedValue(ctx, item)
 		if err != nil {
-			kv.log.Error("error decrypting secret value", "orgId", item.OrgId, "type", item.Type, "namespace", item.Namespace, "err", err)
+			err = secretError("decrypt", orgId, namespace, typ, err, item.ciphertexts()...)
+			kv.log.Error("error decrypting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 			return string(decryptedValue), isFound, err
 		}
 	}
@@ -78,10 +145,85 @@ func (kv *SecretsKVStoreSQL) Get(ctx context.Context, orgId int64, namespace str
 	return string(decryptedValue), isFound, err
 }
 
+// GetMany gets the items of the given types in a namespace with a single query
+func (kv *SecretsKVStoreSQL) GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error) {
+	values := make(map[string]string, len(typs))
+	if len(typs) == 0 {
+		return values, nil
+	}
+	var items []Item
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		return dbSession.Where("org_id = ? AND namespace = ?", orgId, namespace).In("type", typs).Find(&items)
+	})
+	if err != nil {
+		kv.log.Error("error getting secret values", "orgId", orgId, "namespace", namespace, "err", err)
+		return nil, err
+	}
+	now := time.Now()
+	for _, item := range items {
+		if item.expired(now) {
+			continue
+		}
+		decryptedValue, err := kv.getDecryptedValue(ctx, item)
+		if err != nil {
+			err = secretError("decrypt", orgId, namespace, *item.Type, err, item.ciphertexts()...)
+			kv.log.Error("error decrypting secret value", "orgId", orgId, "type", *item.Type, "namespace", namespace, "err", err)
+			return nil, err
+		}
+		values[*item.Type] = string(decryptedValue)
+	}
+	kv.log.Debug("got secret values", "orgId", orgId, "namespace", namespace, "count", len(values))
+	return values, nil
+}
+
+// Exists reports whether an item is in the store, the value is neither read nor decrypted
+func (kv *SecretsKVStoreSQL) Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error) {
+	item := Item{
+		OrgId:     &orgId,
+		Namespace: &namespace,
+		Type:      &typ,
+	}
+	var has bool
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		var err error
+		has, err = dbSession.Cols("id", "expires_at").Get(&item)
+		return err
+	})
+	if err != nil {
+		kv.log.Error("error checking secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+	}
+	return has && !item.expired(time.Now()), err
+}
+
 // Set an item in the store
 func (kv *SecretsKVStoreSQL) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
-	encryptedValue, err := kv.secretsService.Encrypt(ctx, []byte(value), secrets.WithoutScope())
+	return kv.set(ctx, orgId, namespace, typ, value, nil)
+}
+
+// SetWithTTL sets an item in the store that expires after ttl. Expired items are left in the database
+// until they are set again or deleted.
+func (kv *SecretsKVStoreSQL) SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("invalid ttl %s for secret (orgId=%d, namespace=%s, type=%s)", ttl, orgId, namespace, typ)
+	}
+	expiresAt := time.Now().Add(ttl)
+	return kv.set(ctx, orgId, namespace, typ, value, &expiresAt)
+}
+
+func (kv *SecretsKVStoreSQL) set(ctx context.Context, orgId int64, namespace string, typ string, value string, expiresAt *time.Time) error {
+	if err := checkValueSize("sql", kv.maxValueSize, value); err != nil {
+		kv.log.Error("rejected secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return err
+	}
+	payload, compression, err := compressValue(value, kv.compressionThreshold)
+	if err != nil {
+		err = secretError("compress", orgId, namespace, typ, err, value)
+		kv.log.Error("error compressing secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return err
+	}
+	encryptedValue, err := kv.secretsService.Encrypt(ctx, payload, secrets.WithoutScope())
 	if err != nil {
+		err = secretError("encrypt", orgId, namespace, typ, err, value)
 		kv.log.Error("error encrypting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 		return err
 	}
@@ -95,30 +237,40 @@ func (kv *SecretsKVStoreSQL) Set(ctx context.Context, orgId int64, namespace str
 
 		has, err := dbSession.Get(&item)
 		if err != nil {
+			err = secretError("set", orgId, namespace, typ, err, value, encodedValue)
 			kv.log.Error("error checking secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 			return err
 		}
 
-		if has && item.Value == encodedValue {
+		if has && item.Value == encodedValue && item.ExpiresAt == nil && expiresAt == nil {
 			kv.log.Debug("secret value not changed", "orgId", orgId, "type", typ, "namespace", namespace)
 			return nil
 		}
 
+		clearExpiry := item.ExpiresAt != nil && expiresAt == nil
 		item.Value = encodedValue
+		item.EncryptionVersion = EncryptionVersion(encryptedValue)
+		item.ExpiresAt = expiresAt
+		item.Compression = compression
 		item.Updated = time.Now()
 
 		if has {
-			// if item already exists we update it
-			_, err = dbSession.ID(item.Id).Update(&item)
+			// if item already exists we update it, xorm leaves out the nil expiry so it is cleared apart
+			_, err = dbSession.ID(item.Id).MustCols("compression").Update(&item)
+			if err == nil && clearExpiry {
+				_, err = dbSession.Exec("UPDATE secrets SET expires_at = NULL WHERE id = ?", item.Id)
+			}
 			if err != nil {
+				err = secretError("set", orgId, namespace, typ, err, value, encodedValue)
 				kv.log.Error("error updating secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 			} else {
 				kv.decryptionCache.Lock()
 				defer kv.decryptionCache.Unlock()
-				kv.decryptionCache.cache[item.Id] = cachedDecrypted{
+				kv.decryptionCache.set(cachedDecrypted{
+					id:      item.Id,
 					updated: item.Updated,
 					value:   value,
-				}
+				})
 				kv.log.Debug("secret value updated", "orgId", orgId, "type", typ, "namespace", namespace)
 			}
 			return err
@@ -128,6 +280,7 @@ func (kv *SecretsKVStoreSQL) Set(ctx context.Context, orgId int64, namespace str
 		item.Created = item.Updated
 		_, err = dbSession.Insert(&item)
 		if err != nil {
+			err = secretError("set", orgId, namespace, typ, err, value, encodedValue)
 			kv.log.Error("error inserting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
 		} else {
 			kv.log.Debug("secret value inserted", "orgId", orgId, "type", typ, "namespace", namespace)
@@ -136,6 +289,187 @@ func (kv *SecretsKVStoreSQL) Set(ctx context.Context, orgId int64, namespace str
 	})
 }
 
+// CompareAndSwap sets an item to newValue only if its value is oldValue. The encryption of a value changes every
+// time, so the stored value is decrypted and compared, then only updated if it wasn't changed in the meantime.
+func (kv *SecretsKVStoreSQL) CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error) {
+	if err := checkValueSize("sql", kv.maxValueSize, newValue); err != nil {
+		kv.log.Error("rejected secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	item := Item{
+		OrgId:     &orgId,
+		Namespace: &namespace,
+		Type:      &typ,
+	}
+	var has bool
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		var err error
+		has, err = dbSession.Get(&item)
+		return err
+	})
+	if err != nil {
+		kv.log.Error("error getting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	if !has || item.expired(time.Now()) {
+		return false, nil
+	}
+	decryptedValue, err := kv.getDecryptedValue(ctx, item)
+	if err != nil {
+		err = secretError("decrypt", orgId, namespace, typ, err, item.ciphertexts()...)
+		kv.log.Error("error decrypting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	if string(decryptedValue) != oldValue {
+		return false, nil
+	}
+
+	payload, compression, err := compressValue(newValue, kv.compressionThreshold)
+	if err != nil {
+		err = secretError("compress", orgId, namespace, typ, err, newValue)
+		kv.log.Error("error compressing secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	encryptedValue, err := kv.secretsService.Encrypt(ctx, payload, secrets.WithoutScope())
+	if err != nil {
+		err = secretError("encrypt", orgId, namespace, typ, err, newValue)
+		kv.log.Error("error encrypting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	compared := item.Value
+	clearExpiry := item.ExpiresAt != nil
+	item.Value = b64.EncodeToString(encryptedValue)
+	item.EncryptionVersion = EncryptionVersion(encryptedValue)
+	item.ExpiresAt = nil
+	item.Compression = compression
+	item.Updated = time.Now()
+
+	var swapped bool
+	err = kv.sqlStore.WithTransactionalDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		// the update is skipped if the value was changed since it was compared
+		updated, err := dbSession.ID(item.Id).Where("value = ?", compared).MustCols("compression").Update(&item)
+		if err != nil || updated == 0 {
+			return err
+		}
+		if clearExpiry {
+			if _, err := dbSession.Exec("UPDATE secrets SET expires_at = NULL WHERE id = ?", item.Id); err != nil {
+				return err
+			}
+		}
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		err = secretError("set", orgId, namespace, typ, err, newValue, item.Value)
+		kv.log.Error("error updating secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	if !swapped {
+		kv.log.Debug("secret value changed concurrently, not swapped", "orgId", orgId, "type", typ, "namespace", namespace)
+		return false, nil
+	}
+	kv.decryptionCache.Lock()
+	defer kv.decryptionCache.Unlock()
+	kv.decryptionCache.set(cachedDecrypted{
+		id:      item.Id,
+		updated: item.Updated,
+		value:   newValue,
+	})
+	kv.log.Debug("secret value swapped", "orgId", orgId, "type", typ, "namespace", namespace)
+	return true, nil
+}
+
+// SetIfAbsent sets an item only if it is missing or expired. A missing item is inserted, so that of two
+// concurrent calls the unique index on the key only lets one through, and an expired item is only updated
+// while it is still expired.
+func (kv *SecretsKVStoreSQL) SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error) {
+	if err := checkValueSize("sql", kv.maxValueSize, value); err != nil {
+		kv.log.Error("rejected secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	item := Item{
+		OrgId:     &orgId,
+		Namespace: &namespace,
+		Type:      &typ,
+	}
+	var has bool
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		var err error
+		has, err = dbSession.Cols("id", "expires_at").Get(&item)
+		return err
+	})
+	if err != nil {
+		kv.log.Error("error getting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	if has && !item.expired(time.Now()) {
+		return false, nil
+	}
+
+	payload, compression, err := compressValue(value, kv.compressionThreshold)
+	if err != nil {
+		err = secretError("compress", orgId, namespace, typ, err, value)
+		kv.log.Error("error compressing secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	encryptedValue, err := kv.secretsService.Encrypt(ctx, payload, secrets.WithoutScope())
+	if err != nil {
+		err = secretError("encrypt", orgId, namespace, typ, err, value)
+		kv.log.Error("error encrypting secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	item.Value = b64.EncodeToString(encryptedValue)
+	item.EncryptionVersion = EncryptionVersion(encryptedValue)
+	item.ExpiresAt = nil
+	item.Compression = compression
+	item.Updated = time.Now()
+
+	var set bool
+	if has {
+		err = kv.sqlStore.WithTransactionalDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+			// the update is skipped if the item was set again since it was read, which made it live again
+			updated, err := dbSession.ID(item.Id).Where("expires_at IS NOT NULL AND expires_at <= ?", time.Now()).MustCols("compression").Update(&item)
+			if err != nil || updated == 0 {
+				return err
+			}
+			if _, err := dbSession.Exec("UPDATE secrets SET expires_at = NULL WHERE id = ?", item.Id); err != nil {
+				return err
+			}
+			set = true
+			return nil
+		})
+	} else {
+		item.Created = item.Updated
+		err = kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+			_, err := dbSession.Insert(&item)
+			if err != nil && kv.sqlStore.GetDialect().IsUniqueConstraintViolation(err) {
+				// inserted concurrently
+				return nil
+			}
+			set = err == nil
+			return err
+		})
+	}
+	if err != nil {
+		err = secretError("set", orgId, namespace, typ, err, value, item.Value)
+		kv.log.Error("error setting absent secret value", "orgId", orgId, "type", typ, "namespace", namespace, "err", err)
+		return false, err
+	}
+	if !set {
+		kv.log.Debug("secret value set concurrently, not set", "orgId", orgId, "type", typ, "namespace", namespace)
+		return false, nil
+	}
+	kv.decryptionCache.Lock()
+	defer kv.decryptionCache.Unlock()
+	kv.decryptionCache.set(cachedDecrypted{
+		id:      item.Id,
+		updated: item.Updated,
+		value:   value,
+	})
+	kv.log.Debug("absent secret value set", "orgId", orgId, "type", typ, "namespace", namespace)
+	return true, nil
+}
+
 // Del deletes an item from the store.
 func (kv *SecretsKVStoreSQL) Del(ctx context.Context, orgId int64, namespace string, typ string) error {
 	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
@@ -159,7 +493,7 @@ func (kv *SecretsKVStoreSQL) Del(ctx context.Context, orgId int64, namespace str
 			} else {
 				kv.decryptionCache.Lock()
 				defer kv.decryptionCache.Unlock()
-				delete(kv.decryptionCache.cache, item.Id)
+				kv.decryptionCache.delete(item.Id)
 				kv.log.Debug("secret value deleted", "orgId", orgId, "type", typ, "namespace", namespace)
 			}
 			return err
@@ -169,12 +503,47 @@ func (kv *SecretsKVStoreSQL) Del(ctx context.Context, orgId int64, namespace str
 	return err
 }
 
-// Keys get all keys for a given namespace. To query for all
+// DelAll deletes the items of every type in a namespace at once. To delete them in all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *SecretsKVStoreSQL) DelAll(ctx context.Context, orgId int64, namespace string) error {
+	return kv.sqlStore.WithTransactionalDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		var ids []int64
+		query := dbSession.Table(&Item{}).Cols("id").Where("namespace = ?", namespace)
+		if orgId != AllOrganizations {
+			query.And("org_id = ?", orgId)
+		}
+		if err := query.Find(&ids); err != nil {
+			kv.log.Error("error listing secret values", "orgId", orgId, "namespace", namespace, "err", err)
+			return err
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		query = dbSession.Where("namespace = ?", namespace)
+		if orgId != AllOrganizations {
+			query.And("org_id = ?", orgId)
+		}
+		if _, err := query.Delete(&Item{}); err != nil {
+			kv.log.Error("error deleting secret values", "orgId", orgId, "namespace", namespace, "err", err)
+			return err
+		}
+		kv.decryptionCache.Lock()
+		defer kv.decryptionCache.Unlock()
+		for _, id := range ids {
+			kv.decryptionCache.delete(id)
+		}
+		kv.log.Debug("secret values deleted", "orgId", orgId, "namespace", namespace, "count", len(ids))
+		return nil
+	})
+}
+
+// Keys get all keys for a given namespace, expired secrets aside. To query for all
 // organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
 func (kv *SecretsKVStoreSQL) Keys(ctx context.Context, orgId int64, namespace string, typ string) ([]Key, error) {
 	var keys []Key
 	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
-		query := dbSession.Where("namespace = ?", namespace).And("type = ?", typ)
+		query := dbSession.Where("namespace = ?", namespace).And("type = ?", typ).And("expires_at IS NULL OR expires_at > ?", time.Now())
 		if orgId != AllOrganizations {
 			query.And("org_id = ?", orgId)
 		}
@@ -183,8 +552,26 @@ func (kv *SecretsKVStoreSQL) Keys(ctx context.Context, orgId int64, namespace st
 	return keys, err
 }
 
+// Namespaces lists the namespaces holding an item of any type, expired items aside. To list them in all
+// organizations the constant 'kvstore.AllOrganizations' can be passed as orgId.
+func (kv *SecretsKVStoreSQL) Namespaces(ctx context.Context, orgId int64) ([]string, error) {
+	namespaces := make([]string, 0)
+	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
+		query := dbSession.Table(&Item{}).Distinct("namespace").Where("expires_at IS NULL OR expires_at > ?", time.Now())
+		if orgId != AllOrganizations {
+			query.And("org_id = ?", orgId)
+		}
+		return query.OrderBy("namespace").Find(&namespaces)
+	})
+	if err != nil {
+		kv.log.Error("error listing secret namespaces", "orgId", orgId, "err", err)
+		return nil, err
+	}
+	return namespaces, nil
+}
+
 // Rename an item in the store
-func (kv *SecretsKVStoreSQL) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string) error {
+func (kv *SecretsKVStoreSQL) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
 	return kv.sqlStore.WithTransactionalDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
 		item := Item{
 			OrgId:     &orgId,
@@ -198,6 +585,12 @@ func (kv *SecretsKVStoreSQL) Rename(ctx context.Context, orgId int64, namespace
 			return err
 		}
 
+		if has && newNamespace != namespace {
+			if err := kv.deleteRenameTarget(dbSession, orgId, newNamespace, typ, overwrite); err != nil {
+				return err
+			}
+		}
+
 		item.Namespace = &newNamespace
 		item.Updated = time.Now()
 
@@ -216,8 +609,38 @@ func (kv *SecretsKVStoreSQL) Rename(ctx context.Context, orgId int64, namespace
 	})
 }
 
+// deleteRenameTarget makes room for a secret renamed to newNamespace, which must not be taken unless overwrite is true
+func (kv *SecretsKVStoreSQL) deleteRenameTarget(dbSession *sqlstore.DBSession, orgId int64, newNamespace string, typ string, overwrite bool) error {
+	target := Item{
+		OrgId:     &orgId,
+		Namespace: &newNamespace,
+		Type:      &typ,
+	}
+	exists, err := dbSession.Get(&target)
+	if err != nil {
+		kv.log.Error("error checking secret value", "orgId", orgId, "type", typ, "namespace", newNamespace, "err", err)
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	// an expired secret is no longer returned, it doesn't keep the namespace taken
+	if !overwrite && !target.expired(time.Now()) {
+		return secretAlreadyExistsError(orgId, newNamespace, typ)
+	}
+	if _, err := dbSession.ID(target.Id).Delete(&Item{}); err != nil {
+		kv.log.Error("error deleting overwritten secret value", "orgId", orgId, "type", typ, "namespace", newNamespace, "err", err)
+		return err
+	}
+	kv.decryptionCache.Lock()
+	defer kv.decryptionCache.Unlock()
+	kv.decryptionCache.delete(target.Id)
+	return nil
+}
+
 // GetAll this returns all the secrets stored in the database. This is not part of the kvstore interface as we
-// only need it for migration from sql to plugin at this moment
+// only need it for migration from sql to plugin at this moment. The secrets that can't be decrypted are logged
+// and returned with an empty value.
 func (kv *SecretsKVStoreSQL) GetAll(ctx context.Context) ([]Item, error) {
 	var items []Item
 	err := kv.sqlStore.WithDbSession(ctx, func(dbSession *sqlstore.DBSession) error {
@@ -231,39 +654,50 @@ func (kv *SecretsKVStoreSQL) GetAll(ctx context.Context) ([]Item, error) {
 	// decrypting values
 	for i := range items {
 		value, err := kv.getDecryptedValue(ctx, items[i])
-		items[i].Value = string(value)
 		if err != nil {
-			kv.log.Error("error decrypting secret value", "orgId", items[i].OrgId, "type", items[i].Type, "namespace", items[i].Namespace, "err", err)
+			err = secretError("decrypt", *items[i].OrgId, *items[i].Namespace, *items[i].Type, err, items[i].ciphertexts()...)
+			kv.log.Error("error decrypting secret value", "orgId", *items[i].OrgId, "type", *items[i].Type, "namespace", *items[i].Namespace, "err", err)
 		}
+		items[i].Value = string(value)
 	}
 
-	return items, err
+	return items, nil
 }
 
+// getDecryptedValue decrypts the value of the item, or gets it from the decryption cache. The cache is not locked
+// while decrypting so that concurrent reads of other secrets don't wait for it.
 func (kv *SecretsKVStoreSQL) getDecryptedValue(ctx context.Context, item Item) ([]byte, error) {
 	kv.decryptionCache.Lock()
-	defer kv.decryptionCache.Unlock()
-	var decryptedValue []byte
-	var err error
-
-	if cache, ok := kv.decryptionCache.cache[item.Id]; ok && item.Updated.Equal(cache.updated) {
-		return []byte(cache.value), err
+	cache, ok := kv.decryptionCache.get(item.Id)
+	kv.decryptionCache.Unlock()
+	if ok && item.Updated.Equal(cache.updated) {
+		return []byte(cache.value), nil
 	}
 
 	decodedValue, err := b64.DecodeString(item.Value)
 	if err != nil {
-		return decryptedValue, err
+		return nil, err
 	}
 
-	decryptedValue, err = kv.secretsService.Decrypt(ctx, decodedValue)
+	decryptedValue, err := kv.secretsService.Decrypt(ctx, decodedValue)
 	if err != nil {
 		return decryptedValue, err
 	}
+	decryptedValue, err = decompressValue(decryptedValue, item.Compression)
+	if err != nil {
+		return nil, err
+	}
 
-	kv.decryptionCache.cache[item.Id] = cachedDecrypted{
-		updated: item.Updated,
-		value:   string(decryptedValue),
+	kv.decryptionCache.Lock()
+	defer kv.decryptionCache.Unlock()
+	// a concurrent Set may have cached a newer value in the meantime
+	if cache, ok := kv.decryptionCache.get(item.Id); !ok || !cache.updated.After(item.Updated) {
+		kv.decryptionCache.set(cachedDecrypted{
+			id:      item.Id,
+			updated: item.Updated,
+			value:   string(decryptedValue),
+		})
 	}
 
-	return decryptedValue, err
+	return decryptedValue, nil
 }
@@ -2,13 +2,20 @@ package kvstore
 
 import (
 	"context"
+	"crypto/rand"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/log"
 	"github.com/grafana/grafana/pkg/services/secrets/fakes"
 	"github.com/grafana/grafana/pkg/services/secrets/manager"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -95,6 +102,42 @@ func TestSecretsKVStoreSQL(t *testing.T) {
 		}
 	})
 
+	t.Run("existence of keys", func(t *testing.T) {
+		for _, tc := range testCases {
+			exists, err := kv.Exists(ctx, tc.OrgId, tc.Namespace, tc.Type)
+			require.NoError(t, err)
+			require.True(t, exists)
+		}
+		exists, err := With(kv, 2, "namespace1", "testing1").Exists(ctx)
+		require.NoError(t, err)
+		require.False(t, exists)
+	})
+
+	t.Run("get many keys", func(t *testing.T) {
+		values, err := kv.GetMany(ctx, 1, "namespace1", []string{"testing1", "testing3", "missing"})
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"testing1": testCases[2].Value()}, values)
+
+		values, err = kv.GetMany(ctx, 1, "namespace1", nil)
+		require.NoError(t, err)
+		require.Empty(t, values)
+	})
+
+	t.Run("existence of keys whose value can't be decrypted", func(t *testing.T) {
+		err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.Exec("INSERT INTO secrets (org_id, namespace, type, value, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
+				3, "undecryptable", "testing", "not a ciphertext", time.Now(), time.Now())
+			return err
+		})
+		require.NoError(t, err)
+		_, _, err = kv.Get(ctx, 3, "undecryptable", "testing")
+		require.Error(t, err)
+		exists, err := kv.Exists(ctx, 3, "undecryptable", "testing")
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.NoError(t, kv.Del(ctx, 3, "undecryptable", "testing"))
+	})
+
 	t.Run("modify existing key", func(t *testing.T) {
 		tc := testCases[0]
 
@@ -301,3 +344,752 @@ func TestSecretsKVStoreSQL(t *testing.T) {
 		require.Equal(t, 6, found, "querying for all secrets should return 6 records")
 	})
 }
+
+func TestSecretsKVStoreSQL_SetWithTTL(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	ctx := context.Background()
+
+	expire := func(t *testing.T, namespace string) {
+		t.Helper()
+		require.NoError(t, kv.SetWithTTL(ctx, 1, namespace, "token", "expired", time.Millisecond))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("a live secret is returned", func(t *testing.T) {
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "live", "token", "live", time.Hour))
+		value, ok, err := kv.Get(ctx, 1, "live", "token")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "live", value)
+		exists, err := kv.Exists(ctx, 1, "live", "token")
+		require.NoError(t, err)
+		assert.True(t, exists)
+	})
+
+	t.Run("an expired secret is absent", func(t *testing.T) {
+		expire(t, "expired")
+		value, ok, err := kv.Get(ctx, 1, "expired", "token")
+		require.NoError(t, err)
+		assert.False(t, ok)
+		assert.Empty(t, value)
+		exists, err := kv.Exists(ctx, 1, "expired", "token")
+		require.NoError(t, err)
+		assert.False(t, exists)
+		values, err := kv.GetMany(ctx, 1, "expired", []string{"token"})
+		require.NoError(t, err)
+		assert.Empty(t, values)
+		keys, err := kv.Keys(ctx, 1, "expired", "token")
+		require.NoError(t, err)
+		assert.Empty(t, keys)
+	})
+
+	t.Run("setting an expired secret again makes it never expire", func(t *testing.T) {
+		expire(t, "renewed")
+		require.NoError(t, kv.Set(ctx, 1, "renewed", "token", "renewed"))
+		value, ok, err := kv.Get(ctx, 1, "renewed", "token")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "renewed", value)
+	})
+
+	t.Run("an expired secret doesn't keep its namespace taken", func(t *testing.T) {
+		expire(t, "target")
+		require.NoError(t, kv.Set(ctx, 1, "source", "token", "moved"))
+		require.NoError(t, kv.Rename(ctx, 1, "source", "token", "target", false))
+		value, ok, err := kv.Get(ctx, 1, "target", "token")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, "moved", value)
+	})
+
+	t.Run("a ttl must be positive", func(t *testing.T) {
+		require.Error(t, kv.SetWithTTL(ctx, 1, "invalid", "token", "value", 0))
+	})
+}
+
+func TestSecretsKVStoreSQL_ConcurrentAccess(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStoreWithCacheSize(sqlStore, secretsService, log.New("test.logger"), 4)
+	ctx := context.Background()
+
+	typs := make([]string, 8)
+	for i := range typs {
+		typs[i] = fmt.Sprintf("type%d", i)
+		require.NoError(t, kv.Set(ctx, 1, "ns", typs[i], "value"))
+	}
+
+	// run with -race, the readers share the decryption cache, which holds fewer entries than there are secrets
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				value, ok, err := kv.Get(ctx, 1, "ns", typs[(i+j)%len(typs)])
+				if err == nil && (!ok || value != "value") {
+					err = fmt.Errorf("unexpected value %q", value)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+}
+
+func TestSecretsKVStoreSQL_DecryptionCacheEviction(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStoreWithCacheSize(sqlStore, secretsService, log.New("test.logger"), 2)
+
+	ctx := context.Background()
+
+	testCases := []*TestCase{
+		{OrgId: 1, Namespace: "namespace1", Type: "testing"},
+		{OrgId: 1, Namespace: "namespace2", Type: "testing"},
+		{OrgId: 1, Namespace: "namespace3", Type: "testing"},
+	}
+	for _, tc := range testCases {
+		err := kv.Set(ctx, tc.OrgId, tc.Namespace, tc.Type, tc.Value())
+		require.NoError(t, err)
+	}
+
+	cachedValues := func() []string {
+		kv.decryptionCache.Lock()
+		defer kv.decryptionCache.Unlock()
+		values := make([]string, 0, kv.decryptionCache.lru.Len())
+		for e := kv.decryptionCache.lru.Front(); e != nil; e = e.Next() {
+			values = append(values, e.Value.(cachedDecrypted).value)
+		}
+		return values
+	}
+
+	get := func(tc *TestCase) {
+		value, ok, err := kv.Get(ctx, tc.OrgId, tc.Namespace, tc.Type)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, tc.Value(), value)
+	}
+
+	evictionsBefore := testutil.ToFloat64(decryptionCacheEvictionsCounter)
+
+	get(testCases[0])
+	get(testCases[1])
+	// access the first secret again so the second one becomes the least recently used
+	get(testCases[0])
+	require.Equal(t, []string{testCases[0].Value(), testCases[1].Value()}, cachedValues())
+
+	t.Run("exceeding the cap evicts the least recently used entry", func(t *testing.T) {
+		get(testCases[2])
+		require.Equal(t, []string{testCases[2].Value(), testCases[0].Value()}, cachedValues())
+		require.Equal(t, evictionsBefore+1, testutil.ToFloat64(decryptionCacheEvictionsCounter))
+	})
+
+	t.Run("re-accessing an evicted entry repopulates it", func(t *testing.T) {
+		get(testCases[1])
+		require.Equal(t, []string{testCases[1].Value(), testCases[2].Value()}, cachedValues())
+		require.Equal(t, evictionsBefore+2, testutil.ToFloat64(decryptionCacheEvictionsCounter))
+	})
+}
+
+func TestSecretsKVStoreSQL_MaxValueSize(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	kv.SetMaxValueSize(8)
+
+	ctx := context.Background()
+
+	t.Run("values within the limit are stored", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 1, "ns", "small", "12345678"))
+	})
+
+	t.Run("oversized values are rejected before being written", func(t *testing.T) {
+		err := kv.Set(ctx, 1, "ns", "large", "123456789")
+		require.ErrorIs(t, err, ErrSecretValueTooLarge)
+		assert.Contains(t, err.Error(), "limit of 8 bytes of the sql backend")
+
+		_, exists, err := kv.Get(ctx, 1, "ns", "large")
+		require.NoError(t, err)
+		assert.False(t, exists)
+	})
+}
+
+func TestSecretsKVStoreSQL_Compression(t *testing.T) {
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	kv.SetCompressionThreshold(64)
+	ctx := context.Background()
+
+	stored := func(t *testing.T, typ string) Item {
+		t.Helper()
+		item := Item{}
+		err := sqlStore.WithDbSession(ctx, func(sess *sqlstore.DBSession) error {
+			_, err := sess.Where("org_id = ? AND namespace = ? AND type = ?", 1, "ns", typ).Get(&item)
+			return err
+		})
+		require.NoError(t, err)
+		return item
+	}
+	// a new store has no decryption cache, the value is decrypted and decompressed from the database
+	roundTrip := func(t *testing.T, typ string, value string) {
+		t.Helper()
+		got, exists, err := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger")).Get(ctx, 1, "ns", typ)
+		require.NoError(t, err)
+		require.True(t, exists)
+		require.Equal(t, value, got)
+	}
+
+	small := `{"token":"small"}`
+	large := `{"tokens":[` + strings.Repeat(`"a repeated token",`, 200) + `"last"]}`
+	random := make([]byte, 512)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+	incompressible := string(random)
+
+	t.Run("values within the threshold are stored uncompressed", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 1, "ns", "small", small))
+		assert.Empty(t, stored(t, "small").Compression)
+		roundTrip(t, "small", small)
+	})
+
+	t.Run("values above the threshold are stored compressed", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 1, "ns", "large", large))
+		item := stored(t, "large")
+		assert.Equal(t, gzipCompression, item.Compression)
+		assert.Less(t, len(item.Value), len(large))
+		roundTrip(t, "large", large)
+	})
+
+	t.Run("values that don't shrink are stored uncompressed", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 1, "ns", "incompressible", incompressible))
+		assert.Empty(t, stored(t, "incompressible").Compression)
+		roundTrip(t, "incompressible", incompressible)
+	})
+
+	t.Run("a compressed value replaced by a small one is no longer compressed", func(t *testing.T) {
+		require.NoError(t, kv.Set(ctx, 1, "ns", "large", small))
+		assert.Empty(t, stored(t, "large").Compression)
+		roundTrip(t, "large", small)
+
+		swapped, err := kv.CompareAndSwap(ctx, 1, "ns", "large", small, large)
+		require.NoError(t, err)
+		require.True(t, swapped)
+		assert.Equal(t, gzipCompression, stored(t, "large").Compression)
+		roundTrip(t, "large", large)
+	})
+
+	t.Run("compressed values are read without a threshold", func(t *testing.T) {
+		kv.SetCompressionThreshold(0)
+		value, exists, err := kv.Get(ctx, 1, "ns", "large")
+		require.NoError(t, err)
+		require.True(t, exists)
+		assert.Equal(t, large, value)
+	})
+}
+
+func TestSecretsKVStore_RenameCollision(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			orgId := int64(1)
+
+			require.NoError(t, kv.Set(ctx, orgId, "old", "type", "old value"))
+			require.NoError(t, kv.Set(ctx, orgId, "taken", "type", "taken value"))
+
+			t.Run("renaming to the namespace of another secret fails", func(t *testing.T) {
+				err := kv.Rename(ctx, orgId, "old", "type", "taken", false)
+				require.ErrorIs(t, err, ErrSecretAlreadyExists)
+
+				value, exists, err := kv.Get(ctx, orgId, "old", "type")
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, "old value", value)
+				value, _, err = kv.Get(ctx, orgId, "taken", "type")
+				require.NoError(t, err)
+				assert.Equal(t, "taken value", value)
+			})
+
+			t.Run("renaming with overwrite replaces the other secret", func(t *testing.T) {
+				require.NoError(t, kv.Rename(ctx, orgId, "old", "type", "taken", true))
+
+				_, exists, err := kv.Get(ctx, orgId, "old", "type")
+				require.NoError(t, err)
+				assert.False(t, exists)
+				value, exists, err := kv.Get(ctx, orgId, "taken", "type")
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, "old value", value)
+			})
+
+			t.Run("renaming a missing secret leaves the target alone", func(t *testing.T) {
+				require.NoError(t, kv.Rename(ctx, orgId, "missing", "type", "taken", true))
+
+				value, exists, err := kv.Get(ctx, orgId, "taken", "type")
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, "old value", value)
+			})
+		})
+	}
+}
+
+func TestPluginSecretsKVStore_RenameCollision(t *testing.T) {
+	ctx := context.Background()
+	newStore := func() (*SecretsKVStorePlugin, *fakeGRPCSecretsPlugin) {
+		p := &fakeGRPCSecretsPlugin{kv: map[Key]string{
+			buildKey(1, "old", "type"):   "old value",
+			buildKey(1, "taken", "type"): "taken value",
+		}}
+		return &SecretsKVStorePlugin{secretsPlugin: p, log: log.New("test.logger")}, p
+	}
+
+	t.Run("renaming to the namespace of another secret fails", func(t *testing.T) {
+		kv, p := newStore()
+		err := kv.Rename(ctx, 1, "old", "type", "taken", false)
+		require.ErrorIs(t, err, ErrSecretAlreadyExists)
+		assert.Equal(t, "old value", p.kv[buildKey(1, "old", "type")])
+		assert.Equal(t, "taken value", p.kv[buildKey(1, "taken", "type")])
+	})
+
+	t.Run("renaming with overwrite replaces the other secret", func(t *testing.T) {
+		kv, p := newStore()
+		require.NoError(t, kv.Rename(ctx, 1, "old", "type", "taken", true))
+		assert.NotContains(t, p.kv, buildKey(1, "old", "type"))
+		assert.Equal(t, "old value", p.kv[buildKey(1, "taken", "type")])
+	})
+}
+
+func TestSecretsKVStore_KeysOfAllOrganizations(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+		"cache": func(t *testing.T) SecretsKVStore {
+			return WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		},
+		"fake": func(t *testing.T) SecretsKVStore {
+			return NewFakeSecretsKVStore()
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			for _, orgId := range []int64{1, 2, 3} {
+				require.NoError(t, kv.Set(ctx, orgId, "inventory", "type", fmt.Sprintf("value of org %d", orgId)))
+			}
+			require.NoError(t, kv.Set(ctx, 1, "inventory", "other", "other type"))
+			require.NoError(t, kv.Set(ctx, 1, "other", "type", "other namespace"))
+
+			keys, err := kv.Keys(ctx, AllOrganizations, "inventory", "type")
+			require.NoError(t, err)
+			sort.Slice(keys, func(i, j int) bool { return keys[i].OrgId < keys[j].OrgId })
+			assert.Equal(t, []Key{
+				{OrgId: 1, Namespace: "inventory", Type: "type"},
+				{OrgId: 2, Namespace: "inventory", Type: "type"},
+				{OrgId: 3, Namespace: "inventory", Type: "type"},
+			}, keys)
+
+			// the keys are used to get the secret of every organization
+			for _, key := range keys {
+				value, exists, err := kv.Get(ctx, key.OrgId, key.Namespace, key.Type)
+				require.NoError(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, fmt.Sprintf("value of org %d", key.OrgId), value)
+			}
+
+			keys, err = kv.Keys(ctx, 2, "inventory", "type")
+			require.NoError(t, err)
+			assert.Equal(t, []Key{{OrgId: 2, Namespace: "inventory", Type: "type"}}, keys)
+		})
+	}
+}
+
+func TestSecretsKVStore_CompareAndSwap(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+		"cache": func(t *testing.T) SecretsKVStore {
+			return WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			value := func(t *testing.T) string {
+				t.Helper()
+				value, _, err := kv.Get(ctx, 1, "cas", "type")
+				require.NoError(t, err)
+				return value
+			}
+
+			swapped, err := kv.CompareAndSwap(ctx, 1, "cas", "type", "", "created")
+			require.NoError(t, err)
+			assert.False(t, swapped, "a missing secret is not created")
+			exists, err := kv.Exists(ctx, 1, "cas", "type")
+			require.NoError(t, err)
+			assert.False(t, exists)
+
+			require.NoError(t, kv.Set(ctx, 1, "cas", "type", "first"))
+			swapped, err = kv.CompareAndSwap(ctx, 1, "cas", "type", "first", "second")
+			require.NoError(t, err)
+			assert.True(t, swapped)
+			assert.Equal(t, "second", value(t))
+
+			// a session still holding the first value doesn't overwrite the second one
+			swapped, err = kv.CompareAndSwap(ctx, 1, "cas", "type", "first", "lost update")
+			require.NoError(t, err)
+			assert.False(t, swapped)
+			assert.Equal(t, "second", value(t))
+		})
+	}
+
+	t.Run("an expired secret is not swapped", func(t *testing.T) {
+		kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "cas", "expiring", "value", time.Millisecond))
+		time.Sleep(5 * time.Millisecond)
+		swapped, err := kv.CompareAndSwap(ctx, 1, "cas", "expiring", "value", "new value")
+		require.NoError(t, err)
+		assert.False(t, swapped)
+	})
+
+	t.Run("a swapped secret no longer expires", func(t *testing.T) {
+		kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		require.NoError(t, kv.SetWithTTL(ctx, 1, "cas", "expiring", "value", time.Hour))
+		swapped, err := kv.CompareAndSwap(ctx, 1, "cas", "expiring", "value", "new value")
+		require.NoError(t, err)
+		require.True(t, swapped)
+		items, err := kv.GetAll(ctx)
+		require.NoError(t, err)
+		for _, item := range items {
+			if *item.Type == "expiring" {
+				assert.Nil(t, item.ExpiresAt)
+				assert.Equal(t, "new value", item.Value)
+			}
+		}
+	})
+}
+
+func TestSecretsKVStore_SetIfAbsent(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+		"cache": func(t *testing.T) SecretsKVStore {
+			return WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			set, err := kv.SetIfAbsent(ctx, 1, "absent", "type", "first")
+			require.NoError(t, err)
+			assert.True(t, set)
+
+			set, err = kv.SetIfAbsent(ctx, 1, "absent", "type", "second")
+			require.NoError(t, err)
+			assert.False(t, set)
+			value, exists, err := kv.Get(ctx, 1, "absent", "type")
+			require.NoError(t, err)
+			assert.True(t, exists)
+			assert.Equal(t, "first", value)
+		})
+	}
+
+	for _, name := range []string{"sql", "memory"} {
+		t.Run(name+": an expired secret is absent", func(t *testing.T) {
+			kv := stores[name](t)
+			require.NoError(t, kv.SetWithTTL(ctx, 1, "absent", "expiring", "expired", time.Millisecond))
+			time.Sleep(5 * time.Millisecond)
+			set, err := kv.SetIfAbsent(ctx, 1, "absent", "expiring", "value")
+			require.NoError(t, err)
+			require.True(t, set)
+			time.Sleep(5 * time.Millisecond)
+			value, exists, err := kv.Get(ctx, 1, "absent", "expiring")
+			require.NoError(t, err)
+			assert.True(t, exists, "the set secret no longer expires")
+			assert.Equal(t, "value", value)
+		})
+	}
+
+	t.Run("sql: only one of concurrent calls sets the secret", func(t *testing.T) {
+		kv := stores["sql"](t)
+		var wg sync.WaitGroup
+		results := make(chan bool, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				set, err := kv.SetIfAbsent(ctx, 1, "absent", "concurrent", strconv.Itoa(i))
+				assert.NoError(t, err)
+				results <- set
+			}(i)
+		}
+		wg.Wait()
+		close(results)
+		count := 0
+		for set := range results {
+			if set {
+				count++
+			}
+		}
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestSecretsKVStore_DelAll(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+			items, err := kv.GetAll(ctx)
+			require.NoError(t, err)
+			for _, item := range items {
+				require.NoError(t, kv.Del(ctx, *item.OrgId, *item.Namespace, *item.Type))
+			}
+			return kv
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			keys := func(t *testing.T, kv SecretsKVStore) []string {
+				t.Helper()
+				items, err := kv.GetAll(ctx)
+				require.NoError(t, err)
+				keys := make([]string, 0, len(items))
+				for _, item := range items {
+					keys = append(keys, fmt.Sprintf("%d/%s/%s", *item.OrgId, *item.Namespace, *item.Type))
+				}
+				sort.Strings(keys)
+				return keys
+			}
+			setAll := func(t *testing.T, kv SecretsKVStore) {
+				t.Helper()
+				for _, orgId := range []int64{1, 2} {
+					for _, typ := range []string{"type1", "type2"} {
+						require.NoError(t, kv.Set(ctx, orgId, "plugin", typ, "value"))
+					}
+					require.NoError(t, kv.Set(ctx, orgId, "other", "type1", "value"))
+				}
+			}
+
+			t.Run("deletes every type of the namespace in the organization", func(t *testing.T) {
+				kv := newStore(t)
+				setAll(t, kv)
+				require.NoError(t, kv.DelAll(ctx, 1, "plugin"))
+				assert.Equal(t, []string{"1/other/type1", "2/other/type1", "2/plugin/type1", "2/plugin/type2"}, keys(t, kv))
+			})
+
+			t.Run("deletes the namespace in all organizations", func(t *testing.T) {
+				kv := newStore(t)
+				setAll(t, kv)
+				require.NoError(t, kv.DelAll(ctx, AllOrganizations, "plugin"))
+				assert.Equal(t, []string{"1/other/type1", "2/other/type1"}, keys(t, kv))
+			})
+
+			t.Run("deleting an empty namespace does nothing", func(t *testing.T) {
+				kv := newStore(t)
+				setAll(t, kv)
+				require.NoError(t, kv.DelAll(ctx, AllOrganizations, "missing"))
+				assert.Len(t, keys(t, kv), 6)
+			})
+		})
+	}
+}
+
+// BenchmarkSecretsKVStoreSQL_GetMany compares getting the secrets of a namespace with a query per secret
+// and with a single query
+func BenchmarkSecretsKVStoreSQL_GetMany(b *testing.B) {
+	sqlStore := sqlstore.InitTestDB(b)
+	secretsService := manager.SetupTestService(b, fakes.NewFakeSecretsStore())
+	kv := NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+	ctx := context.Background()
+
+	typs := make([]string, 50)
+	for i := range typs {
+		typs[i] = fmt.Sprintf("type%d", i)
+		require.NoError(b, kv.Set(ctx, 1, "datasource", typs[i], "secret"))
+	}
+
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, typ := range typs {
+				_, _, err := kv.Get(ctx, 1, "datasource", typ)
+				require.NoError(b, err)
+			}
+		}
+	})
+
+	b.Run("get many", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			values, err := kv.GetMany(ctx, 1, "datasource", typs)
+			require.NoError(b, err)
+			require.Len(b, values, len(typs))
+		}
+	})
+}
+
+func TestPluginSecretsKVStore_GetMany(t *testing.T) {
+	ctx := context.Background()
+	fallback := NewInMemorySecretsKVStore()
+	require.NoError(t, fallback.Set(ctx, 1, "ns", "fallback", "fallback value"))
+	kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), fallback)
+	kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{buildKey(1, "ns", "plugin"): "plugin value"}}
+	kv.fallbackEnabled = true
+
+	values, err := kv.GetMany(ctx, 1, "ns", []string{"plugin", "fallback", "missing"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"plugin": "plugin value", "fallback": "fallback value"}, values)
+}
+
+func TestPluginSecretsKVStore_Exists(t *testing.T) {
+	ctx := context.Background()
+	fallback := NewInMemorySecretsKVStore()
+	require.NoError(t, fallback.Set(ctx, 1, "fallback", "type", "fallback value"))
+	kv := &SecretsKVStorePlugin{
+		secretsPlugin: &fakeGRPCSecretsPlugin{kv: map[Key]string{buildKey(1, "plugin", "type"): "plugin value"}},
+		log:           log.New("test.logger"),
+		fallbackStore: fallback,
+	}
+
+	exists, err := kv.Exists(ctx, 1, "plugin", "type")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = kv.Exists(ctx, 1, "fallback", "type")
+	require.NoError(t, err)
+	assert.False(t, exists, "the fallback is only used while enabled")
+
+	kv.fallbackEnabled = true
+	exists, err = kv.Exists(ctx, 1, "fallback", "type")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = kv.Exists(ctx, 1, "missing", "type")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestSecretsKVStore_Namespaces(t *testing.T) {
+	ctx := context.Background()
+	sqlStore := sqlstore.InitTestDB(t)
+	secretsService := manager.SetupTestService(t, fakes.NewFakeSecretsStore())
+
+	stores := map[string]func(t *testing.T) SecretsKVStore{
+		"sql": func(t *testing.T) SecretsKVStore {
+			return NewSQLSecretsKVStore(sqlStore, secretsService, log.New("test.logger"))
+		},
+		"memory": func(t *testing.T) SecretsKVStore {
+			return NewInMemorySecretsKVStore()
+		},
+		"plugin": func(t *testing.T) SecretsKVStore {
+			kv := NewFakePluginSecretsKVStore(t, NewFakeFeatureToggles(t, false), NewInMemorySecretsKVStore())
+			kv.secretsPlugin = &fakeGRPCSecretsPlugin{kv: map[Key]string{}}
+			return kv
+		},
+		"cache": func(t *testing.T) SecretsKVStore {
+			return WithCache(NewInMemorySecretsKVStore(), time.Minute, time.Minute)
+		},
+		"fake": func(t *testing.T) SecretsKVStore {
+			return NewFakeSecretsKVStore()
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			kv := newStore(t)
+			namespaces, err := kv.Namespaces(ctx, 1)
+			require.NoError(t, err)
+			assert.Empty(t, namespaces)
+
+			require.NoError(t, kv.Set(ctx, 1, "zulu", "type", "value"))
+			require.NoError(t, kv.Set(ctx, 1, "alpha", "type", "value"))
+			require.NoError(t, kv.Set(ctx, 1, "alpha", "other", "other type"))
+			require.NoError(t, kv.Set(ctx, 2, "bravo", "type", "other org"))
+
+			namespaces, err = kv.Namespaces(ctx, 1)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alpha", "zulu"}, namespaces)
+
+			namespaces, err = kv.Namespaces(ctx, AllOrganizations)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"alpha", "bravo", "zulu"}, namespaces)
+		})
+	}
+}
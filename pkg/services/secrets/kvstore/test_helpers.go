@@ -5,6 +5,7 @@ import (
 	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/grafana/grafana/pkg/infra/kvstore"
 	"github.com/grafana/grafana/pkg/infra/log"
@@ -60,11 +61,44 @@ func (f *FakeSecretsKVStore) Get(ctx context.Context, orgId int64, namespace str
 	return value, found, nil
 }
 
+func (f *FakeSecretsKVStore) GetMany(ctx context.Context, orgId int64, namespace string, typs []string) (map[string]string, error) {
+	values := make(map[string]string, len(typs))
+	for _, typ := range typs {
+		if value := f.store[buildKey(orgId, namespace, typ)]; value != "" {
+			values[typ] = value
+		}
+	}
+	return values, nil
+}
+
+func (f *FakeSecretsKVStore) Exists(ctx context.Context, orgId int64, namespace string, typ string) (bool, error) {
+	return f.store[buildKey(orgId, namespace, typ)] != "", nil
+}
+
 func (f *FakeSecretsKVStore) Set(ctx context.Context, orgId int64, namespace string, typ string, value string) error {
 	f.store[buildKey(orgId, namespace, typ)] = value
 	return nil
 }
 
+// SetWithTTL sets the value, the fake doesn't expire secrets
+func (f *FakeSecretsKVStore) SetWithTTL(ctx context.Context, orgId int64, namespace string, typ string, value string, ttl time.Duration) error {
+	return f.Set(ctx, orgId, namespace, typ, value)
+}
+
+func (f *FakeSecretsKVStore) CompareAndSwap(ctx context.Context, orgId int64, namespace string, typ string, oldValue string, newValue string) (bool, error) {
+	if value, ok := f.store[buildKey(orgId, namespace, typ)]; !ok || value != oldValue {
+		return false, nil
+	}
+	return true, f.Set(ctx, orgId, namespace, typ, newValue)
+}
+
+func (f *FakeSecretsKVStore) SetIfAbsent(ctx context.Context, orgId int64, namespace string, typ string, value string) (bool, error) {
+	if _, ok := f.store[buildKey(orgId, namespace, typ)]; ok {
+		return false, nil
+	}
+	return true, f.Set(ctx, orgId, namespace, typ, value)
+}
+
 func (f *FakeSecretsKVStore) Del(ctx context.Context, orgId int64, namespace string, typ string) error {
 	if f.delError {
 		return errors.New("mocked del error")
@@ -73,20 +107,47 @@ func (f *FakeSecretsKVStore) Del(ctx context.Context, orgId int64, namespace str
 	return nil
 }
 
+func (f *FakeSecretsKVStore) DelAll(ctx context.Context, orgId int64, namespace string) error {
+	if f.delError {
+		return errors.New("mocked del error")
+	}
+	for k := range f.store {
+		if k.Namespace == namespace && (orgId == AllOrganizations || k.OrgId == orgId) {
+			delete(f.store, k)
+		}
+	}
+	return nil
+}
+
 // List all keys with an optional filter. If default values are provided, filter is not applied.
+// The keys of all organizations are listed when orgId is AllOrganizations.
 func (f *FakeSecretsKVStore) Keys(ctx context.Context, orgId int64, namespace string, typ string) ([]Key, error) {
 	res := make([]Key, 0)
 	for k := range f.store {
 		if orgId == AllOrganizations && namespace == "" && typ == "" {
 			res = append(res, k)
-		} else if k.OrgId == orgId && k.Namespace == namespace && k.Type == typ {
+		} else if (orgId == AllOrganizations || k.OrgId == orgId) && k.Namespace == namespace && k.Type == typ {
 			res = append(res, k)
 		}
 	}
 	return res, nil
 }
 
-func (f *FakeSecretsKVStore) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string) error {
+func (f *FakeSecretsKVStore) Namespaces(ctx context.Context, orgId int64) ([]string, error) {
+	items, err := f.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return itemNamespaces(items, orgId), nil
+}
+
+func (f *FakeSecretsKVStore) Rename(ctx context.Context, orgId int64, namespace string, typ string, newNamespace string, overwrite bool) error {
+	if _, ok := f.store[buildKey(orgId, namespace, typ)]; !ok || namespace == newNamespace {
+		return nil
+	}
+	if _, exists := f.store[buildKey(orgId, newNamespace, typ)]; exists && !overwrite {
+		return secretAlreadyExistsError(orgId, newNamespace, typ)
+	}
 	f.store[buildKey(orgId, newNamespace, typ)] = f.store[buildKey(orgId, namespace, typ)]
 	delete(f.store, buildKey(orgId, namespace, typ))
 	return nil
@@ -177,7 +238,7 @@ func (c *fakeGRPCSecretsPlugin) ListSecrets(ctx context.Context, in *secretsmana
 	for k := range c.kv {
 		if in.KeyDescriptor.OrgId == AllOrganizations && in.KeyDescriptor.Namespace == "" && in.KeyDescriptor.Type == "" {
 			res = append(res, internalToProtoKey(k))
-		} else if k.OrgId == in.KeyDescriptor.OrgId && k.Namespace == in.KeyDescriptor.Namespace && k.Type == in.KeyDescriptor.Type {
+		} else if (in.AllOrganizations || k.OrgId == in.KeyDescriptor.OrgId) && k.Namespace == in.KeyDescriptor.Namespace && k.Type == in.KeyDescriptor.Type {
 			res = append(res, internalToProtoKey(k))
 		}
 	}
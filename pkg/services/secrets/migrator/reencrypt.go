@@ -8,6 +8,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/services/ngalert/notifier"
 	"github.com/grafana/grafana/pkg/services/secrets"
+	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
 	"github.com/grafana/grafana/pkg/services/secrets/manager"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 )
@@ -108,6 +109,13 @@ func (s b64Secret) reencrypt(ctx context.Context, secretsSrv *manager.SecretsSer
 			}
 
 			encoded := s.encoding.EncodeToString(encrypted)
+			if s.versionColumnName != "" {
+				updateSQL := fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", s.tableName, s.versionColumnName)
+				if _, err = sess.Exec(updateSQL, secretskvs.EncryptionVersion(encrypted), row.Id); err != nil {
+					logger.Warn("Could not update the encryption version of a secret", "table", s.tableName, "id", row.Id, "error", err)
+					return err
+				}
+			}
 			if s.hasUpdatedColumn {
 				updateSQL := fmt.Sprintf("UPDATE %s SET %s = ?, updated = ? WHERE id = ?", s.tableName, s.columnName)
 				_, err = sess.Exec(updateSQL, encoded, nowInUTC(), row.Id)
@@ -8,6 +8,7 @@ import (
 
 	"github.com/grafana/grafana/pkg/services/encryption"
 	"github.com/grafana/grafana/pkg/services/ngalert/notifier"
+	secretskvs "github.com/grafana/grafana/pkg/services/secrets/kvstore"
 	"github.com/grafana/grafana/pkg/services/secrets/manager"
 	"github.com/grafana/grafana/pkg/services/sqlstore"
 )
@@ -116,6 +117,13 @@ func (s b64Secret) rollback(
 			}
 
 			encoded := s.encoding.EncodeToString(encrypted)
+			if s.versionColumnName != "" {
+				updateSQL := fmt.Sprintf("UPDATE %s SET %s = ? WHERE id = ?", s.tableName, s.versionColumnName)
+				if _, err = sess.Exec(updateSQL, secretskvs.EncryptionVersion(encrypted), row.Id); err != nil {
+					logger.Warn("Could not update the encryption version of a secret", "table", s.tableName, "id", row.Id, "error", err)
+					return err
+				}
+			}
 			if s.hasUpdatedColumn {
 				updateSQL := fmt.Sprintf("UPDATE %s SET %s = ?, updated = ? WHERE id = ?", s.tableName, s.columnName)
 				_, err = sess.Exec(updateSQL, encoded, nowInUTC(), row.Id)
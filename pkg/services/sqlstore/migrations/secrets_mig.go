@@ -73,4 +73,38 @@ func addSecretsMigration(mg *migrator.Migrator) {
 	))
 
 	// --------------------
+
+	mg.AddMigration("add encryption_version column to secrets", migrator.NewAddColumnMigration(
+		secretsV1,
+		&migrator.Column{
+			Name:     "encryption_version",
+			Type:     migrator.DB_NVarchar,
+			Length:   50,
+			Default:  "'legacy'",
+			Nullable: false,
+		},
+	))
+
+	mg.AddMigration("add expires_at column to secrets", migrator.NewAddColumnMigration(
+		secretsV1,
+		&migrator.Column{Name: "expires_at", Type: migrator.DB_DateTime, Nullable: true},
+	))
+
+	mg.AddMigration("add compression column to secrets", migrator.NewAddColumnMigration(
+		secretsV1,
+		&migrator.Column{
+			Name:     "compression",
+			Type:     migrator.DB_NVarchar,
+			Length:   20,
+			Default:  "''",
+			Nullable: false,
+		},
+	))
+
+	// the indices of the secrets table were never created, the duplicated secrets are dropped before adding
+	// the unique one, keeping the last inserted
+	mg.AddMigration("delete duplicated secrets", migrator.NewRawSQLMigration(
+		"DELETE FROM secrets WHERE id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM secrets GROUP BY org_id, namespace, type) AS kept)"))
+
+	mg.AddMigration("add unique index secrets org_id namespace type", migrator.NewAddIndexMigration(secretsV1, secretsV1.Indices[2]))
 }
@@ -0,0 +1,85 @@
+package sqlstore
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	ac "github.com/grafana/grafana/pkg/services/accesscontrol"
+	"github.com/grafana/grafana/pkg/services/user"
+)
+
+// MergeUserOperation is a change merging a user into another one would apply to a table
+type MergeUserOperation struct {
+	Table  string
+	Action string
+	Rows   int64
+}
+
+// MergeUserDryRun returns the operations merging the user with id from into the user with id into would perform,
+// without executing them. The rows removed from each table are counted with the same conditions
+// that are used when the user is deleted, so that the preview follows the actual implementation.
+// The rows the caller moves to the kept user before deleting the other one are counted as deleted.
+func (ss *SQLStore) MergeUserDryRun(ctx context.Context, into int64, from int64) ([]MergeUserOperation, error) {
+	var ops []MergeUserOperation
+	err := ss.WithDbSession(ctx, func(sess *DBSession) error {
+		intoUser := user.User{ID: into}
+		has, err := sess.Where(NotServiceAccountFilter(ss)).Get(&intoUser)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return user.ErrUserNotFound
+		}
+		fromUser := user.User{ID: from}
+		has, err = sess.Where(NotServiceAccountFilter(ss)).Get(&fromUser)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return user.ErrUserNotFound
+		}
+
+		for _, deletion := range UserDeletions() {
+			table, count, err := countUserDeletion(sess, deletion, from)
+			if err != nil {
+				return err
+			}
+			ops = append(ops, MergeUserOperation{Table: table, Action: "delete", Rows: count})
+		}
+
+		acCounts := []struct {
+			table string
+			query string
+			args  []interface{}
+		}{
+			{"user_role", "SELECT COUNT(*) FROM user_role WHERE user_id = ?", []interface{}{from}},
+			{"permission", "SELECT COUNT(*) FROM permission WHERE scope = ? OR role_id IN (SELECT id FROM role WHERE name = ?)",
+				[]interface{}{ac.Scope("users", "id", strconv.FormatInt(from, 10)), ac.ManagedUserRoleName(from)}},
+			{"role", "SELECT COUNT(*) FROM role WHERE name = ?", []interface{}{ac.ManagedUserRoleName(from)}},
+		}
+		for _, c := range acCounts {
+			var count int64
+			if _, err := sess.SQL(c.query, c.args...).Get(&count); err != nil {
+				return err
+			}
+			ops = append(ops, MergeUserOperation{Table: c.table, Action: "delete", Rows: count})
+		}
+
+		// the user kept gets its login and email lowercased
+		ops = append(ops, MergeUserOperation{Table: "user", Action: "update", Rows: 1})
+		return nil
+	})
+	return ops, err
+}
+
+// countUserDeletion turns a statement of UserDeletions into a count of the rows it would delete
+func countUserDeletion(sess *DBSession, deletion string, userID int64) (string, int64, error) {
+	rest := strings.TrimPrefix(deletion, "DELETE FROM ")
+	table := strings.Trim(rest[:strings.Index(rest, " ")], dialect.Quote(""))
+	var count int64
+	if _, err := sess.SQL("SELECT COUNT(*) FROM "+rest, userID).Get(&count); err != nil {
+		return "", 0, err
+	}
+	return table, count, nil
+}
@@ -128,3 +128,36 @@ func createFiveTestUsers(t *testing.T, sqlStore *SQLStore, fn func(i int) *user.
 
 	return users
 }
+
+func TestIntegrationMergeUserDryRun(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+	ss := InitTestDB(t)
+	ctx := context.Background()
+
+	into, err := ss.CreateUser(ctx, user.CreateUserCommand{Email: "into@test.com", Login: "into"})
+	require.NoError(t, err)
+	from, err := ss.CreateUser(ctx, user.CreateUserCommand{Email: "from@test.com", Login: "from"})
+	require.NoError(t, err)
+
+	ops, err := ss.MergeUserDryRun(ctx, into.ID, from.ID)
+	require.NoError(t, err)
+
+	rows := map[string]int64{}
+	for _, op := range ops {
+		if op.Action == "delete" {
+			rows[op.Table] += op.Rows
+		}
+	}
+	require.Equal(t, int64(1), rows["user"])
+	require.Equal(t, int64(1), rows["org_user"])
+	require.Equal(t, int64(0), rows["star"])
+
+	// nothing is actually deleted
+	query := models.GetUserByIdQuery{Id: from.ID}
+	require.NoError(t, ss.GetUserById(ctx, &query))
+
+	_, err = ss.MergeUserDryRun(ctx, into.ID, -1)
+	require.ErrorIs(t, err, user.ErrUserNotFound)
+}